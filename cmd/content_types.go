@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	contentTypesDomain string
+	contentTypesDryRun bool
+)
+
+func init() {
+	contentTypesCmd.Flags().StringVar(&contentTypesDomain, "domain", "", "Only rewrite the objects of the page with this domain")
+	contentTypesCmd.Flags().BoolVar(&contentTypesDryRun, "dry-run", false, "Report the changes without applying them")
+
+	RootCmd.AddCommand(contentTypesCmd)
+}
+
+var contentTypesCmd = &cobra.Command{
+	Use:   "rewrite-content-types",
+	Short: "Corrects the Content-Type of objects already uploaded",
+	Long: `Corrects the Content-Type of the objects of all deployments to the one they
+would be uploaded with now, honouring pages[].bucket.contentTypes. Objects are
+rewritten in place with their other metadata kept.
+
+Proxies with proxy.cache enabled keep serving the headers of objects they have
+cached; clear proxy.cache.dir for them to pick up the corrected types.`,
+	Example: "staticpages rewrite-content-types --domain example.com --dry-run",
+	Args:    cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		matched := false
+		for _, page := range configuration.Pages {
+			if contentTypesDomain != "" && page.Domain.String() != contentTypesDomain {
+				continue
+			}
+			matched = true
+
+			changes, err := s3_client.NewS3PageClient(page).RewriteContentTypes(cmd.Context(), contentTypesDryRun)
+			skipped := 0
+			for _, change := range changes {
+				if change.Skipped != "" {
+					skipped++
+					fmt.Printf("%s: %s -> %s skipped: %s\n", change.Key, change.From, change.To, change.Skipped)
+					continue
+				}
+				fmt.Printf("%s: %s -> %s\n", change.Key, change.From, change.To)
+			}
+			if err != nil {
+				return humane.Wrap(err, fmt.Sprintf("failed to rewrite the content types of %s", page.Domain.String()))
+			}
+
+			fmt.Printf("%s: %d objects corrected, %d skipped\n", page.Domain.String(), len(changes)-skipped, skipped)
+		}
+
+		if !matched {
+			return humane.New(fmt.Sprintf("No page configured for domain %q", contentTypesDomain),
+				"Pass the domain of one of the configured pages[], or omit --domain to rewrite all pages.")
+		}
+		return nil
+	},
+}
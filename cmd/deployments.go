@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	deploymentsDomain string
+	deploymentsOutput string
+)
+
+func init() {
+	listDeploymentsCmd.Flags().StringVar(&deploymentsDomain, "domain", "", "Domain of the page whose deployments to list")
+	listDeploymentsCmd.Flags().StringVarP(&deploymentsOutput, "output", "o", "table", "Output format: table or json")
+	_ = listDeploymentsCmd.MarkFlagRequired("domain")
+
+	RootCmd.AddCommand(listDeploymentsCmd)
+}
+
+var listDeploymentsCmd = &cobra.Command{
+	Use:   "list-deployments",
+	Short: "Lists the deployments of a page together with their provenance",
+	Long: `Lists the deployments recorded in the page index of a page, newest first,
+together with the workflow run each was uploaded from.`,
+	Example: "staticpages list-deployments --domain example.com -o json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if deploymentsOutput != "table" && deploymentsOutput != "json" {
+			return humane.New(fmt.Sprintf("Unknown output format %q", deploymentsOutput),
+				"Pass --output table or --output json.")
+		}
+
+		idx := slices.IndexFunc(configuration.Pages, func(page *config.Page) bool { return page.Domain.String() == deploymentsDomain })
+		if idx < 0 {
+			return humane.New(fmt.Sprintf("No page configured for domain %q", deploymentsDomain),
+				"Pass the domain of one of the configured pages[].")
+		}
+
+		doc, err := s3_client.NewS3PageClient(configuration.Pages[idx]).DownloadPageIndexDocument(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		deployments := slices.Clone(doc.Deployments)
+		slices.Reverse(deployments)
+
+		if deploymentsOutput == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(deployments); err != nil {
+				return humane.Wrap(err, "failed to encode deployments")
+			}
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "SHA\tBRANCH\tENVIRONMENT\tDEPLOYED\tACTOR\tWORKFLOW\tRUN\tEVENT")
+		for _, d := range deployments {
+			run := d.Provenance.RunID
+			if run != "" && d.Provenance.RunAttempt != "" {
+				run += "/" + d.Provenance.RunAttempt
+			}
+			event := d.Provenance.EventName
+			if d.Provenance.PullRequest != "" {
+				event += " #" + d.Provenance.PullRequest
+			}
+
+			sha := d.SHA()
+			if d.Provenance.CommitUnverified {
+				sha += " (unverified)"
+			}
+
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				sha, d.Branch, d.Environment, d.Date.Local().Format(time.DateTime),
+				d.Provenance.Actor, d.Provenance.Workflow, run, event)
+		}
+		return w.Flush()
+	},
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
 	"github.com/sierrasoftworks/humane-errors-go"
 	"github.com/spechtlabs/go-otel-utils/otelzap"
 	"github.com/spf13/cobra"
@@ -88,6 +89,8 @@ func readConfig() {
 		fmt.Printf("Unable to read config file, assuming default values: %s\n", herr.Display())
 		os.Exit(1)
 	}
+
+	s3_client.ConfigureIndexCache(configuration.IndexCache)
 }
 
 // RootCmd represents the base command when called without any subcommands
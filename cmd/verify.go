@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spf13/cobra"
+)
+
+var verifyDomain string
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyDomain, "domain", "", "Domain of the page whose deployments to verify")
+	_ = verifyCmd.MarkFlagRequired("domain")
+
+	RootCmd.AddCommand(verifyCmd)
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [commit-sha...]",
+	Short: "Verifies deployments against the checksums recorded at upload",
+	Long: `Downloads every object of the given deployments of a page, or of all its
+deployments when none are given, and compares them against the SHA-256
+digests recorded in their manifests when they were uploaded.`,
+	Example: "staticpages verify --domain example.com 3f9a1c2b...",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		idx := slices.IndexFunc(configuration.Pages, func(page *config.Page) bool { return page.Domain.String() == verifyDomain })
+		if idx < 0 {
+			return humane.New(fmt.Sprintf("No page configured for domain %q", verifyDomain),
+				"Pass the domain of one of the configured pages[].")
+		}
+
+		client := s3_client.NewS3PageClient(configuration.Pages[idx])
+
+		shas := args
+		if len(shas) == 0 {
+			index, err := client.DownloadPageIndex(cmd.Context())
+			if err != nil {
+				return err
+			}
+			for sha := range index {
+				shas = append(shas, sha)
+			}
+			slices.Sort(shas)
+		}
+
+		failed := 0
+		for _, sha := range shas {
+			result, err := client.VerifyDeployment(cmd.Context(), sha)
+			if err != nil {
+				fmt.Printf("%s: %s\n", sha, err.Display())
+				failed++
+				continue
+			}
+
+			fmt.Printf("%s: %d objects verified\n", sha, result.Verified)
+			for _, name := range result.Mismatched {
+				fmt.Printf("  mismatched: %s\n", name)
+			}
+			for _, name := range result.Missing {
+				fmt.Printf("  missing:    %s\n", name)
+			}
+			for _, name := range result.Unexpected {
+				fmt.Printf("  unexpected: %s\n", name)
+			}
+			if !result.OK() {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return humane.New(fmt.Sprintf("%d of %d deployments failed verification", failed, len(shas)),
+				"Redeploy the affected commits to restore their objects.")
+		}
+		return nil
+	},
+}
@@ -113,6 +113,7 @@ export default defineUserConfig({
           items: [
             { text: 'Set up Cloudflare CDN', link: 'setup-cloudflare-cdn', icon: 'mdi:cloud-outline' },
             { text: 'Fix Backblaze Redirect Issue', link: 'fix-backblaze-redirect-issue', icon: 'mdi:wrench' },
+            { text: 'Configure TLS and ACME', link: 'configure-tls', icon: 'mdi:lock-outline' },
           ],
         },
         {
@@ -122,6 +123,7 @@ export default defineUserConfig({
           items: [
             { text: 'Backblaze B2 URL Structure', link: 'backblaze-b2-url-structure', icon: 'mdi:link-variant' },
             { text: 'Proxy Origin Bypass', link: 'proxy-origin-bypass', icon: 'mdi:shield-lock-outline' },
+            { text: 'Page Index', link: 'page-index', icon: 'mdi:file-tree-outline' },
           ],
         },
         {
@@ -150,6 +152,7 @@ export default defineUserConfig({
           items: [
             { text: 'Set up Cloudflare CDN', link: 'setup-cloudflare-cdn', icon: 'mdi:cloud-outline' },
             { text: 'Fix Backblaze Redirect Issue', link: 'fix-backblaze-redirect-issue', icon: 'mdi:wrench' },
+            { text: 'Configure TLS and ACME', link: 'configure-tls', icon: 'mdi:lock-outline' },
           ],
         },
         {
@@ -159,6 +162,7 @@ export default defineUserConfig({
           items: [
             { text: 'Backblaze B2 URL Structure', link: 'backblaze-b2-url-structure', icon: 'mdi:link-variant' },
             { text: 'Proxy Origin Bypass', link: 'proxy-origin-bypass', icon: 'mdi:shield-lock-outline' },
+            { text: 'Page Index', link: 'page-index', icon: 'mdi:file-tree-outline' },
           ],
         },
         {
@@ -187,6 +191,7 @@ export default defineUserConfig({
           items: [
             { text: 'Set up Cloudflare CDN', link: 'setup-cloudflare-cdn', icon: 'mdi:cloud-outline' },
             { text: 'Fix Backblaze Redirect Issue', link: 'fix-backblaze-redirect-issue', icon: 'mdi:wrench' },
+            { text: 'Configure TLS and ACME', link: 'configure-tls', icon: 'mdi:lock-outline' },
           ],
         },
         {
@@ -196,6 +201,7 @@ export default defineUserConfig({
           items: [
             { text: 'Backblaze B2 URL Structure', link: 'backblaze-b2-url-structure', icon: 'mdi:link-variant' },
             { text: 'Proxy Origin Bypass', link: 'proxy-origin-bypass', icon: 'mdi:shield-lock-outline' },
+            { text: 'Page Index', link: 'page-index', icon: 'mdi:file-tree-outline' },
           ],
         },
         {
@@ -224,6 +230,7 @@ export default defineUserConfig({
           items: [
             { text: 'Set up Cloudflare CDN', link: 'setup-cloudflare-cdn', icon: 'mdi:cloud-outline' },
             { text: 'Fix Backblaze Redirect Issue', link: 'fix-backblaze-redirect-issue', icon: 'mdi:wrench' },
+            { text: 'Configure TLS and ACME', link: 'configure-tls', icon: 'mdi:lock-outline' },
           ],
         },
         {
@@ -233,6 +240,7 @@ export default defineUserConfig({
           items: [
             { text: 'Backblaze B2 URL Structure', link: 'backblaze-b2-url-structure', icon: 'mdi:link-variant' },
             { text: 'Proxy Origin Bypass', link: 'proxy-origin-bypass', icon: 'mdi:shield-lock-outline' },
+            { text: 'Page Index', link: 'page-index', icon: 'mdi:file-tree-outline' },
           ],
         },
         {
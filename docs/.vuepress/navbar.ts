@@ -18,6 +18,7 @@ export const navbar = defineNavbarConfig([
     items: [
       { text: 'Setup Cloudflare CDN', link: '/how-to/setup-cloudflare-cdn', icon: 'mdi:cloud-outline' },
       { text: 'Fix Backblaze Redirect Issue', link: '/how-to/fix-backblaze-redirect-issue', icon: 'mdi:wrench' },
+      { text: 'Configure TLS and ACME', link: '/how-to/configure-tls', icon: 'mdi:lock-outline' },
     ],
   },
 
@@ -27,6 +28,7 @@ export const navbar = defineNavbarConfig([
     items: [
       { text: 'Backblaze B2 URL Structure', link: '/explanation/backblaze-b2-url-structure', icon: 'mdi:link-variant' },
       { text: 'Proxy Origin Bypass', link: '/explanation/proxy-origin-bypass', icon: 'mdi:shield-lock-outline' },
+      { text: 'Page Index', link: '/explanation/page-index', icon: 'mdi:file-tree-outline' },
     ],
   },
 
@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/SpechtLabs/StaticPages/cmd"
+	"github.com/SpechtLabs/StaticPages/pkg/health"
 	"github.com/gin-gonic/gin"
 	"github.com/sierrasoftworks/humane-errors-go"
 	"github.com/spechtlabs/go-otel-utils/otelprovider"
@@ -88,6 +89,8 @@ func main() {
 		undoZapGlobals()
 	}()
 
+	health.SetBuildInfo(health.BuildInfo{Version: Version, Commit: Commit, Date: Date})
+
 	cmd.RootCmd.AddCommand(versionCmd)
 	err = cmd.RootCmd.Execute()
 	if err != nil {
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sierrasoftworks/humane-errors-go"
+)
+
+const (
+	checksumPrefix = "sha256["
+	checksumSuffix = "]"
+
+	// manifestField is the form field carrying the digests of the uploaded
+	// files in the output format of sha256sum, as a value or as a file.
+	manifestField = "manifest"
+)
+
+// cleanRelativePath returns relPath as a clean relative path, so neither
+// "./" prefixes nor ".." segments let it differ from the path it is
+// declared under or escape the folder it is saved in.
+func cleanRelativePath(relPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(relPath, "\\", "/")), "/")
+}
+
+// saveUploadedFile saves file to dst and returns its hex encoded SHA-256
+// digest.
+func saveUploadedFile(file *multipart.FileHeader, dst string) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = src.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), src); err != nil {
+		_ = out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// declaredChecksums returns the digests the client declared for the files of
+// form, by their relative paths. They are sent either as sha256[<path>]
+// fields, or as a manifest field in the format of sha256sum.
+func declaredChecksums(form *multipart.Form) (map[string]string, humane.Error) {
+	declared := make(map[string]string)
+	if form == nil {
+		return declared, nil
+	}
+
+	add := func(relPath, digest string) humane.Error {
+		digest = strings.ToLower(strings.TrimSpace(digest))
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return humane.New(fmt.Sprintf("invalid SHA-256 digest %q for file %s", digest, relPath),
+				"Send the digests hex encoded, as printed by sha256sum.")
+		}
+		declared[cleanRelativePath(relPath)] = digest
+		return nil
+	}
+
+	for key, values := range form.Value {
+		relPath, ok := strings.CutPrefix(key, checksumPrefix)
+		if !ok || !strings.HasSuffix(relPath, checksumSuffix) || len(values) == 0 {
+			continue
+		}
+		if herr := add(strings.TrimSuffix(relPath, checksumSuffix), values[0]); herr != nil {
+			return nil, herr
+		}
+	}
+
+	manifests := slices.Clone(form.Value[manifestField])
+	for _, file := range form.File[manifestField] {
+		data, err := readFormFile(file)
+		if err != nil {
+			return nil, humane.Wrap(err, "failed to read checksum manifest")
+		}
+		manifests = append(manifests, data)
+	}
+
+	for _, manifest := range manifests {
+		scanner := bufio.NewScanner(strings.NewReader(manifest))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			// sha256sum prints "<digest>  <path>", or "<digest> *<path>" in
+			// binary mode.
+			digest, relPath, ok := strings.Cut(line, " ")
+			if !ok {
+				return nil, humane.New(fmt.Sprintf("invalid checksum manifest line %q", line),
+					"Send the manifest in the output format of sha256sum: '<digest>  <path>' per line.")
+			}
+			if herr := add(strings.TrimPrefix(strings.TrimLeft(relPath, " "), "*"), digest); herr != nil {
+				return nil, herr
+			}
+		}
+	}
+
+	return declared, nil
+}
+
+func readFormFile(file *multipart.FileHeader) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+// verifyChecksums compares the digests of the received files with the
+// declared ones. It returns the files whose digests differ, and the declared
+// files that were not received. Received files without a declared digest
+// pass.
+func verifyChecksums(declared, received map[string]string) (mismatched, missing []string) {
+	mismatched, missing = make([]string, 0), make([]string, 0)
+	for relPath, digest := range declared {
+		actual, ok := received[relPath]
+		switch {
+		case !ok:
+			missing = append(missing, relPath)
+		case actual != digest:
+			mismatched = append(mismatched, relPath)
+		}
+	}
+
+	slices.Sort(mismatched)
+	slices.Sort(missing)
+	return mismatched, missing
+}
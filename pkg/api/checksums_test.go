@@ -0,0 +1,224 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+// multipartBody encodes values and files as a multipart form.
+func multipartBody(t *testing.T, values, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range values {
+		require.NoError(t, writer.WriteField(name, value))
+	}
+	for name, content := range files {
+		part, err := writer.CreateFormFile(name, filepath.Base(name))
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	return body, writer.FormDataContentType()
+}
+
+// multipartForm returns values and files parsed like a request form.
+func multipartForm(t *testing.T, values, files map[string]string) *multipart.Form {
+	t.Helper()
+
+	body, contentType := multipartBody(t, values, files)
+	_, boundary, _ := strings.Cut(contentType, "boundary=")
+
+	form, err := multipart.NewReader(body, boundary).ReadForm(1 << 20)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = form.RemoveAll() })
+	return form
+}
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCleanRelativePath(t *testing.T) {
+	tests := map[string]string{
+		"index.html":           "index.html",
+		"./docs/index.html":    "docs/index.html",
+		"docs//a/../b.html":    "docs/b.html",
+		"../../etc/passwd":     "etc/passwd",
+		"/absolute/file.css":   "absolute/file.css",
+		`windows\path\app.js`:  "windows/path/app.js",
+		`..\..\outside\app.js`: "outside/app.js",
+	}
+
+	for relPath, expected := range tests {
+		assert.Equal(t, expected, cleanRelativePath(relPath), relPath)
+	}
+}
+
+func TestDeclaredChecksums(t *testing.T) {
+	index, app := digestOf("index"), digestOf("app")
+
+	tests := []struct {
+		name          string
+		values        map[string]string
+		files         map[string]string
+		expected      map[string]string
+		errorContains string
+	}{
+		{
+			name:     "nothing declared",
+			expected: map[string]string{},
+		},
+		{
+			name:     "fields",
+			values:   map[string]string{"sha256[index.html]": index, "sha256[./js/app.js]": strings.ToUpper(app), "other": "x"},
+			expected: map[string]string{"index.html": index, "js/app.js": app},
+		},
+		{
+			name:     "manifest field",
+			values:   map[string]string{manifestField: index + "  index.html\n\n# comment\n" + app + " *js/app.js\n"},
+			expected: map[string]string{"index.html": index, "js/app.js": app},
+		},
+		{
+			name:     "manifest file",
+			files:    map[string]string{manifestField: index + "  ./index.html\r\n" + app + "  js/app.js"},
+			expected: map[string]string{"index.html": index, "js/app.js": app},
+		},
+		{
+			name:     "fields and manifest",
+			values:   map[string]string{"sha256[index.html]": index, manifestField: app + "  js/app.js"},
+			expected: map[string]string{"index.html": index, "js/app.js": app},
+		},
+		{
+			name:     "file paths with spaces",
+			values:   map[string]string{manifestField: index + "  my page.html"},
+			expected: map[string]string{"my page.html": index},
+		},
+		{
+			name:          "invalid digest field",
+			values:        map[string]string{"sha256[index.html]": "not-hex"},
+			errorContains: `invalid SHA-256 digest "not-hex" for file index.html`,
+		},
+		{
+			name:          "short digest",
+			values:        map[string]string{"sha256[index.html]": index[:32]},
+			errorContains: "invalid SHA-256 digest",
+		},
+		{
+			name:          "manifest line without path",
+			values:        map[string]string{manifestField: index},
+			errorContains: "invalid checksum manifest line",
+		},
+		{
+			name:          "manifest with swapped columns",
+			values:        map[string]string{manifestField: "index.html  " + index},
+			errorContains: "invalid SHA-256 digest",
+		},
+		{
+			name:          "manifest in another format",
+			files:         map[string]string{manifestField: `{"index.html": "` + index + `"}`},
+			errorContains: "invalid",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			declared, err := declaredChecksums(multipartForm(t, tc.values, tc.files))
+			if tc.errorContains != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tc.errorContains)
+				}
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, tc.expected, declared)
+		})
+	}
+
+	declared, err := declaredChecksums(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, declared)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	index, app := digestOf("index"), digestOf("app")
+	received := map[string]string{"index.html": index, "js/app.js": app}
+
+	tests := []struct {
+		name       string
+		declared   map[string]string
+		mismatched []string
+		missing    []string
+	}{
+		{name: "nothing declared", declared: map[string]string{}},
+		{name: "all match", declared: map[string]string{"index.html": index, "js/app.js": app}},
+		{name: "some declared", declared: map[string]string{"index.html": index}},
+		{name: "mismatch", declared: map[string]string{"index.html": app, "js/app.js": index}, mismatched: []string{"index.html", "js/app.js"}},
+		{name: "missing", declared: map[string]string{"index.html": index, "b.css": app, "a.css": app}, missing: []string{"a.css", "b.css"}},
+		{name: "mismatch and missing", declared: map[string]string{"index.html": app, "gone.html": index}, mismatched: []string{"index.html"}, missing: []string{"gone.html"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mismatched, missing := verifyChecksums(tc.declared, received)
+			assert.ElementsMatch(t, tc.mismatched, mismatched)
+			assert.ElementsMatch(t, tc.missing, missing)
+		})
+	}
+}
+
+func TestSaveArtifactsToTemp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := &RestApi{tracer: otel.Tracer("test")}
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	save := func() (string, map[string]string) {
+		body, contentType := multipartBody(t, nil, map[string]string{
+			"files[index.html]":      "index",
+			"files[../js/app.js]":    "app",
+			"not-a-file[robots.txt]": "ignored",
+		})
+		ct, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ct.Request = httptest.NewRequest(http.MethodPost, "/api/upload", body)
+		ct.Request.Header.Set("Content-Type", contentType)
+
+		uploadPath, fileCount, size, digests, err := r.saveArtifactsToTemp(t.Context(), ct, sha)
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(uploadPath) })
+
+		assert.Equal(t, 2, fileCount)
+		assert.Equal(t, int64(len("index")+len("app")), size)
+		return uploadPath, digests
+	}
+
+	uploadPath, digests := save()
+	assert.Equal(t, map[string]string{"index.html": digestOf("index"), "js/app.js": digestOf("app")}, digests)
+
+	content, err := os.ReadFile(filepath.Join(uploadPath, "js", "app.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "app", string(content))
+
+	// Uploads of the same commit do not share a folder, so neither concurrent
+	// uploads nor the leftovers of failed ones mix.
+	other, _ := save()
+	assert.NotEqual(t, uploadPath, other)
+	assert.Contains(t, filepath.Base(other), sha)
+}
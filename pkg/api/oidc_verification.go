@@ -2,31 +2,31 @@ package api
 
 import (
 	"context"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
 	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
-	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/sierrasoftworks/humane-errors-go"
 )
 
-func (r *RestApi) extractAndVerifyAuth(ctx context.Context, authHeader string) (*s3_client.PageIndexData, humane.Error) {
+func (r *RestApi) extractAndVerifyAuth(ctx context.Context, authHeader string) (*s3_client.PageIndexData, *verifiedToken, humane.Error) {
 	ctx, span := r.tracer.Start(ctx, "restApi.extractAndVerifyAuth")
 	defer span.End()
 
 	rawToken, err := extractBearerToken(authHeader)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	issuerSet, err := collectUniqueIssuers(r.conf.Pages)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return verifyAgainstIssuers(ctx, rawToken, issuerSet)
+	return verifyAgainstIssuers(ctx, r.verifiers, rawToken, issuerSet)
 }
 
 func waitForAllErrors(errs <-chan humane.Error) <-chan humane.Error {
@@ -56,8 +56,8 @@ func extractBearerToken(authHeader string) (string, humane.Error) {
 	return strings.TrimPrefix(authHeader, "Bearer "), nil
 }
 
-func collectUniqueIssuers(pages []*config.Page) (map[string]config.ClaimMap, humane.Error) {
-	issuerSet := make(map[string]config.ClaimMap)
+func collectUniqueIssuers(pages []*config.Page) (map[issuerKey]config.ClaimMap, humane.Error) {
+	issuerSet := make(map[issuerKey]config.ClaimMap)
 	for _, page := range pages {
 		issuer, err := page.Git.GetOidcIssuer()
 		if err != nil {
@@ -69,33 +69,42 @@ func collectUniqueIssuers(pages []*config.Page) (map[string]config.ClaimMap, hum
 			return nil, humane.Wrap(err, "failed to get OIDC claim mapping")
 		}
 
-		issuerSet[issuer] = claimMap // deduplicates issuers
+		audience, err := page.Git.GetOidcAudience()
+		if err != nil {
+			return nil, humane.Wrap(err, "failed to get OIDC audience")
+		}
+
+		issuerSet[issuerKey{issuer: issuer, audience: audience}] = claimMap // deduplicates issuers per audience
 	}
 	return issuerSet, nil
 }
 
-func verifyAgainstIssuers(ctx context.Context, rawToken string, issuerSet map[string]config.ClaimMap) (*s3_client.PageIndexData, humane.Error) {
+func verifyAgainstIssuers(ctx context.Context, verifiers *tokenVerifiers, rawToken string, issuerSet map[issuerKey]config.ClaimMap) (*s3_client.PageIndexData, *verifiedToken, humane.Error) {
+	type result struct {
+		metadata *s3_client.PageIndexData
+		token    *verifiedToken
+	}
+
 	var (
-		wg         sync.WaitGroup
-		metadataCh = make(chan *s3_client.PageIndexData, 1)
-		errorCh    = make(chan humane.Error, len(issuerSet))
+		wg       sync.WaitGroup
+		resultCh = make(chan result, len(issuerSet))
+		errorCh  = make(chan humane.Error, len(issuerSet))
 	)
 
-	for issuer, claimMap := range issuerSet {
-		issuer := issuer
+	for key, claimMap := range issuerSet {
+		key := key
 		claimMap := claimMap
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			provider, err := oidc.NewProvider(ctx, issuer)
-			if err != nil {
-				errorCh <- humane.Wrap(err, "failed to initialize OIDC provider")
+			verifier, herr := verifiers.verifier(ctx, key)
+			if herr != nil {
+				errorCh <- herr
 				return
 			}
 
-			verifier := provider.VerifierContext(ctx, &oidc.Config{SkipClientIDCheck: true})
 			idToken, err := verifier.Verify(ctx, rawToken)
 			if err != nil {
 				errorCh <- humane.Wrap(err, "failed to verify OIDC token")
@@ -108,6 +117,13 @@ func verifyAgainstIssuers(ctx context.Context, rawToken string, issuerSet map[st
 				return
 			}
 
+			if herr := checkTimes(claims, time.Now()); herr != nil {
+				errorCh <- herr
+				return
+			}
+
+			jti, _ := claims["jti"].(string)
+
 			var (
 				repository  string
 				commit      string
@@ -121,14 +137,17 @@ func verifyAgainstIssuers(ctx context.Context, rawToken string, issuerSet map[st
 				errorCh <- humane.New("failed to extract repository claim")
 			}
 
+			// Providers without a commit claim leave it to the upload to name
+			// the commit.
 			if c, ok := claims[claimMap[config.CommitClaim]].(string); ok {
 				commit = c
-			} else {
+			} else if claimMap[config.CommitClaim] != "" {
 				errorCh <- humane.New("failed to extract commit claim")
 			}
 
-			if b, ok := claims[claimMap[config.BranchClaim]].(string); ok {
-				branch, _ = strings.CutPrefix(b, "refs/heads/")
+			ref, ok := claims[claimMap[config.BranchClaim]].(string)
+			if ok {
+				branch = config.NormalizeRef(ref)
 			} else {
 				errorCh <- humane.New("failed to extract branch claim")
 			}
@@ -137,13 +156,20 @@ func verifyAgainstIssuers(ctx context.Context, rawToken string, issuerSet map[st
 				environment = e
 			}
 
-			metadataCh <- s3_client.NewPageCommitMetadata(
+			metadata := s3_client.NewPageCommitMetadata(
 				repository,
 				commit,
 				branch,
 				environment,
 				time.Now(),
 			)
+			metadata.Uploader = idToken.Subject
+			metadata.Provenance = provenanceFromClaims(claims, claimMap, ref)
+			metadata.Provenance.RefType = config.RefType(ref, metadata.Provenance.RefType)
+			resultCh <- result{
+				metadata: metadata,
+				token:    &verifiedToken{issuer: idToken.Issuer, audience: idToken.Audience, id: jti, expiry: idToken.Expiry},
+			}
 		}()
 	}
 
@@ -153,16 +179,67 @@ func verifyAgainstIssuers(ctx context.Context, rawToken string, issuerSet map[st
 	}()
 
 	select {
-	case metadata := <-metadataCh:
-		return metadata, nil
+	case res := <-resultCh:
+		return res.metadata, res.token, nil
 
 	case <-ctx.Done():
-		return nil, humane.Wrap(ctx.Err(), "context cancelled while verifying token")
+		return nil, nil, humane.Wrap(ctx.Err(), "context cancelled while verifying token")
 
 	case <-time.After(10 * time.Second):
-		return nil, humane.New("OIDC verification timed out")
+		return nil, nil, humane.New("OIDC verification timed out")
 
 	case err := <-waitForAllErrors(errorCh):
-		return nil, humane.Wrap(err, "none of the configured OIDC providers accepted the token")
+		// Every verification finished; one may have succeeded all the same.
+		select {
+		case res := <-resultCh:
+			return res.metadata, res.token, nil
+		default:
+		}
+		return nil, nil, humane.Wrap(err, "none of the configured OIDC providers accepted the token")
 	}
 }
+
+// provenanceFromClaims extracts the provenance claims mapped in claimMap. The
+// pull request number falls back to the one in ref, for providers like GitHub
+// that only carry it in the ref of pull request events.
+func provenanceFromClaims(claims map[string]interface{}, claimMap config.ClaimMap, ref string) s3_client.Provenance {
+	claim := func(c config.Claim) string {
+		name, ok := claimMap[c]
+		if !ok || name == "" {
+			return ""
+		}
+
+		switch v := claims[name].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+		default:
+			return ""
+		}
+	}
+
+	provenance := s3_client.Provenance{
+		Actor:          claim(config.ActorClaim),
+		Workflow:       claim(config.WorkflowClaim),
+		RunID:          claim(config.RunIDClaim),
+		RunAttempt:     claim(config.RunAttemptClaim),
+		EventName:      claim(config.EventNameClaim),
+		PullRequest:    claim(config.PullRequestClaim),
+		RefType:        claim(config.RefTypeClaim),
+		JobWorkflowRef: claim(config.JobWorkflowRefClaim),
+		HeadRepository: claim(config.HeadRepositoryClaim),
+	}
+
+	if provenance.PullRequest == "" {
+		if rest, ok := strings.CutPrefix(ref, "refs/pull/"); ok {
+			if number, _, ok := strings.Cut(rest, "/"); ok {
+				provenance.PullRequest = number
+			}
+		}
+	}
+
+	return provenance
+}
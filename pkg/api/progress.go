@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+
+	// progressInterval bounds how often upload progress is streamed, so large
+	// deployments do not produce a line per file.
+	progressInterval = time.Second
+)
+
+// acceptsNDJSON reports whether the client asked for the response as
+// newline-delimited JSON.
+func acceptsNDJSON(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept") {
+		for part := range strings.SplitSeq(value, ",") {
+			if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == ndjsonContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// progressStream streams upload progress to the client as newline-delimited
+// JSON, one {"progress": ...} object per line, and the result last.
+type progressStream struct {
+	ct       *gin.Context
+	started  bool
+	reported time.Time
+}
+
+func newProgressStream(ct *gin.Context) *progressStream {
+	return &progressStream{ct: ct}
+}
+
+// progress streams p, unless progress was streamed less than
+// progressInterval ago. The last file is always reported.
+func (s *progressStream) progress(p s3_client.UploadProgress) {
+	if p.Files < p.FilesTotal && time.Since(s.reported) < progressInterval {
+		return
+	}
+	s.reported = time.Now()
+	s.write(http.StatusOK, gin.H{"progress": p})
+}
+
+// result streams the result of the upload. code is only sent when nothing
+// has been streamed yet.
+func (s *progressStream) result(code int, body any) {
+	s.write(code, body)
+}
+
+func (s *progressStream) write(code int, body any) {
+	if !s.started {
+		s.started = true
+		s.ct.Header("Content-Type", ndjsonContentType)
+		s.ct.Status(code)
+	}
+
+	line, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	_, _ = s.ct.Writer.Write(append(line, '\n'))
+	s.ct.Writer.Flush()
+}
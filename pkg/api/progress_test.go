@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsNDJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   bool
+	}{
+		{name: "no accept header"},
+		{name: "json", accept: []string{"application/json"}},
+		{name: "ndjson", accept: []string{"application/x-ndjson"}, want: true},
+		{name: "one of several", accept: []string{"application/json, application/x-ndjson;q=0.9"}, want: true},
+		{name: "in another header value", accept: []string{"application/json", "application/x-ndjson"}, want: true},
+		{name: "case insensitive", accept: []string{"Application/X-NDJSON"}, want: true},
+		{name: "wildcard", accept: []string{"*/*"}},
+		{name: "malformed", accept: []string{"application/x-ndjson;;"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/upload", nil)
+			for _, value := range tc.accept {
+				req.Header.Add("Accept", value)
+			}
+			assert.Equal(t, tc.want, acceptsNDJSON(req))
+		})
+	}
+}
+
+// streamLines decodes the lines streamed to rr.
+func streamLines(t *testing.T, rr *httptest.ResponseRecorder) []map[string]json.RawMessage {
+	t.Helper()
+
+	var lines []map[string]json.RawMessage
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var line map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func newTestProgressStream() (*progressStream, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	rr := httptest.NewRecorder()
+	ct, _ := gin.CreateTestContext(rr)
+	return newProgressStream(ct), rr
+}
+
+func TestProgressStream(t *testing.T) {
+	stream, rr := newTestProgressStream()
+
+	// Progress is reported at most once per interval, but for the last file.
+	stream.progress(s3_client.UploadProgress{Files: 1, FilesTotal: 3})
+	stream.progress(s3_client.UploadProgress{Files: 2, FilesTotal: 3})
+	stream.progress(s3_client.UploadProgress{Files: 3, FilesTotal: 3})
+	stream.result(http.StatusOK, gin.H{"status": "upload successful"})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, ndjsonContentType, rr.Header().Get("Content-Type"))
+
+	lines := streamLines(t, rr)
+	require.Len(t, lines, 3)
+
+	var first, last s3_client.UploadProgress
+	require.NoError(t, json.Unmarshal(lines[0]["progress"], &first))
+	require.NoError(t, json.Unmarshal(lines[1]["progress"], &last))
+	assert.Equal(t, 1, first.Files)
+	assert.Equal(t, 3, last.Files)
+	assert.JSONEq(t, `"upload successful"`, string(lines[2]["status"]))
+}
+
+func TestProgressStreamReportsAfterInterval(t *testing.T) {
+	stream, rr := newTestProgressStream()
+
+	stream.progress(s3_client.UploadProgress{Files: 1, FilesTotal: 3})
+	stream.reported = time.Now().Add(-progressInterval)
+	stream.progress(s3_client.UploadProgress{Files: 2, FilesTotal: 3})
+
+	assert.Len(t, streamLines(t, rr), 2)
+}
+
+func TestProgressStreamFailure(t *testing.T) {
+	// Without progress streamed, the result carries the status.
+	stream, rr := newTestProgressStream()
+	stream.result(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts"})
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	lines := streamLines(t, rr)
+	require.Len(t, lines, 1)
+	assert.JSONEq(t, `"failed to save artifacts"`, string(lines[0]["error"]))
+
+	// Once progress was streamed, the status is sent; failures are only
+	// reported in the last line.
+	stream, rr = newTestProgressStream()
+	stream.progress(s3_client.UploadProgress{Files: 1, FilesTotal: 2})
+	stream.result(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts"})
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	lines = streamLines(t, rr)
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "progress")
+	assert.JSONEq(t, `"failed to save artifacts"`, string(lines[1]["error"]))
+}
@@ -2,11 +2,11 @@ package api
 
 import (
 	"context"
-	"net/http"
-	"strings"
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/health"
+	"github.com/SpechtLabs/StaticPages/pkg/tlsserver"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	"github.com/sierrasoftworks/humane-errors-go"
@@ -25,10 +25,13 @@ const (
 
 // RestApi represents a RESTful API server encapsulating an HTTP server, router, and static page configuration.
 type RestApi struct {
-	srv    *http.Server
+	srv    *tlsserver.Server
 	router *gin.Engine
 	conf   config.StaticPagesConfig
 	tracer trace.Tracer
+
+	// verifiers verifies upload tokens.
+	verifiers *tokenVerifiers
 }
 
 // NewRestApi initializes and returns a new RestApi instance configured with the provided StaticPagesConfig.
@@ -37,13 +40,21 @@ func NewRestApi(conf config.StaticPagesConfig) *RestApi {
 		srv:    nil,
 		conf:   conf,
 		tracer: otel.Tracer("StaticPages-API"),
+
+		verifiers: newTokenVerifiers(),
 	}
 
 	// Setup Gin router
 	r.router = gin.New(func(e *gin.Engine) {})
 
-	// Setup Routes
-	r.router.POST("/api/upload", r.UploadHandler)
+	// Setup health, readiness and version endpoints. They are registered
+	// before the middleware on purpose: probes hit them every few seconds,
+	// and tracing, logging and counting each of them would drown the
+	// requests that matter.
+	checker := health.NewChecker(conf, health.WithIssuerChecks())
+	r.router.GET("/healthz", gin.WrapH(health.LivenessHandler()))
+	r.router.GET("/readyz", gin.WrapH(checker.ReadinessHandler()))
+	r.router.GET("/version", gin.WrapH(health.VersionHandler()))
 
 	// Setup otelgin to expose Open Telemetry
 	r.router.Use(otelgin.Middleware("StaticPages-API"))
@@ -72,6 +83,9 @@ func NewRestApi(conf config.StaticPagesConfig) *RestApi {
 	p := ginprometheus.NewPrometheus("staticpages")
 	p.Use(r.router)
 
+	// Setup Routes
+	r.router.POST("/api/upload", r.UploadHandler)
+
 	return r
 }
 
@@ -89,21 +103,24 @@ func (r *RestApi) ServeAsync(addr string) {
 func (r *RestApi) Serve(addr string) humane.Error {
 	otelzap.L().Info("Starting REST API Server", zap.String("address", addr))
 
-	// configure the HTTP Server
-	r.srv = &http.Server{
-		Addr:    addr,
-		Handler: r.router,
+	// Refuse to start with pages whose upload tokens cannot be verified, e.g.
+	// for lack of an audience, rather than failing every upload.
+	if _, herr := collectUniqueIssuers(r.conf.Pages); herr != nil {
+		return herr
 	}
 
-	if err := r.srv.ListenAndServe(); err != nil {
-		if strings.Contains(err.Error(), http.ErrServerClosed.Error()) {
-			otelzap.L().Info("API server stopped", zap.String("addr", r.srv.Addr))
-			return nil
-		}
+	// configure the HTTP Server, and the HTTPS server if TLS is enabled
+	srv, herr := tlsserver.NewAPI(r.conf, addr, r.conf.ApiTLSBindAddr(), r.router)
+	if herr != nil {
+		return herr
+	}
+	r.srv = srv
 
+	if err := r.srv.ListenAndServe(); err != nil {
 		return humane.Wrap(err, "Unable to start API Server", "Make sure the api server is not already running and try again.")
 	}
 
+	otelzap.L().Info("API server stopped", zap.String("addr", addr))
 	return nil
 }
 
@@ -121,6 +138,7 @@ func (r *RestApi) Shutdown() humane.Error {
 	if err := r.srv.Shutdown(ctx); err != nil {
 		return humane.Wrap(err, "Unable to shutdown api server", "Make sure the api server is running and try again.")
 	}
+	r.verifiers.stop()
 
 	return nil
 }
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"golang.org/x/sync/singleflight"
+)
+
+// tokenClockSkew is how far the clocks of the API and the issuers may
+// disagree on the iat and nbf of a token.
+const tokenClockSkew = time.Minute
+
+// issuerKey identifies the tokens of an issuer minted for an audience.
+type issuerKey struct {
+	issuer   string
+	audience string
+}
+
+// verifiedToken is what the verification of an upload token established
+// beyond its claims.
+type verifiedToken struct {
+	issuer   string
+	audience []string
+	id       string
+	expiry   time.Time
+}
+
+// tokenVerifiers discovers every issuer once and keeps its provider for the
+// lifetime of the API. The key set of a provider refreshes itself when it
+// meets a token signed with a key it does not know yet. It also records the
+// IDs of the tokens used until they expire, so none is accepted twice. The
+// record is kept in memory: with several API replicas behind a load
+// balancer, each replica accepts a token once.
+type tokenVerifiers struct {
+	mu        sync.RWMutex
+	providers map[string]*oidc.Provider
+	discovery singleflight.Group
+
+	used *ttlcache.Cache[string, struct{}]
+}
+
+func newTokenVerifiers() *tokenVerifiers {
+	used := ttlcache.New[string, struct{}](ttlcache.WithDisableTouchOnHit[string, struct{}]())
+	go used.Start()
+
+	return &tokenVerifiers{
+		providers: make(map[string]*oidc.Provider),
+		used:      used,
+	}
+}
+
+// verifier returns a verifier of the tokens of key. A failed discovery is not
+// cached, so it is retried with the next upload.
+func (v *tokenVerifiers) verifier(ctx context.Context, key issuerKey) (*oidc.IDTokenVerifier, humane.Error) {
+	v.mu.RLock()
+	provider, ok := v.providers[key.issuer]
+	v.mu.RUnlock()
+
+	if !ok {
+		res, err, _ := v.discovery.Do(key.issuer, func() (interface{}, error) {
+			// The provider fetches its keys with the context it was created
+			// with, so it must outlive the upload discovering it.
+			provider, err := oidc.NewProvider(context.WithoutCancel(ctx), key.issuer)
+			if err != nil {
+				return nil, err
+			}
+
+			v.mu.Lock()
+			v.providers[key.issuer] = provider
+			v.mu.Unlock()
+			return provider, nil
+		})
+		if err != nil {
+			return nil, humane.Wrap(err, "failed to initialize OIDC provider", "Make sure the issuer is reachable and serves its discovery document.")
+		}
+		provider = res.(*oidc.Provider)
+	}
+
+	// An empty audience fails every verification rather than skipping the
+	// check.
+	return provider.VerifierContext(context.WithoutCancel(ctx), &oidc.Config{
+		ClientID: key.audience,
+	}), nil
+}
+
+// checkTimes checks the iat and nbf claims of a token. Its expiry is checked
+// by the verifier.
+func checkTimes(claims map[string]interface{}, now time.Time) humane.Error {
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return humane.New("token has no iat claim", "Upload tokens must state when they were issued.")
+	}
+	if issued := time.Unix(int64(iat), 0); issued.After(now.Add(tokenClockSkew)) {
+		return humane.New(fmt.Sprintf("token was issued in the future, at %s", issued.UTC().Format(time.RFC3339)),
+			"Make sure the clocks of the API server and the issuer are synchronized.")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if notBefore := time.Unix(int64(nbf), 0); notBefore.After(now.Add(tokenClockSkew)) {
+			return humane.New(fmt.Sprintf("token is not valid before %s", notBefore.UTC().Format(time.RFC3339)),
+				"Make sure the clocks of the API server and the issuer are synchronized.")
+		}
+	}
+
+	return nil
+}
+
+// markUsed records the use of token, and fails if it was used before. The
+// record is kept until the token expires, unless it is released. Tokens
+// without an ID are refused, unless allowMissingID is set; their use is not
+// recorded then.
+func (v *tokenVerifiers) markUsed(token verifiedToken, allowMissingID bool) humane.Error {
+	if token.id == "" {
+		if allowMissingID {
+			return nil
+		}
+		return humane.New("token has no jti claim", "Upload tokens must carry a unique ID, so they cannot be replayed.",
+			"Set pages[].git.oidc.allowMissingJti for Git providers issuing tokens without one.")
+	}
+
+	ttl := time.Until(token.expiry) + tokenClockSkew
+	if _, found := v.used.GetOrSet(usedKey(token), struct{}{}, ttlcache.WithTTL[string, struct{}](ttl)); found {
+		return humane.New("token has already been used", "Request a new token for every upload.")
+	}
+	return nil
+}
+
+// stop stops the expiry of the records of used tokens.
+func (v *tokenVerifiers) stop() {
+	v.used.Stop()
+}
+
+// release forgets the use of token, so an upload failing after it was
+// authenticated can be retried with the same token.
+func (v *tokenVerifiers) release(token verifiedToken) {
+	if token.id != "" {
+		v.used.Delete(usedKey(token))
+	}
+}
+
+func usedKey(token verifiedToken) string {
+	return token.issuer + "\x00" + token.id
+}
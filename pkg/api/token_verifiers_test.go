@@ -0,0 +1,363 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIssuer is a minimal OIDC provider signing RS256 upload tokens for
+// whatever claims the test passes, counting how often it is discovered.
+type fakeIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	discoveries atomic.Int32
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	f := &fakeIssuer{t: t, key: key}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeIssuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		f.discoveries.Add(1)
+		writeTestJSON(w, map[string]any{
+			"issuer":                                f.URL,
+			"jwks_uri":                              f.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+
+	case "/keys":
+		writeTestJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// token returns a token of a push to main, with claims added or, for nil
+// values, removed.
+func (f *fakeIssuer) token(claims map[string]any) string {
+	now := time.Now()
+	payload := map[string]any{
+		"iss":        f.URL,
+		"sub":        "repo:org/site:ref:refs/heads/main",
+		"aud":        "staticpages",
+		"exp":        now.Add(5 * time.Minute).Unix(),
+		"iat":        now.Unix(),
+		"jti":        randomID(f.t),
+		"repository": "org/site",
+		"sha":        "0123456789abcdef0123456789abcdef01234567",
+		"ref":        "refs/heads/main",
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(payload, k)
+			continue
+		}
+		payload[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	body, _ := json.Marshal(payload)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	require.NoError(f.t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func randomID(t *testing.T) string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestVerifiers(t *testing.T) *tokenVerifiers {
+	v := newTokenVerifiers()
+	t.Cleanup(v.stop)
+	return v
+}
+
+var testClaimMap = config.ClaimMap{
+	config.RepositoryClaim: "repository",
+	config.CommitClaim:     "sha",
+	config.BranchClaim:     "ref",
+}
+
+func TestVerifyAgainstIssuers_Audience(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifiers := newTestVerifiers(t)
+
+	tests := []struct {
+		name          string
+		audience      string
+		tokenAudience any
+		errorContains string
+	}{
+		{name: "matching audience", audience: "staticpages", tokenAudience: "staticpages"},
+		{name: "one of several audiences", audience: "staticpages", tokenAudience: []string{"other", "staticpages"}},
+		{name: "audience mismatch", audience: "staticpages", tokenAudience: "https://github.com/org", errorContains: "expected audience"},
+		{name: "no audience accepts none", audience: "", tokenAudience: "https://github.com/org", errorContains: "clientID must be provided"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			issuers := map[issuerKey]config.ClaimMap{{issuer: issuer.URL, audience: tc.audience}: testClaimMap}
+
+			metadata, token, err := verifyAgainstIssuers(context.Background(), verifiers, issuer.token(map[string]any{"aud": tc.tokenAudience}), issuers)
+			if tc.errorContains != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Display(), tc.errorContains)
+				}
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, "org/site", metadata.Repository())
+			assert.Equal(t, "main", metadata.Branch)
+			assert.Equal(t, config.RefTypeBranch, metadata.Provenance.RefType)
+			assert.Equal(t, issuer.URL, token.issuer)
+			assert.NotEmpty(t, token.id)
+		})
+	}
+}
+
+func TestVerifyAgainstIssuers_Times(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifiers := newTestVerifiers(t)
+	issuers := map[issuerKey]config.ClaimMap{{issuer: issuer.URL, audience: "staticpages"}: testClaimMap}
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		claims        map[string]any
+		errorContains string
+	}{
+		{name: "valid", claims: nil},
+		{name: "expired", claims: map[string]any{"exp": now.Add(-time.Minute).Unix()}, errorContains: "expired"},
+		{name: "without iat", claims: map[string]any{"iat": nil}, errorContains: "no iat claim"},
+		{name: "issued in the future", claims: map[string]any{"iat": now.Add(time.Hour).Unix()}, errorContains: "issued in the future"},
+		{name: "issued within clock skew", claims: map[string]any{"iat": now.Add(tokenClockSkew / 2).Unix()}},
+		{name: "not valid yet", claims: map[string]any{"nbf": now.Add(time.Hour).Unix()}, errorContains: "before the nbf"},
+		{name: "valid since", claims: map[string]any{"nbf": now.Add(-time.Minute).Unix()}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := verifyAgainstIssuers(context.Background(), verifiers, issuer.token(tc.claims), issuers)
+			if tc.errorContains == "" {
+				assert.Nil(t, err)
+				return
+			}
+
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Display(), tc.errorContains)
+			}
+		})
+	}
+}
+
+// The claims of GitHub tokens as they are issued: a pull_request_target run
+// of a fork carries the ref of the base branch and nothing naming the fork.
+func TestVerifyAgainstIssuers_GitHubPullRequestTargetIsRefused(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifiers := newTestVerifiers(t)
+
+	git := config.GitConfig{Provider: "github", Repository: "org/site", MainBranch: "main"}
+	claimMap, herr := git.GetOidcClaimMapping()
+	require.Nil(t, herr)
+	issuers := map[issuerKey]config.ClaimMap{{issuer: issuer.URL, audience: "staticpages"}: claimMap}
+
+	githubClaims := func(event string) map[string]any {
+		return map[string]any{
+			"sub":                   "repo:org/site:pull_request",
+			"ref":                   "refs/heads/main",
+			"ref_type":              "branch",
+			"ref_protected":         "true",
+			"head_ref":              "patch-1",
+			"base_ref":              "main",
+			"repository":            "org/site",
+			"repository_id":         "123456",
+			"repository_owner":      "org",
+			"repository_owner_id":   "654321",
+			"repository_visibility": "public",
+			"actor":                 "mallory",
+			"actor_id":              "999",
+			"workflow":              "Preview",
+			"workflow_ref":          "org/site/.github/workflows/preview.yml@refs/heads/main",
+			"job_workflow_ref":      "org/site/.github/workflows/preview.yml@refs/heads/main",
+			"event_name":            event,
+			"run_id":                "4242",
+			"run_number":            "17",
+			"run_attempt":           "1",
+			"runner_environment":    "github-hosted",
+		}
+	}
+
+	metadata, _, err := verifyAgainstIssuers(context.Background(), verifiers, issuer.token(githubClaims("pull_request_target")), issuers)
+	require.Nil(t, err)
+
+	herr = git.AuthorizeDeploy(deployClaims(metadata, metadata.Repository()))
+	if assert.NotNil(t, herr, "a pull_request_target run must not deploy production") {
+		assert.Contains(t, herr.Error(), "pull_request_target")
+	}
+
+	metadata, _, err = verifyAgainstIssuers(context.Background(), verifiers, issuer.token(githubClaims("push")), issuers)
+	require.Nil(t, err)
+	assert.Nil(t, git.AuthorizeDeploy(deployClaims(metadata, metadata.Repository())))
+}
+
+func TestCollectUniqueIssuers_RequiresAudience(t *testing.T) {
+	issuers, err := collectUniqueIssuers([]*config.Page{{Git: config.GitConfig{Provider: "github", Repository: "org/site"}}})
+	require.Nil(t, err)
+	assert.Contains(t, issuers, issuerKey{issuer: "https://token.actions.githubusercontent.com", audience: "staticpages"})
+
+	_, err = collectUniqueIssuers([]*config.Page{{Git: config.GitConfig{Provider: "bitbucket", Repository: "ws/site"}}})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Display(), "No OIDC audience configured")
+	}
+}
+
+func TestCheckTimes(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	unix := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+
+	tests := []struct {
+		name          string
+		claims        map[string]interface{}
+		errorContains string
+	}{
+		{name: "issued now", claims: map[string]interface{}{"iat": unix(0)}},
+		{name: "issued before", claims: map[string]interface{}{"iat": unix(-time.Hour)}},
+		{name: "issued at the edge of the skew", claims: map[string]interface{}{"iat": unix(tokenClockSkew)}},
+		{name: "issued past the skew", claims: map[string]interface{}{"iat": unix(tokenClockSkew + time.Second)}, errorContains: "issued in the future"},
+		{name: "no iat", claims: map[string]interface{}{}, errorContains: "no iat claim"},
+		{name: "iat of the wrong type", claims: map[string]interface{}{"iat": "now"}, errorContains: "no iat claim"},
+		{name: "nbf reached", claims: map[string]interface{}{"iat": unix(0), "nbf": unix(0)}},
+		{name: "nbf within the skew", claims: map[string]interface{}{"iat": unix(0), "nbf": unix(tokenClockSkew)}},
+		{name: "nbf past the skew", claims: map[string]interface{}{"iat": unix(0), "nbf": unix(tokenClockSkew + time.Second)}, errorContains: "not valid before"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkTimes(tc.claims, now)
+			if tc.errorContains == "" {
+				assert.Nil(t, err)
+				return
+			}
+
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tc.errorContains)
+			}
+		})
+	}
+}
+
+func TestTokenVerifiers_CachesProviders(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	verifiers := newTestVerifiers(t)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifiers.verifier(context.Background(), issuerKey{issuer: issuer.URL, audience: "staticpages"})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// Another audience of the same issuer shares its provider.
+	_, err := verifiers.verifier(context.Background(), issuerKey{issuer: issuer.URL, audience: "other"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), issuer.discoveries.Load())
+
+	// Failed discoveries are not cached.
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	for range 2 {
+		_, err := verifiers.verifier(context.Background(), issuerKey{issuer: unreachable.URL})
+		assert.NotNil(t, err)
+	}
+	verifiers.mu.RLock()
+	assert.Len(t, verifiers.providers, 1)
+	verifiers.mu.RUnlock()
+}
+
+func TestTokenVerifiers_MarkUsed(t *testing.T) {
+	verifiers := newTestVerifiers(t)
+	token := verifiedToken{issuer: "https://issuer.example.com", id: "abc", expiry: time.Now().Add(time.Minute)}
+
+	assert.Nil(t, verifiers.markUsed(token, false))
+
+	err := verifiers.markUsed(token, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "already been used")
+	}
+
+	// The same ID from another issuer is another token.
+	other := token
+	other.issuer = "https://other.example.com"
+	assert.Nil(t, verifiers.markUsed(other, false))
+
+	// A released token, of a failed upload, can be used again, once.
+	verifiers.release(token)
+	assert.Nil(t, verifiers.markUsed(token, false))
+	assert.NotNil(t, verifiers.markUsed(token, false))
+}
+
+func TestTokenVerifiers_MarkUsedWithoutID(t *testing.T) {
+	verifiers := newTestVerifiers(t)
+	token := verifiedToken{issuer: "https://issuer.example.com", expiry: time.Now().Add(time.Minute)}
+
+	err := verifiers.markUsed(token, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no jti claim")
+	}
+
+	// Allowed, such tokens cannot be checked for replays.
+	assert.Nil(t, verifiers.markUsed(token, true))
+	assert.Nil(t, verifiers.markUsed(token, true))
+	verifiers.release(token)
+	assert.Equal(t, 0, verifiers.used.Len())
+}
@@ -30,7 +30,7 @@ func (r *RestApi) UploadHandler(ct *gin.Context) {
 	}
 
 	// Get Repository Metadata claims (and verify authentication)
-	metadata, herr := r.extractAndVerifyAuth(ctx, ct.GetHeader("Authorization"))
+	metadata, token, herr := r.extractAndVerifyAuth(ctx, ct.GetHeader("Authorization"))
 	if herr != nil {
 		otelzap.L().WithError(herr).Ctx(ctx).Error("failed to extract or verify auth")
 		ct.JSON(http.StatusForbidden, gin.H{"error": "invalid authorization header"})
@@ -38,73 +38,206 @@ func (r *RestApi) UploadHandler(ct *gin.Context) {
 	}
 
 	// Get the Page Configuration
-	page, herr := r.extractPagesConfig(ctx, metadata.Repository())
+	page, herr := r.extractPagesConfig(ctx, metadata.Repository(), token)
 	if herr != nil {
 		otelzap.L().WithError(herr).Ctx(ctx).Error("repository not authorized", zap.String("repository", metadata.Repository()))
 		ct.JSON(http.StatusForbidden, gin.H{"error": "repository not authorized"})
 		return
 	}
 
+	// The token is reserved for this upload, so it cannot be replayed while
+	// the upload is made, and released unless the upload is accepted, so a
+	// failed upload can be retried.
+	if herr := r.verifiers.markUsed(*token, page.Git.Oidc.AllowMissingJti); herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("token refused", zap.String("repository", metadata.Repository()))
+		ct.JSON(http.StatusForbidden, gin.H{"error": "invalid authorization header", "details": herr.Error()})
+		return
+	}
+	accepted := false
+	defer func() {
+		if !accepted {
+			r.verifiers.release(*token)
+		}
+	}()
+
+	// Deployments are stored by repository name, which tokens identifying the
+	// repository by ID do not carry, and by commit, which some providers
+	// leave to the upload to name.
+	tokenRepository := metadata.Repository()
+	sha, unverified, herr := uploadCommit(metadata.SHA(), ct.Request)
+	if herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("upload names no valid commit", zap.String("repository", page.Git.Repository))
+		ct.JSON(http.StatusBadRequest, gin.H{"error": "invalid commit", "details": herr.Error()})
+		return
+	}
+	metadata = metadata.WithIdentity(page.Git.Repository, sha)
+	metadata.Provenance.CommitUnverified = unverified
+
+	if herr := page.Git.AuthorizeDeploy(deployClaims(metadata, tokenRepository)); herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("deployment refused by policy",
+			zap.String("repository", metadata.Repository()),
+			zap.String("branch", metadata.Branch),
+			zap.String("commit_sha", metadata.SHA()),
+		)
+		span.SetAttributes(attribute.String("policy.denied", herr.Error()))
+		ct.JSON(http.StatusForbidden, gin.H{"error": "deployment not authorized", "reason": herr.Error(), "advice": herr.Advice()})
+		return
+	}
+
+	s3client := s3_client.NewS3PageClient(page)
+
+	// A commit named by the upload itself must not replace a deployment of it
+	// before any of its files are written.
+	if metadata.Provenance.CommitUnverified {
+		pageIndex, herr := s3client.DownloadPageIndexDocument(ctx)
+		if herr != nil {
+			otelzap.L().WithError(herr).Ctx(ctx).Error("unable to get metadata", zap.String("domain", page.Domain.String()))
+			ct.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read page metadata"})
+			return
+		}
+
+		if herr := checkUnverifiedCommit(pageIndex.Index(), metadata); herr != nil {
+			otelzap.L().WithError(herr).Ctx(ctx).Warn("unverified commit refused", zap.String("commit_sha", metadata.SHA()))
+			ct.JSON(http.StatusConflict, gin.H{"error": "commit already deployed", "reason": herr.Error(), "advice": herr.Advice()})
+			return
+		}
+	}
+
 	// Parse uploaded files
-	uploadPath, fileCount, size, herr := r.saveArtifactsToTemp(ctx, ct, metadata.SHA())
+	uploadPath, fileCount, size, digests, herr := r.saveArtifactsToTemp(ctx, ct, metadata.SHA())
+	defer func() { _ = os.RemoveAll(uploadPath) }()
 	if herr != nil {
 		otelzap.L().WithError(herr).Ctx(ctx).Error("failed to save artifacts to temp folder", zap.String("commit_sha", metadata.SHA()))
 		ct.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts"})
 		return
 	}
 
+	// Verify the files against the digests the client sent along, if any
+	form, _ := ct.MultipartForm()
+	declared, herr := declaredChecksums(form)
+	if herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("invalid checksums", zap.String("commit_sha", metadata.SHA()))
+		ct.JSON(http.StatusBadRequest, gin.H{"error": "invalid checksums", "details": herr.Display()})
+		return
+	}
+
+	if mismatched, missing := verifyChecksums(declared, digests); len(mismatched) > 0 || len(missing) > 0 {
+		otelzap.L().Ctx(ctx).Warn("uploaded files do not match their checksums",
+			zap.String("commit_sha", metadata.SHA()),
+			zap.Strings("mismatched", mismatched),
+			zap.Strings("missing", missing),
+		)
+		ct.JSON(http.StatusUnprocessableEntity, gin.H{"error": "checksum mismatch", "mismatched": mismatched, "missing": missing})
+		return
+	}
+
 	span.SetAttributes(
 		attribute.Int("file_count", fileCount),
 		attribute.Int64("file_size", size),
 	)
 
-	s3client := s3_client.NewS3PageClient(page)
-	herr = s3client.UploadFolder(ctx, uploadPath, filepath.Join(metadata.Repository(), metadata.SHA()))
+	// Clients asking for NDJSON get the upload progress streamed as it is
+	// made, followed by the result. The status is sent with the first line,
+	// so failures past that point are only reported in the last one.
+	respond := ct.JSON
+	var options []s3_client.UploadOption
+	if acceptsNDJSON(ct.Request) {
+		stream := newProgressStream(ct)
+		respond = stream.result
+		options = append(options, s3_client.WithProgress(stream.progress))
+	}
+
+	manifest := s3_client.NewManifest(metadata.Repository(), metadata.SHA())
+	options = append(options, s3_client.WithChecksums(digests), s3_client.WithManifest(manifest))
+
+	progress, herr := s3client.UploadFolder(ctx, uploadPath, filepath.Join(metadata.Repository(), metadata.SHA()), options...)
+	span.SetAttributes(attribute.Int("upload.multipart_files", progress.MultipartFiles))
 	if herr != nil {
 		otelzap.L().WithError(herr).Ctx(ctx).Error("failed to upload artifacts to storage backend")
-		ct.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts"})
+		respond(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts", "upload": progress})
+		return
+	}
+
+	// The manifest goes first, so every deployment in the index can be
+	// verified.
+	if herr := s3client.UploadManifest(ctx, manifest); herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Error("failed to upload deployment manifest")
+		respond(http.StatusInternalServerError, gin.H{"error": "failed to save artifacts", "upload": progress})
 		return
 	}
 
-	pageIndex, err := s3client.DownloadPageIndex(ctx)
+	pageIndex, err := s3client.DownloadPageIndexDocument(ctx)
 	if err != nil {
 		otelzap.L().WithError(err).Ctx(ctx).Error("unable to get metadata", zap.String("domain", page.Domain.String()))
-		ct.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update page metadata"})
+		respond(http.StatusInternalServerError, gin.H{"error": "failed to update page metadata"})
+		return
+	}
+
+	// Check again, in case the commit was deployed while the files were
+	// uploaded.
+	if herr := checkUnverifiedCommit(pageIndex.Index(), metadata); herr != nil {
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("unverified commit refused", zap.String("commit_sha", metadata.SHA()))
+		respond(http.StatusConflict, gin.H{"error": "commit already deployed", "reason": herr.Error(), "advice": herr.Advice()})
 		return
 	}
 
 	// Update our Page Metadata
-	pageIndex[metadata.SHA()] = metadata
+	pageIndex.Add(metadata)
 
 	span.SetAttributes(
-		attribute.Int("index_size", len(pageIndex)),
+		attribute.Int("index_size", len(pageIndex.Deployments)),
 	)
 
 	herr = s3client.UploadPageIndex(ctx, pageIndex)
 	if herr != nil {
 		otelzap.L().WithError(herr).Ctx(ctx).Error("failed to update page metadata")
-		ct.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update page metadata"})
+		respond(http.StatusInternalServerError, gin.H{"error": "failed to update page metadata"})
 		return
 	}
 
+	accepted = true
+
 	// Invalidate the cache immediately (useful if we're running "all in one")
 	s3_client.InvalidatePageMetadata(page)
 
 	span.SetStatus(codes.Ok, "")
-	ct.JSON(http.StatusOK, gin.H{
+	respond(http.StatusOK, gin.H{
 		"status":      "upload successful",
 		"file_count":  fileCount,
 		"url":         fmt.Sprintf("https://%s", page.Domain.String()),
 		"preview_url": getPreviewUrls(page, metadata),
+		"upload":      progress,
 	})
 }
 
-func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, commitSha string) (string, int, int64, humane.Error) {
+// deployClaims returns the claims of the upload described by metadata that
+// the deploy policy of its page is evaluated against. tokenRepository is the
+// repository as the upload token names it.
+func deployClaims(metadata *s3_client.PageIndexData, tokenRepository string) config.DeployClaims {
+	return config.DeployClaims{
+		Branch:         metadata.Branch,
+		Environment:    metadata.Environment,
+		EventName:      metadata.Provenance.EventName,
+		JobWorkflowRef: metadata.Provenance.JobWorkflowRef,
+		Repository:     tokenRepository,
+		HeadRepository: metadata.Provenance.HeadRepository,
+		RefType:        metadata.Provenance.RefType,
+	}
+}
+
+// saveArtifactsToTemp saves the uploaded files to a new temporary folder, and
+// returns it together with the hex encoded SHA-256 digests of the files by
+// their paths relative to it. Every upload gets a folder of its own, so
+// neither concurrent uploads of a commit nor the leftovers of a failed one end
+// up in it. The caller removes it.
+func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, commitSha string) (string, int, int64, map[string]string, humane.Error) {
 	ctx, span := r.tracer.Start(ctx, "restApi.saveArtifactsToTemp")
 	defer span.End()
 
-	tempDir := os.TempDir()
-	uploadPath := filepath.Join(tempDir, commitSha)
+	uploadPath, err := os.MkdirTemp("", "staticpages-"+commitSha+"-")
+	if err != nil {
+		return "", 0, 0, nil, humane.Wrap(err, "failed to create upload cache directory", "Make sure the temporary directory is writable and try again.")
+	}
 
 	otelzap.L().Ctx(ctx).Debug("start saving artifacts", zap.String("path", uploadPath))
 
@@ -112,7 +245,7 @@ func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, comm
 	if err != nil {
 		otelzap.L().WithError(err).Ctx(ctx).Error("failed to parse multipart form")
 		ct.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
-		return uploadPath, 0, 0, humane.Wrap(err, "failed to parse multipart form", "Make sure the request is correctly formatted and try again.")
+		return uploadPath, 0, 0, nil, humane.Wrap(err, "failed to parse multipart form", "Make sure the request is correctly formatted and try again.")
 	}
 
 	var (
@@ -122,6 +255,7 @@ func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, comm
 		countMu   sync.Mutex
 		fileCount int
 		size      int64
+		digests   = make(map[string]string)
 	)
 
 	for key, files := range form.File {
@@ -129,6 +263,7 @@ func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, comm
 		if !ok {
 			continue
 		}
+		relPath = cleanRelativePath(relPath)
 
 		for _, file := range files {
 			wg.Add(1)
@@ -146,7 +281,8 @@ func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, comm
 					return
 				}
 
-				if err := ct.SaveUploadedFile(file, dst); err != nil {
+				digest, err := saveUploadedFile(file, dst)
+				if err != nil {
 					errOnce.Do(func() {
 						errResult = humane.Wrap(err, "failed to save file", "Make sure the upload cache directory is writable and try again.")
 					})
@@ -156,13 +292,14 @@ func (r *RestApi) saveArtifactsToTemp(ctx context.Context, ct *gin.Context, comm
 				countMu.Lock()
 				fileCount++
 				size += file.Size
+				digests[relPath] = digest
 				countMu.Unlock()
 			}(relPath)
 		}
 	}
 
 	wg.Wait()
-	return uploadPath, fileCount, size, errResult
+	return uploadPath, fileCount, size, digests, errResult
 }
 
 func getPreviewUrls(page *config.Page, metadata *s3_client.PageIndexData) []string {
@@ -2,18 +2,32 @@ package api
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
 	"github.com/sierrasoftworks/humane-errors-go"
 )
 
-func (r *RestApi) extractPagesConfig(ctx context.Context, repo string) (*config.Page, humane.Error) {
+// extractPagesConfig returns the page of repo whose issuer minted token for
+// its audience, if it has one.
+func (r *RestApi) extractPagesConfig(ctx context.Context, repo string, token *verifiedToken) (*config.Page, humane.Error) {
 	_, span := r.tracer.Start(ctx, "restApi.extractPagesConfig")
 	defer span.End()
 
 	for _, page := range r.conf.Pages {
-		if page.Git.Repository == repo {
+		if page.Git.TokenRepository() != repo {
+			continue
+		}
+
+		if issuer, err := page.Git.GetOidcIssuer(); err != nil || issuer != token.issuer {
+			continue
+		}
+		if audience, err := page.Git.GetOidcAudience(); err == nil && slices.Contains(token.audience, audience) {
 			return page, nil
 		}
 	}
@@ -30,3 +44,55 @@ func extractRelativePath(key string) (string, bool) {
 	}
 	return key[len(prefix) : len(key)-len(suffix)], true
 }
+
+// commitField is the form field naming the commit uploaded, for providers
+// whose tokens carry none.
+const commitField = "commit"
+
+// uploadCommit returns the commit an upload deploys: the one of its token, or
+// for tokens carrying none, the one named in the commit field of the form,
+// which is reported as unverified.
+func uploadCommit(tokenSHA string, req *http.Request) (sha string, unverified bool, herr humane.Error) {
+	if tokenSHA != "" {
+		return tokenSHA, false, nil
+	}
+
+	sha = strings.ToLower(req.PostFormValue(commitField))
+	if !isCommitSHA(sha) {
+		return "", false, humane.New(fmt.Sprintf("the token carries no commit; send its full SHA in the %q field", commitField),
+			"Pass the commit the upload was built from, e.g. $BITBUCKET_COMMIT.")
+	}
+	return sha, true, nil
+}
+
+// checkUnverifiedCommit refuses an upload naming its commit itself, see
+// uploadCommit, when the commit was deployed before from another branch or
+// environment. Nothing proves the upload was built from that commit, so it
+// could otherwise replace a deployment it may not make, like the commit live
+// in production from a pipeline only allowed to deploy previews.
+func checkUnverifiedCommit(deployments s3_client.PageIndex, metadata *s3_client.PageIndexData) humane.Error {
+	if !metadata.Provenance.CommitUnverified {
+		return nil
+	}
+
+	existing, herr := deployments.GetBySHA(metadata.SHA())
+	if herr != nil {
+		return nil
+	}
+
+	if existing.Branch != metadata.Branch || existing.Environment != metadata.Environment {
+		return humane.New(fmt.Sprintf("commit %s was already deployed from branch %q", metadata.SHA(), existing.Branch),
+			"The token carries no commit, so an upload may not replace a deployment of the commit made from another branch or environment.",
+			"Upload the commit from the branch and environment it was deployed from.")
+	}
+	return nil
+}
+
+// isCommitSHA reports whether sha is a full SHA-1 or SHA-256 commit hash.
+func isCommitSHA(sha string) bool {
+	if len(sha) != 40 && len(sha) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sha)
+	return err == nil
+}
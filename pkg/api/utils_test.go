@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCommitSHA(t *testing.T) {
+	tests := []struct {
+		name string
+		sha  string
+		want bool
+	}{
+		{name: "sha1", sha: "0123456789abcdef0123456789abcdef01234567", want: true},
+		{name: "sha256", sha: strings.Repeat("ab", 32), want: true},
+		{name: "empty", sha: "", want: false},
+		{name: "abbreviated", sha: "0123456", want: false},
+		{name: "not hex", sha: "0123456789abcdef0123456789abcdef0123456g", want: false},
+		{name: "path", sha: "../../../../../../../../../../../etc/pass", want: false},
+		{name: "between lengths", sha: strings.Repeat("a", 50), want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isCommitSHA(tc.sha))
+		})
+	}
+}
+
+func TestUploadCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	form := func(commit string) url.Values {
+		values := url.Values{}
+		if commit != "" {
+			values.Set(commitField, commit)
+		}
+		return values
+	}
+
+	tests := []struct {
+		name           string
+		tokenSHA       string
+		form           url.Values
+		wantSHA        string
+		wantUnverified bool
+		errorContains  string
+	}{
+		{name: "token commit", tokenSHA: sha, form: form(""), wantSHA: sha},
+		{name: "token commit wins over the form", tokenSHA: sha, form: form(strings.Repeat("f", 40)), wantSHA: sha},
+		{name: "form commit", form: form(sha), wantSHA: sha, wantUnverified: true},
+		{name: "form commit is lower cased", form: form(strings.ToUpper(sha)), wantSHA: sha, wantUnverified: true},
+		{name: "no commit", form: form(""), errorContains: `send its full SHA in the "commit" field`},
+		{name: "invalid commit", form: form("main"), errorContains: "the token carries no commit"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			got, unverified, err := uploadCommit(tc.tokenSHA, req)
+			if tc.errorContains != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tc.errorContains)
+				}
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantSHA, got)
+			assert.Equal(t, tc.wantUnverified, unverified)
+		})
+	}
+}
+
+func TestCheckUnverifiedCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	doc := &s3_client.PageIndexDocument{}
+	doc.Add(s3_client.NewPageCommitMetadata("org/site", sha, "main", "production", time.Now()))
+	deployments := doc.Index()
+
+	upload := func(sha, branch, environment string, unverified bool) *s3_client.PageIndexData {
+		metadata := s3_client.NewPageCommitMetadata("org/site", sha, branch, environment, time.Now())
+		metadata.Provenance.CommitUnverified = unverified
+		return metadata
+	}
+
+	tests := []struct {
+		name          string
+		upload        *s3_client.PageIndexData
+		errorContains string
+	}{
+		{name: "verified commit", upload: upload(sha, "feature", "", false)},
+		{name: "new commit", upload: upload(strings.Repeat("f", 40), "feature", "", true)},
+		{name: "same branch and environment", upload: upload(sha, "main", "production", true)},
+		{name: "other branch", upload: upload(sha, "feature", "", true), errorContains: `already deployed from branch "main"`},
+		{name: "other environment", upload: upload(sha, "main", "staging", true), errorContains: "already deployed"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			herr := checkUnverifiedCommit(deployments, tc.upload)
+			if tc.errorContains == "" {
+				assert.Nil(t, herr)
+				return
+			}
+
+			if assert.NotNil(t, herr) {
+				assert.Contains(t, herr.Error(), tc.errorContains)
+			}
+		})
+	}
+}
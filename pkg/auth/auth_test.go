@@ -0,0 +1,677 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIssuer is a minimal OIDC provider issuing RS256 ID tokens for whatever
+// claims the test sets, without asking anyone to log in.
+type fakeIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+	codes  map[string]string // code -> nonce
+}
+
+func newFakeIssuer(t *testing.T, claims map[string]any) *fakeIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	f := &fakeIssuer{t: t, key: key, claims: claims, codes: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeIssuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		writeTestJSON(w, map[string]any{
+			"issuer":                                f.URL,
+			"authorization_endpoint":                f.URL + "/authorize",
+			"token_endpoint":                        f.URL + "/token",
+			"jwks_uri":                              f.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+
+	case "/keys":
+		writeTestJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+
+	case "/authorize":
+		// Log in immediately and return to the client.
+		query := r.URL.Query()
+		code := randomString()
+
+		f.mu.Lock()
+		f.codes[code] = query.Get("nonce")
+		f.mu.Unlock()
+
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		values := redirect.Query()
+		values.Set("code", code)
+		values.Set("state", query.Get("state"))
+		redirect.RawQuery = values.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+
+	case "/token":
+		require.NoError(f.t, r.ParseForm())
+		assert.NotEmpty(f.t, r.PostForm.Get("code_verifier"), "PKCE verifier must be sent")
+
+		f.mu.Lock()
+		nonce, ok := f.codes[r.PostForm.Get("code")]
+		delete(f.codes, r.PostForm.Get("code"))
+		f.mu.Unlock()
+
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		clientID, _, _ := r.BasicAuth()
+		writeTestJSON(w, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     f.idToken(clientID, nonce),
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeIssuer) idToken(audience, nonce string) string {
+	claims := map[string]any{
+		"iss":   f.URL,
+		"aud":   audience,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+
+	f.mu.Lock()
+	for k, v := range f.claims {
+		claims[k] = v
+	}
+	f.mu.Unlock()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	require.NoError(f.t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// browser follows redirects across hosts the way a browser would, sending
+// every request to handler unless it targets the issuer.
+type browser struct {
+	t       *testing.T
+	handler http.Handler
+	issuer  *fakeIssuer
+	cookies map[string]*http.Cookie
+}
+
+func newBrowser(t *testing.T, handler http.Handler, issuer *fakeIssuer) *browser {
+	return &browser{t: t, handler: handler, issuer: issuer, cookies: make(map[string]*http.Cookie)}
+}
+
+// get requests rawURL and follows redirects, returning the final response.
+func (b *browser) get(rawURL string) *httptest.ResponseRecorder {
+	b.t.Helper()
+	return b.do(http.MethodGet, rawURL)
+}
+
+// post is get with a POST as the first request.
+func (b *browser) post(rawURL string) *httptest.ResponseRecorder {
+	b.t.Helper()
+	return b.do(http.MethodPost, rawURL)
+}
+
+func (b *browser) do(method, rawURL string) *httptest.ResponseRecorder {
+	b.t.Helper()
+
+	for range 10 {
+		var rr *httptest.ResponseRecorder
+		if b.issuer != nil && strings.HasPrefix(rawURL, b.issuer.URL) {
+			rr = httptest.NewRecorder()
+			b.issuer.Config.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, rawURL, nil))
+		} else {
+			req := httptest.NewRequest(method, rawURL, nil)
+			for _, c := range b.cookies {
+				req.AddCookie(c)
+			}
+			rr = httptest.NewRecorder()
+			b.handler.ServeHTTP(rr, req)
+
+			for _, c := range rr.Result().Cookies() {
+				if c.MaxAge < 0 {
+					delete(b.cookies, c.Name)
+				} else {
+					b.cookies[c.Name] = c
+				}
+			}
+		}
+
+		if rr.Code != http.StatusFound && rr.Code != http.StatusSeeOther {
+			return rr
+		}
+
+		next, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(b.t, err)
+		base, _ := url.Parse(rawURL)
+		rawURL = base.ResolveReference(next).String()
+		method = http.MethodGet
+	}
+
+	b.t.Fatalf("too many redirects")
+	return nil
+}
+
+func TestSessionsRejectTamperedAndExpiredCookies(t *testing.T) {
+	sessions := NewSessions("test", "secret", time.Hour, "example.com")
+
+	rr := httptest.NewRecorder()
+	sessions.Set(rr, httptest.NewRequest(http.MethodGet, "/", nil), Session{Subject: "alice", Method: "oidc"})
+	cookie := rr.Result().Cookies()[0]
+	assert.Equal(t, "example.com", cookie.Domain)
+	assert.True(t, cookie.HttpOnly)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	session, ok := sessions.Get(req)
+	require.True(t, ok)
+	assert.Equal(t, "alice", session.Subject)
+
+	// Another secret must not accept the cookie.
+	_, ok = NewSessions("test", "other", time.Hour, "example.com").Get(req)
+	assert.False(t, ok)
+
+	// Nor another domain with the same secret.
+	_, ok = NewSessions("test", "secret", time.Hour, "other.com").Get(req)
+	assert.False(t, ok)
+
+	// Changing the payload breaks the signature.
+	payload, signature, _ := strings.Cut(cookie.Value, ".")
+	decoded, _ := base64.RawURLEncoding.DecodeString(payload)
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(decoded), "alice", "mallory", 1)))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "test", Value: forged + "." + signature})
+	_, ok = sessions.Get(req)
+	assert.False(t, ok)
+
+	// Expired sessions are rejected even with a valid signature.
+	expired := NewSessions("test", "secret", time.Hour, "example.com")
+	rr = httptest.NewRecorder()
+	expired.write(rr, httptest.NewRequest(http.MethodGet, "/", nil), "test", Session{Subject: "alice", Expires: time.Now().Add(-time.Minute).Unix()}, time.Hour)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	_, ok = sessions.Get(req)
+	assert.False(t, ok)
+}
+
+func TestReturnURL(t *testing.T) {
+	domain := config.FromString("example.com")
+	req := httptest.NewRequest(http.MethodGet, "http://feature.example.com/.staticpages/login", nil)
+
+	tests := map[string]string{
+		"/docs?a=b":                          "http://feature.example.com/docs?a=b",
+		"https://other.example.com/page":     "https://other.example.com/page",
+		"https://evil.com/":                  "http://feature.example.com/",
+		"//evil.com/":                        "http://feature.example.com/",
+		"https://example.com.evil.com/":      "http://feature.example.com/",
+		"javascript:alert(1)":                "http://feature.example.com/",
+		"":                                   "http://feature.example.com/",
+		"https://feature.example.com:8443/x": "https://feature.example.com:8443/x",
+	}
+
+	for rd, expected := range tests {
+		assert.Equal(t, expected, returnURL(req, domain, rd), rd)
+	}
+}
+
+func previewPage(access config.PreviewAccess) *config.Page {
+	return &config.Page{
+		Domain:  config.FromString("example.com"),
+		Preview: config.PreviewConfig{Enabled: true, Access: access},
+	}
+}
+
+func TestNewPreviewAccess(t *testing.T) {
+	access, err := NewPreviewAccess(previewPage(config.PreviewAccess{}), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, access, "previews without access rules are public")
+
+	_, err = NewPreviewAccess(previewPage(config.PreviewAccess{AllowCIDRs: []string{"10.0.0.0/33"}}), nil)
+	assert.NotNil(t, err)
+
+	_, err = NewPreviewAccess(previewPage(config.PreviewAccess{Password: "secret"}), nil)
+	assert.NotNil(t, err, "a password login needs a session secret")
+
+	_, err = NewPreviewAccess(previewPage(config.PreviewAccess{BasicAuth: config.BasicAuth{Username: "ENV(STATICPAGES_TEST_UNSET)", Password: "x"}}), nil)
+	assert.NotNil(t, err)
+
+	_, err = NewPreviewAccess(previewPage(config.PreviewAccess{
+		OIDC:          config.OIDCLogin{Issuer: "https://issuer.example.com", ClientID: "client"},
+		SessionSecret: "session",
+	}), nil)
+	assert.NotNil(t, err, "an OIDC login needs an allowlist")
+}
+
+func TestPreviewAccessNetworksAndBasicAuth(t *testing.T) {
+	_, loadBalancer, _ := net.ParseCIDR("198.51.100.0/24")
+	access, err := NewPreviewAccess(previewPage(config.PreviewAccess{
+		AllowCIDRs: []string{"10.0.0.0/8", "192.0.2.1"},
+		BasicAuth:  config.BasicAuth{Username: "review", Password: "s3cret"},
+	}), []*net.IPNet{loadBalancer})
+	require.Nil(t, err)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		user, pass   string
+		allowed      bool
+	}{
+		{name: "allowed network", remoteAddr: "10.1.2.3:1234", allowed: true},
+		{name: "allowed address", remoteAddr: "192.0.2.1:1234", allowed: true},
+		{name: "other address", remoteAddr: "192.0.2.2:1234"},
+		{name: "allowed client behind load balancer", remoteAddr: "198.51.100.7:1234", forwardedFor: "10.1.2.3", allowed: true},
+		{name: "other client behind load balancer", remoteAddr: "198.51.100.7:1234", forwardedFor: "192.0.2.2"},
+		{name: "forwarded for by untrusted client", remoteAddr: "192.0.2.2:1234", forwardedFor: "10.1.2.3"},
+		{name: "credentials", remoteAddr: "192.0.2.2:1234", user: "review", pass: "s3cret", allowed: true},
+		{name: "wrong password", remoteAddr: "192.0.2.2:1234", user: "review", pass: "wrong"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://feature.example.com/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.pass)
+			}
+
+			rr := httptest.NewRecorder()
+			assert.Equal(t, test.allowed, access.Allow(rr, req))
+			if !test.allowed {
+				assert.Equal(t, http.StatusUnauthorized, rr.Code)
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "Basic")
+			}
+		})
+	}
+}
+
+// guarded serves "content" for requests access allows, like the proxy does.
+func guarded(access *PreviewAccess) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, PathPrefix) {
+			access.ServeHTTP(w, r)
+			return
+		}
+		if access.Allow(w, r) {
+			_, _ = w.Write([]byte("content"))
+		}
+	})
+}
+
+func TestPreviewAccessPasswordLogin(t *testing.T) {
+	access, err := NewPreviewAccess(previewPage(config.PreviewAccess{Password: "letmein", SessionSecret: "session"}), nil)
+	require.Nil(t, err)
+	handler := guarded(access)
+
+	// Visitors are sent to the login page, which returns them afterwards.
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://feature.example.com/docs/", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, LoginPath+"?rd=%2Fdocs%2F", rr.Header().Get("Location"))
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}, "rd": {"/docs/"}}
+		req := httptest.NewRequest(http.MethodPost, "http://feature.example.com"+LoginPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = login("wrong")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	rr = login("letmein")
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Equal(t, "http://feature.example.com/docs/", rr.Header().Get("Location"))
+	cookies := rr.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	// The session covers every preview of the page.
+	req := httptest.NewRequest(http.MethodGet, "http://other.example.com/docs/", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "content", rr.Body.String())
+
+	// Logging out takes a POST.
+	req = httptest.NewRequest(http.MethodGet, "http://feature.example.com"+LogoutPath, nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	req = httptest.NewRequest(http.MethodPost, "http://feature.example.com"+LogoutPath, nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	require.Len(t, rr.Result().Cookies(), 1)
+	assert.Negative(t, rr.Result().Cookies()[0].MaxAge)
+}
+
+func TestPreviewAccessSessionsAreBoundToThePage(t *testing.T) {
+	shared := config.PreviewAccess{Password: "letmein", SessionSecret: "session"}
+	access, err := NewPreviewAccess(previewPage(shared), nil)
+	require.Nil(t, err)
+
+	other := previewPage(shared)
+	other.Domain = config.FromString("other.com")
+	otherAccess, err := NewPreviewAccess(other, nil)
+	require.Nil(t, err)
+
+	form := url.Values{"password": {"letmein"}}
+	req := httptest.NewRequest(http.MethodPost, "http://feature.other.com"+LoginPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	otherAccess.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusSeeOther, rr.Code)
+
+	// A session of another page with the same secret is not accepted.
+	req = httptest.NewRequest(http.MethodGet, "http://feature.example.com/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	assert.False(t, access.Allow(httptest.NewRecorder(), req))
+
+	req = httptest.NewRequest(http.MethodGet, "http://feature.other.com/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	assert.True(t, otherAccess.Allow(httptest.NewRecorder(), req))
+}
+
+func TestPreviewAccessOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t, map[string]any{"sub": "alice", "email": "alice@example.com"})
+
+	access, err := NewPreviewAccess(previewPage(config.PreviewAccess{
+		OIDC:           config.OIDCLogin{Issuer: issuer.URL, ClientID: "client", ClientSecret: "secret"},
+		LoginAllowlist: config.LoginAllowlist{AllowedEmailDomains: []string{"example.com"}},
+		SessionSecret:  "session",
+	}), nil)
+	require.Nil(t, err)
+
+	b := newBrowser(t, guarded(access), issuer)
+	rr := b.get("http://feature.example.com/docs/")
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "content", rr.Body.String())
+	assert.Contains(t, b.cookies, previewCookie)
+	assert.NotContains(t, b.cookies, previewCookie+"_login", "the login state must be cleared")
+
+	// A callback without a started login is rejected.
+	rr = httptest.NewRecorder()
+	access.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com"+CallbackPath+"?code=x&state=y", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Visitors the issuer knows, but the allowlist does not, are denied.
+	issuer.mu.Lock()
+	issuer.claims = map[string]any{"sub": "mallory", "email": "mallory@gmail.com"}
+	issuer.mu.Unlock()
+
+	b = newBrowser(t, guarded(access), issuer)
+	rr = b.get("http://feature.example.com/docs/")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Access denied")
+	assert.NotContains(t, b.cookies, previewCookie)
+}
+
+func TestPreviewAccessThrottlesWrongPasswords(t *testing.T) {
+	access, err := NewPreviewAccess(previewPage(config.PreviewAccess{
+		BasicAuth:     config.BasicAuth{Username: "review", Password: "s3cret"},
+		Password:      "letmein",
+		SessionSecret: "session",
+	}), nil)
+	require.Nil(t, err)
+
+	now := time.Now()
+	access.failures.now = func() time.Time { return now }
+
+	login := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "http://feature.example.com"+LoginPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		access.ServeHTTP(rr, req)
+		return rr
+	}
+
+	basicAuth := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://feature.example.com/", nil)
+		req.SetBasicAuth("review", password)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		access.Allow(rr, req)
+		return rr
+	}
+
+	for range maxFailedLogins - 1 {
+		require.Equal(t, http.StatusUnauthorized, login("192.0.2.1:1234", "wrong").Code)
+	}
+	require.Equal(t, http.StatusFound, basicAuth("192.0.2.1:1234", "wrong").Code)
+
+	// Once throttled, even the right password has to wait.
+	rr := login("192.0.2.1:1234", "letmein")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusTooManyRequests, basicAuth("192.0.2.1:1234", "s3cret").Code)
+
+	// Other clients are not affected.
+	assert.Equal(t, http.StatusSeeOther, login("192.0.2.2:1234", "letmein").Code)
+
+	// Waiting earns another attempt.
+	now = now.Add(failedLoginCooldown)
+	assert.Equal(t, http.StatusSeeOther, login("192.0.2.1:1234", "letmein").Code)
+}
+
+func TestDenyAll(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://feature.example.com/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+
+	assert.False(t, DenyAll("example.com").Allow(rr, req))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func sitePage(issuer string, auth config.PageAuth) *config.Page {
+	auth.OIDC = config.OIDCLogin{Issuer: issuer, ClientID: "client", ClientSecret: "secret"}
+	auth.SessionSecret = "session"
+	return &config.Page{Domain: config.FromString("example.com"), Auth: auth}
+}
+
+// protected serves "content" with the identity headers for logged-in
+// visitors, like the proxy does.
+func protected(site *SiteAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, PathPrefix) {
+			site.ServeHTTP(w, r)
+			return
+		}
+
+		session, ok := site.Authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		SetIdentityHeaders(r.Header, session)
+		_, _ = w.Write([]byte(r.Header.Get(HeaderUser) + "|" + r.Header.Get(HeaderEmail) + "|" + r.Header.Get(HeaderGroups)))
+	})
+}
+
+func TestSiteAuthAllowlists(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		auth    config.PageAuth
+		allowed bool
+		body    string
+	}{
+		{
+			name:    "anyone without allowlists",
+			claims:  map[string]any{"sub": "alice", "email": "alice@gmail.com"},
+			allowed: true,
+			body:    "alice|alice@gmail.com|",
+		},
+		{
+			name:    "allowed email domain",
+			claims:  map[string]any{"sub": "alice", "email": "Alice@Example.com", "email_verified": true},
+			auth:    config.PageAuth{AllowedEmailDomains: []string{"@example.com"}},
+			allowed: true,
+		},
+		{
+			name:   "other email domain",
+			claims: map[string]any{"sub": "mallory", "email": "mallory@evil.com"},
+			auth:   config.PageAuth{AllowedEmailDomains: []string{"example.com"}},
+		},
+		{
+			name:   "unverified email",
+			claims: map[string]any{"sub": "mallory", "email": "mallory@example.com", "email_verified": false},
+			auth:   config.PageAuth{AllowedEmailDomains: []string{"example.com"}},
+		},
+		{
+			name:    "allowed group only keeps allowed groups",
+			claims:  map[string]any{"sub": "bob", "roles": []any{"staff", "docs"}},
+			auth:    config.PageAuth{AllowedGroups: []string{"docs"}, GroupsClaim: "roles"},
+			allowed: true,
+			body:    "bob||docs",
+		},
+		{
+			name:   "no allowed group",
+			claims: map[string]any{"sub": "bob", "groups": "staff"},
+			auth:   config.PageAuth{AllowedGroups: []string{"docs"}},
+		},
+		{
+			name:   "both lists have to match",
+			claims: map[string]any{"sub": "carol", "email": "carol@example.com", "groups": []any{"staff"}},
+			auth:   config.PageAuth{AllowedEmailDomains: []string{"example.com"}, AllowedGroups: []string{"docs"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newFakeIssuer(t, test.claims)
+			site, err := NewSiteAuth(sitePage(issuer.URL, test.auth))
+			require.Nil(t, err)
+
+			rr := newBrowser(t, protected(site), issuer).get("http://example.com/runbook/")
+			if !test.allowed {
+				assert.Equal(t, http.StatusForbidden, rr.Code)
+				assert.Contains(t, rr.Body.String(), "Access denied")
+				return
+			}
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			if test.body != "" {
+				assert.Equal(t, test.body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestSiteAuthRequiresLogin(t *testing.T) {
+	site, err := NewSiteAuth(sitePage("http://127.0.0.1:1", config.PageAuth{}))
+	require.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	site.Authenticate(rr, httptest.NewRequest(http.MethodGet, "http://example.com/a?b=c", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, LoginPath+"?rd=%2Fa%3Fb%3Dc", rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	site.Authenticate(rr, httptest.NewRequest(http.MethodPost, "http://example.com/a", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	_, err = NewSiteAuth(&config.Page{Auth: config.PageAuth{OIDC: config.OIDCLogin{Issuer: "x", ClientID: "client"}}})
+	assert.NotNil(t, err, "a session secret is required")
+}
+
+func TestSiteAuthLogout(t *testing.T) {
+	issuer := newFakeIssuer(t, map[string]any{"sub": "alice"})
+	site, err := NewSiteAuth(sitePage(issuer.URL, config.PageAuth{}))
+	require.Nil(t, err)
+
+	b := newBrowser(t, protected(site), issuer)
+	require.Equal(t, http.StatusOK, b.get("http://example.com/").Code)
+	require.Contains(t, b.cookies, siteCookie)
+
+	// The fake issuer has no end_session_endpoint, so the proxy confirms the
+	// logout itself.
+	// Logging out changes state, so it takes a POST.
+	rr := b.get("http://example.com" + LogoutPath)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Contains(t, b.cookies, siteCookie)
+
+	rr = b.post("http://example.com" + LogoutPath)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Signed out")
+	assert.NotContains(t, b.cookies, siteCookie)
+}
+
+func TestSetIdentityHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set(HeaderUser, "forged")
+	h.Set(HeaderGroups, "admins")
+
+	SetIdentityHeaders(h, nil)
+	assert.Empty(t, h.Get(HeaderUser))
+	assert.Empty(t, h.Get(HeaderGroups))
+
+	SetIdentityHeaders(h, &Session{Subject: "alice", Email: "alice@example.com", Groups: []string{"a", "b"}})
+	assert.Equal(t, "alice", h.Get(HeaderUser))
+	assert.Equal(t, "alice@example.com", h.Get(HeaderEmail))
+	assert.Equal(t, "a,b", h.Get(HeaderGroups))
+}
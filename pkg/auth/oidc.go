@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// The endpoints of the login flows. They are served on every host of a page
+// and never reach the backend.
+const (
+	PathPrefix   = "/.staticpages/"
+	LoginPath    = PathPrefix + "login"
+	CallbackPath = PathPrefix + "callback"
+	LogoutPath   = PathPrefix + "logout"
+)
+
+// loginTTL bounds how long a visitor may take to log in at the issuer.
+const loginTTL = 10 * time.Minute
+
+// loginState is kept in a signed cookie between redirecting to the issuer and
+// its callback.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"rd"`
+	Expires  int64  `json:"exp"`
+}
+
+// OIDC logs visitors in through the authorization code flow with PKCE.
+//
+// The callback is served on the page domain rather than the host the visitor
+// started on, so a single redirect URL registered with the issuer covers every
+// preview. Cookies are scoped to the page domain for the same reason.
+type OIDC struct {
+	conf     config.OIDCLogin
+	domain   config.DomainScope
+	sessions *Sessions
+	tracer   trace.Tracer
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// NewOIDC returns a login flow for the pages served on domain.
+func NewOIDC(conf config.OIDCLogin, domain config.DomainScope, sessions *Sessions) *OIDC {
+	return &OIDC{
+		conf:     conf,
+		domain:   domain,
+		sessions: sessions,
+		tracer:   otel.Tracer("StaticPages-Auth"),
+	}
+}
+
+// discover returns the provider, fetching its discovery document on first use
+// so an unreachable issuer does not prevent startup.
+func (o *OIDC) discover(ctx context.Context) (*oidc.Provider, humane.Error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, o.conf.Issuer)
+	if err != nil {
+		return nil, humane.Wrap(err, "unable to discover OIDC issuer",
+			"Make sure the issuer is reachable and serves /.well-known/openid-configuration.")
+	}
+
+	o.provider = provider
+	return provider, nil
+}
+
+func (o *OIDC) oauth2Config(r *http.Request, provider *oidc.Provider) *oauth2.Config {
+	redirectURL := o.conf.RedirectURL
+	if redirectURL == "" {
+		host := o.domain.String()
+		if _, port, err := net.SplitHostPort(r.Host); err == nil {
+			host = net.JoinHostPort(host, port)
+		}
+		redirectURL = scheme(r) + "://" + host + CallbackPath
+	}
+
+	scopes := o.conf.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	return &oauth2.Config{
+		ClientID:     o.conf.ClientID.String(),
+		ClientSecret: o.conf.ClientSecret.String(),
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+}
+
+// Login redirects the visitor to the issuer. After logging in, the callback
+// returns them to returnTo, an absolute URL on the page domain.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request, returnTo string) {
+	ctx, span := o.tracer.Start(r.Context(), "auth.OIDC.Login", trace.WithAttributes(attribute.String("auth.issuer", o.conf.Issuer)))
+	defer span.End()
+
+	provider, err := o.discover(ctx)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, "Login unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: returnTo,
+		Expires:  time.Now().Add(loginTTL).Unix(),
+	}
+	o.sessions.write(w, r, o.stateCookie(), state, loginTTL)
+
+	authURL := o.oauth2Config(r, provider).AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.S256ChallengeOption(state.Verifier))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Claims are the claims of a verified ID token used for sessions.
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Name          string `json:"name"`
+
+	raw map[string]any
+}
+
+// Strings returns the claim name as a list of strings. A single string is
+// returned as a list of one; anything else as nil.
+func (c *Claims) Strings(name string) []string {
+	switch value := c.raw[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// Callback completes a login: it checks the state, exchanges the code and
+// verifies the ID token. It returns the verified claims and where to return
+// the visitor to; storing the session is up to the caller.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) (*Claims, string, humane.Error) {
+	ctx, span := o.tracer.Start(r.Context(), "auth.OIDC.Callback", trace.WithAttributes(attribute.String("auth.issuer", o.conf.Issuer)))
+	defer span.End()
+
+	var state loginState
+	if err := o.sessions.read(r, o.stateCookie(), &state); err != nil {
+		return nil, "", humane.Wrap(err, "login expired or was not started here", "Start the login again.")
+	}
+	o.sessions.clear(w, r, o.stateCookie())
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		return nil, "", humane.New("issuer denied the login: "+errCode, query.Get("error_description"))
+	}
+
+	if query.Get("state") == "" || query.Get("state") != state.State {
+		return nil, "", humane.New("login state mismatch", "Start the login again.")
+	}
+
+	provider, herr := o.discover(ctx)
+	if herr != nil {
+		return nil, "", herr
+	}
+
+	token, err := o.oauth2Config(r, provider).Exchange(ctx, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return nil, "", humane.Wrap(err, "unable to exchange authorization code",
+			"Make sure the client ID, client secret and redirect URL match the registration at the issuer.")
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", humane.New("issuer returned no ID token", "Make sure the openid scope is granted.")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.conf.ClientID.String()}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, "", humane.Wrap(err, "invalid ID token")
+	}
+
+	if idToken.Nonce != state.Nonce {
+		return nil, "", humane.New("ID token nonce mismatch", "Start the login again.")
+	}
+
+	var claims Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, "", humane.Wrap(err, "unable to parse ID token claims")
+	}
+	if err := idToken.Claims(&claims.raw); err != nil {
+		return nil, "", humane.Wrap(err, "unable to parse ID token claims")
+	}
+
+	span.SetAttributes(attribute.String("auth.subject", claims.Subject))
+	return &claims, state.ReturnTo, nil
+}
+
+// EndSessionURL returns the URL logging the visitor out at the issuer, if it
+// supports RP-initiated logout, returning them to postLogout afterwards.
+func (o *OIDC) EndSessionURL(ctx context.Context, postLogout string) (string, bool) {
+	provider, herr := o.discover(ctx)
+	if herr != nil {
+		return "", false
+	}
+
+	var metadata struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil || metadata.EndSessionEndpoint == "" {
+		return "", false
+	}
+
+	endSession, err := url.Parse(metadata.EndSessionEndpoint)
+	if err != nil {
+		return "", false
+	}
+
+	query := endSession.Query()
+	query.Set("client_id", o.conf.ClientID.String())
+	query.Set("post_logout_redirect_uri", postLogout)
+	endSession.RawQuery = query.Encode()
+
+	return endSession.String(), true
+}
+
+func (o *OIDC) stateCookie() string {
+	return o.sessions.name + "_login"
+}
+
+// returnURL returns the absolute URL to return to after a login started on r,
+// as requested by rd. Anything outside the page domain returns to the root of
+// the current host instead, so the login cannot be used as an open redirect.
+func returnURL(r *http.Request, domain config.DomainScope, rd string) string {
+	base := &url.URL{Scheme: scheme(r), Host: r.Host, Path: "/"}
+
+	target, err := base.Parse(rd)
+	if err != nil || rd == "" || strings.HasPrefix(rd, "//") || (target.Scheme != "http" && target.Scheme != "https") {
+		return base.String()
+	}
+
+	if !domain.Is(strings.ToLower(target.Hostname())) {
+		return base.String()
+	}
+
+	return target.String()
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
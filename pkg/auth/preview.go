@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/SpechtLabs/StaticPages/pkg/clientip"
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+)
+
+const previewCookie = "staticpages_preview"
+
+// PreviewAccess enforces pages[].preview.access for the previews of a page.
+type PreviewAccess struct {
+	domain   config.DomainScope
+	networks []*net.IPNet
+	trusted  []*net.IPNet // load balancers reporting the client in X-Forwarded-For
+	basic    config.BasicAuth
+	password config.EnvValue
+	oidc     *OIDC
+	allow    allowlist
+	sessions *Sessions
+
+	// failures throttles guessing the basic authentication credentials and
+	// the password.
+	failures *failedLogins
+
+	// deny rejects every request; used when the configuration is invalid, so
+	// a typo does not make previews public.
+	deny bool
+}
+
+// NewPreviewAccess returns the access rules of the previews of page, or nil
+// if they are public. Requests from trusted proxies are matched against
+// allowCIDRs by the client address they forward.
+func NewPreviewAccess(page *config.Page, trusted []*net.IPNet) (*PreviewAccess, humane.Error) {
+	conf := page.Preview.Access
+	if !conf.Configured() {
+		return nil, nil
+	}
+
+	a := &PreviewAccess{domain: page.Domain, trusted: trusted, basic: conf.BasicAuth, password: conf.Password, failures: newFailedLogins()}
+
+	for _, cidr := range conf.AllowCIDRs {
+		network, err := clientip.ParseNetwork(cidr)
+		if err != nil {
+			return nil, humane.Wrap(err, fmt.Sprintf("invalid preview.access.allowCIDRs entry %q", cidr),
+				"Use CIDR notation such as 10.0.0.0/8, or a single IP address.")
+		}
+		a.networks = append(a.networks, network)
+	}
+
+	for name, value := range map[string]config.EnvValue{
+		"basicAuth.username": conf.BasicAuth.Username,
+		"basicAuth.password": conf.BasicAuth.Password,
+		"password":           conf.Password,
+		"oidc.clientId":      conf.OIDC.ClientID,
+		"oidc.clientSecret":  conf.OIDC.ClientSecret,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := value.Validate(); err != nil {
+			return nil, humane.Wrap(err, "invalid preview.access."+name)
+		}
+	}
+
+	if conf.BasicAuth.Username != "" && conf.BasicAuth.Password == "" {
+		return nil, humane.New("preview.access.basicAuth has no password", "Configure preview.access.basicAuth.password.")
+	}
+
+	if conf.Password != "" || conf.OIDC.Issuer != "" {
+		if conf.SessionSecret == "" || conf.SessionSecret.Validate() != nil {
+			return nil, humane.New("preview.access.sessionSecret is required for password and OIDC logins",
+				"Configure a long random preview.access.sessionSecret, e.g. through ENV(...).")
+		}
+		a.sessions = NewSessions(previewCookie, conf.SessionSecret.String(), conf.SessionTTL, page.Domain.String())
+	}
+
+	if conf.OIDC.Issuer != "" {
+		if conf.OIDC.ClientID == "" {
+			return nil, humane.New("preview.access.oidc has no clientId", "Configure preview.access.oidc.clientId.")
+		}
+		if !conf.LoginAllowlist.Configured() {
+			return nil, humane.New("preview.access.oidc has no allowlist, so everyone with an account at the issuer could read the previews",
+				"Configure preview.access.allowedEmailDomains or preview.access.allowedGroups.")
+		}
+		a.oidc = NewOIDC(conf.OIDC, page.Domain, a.sessions)
+		a.allow = newAllowlist(page.Domain, conf.LoginAllowlist)
+	}
+
+	return a, nil
+}
+
+// DenyAll returns access rules rejecting every preview request.
+func DenyAll(domain config.DomainScope) *PreviewAccess {
+	return &PreviewAccess{domain: domain, deny: true}
+}
+
+// Allow reports whether r may read the preview. If not, it has responded with
+// a redirect to the login page or a basic authentication challenge.
+func (a *PreviewAccess) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if a.deny {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if a.fromAllowedNetwork(r) {
+		return true
+	}
+
+	if _, _, ok := r.BasicAuth(); ok && a.basic.Username != "" {
+		client := clientip.FromRequest(r, a.trusted)
+		if wait := a.failures.retryAfter(client); wait > 0 {
+			http.Error(w, retryAfterHeader(w, wait), http.StatusTooManyRequests)
+			return false
+		}
+
+		if a.validBasicAuth(r) {
+			return true
+		}
+		a.failures.record(client)
+	}
+
+	if a.sessions != nil {
+		if _, ok := a.sessions.Get(r); ok {
+			return true
+		}
+
+		http.Redirect(w, r, LoginPath+"?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="Previews of %s", charset="UTF-8"`, a.domain))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (a *PreviewAccess) fromAllowedNetwork(r *http.Request) bool {
+	if len(a.networks) == 0 {
+		return false
+	}
+	return clientip.Contains(a.networks, net.ParseIP(clientip.FromRequest(r, a.trusted)))
+}
+
+func (a *PreviewAccess) validBasicAuth(r *http.Request) bool {
+	if a.basic.Username == "" {
+		return false
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	// Both comparisons always run, so timing does not reveal which one failed.
+	userOK := secureCompare(username, a.basic.Username.String())
+	passwordOK := secureCompare(password, a.basic.Password.String())
+	return userOK && passwordOK
+}
+
+// secureCompare compares in constant time, regardless of the lengths.
+func secureCompare(given, expected string) bool {
+	g := sha256.Sum256([]byte(given))
+	e := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(g[:], e[:]) == 1
+}
+
+// ServeHTTP serves the login, callback and logout endpoints below PathPrefix.
+func (a *PreviewAccess) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.deny || a.sessions == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case LoginPath:
+		a.serveLogin(w, r)
+
+	case CallbackPath:
+		if a.oidc == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		claims, returnTo, err := a.oidc.Callback(w, r)
+		if err != nil {
+			otelzap.L().WithError(err).Ctx(r.Context()).Warn("preview login failed", zap.String("domain", a.domain.String()))
+			http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+			return
+		}
+
+		session, err := a.allow.authorize(claims)
+		if err != nil {
+			otelzap.L().WithError(err).Ctx(r.Context()).Info("preview login denied",
+				zap.String("domain", a.domain.String()),
+				zap.String("subject", claims.Subject),
+				zap.String("email", claims.Email))
+			renderMessage(w, http.StatusForbidden, "Access denied", err.Error())
+			return
+		}
+
+		a.sessions.Set(w, r, *session)
+		http.Redirect(w, r, returnURL(r, a.domain, returnTo), http.StatusFound)
+
+	case LogoutPath:
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		a.sessions.Clear(w, r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *PreviewAccess) serveLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := returnURL(r, a.domain, r.FormValue("rd"))
+
+	// Without a password, there is nothing to ask the visitor for.
+	if a.oidc != nil && (a.password == "" || r.FormValue("sso") != "") {
+		a.oidc.Login(w, r, returnTo)
+		return
+	}
+
+	if a.password == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		a.renderLogin(w, http.StatusOK, returnTo, "")
+
+	case http.MethodPost:
+		client := clientip.FromRequest(r, a.trusted)
+		if wait := a.failures.retryAfter(client); wait > 0 {
+			a.renderLogin(w, http.StatusTooManyRequests, returnTo, retryAfterHeader(w, wait))
+			return
+		}
+
+		if !secureCompare(r.PostFormValue("password"), a.password.String()) {
+			a.failures.record(client)
+			otelzap.L().Ctx(r.Context()).Info("preview login with wrong password",
+				zap.String("domain", a.domain.String()),
+				zap.String("client", client))
+			a.renderLogin(w, http.StatusUnauthorized, returnTo, "Wrong password.")
+			return
+		}
+
+		a.sessions.Set(w, r, Session{Subject: "password", Method: "password"})
+		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Preview of {{.Domain}}</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form { display: flex; flex-direction: column; gap: .75rem; width: 18rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.LoginPath}}">
+<h1>Preview of {{.Domain}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="rd" value="{{.ReturnTo}}">
+<input type="password" name="password" placeholder="Password" autofocus required>
+<button type="submit">Continue</button>
+{{if .SSO}}<a href="{{.LoginPath}}?sso=1&amp;rd={{.ReturnTo}}">Sign in with single sign-on</a>{{end}}
+</form>
+</body>
+</html>
+`))
+
+func (a *PreviewAccess) renderLogin(w http.ResponseWriter, status int, returnTo, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := loginTemplate.Execute(w, map[string]any{
+		"Domain":    a.domain.String(),
+		"LoginPath": LoginPath,
+		"ReturnTo":  returnTo,
+		"Error":     message,
+		"SSO":       a.oidc != nil,
+	}); err != nil {
+		otelzap.L().WithError(err).Debug("unable to render login page")
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultSessionTTL is how long a login lasts unless configured otherwise.
+const DefaultSessionTTL = 24 * time.Hour
+
+var errInvalidCookie = errors.New("invalid or expired cookie")
+
+// Session is the identity of a logged-in visitor.
+type Session struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Method  string   `json:"method"`
+	Expires int64    `json:"exp"`
+}
+
+// Sessions stores sessions in cookies signed with HMAC-SHA256. The cookies are
+// scoped to the page domain, so one login covers all of its previews, and
+// bound to it, so pages sharing a secret do not accept each other's logins.
+type Sessions struct {
+	name   string
+	key    []byte
+	ttl    time.Duration
+	domain string
+}
+
+// NewSessions returns a cookie store for the cookie name, signing it with
+// secret.
+func NewSessions(name, secret string, ttl time.Duration, domain string) *Sessions {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name))
+
+	return &Sessions{name: name, key: mac.Sum(nil), ttl: ttl, domain: domain}
+}
+
+// Get returns the session of the request, if it carries a valid one.
+func (s *Sessions) Get(r *http.Request) (*Session, bool) {
+	var session Session
+	if err := s.read(r, s.name, &session); err != nil {
+		return nil, false
+	}
+	return &session, true
+}
+
+// Set stores session in the response, valid for the configured TTL.
+func (s *Sessions) Set(w http.ResponseWriter, r *http.Request, session Session) {
+	session.Expires = time.Now().Add(s.ttl).Unix()
+	s.write(w, r, s.name, session, s.ttl)
+}
+
+// Clear removes the session cookie.
+func (s *Sessions) Clear(w http.ResponseWriter, r *http.Request) {
+	s.clear(w, r, s.name)
+}
+
+// cookiePayload is the signed content of a cookie: its value and the page
+// domain it was issued for.
+type cookiePayload struct {
+	Domain string          `json:"dom"`
+	Value  json.RawMessage `json:"val"`
+}
+
+// write stores value signed in the cookie name. value must carry its own
+// expiry in an "exp" field, which read enforces.
+func (s *Sessions) write(w http.ResponseWriter, r *http.Request, name string, value any, ttl time.Duration) {
+	raw, _ := json.Marshal(value)
+	payload, _ := json.Marshal(cookiePayload{Domain: s.domain, Value: raw})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + s.sign(name, encoded),
+		Path:     "/",
+		Domain:   s.domain,
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   isSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// read verifies the cookie name, issued for our domain, and decodes it into
+// value.
+func (s *Sessions) read(r *http.Request, name string, value any) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(name, encoded))) {
+		return errInvalidCookie
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return errInvalidCookie
+	}
+
+	var payload cookiePayload
+	if err := json.Unmarshal(decoded, &payload); err != nil || payload.Domain != s.domain {
+		return errInvalidCookie
+	}
+
+	var expiry struct {
+		Expires int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload.Value, &expiry); err != nil || time.Now().Unix() >= expiry.Expires {
+		return errInvalidCookie
+	}
+
+	return json.Unmarshal(payload.Value, value)
+}
+
+func (s *Sessions) clear(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		Domain:   s.domain,
+		MaxAge:   -1,
+		Secure:   isSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sign binds the signature to the cookie name, so one cookie cannot be
+// replayed as another.
+func (s *Sessions) sign(name, encoded string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(name + "\x00" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isSecure reports whether the client reached us through HTTPS, directly or
+// through a TLS terminating load balancer.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// scheme returns the scheme the client used to reach us.
+func scheme(r *http.Request) string {
+	if isSecure(r) {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+)
+
+const (
+	siteCookie = "staticpages_session"
+
+	defaultGroupsClaim = "groups"
+)
+
+// The headers carrying the identity of the visitor to the backend. They are
+// removed from every request to a protected page, so clients cannot forge
+// them.
+const (
+	HeaderUser   = "X-Forwarded-User"
+	HeaderEmail  = "X-Forwarded-Email"
+	HeaderGroups = "X-Forwarded-Groups"
+)
+
+// SiteAuth enforces pages[].auth: every request to the page requires a login
+// through OIDC by a visitor on the allowlist.
+type SiteAuth struct {
+	domain   config.DomainScope
+	conf     config.PageAuth
+	allow    allowlist
+	oidc     *OIDC
+	sessions *Sessions
+}
+
+// NewSiteAuth returns the login requirement of page, or nil if the page is
+// public.
+func NewSiteAuth(page *config.Page) (*SiteAuth, humane.Error) {
+	conf := page.Auth
+	if !conf.Enabled() {
+		return nil, nil
+	}
+
+	if conf.OIDC.ClientID == "" {
+		return nil, humane.New("auth.oidc has no clientId", "Configure auth.oidc.clientId.")
+	}
+
+	for name, value := range map[string]config.EnvValue{
+		"oidc.clientId":     conf.OIDC.ClientID,
+		"oidc.clientSecret": conf.OIDC.ClientSecret,
+		"sessionSecret":     conf.SessionSecret,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := value.Validate(); err != nil {
+			return nil, humane.Wrap(err, "invalid auth."+name)
+		}
+	}
+
+	if conf.SessionSecret == "" {
+		return nil, humane.New("auth.sessionSecret is required",
+			"Configure a long random auth.sessionSecret, e.g. through ENV(...).")
+	}
+
+	sessions := NewSessions(siteCookie, conf.SessionSecret.String(), conf.SessionTTL, page.Domain.String())
+	return &SiteAuth{
+		domain:   page.Domain,
+		conf:     conf,
+		allow:    newAllowlist(page.Domain, conf.LoginAllowlist),
+		oidc:     NewOIDC(conf.OIDC, page.Domain, sessions),
+		sessions: sessions,
+	}, nil
+}
+
+// Authenticate returns the session of r. Without one, it has responded with a
+// redirect to the login for GET and HEAD requests, and 401 otherwise.
+func (a *SiteAuth) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	if session, ok := a.sessions.Get(r); ok {
+		return session, true
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	http.Redirect(w, r, LoginPath+"?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	return nil, false
+}
+
+// IdentityHeaders reports whether the identity is passed to the backend.
+func (a *SiteAuth) IdentityHeaders() bool {
+	return a.conf.IdentityHeaders
+}
+
+// ServeHTTP serves the login, callback and logout endpoints below PathPrefix.
+func (a *SiteAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case LoginPath:
+		a.oidc.Login(w, r, returnURL(r, a.domain, r.FormValue("rd")))
+
+	case CallbackPath:
+		claims, returnTo, err := a.oidc.Callback(w, r)
+		if err != nil {
+			otelzap.L().WithError(err).Ctx(r.Context()).Warn("login failed", zap.String("domain", a.domain.String()))
+			renderMessage(w, http.StatusForbidden, "Login failed", err.Error())
+			return
+		}
+
+		session, err := a.allow.authorize(claims)
+		if err != nil {
+			otelzap.L().WithError(err).Ctx(r.Context()).Info("login denied",
+				zap.String("domain", a.domain.String()),
+				zap.String("subject", claims.Subject),
+				zap.String("email", claims.Email))
+			renderMessage(w, http.StatusForbidden, "Access denied", err.Error())
+			return
+		}
+
+		a.sessions.Set(w, r, *session)
+		http.Redirect(w, r, returnURL(r, a.domain, returnTo), http.StatusFound)
+
+	case LogoutPath:
+		// Logging out changes state, so links and prefetches must not trigger it.
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		a.sessions.Clear(w, r)
+
+		home := returnURL(r, a.domain, "/")
+		if endSession, ok := a.oidc.EndSessionURL(r.Context(), home); ok {
+			http.Redirect(w, r, endSession, http.StatusFound)
+			return
+		}
+		renderMessage(w, http.StatusOK, "Signed out", "You have been signed out of "+a.domain.String()+".")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowlist checks the claims of OIDC logins against a config.LoginAllowlist.
+type allowlist struct {
+	domain config.DomainScope
+	conf   config.LoginAllowlist
+}
+
+func newAllowlist(domain config.DomainScope, conf config.LoginAllowlist) allowlist {
+	if conf.GroupsClaim == "" {
+		conf.GroupsClaim = defaultGroupsClaim
+	}
+
+	domains := make([]string, 0, len(conf.AllowedEmailDomains))
+	for _, domain := range conf.AllowedEmailDomains {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+	conf.AllowedEmailDomains = domains
+
+	return allowlist{domain: domain, conf: conf}
+}
+
+// authorize checks the verified claims against the allowlists and returns the
+// session to store for them.
+func (a allowlist) authorize(claims *Claims) (*Session, humane.Error) {
+	session := &Session{Subject: claims.Subject, Email: claims.Email, Name: claims.Name, Method: "oidc"}
+
+	if len(a.conf.AllowedEmailDomains) > 0 {
+		if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+			return nil, humane.New("no verified email address", "Make sure the issuer releases a verified email claim.")
+		}
+
+		_, domain, _ := strings.Cut(strings.ToLower(claims.Email), "@")
+		if !slices.Contains(a.conf.AllowedEmailDomains, domain) {
+			return nil, humane.New(fmt.Sprintf("%s is not allowed to access %s", claims.Email, a.domain),
+				"Log in with an account of an allowed email domain.")
+		}
+	}
+
+	groups := claims.Strings(a.conf.GroupsClaim)
+	if len(a.conf.AllowedGroups) > 0 {
+		// Only the allowed groups are kept, as the full list may not fit in a
+		// cookie.
+		groups = slices.DeleteFunc(groups, func(group string) bool {
+			return !slices.Contains(a.conf.AllowedGroups, group)
+		})
+
+		if len(groups) == 0 {
+			return nil, humane.New(fmt.Sprintf("%s is in none of the groups allowed to access %s", claims.Subject, a.domain),
+				"Ask for membership in one of the allowed groups.")
+		}
+	}
+	session.Groups = groups
+
+	return session, nil
+}
+
+// SetIdentityHeaders replaces the identity headers in h with the identity of
+// session. A nil session only removes them.
+func SetIdentityHeaders(h http.Header, session *Session) {
+	h.Del(HeaderUser)
+	h.Del(HeaderEmail)
+	h.Del(HeaderGroups)
+
+	if session == nil {
+		return
+	}
+
+	h.Set(HeaderUser, session.Subject)
+	if session.Email != "" {
+		h.Set(HeaderEmail, session.Email)
+	}
+	if len(session.Groups) > 0 {
+		h.Set(HeaderGroups, strings.Join(session.Groups, ","))
+	}
+}
+
+type ctxSession struct{}
+
+// WithSession returns a context carrying the session of the visitor.
+func WithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, ctxSession{}, session)
+}
+
+// SessionFromContext returns the session stored by WithSession, if any.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(ctxSession{}).(*Session)
+	return session
+}
+
+var messageTemplate = template.Must(template.New("message").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+</head>
+<body style="font-family: system-ui, sans-serif; text-align: center; margin-top: 15vh;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+func renderMessage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := messageTemplate.Execute(w, map[string]string{"Title": title, "Message": message}); err != nil {
+		otelzap.L().WithError(err).Debug("unable to render message page")
+	}
+}
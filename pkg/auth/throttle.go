@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxFailedLogins is how many wrong passwords a client may enter in a row
+	// before it is throttled.
+	maxFailedLogins = 5
+
+	// failedLoginCooldown is how long it takes a throttled client to earn
+	// another attempt.
+	failedLoginCooldown = 30 * time.Second
+
+	// failedLoginSweepInterval is how often the failures of clients that
+	// stopped trying are dropped.
+	failedLoginSweepInterval = time.Minute
+)
+
+// failedLogins throttles password guessing. Every client address may fail
+// maxFailedLogins times, after which it earns one more attempt every
+// failedLoginCooldown. Correct passwords do not count.
+type failedLogins struct {
+	mu        sync.Mutex
+	clients   map[string]*loginFailures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type loginFailures struct {
+	attempts float64 // attempts left
+	last     time.Time
+}
+
+func newFailedLogins() *failedLogins {
+	return &failedLogins{clients: make(map[string]*loginFailures), now: time.Now}
+}
+
+// retryAfter returns how long client has to wait before it may try again, or
+// zero if it may try now.
+func (f *failedLogins) retryAfter(client string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failures := f.refill(client, f.now())
+	if failures == nil || failures.attempts >= 1 {
+		return 0
+	}
+	return time.Duration((1 - failures.attempts) * float64(failedLoginCooldown))
+}
+
+// record counts a wrong password entered by client.
+func (f *failedLogins) record(client string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.sweep(now)
+
+	failures := f.refill(client, now)
+	if failures == nil {
+		failures = &loginFailures{attempts: maxFailedLogins, last: now}
+		f.clients[client] = failures
+	}
+	failures.attempts = max(0, failures.attempts-1)
+}
+
+// refill credits client with the attempts earned since its last failure. It
+// returns nil for clients without failures.
+func (f *failedLogins) refill(client string, now time.Time) *loginFailures {
+	failures, ok := f.clients[client]
+	if !ok {
+		return nil
+	}
+
+	earned := now.Sub(failures.last).Seconds() / failedLoginCooldown.Seconds()
+	failures.attempts = min(maxFailedLogins, failures.attempts+earned)
+	failures.last = now
+	return failures
+}
+
+// sweep drops the clients that earned all their attempts back, as they are no
+// different from a client that never failed. This bounds the memory held for
+// clients that stopped trying.
+func (f *failedLogins) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < failedLoginSweepInterval {
+		return
+	}
+	f.lastSweep = now
+
+	for client := range f.clients {
+		if failures := f.refill(client, now); failures.attempts >= maxFailedLogins {
+			delete(f.clients, client)
+		}
+	}
+}
+
+// retryAfterHeader sets Retry-After to wait, rounded up to whole seconds, and
+// returns a description of it for the visitor.
+func retryAfterHeader(w http.ResponseWriter, wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return fmt.Sprintf("Too many wrong passwords. Try again in %d seconds.", seconds)
+}
@@ -0,0 +1,79 @@
+// Package clientip determines the address of the client sending a request,
+// through the load balancers trusted to report it in X-Forwarded-For.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetwork parses a network in CIDR notation or a single IP address.
+func ParseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// Contains reports whether ip is in any of networks.
+func Contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromRequest returns the address of the client sending req. For requests
+// from a trusted proxy, it is the last address in X-Forwarded-For that is not
+// itself a trusted proxy, so clients cannot pose as another address by sending
+// the header themselves.
+func FromRequest(req *http.Request, trusted []*net.IPNet) string {
+	remote := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	if !Contains(trusted, net.ParseIP(remote)) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !Contains(trusted, ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,93 @@
+package clientip_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/clientip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := map[string]struct {
+		value    string
+		expected string
+		invalid  bool
+	}{
+		"network":      {value: "10.0.0.0/8", expected: "10.0.0.0/8"},
+		"address":      {value: "192.0.2.1", expected: "192.0.2.1/32"},
+		"IPv6 network": {value: "2001:db8::/32", expected: "2001:db8::/32"},
+		"IPv6 address": {value: "2001:db8::1", expected: "2001:db8::1/128"},
+		"bad prefix":   {value: "10.0.0.0/33", invalid: true},
+		"garbage":      {value: "invalid", invalid: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			network, err := clientip.ParseNetwork(test.value)
+			if test.invalid {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, network.String())
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	networks := mustParse(t, "10.0.0.0/8", "192.0.2.1")
+
+	assert.True(t, clientip.Contains(networks, net.ParseIP("10.1.2.3")))
+	assert.True(t, clientip.Contains(networks, net.ParseIP("192.0.2.1")))
+	assert.False(t, clientip.Contains(networks, net.ParseIP("192.0.2.2")))
+	assert.False(t, clientip.Contains(networks, nil))
+	assert.False(t, clientip.Contains(nil, net.ParseIP("10.1.2.3")))
+}
+
+func TestFromRequest(t *testing.T) {
+	trusted := mustParse(t, "10.0.0.0/8", "192.0.2.1")
+
+	tests := map[string]struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		"direct":                   {"203.0.113.7:4711", nil, "203.0.113.7"},
+		"untrusted forwarded for":  {"203.0.113.7:4711", []string{"198.51.100.1"}, "203.0.113.7"},
+		"trusted proxy":            {"10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		"spoofed by client":        {"192.0.2.1:80", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		"chain of trusted proxies": {"10.1.2.3:80", []string{"198.51.100.1, 10.9.9.9", "192.0.2.1"}, "198.51.100.1"},
+		"only trusted proxies":     {"10.1.2.3:80", []string{"10.0.0.1"}, "10.0.0.1"},
+		"garbage":                  {"10.1.2.3:80", []string{"unknown"}, "10.1.2.3"},
+		"no header":                {"10.1.2.3:80", nil, "10.1.2.3"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remote
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			assert.Equal(t, test.expected, clientip.FromRequest(req, trusted))
+		})
+	}
+}
+
+func mustParse(t *testing.T, values ...string) []*net.IPNet {
+	t.Helper()
+
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, err := clientip.ParseNetwork(value)
+		require.NoError(t, err)
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,42 @@
+package config
+
+import "time"
+
+// PageAuth protects the whole page, its production domain and all previews,
+// behind an OIDC login. It takes precedence over preview.access.
+type PageAuth struct {
+	OIDC OIDCLogin `yaml:"oidc"`
+
+	// LoginAllowlist restricts who may log in. Without it, everyone the
+	// issuer authenticates is allowed.
+	LoginAllowlist `yaml:",inline" mapstructure:",squash"`
+
+	SessionSecret EnvValue      `yaml:"sessionSecret"`
+	SessionTTL    time.Duration `yaml:"sessionTTL"`
+
+	// IdentityHeaders passes the identity of the visitor to the backend in
+	// X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups.
+	IdentityHeaders bool `yaml:"identityHeaders"`
+}
+
+// LoginAllowlist restricts who may log in through OIDC.
+type LoginAllowlist struct {
+	// AllowedEmailDomains and AllowedGroups restrict who may log in. When both
+	// are set, a visitor has to match both.
+	AllowedEmailDomains []string `yaml:"allowedEmailDomains"`
+	AllowedGroups       []string `yaml:"allowedGroups"`
+
+	// GroupsClaim is the ID token claim listing the groups of the visitor.
+	// Defaults to "groups".
+	GroupsClaim string `yaml:"groupsClaim"`
+}
+
+// Configured reports whether the allowlist restricts anyone.
+func (l *LoginAllowlist) Configured() bool {
+	return len(l.AllowedEmailDomains) > 0 || len(l.AllowedGroups) > 0
+}
+
+// Enabled reports whether the page requires a login.
+func (a *PageAuth) Enabled() bool {
+	return a.OIDC.Issuer != ""
+}
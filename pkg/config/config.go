@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"time"
 
+	"github.com/sierrasoftworks/humane-errors-go"
 	"github.com/spf13/viper"
 )
 
@@ -12,6 +14,18 @@ type Format string
 func init() {
 	viper.SetDefault("server.proxyPort", 8080)
 	viper.SetDefault("server.apiPort", 8081)
+	viper.SetDefault("server.metricsPort", 0)
+
+	viper.SetDefault("server.tls.enabled", false)
+	viper.SetDefault("server.tls.proxyPort", 8443)
+	viper.SetDefault("server.tls.apiPort", 8444)
+	viper.SetDefault("server.tls.redirectHTTP", true)
+	viper.SetDefault("server.tls.acme.enabled", false)
+	viper.SetDefault("server.tls.acme.directoryURL", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("server.tls.acme.onDemand", true)
+	viper.SetDefault("server.tls.acme.cache.type", ACMECacheDir)
+	viper.SetDefault("server.tls.acme.cache.dir", "acme")
+	viper.SetDefault("server.tls.acme.cache.prefix", "acme/")
 	viper.SetDefault("server.host", "")
 
 	viper.SetDefault("output.format", ShortFormat)
@@ -21,6 +35,41 @@ func init() {
 	viper.SetDefault("proxy.timeout", "90s")
 	viper.SetDefault("proxy.compression", true)
 	viper.SetDefault("proxy.probeTimeout", "2s")
+
+	viper.SetDefault("proxy.dns.mode", DNSModeCustom)
+	viper.SetDefault("proxy.dns.servers", []string{"8.8.8.8:53", "1.1.1.1:53"})
+	viper.SetDefault("proxy.dns.timeout", "5s")
+	viper.SetDefault("proxy.dns.minTTL", "5s")
+	viper.SetDefault("proxy.dns.maxTTL", "5m")
+
+	viper.SetDefault("proxy.health.failureThreshold", 3)
+	viper.SetDefault("proxy.health.cooldown", "30s")
+	viper.SetDefault("proxy.health.interval", "10s")
+
+	viper.SetDefault("proxy.cache.enabled", false)
+	viper.SetDefault("proxy.cache.dir", "")
+	viper.SetDefault("proxy.cache.maxSize", 1<<30) // 1 GiB
+
+	viper.SetDefault("proxy.limits.client.rate", 0)
+	viper.SetDefault("proxy.limits.client.burst", 0)
+	viper.SetDefault("proxy.limits.trustedProxies", []string{})
+	viper.SetDefault("proxy.limits.maxInFlight", 0)
+	viper.SetDefault("proxy.limits.maxQueued", 1000)
+	viper.SetDefault("proxy.limits.queueTimeout", "10s")
+
+	viper.SetDefault("proxy.encoding.precompressed", true)
+	viper.SetDefault("proxy.encoding.dynamic", true)
+	viper.SetDefault("proxy.encoding.minSize", 1024)
+	viper.SetDefault("proxy.encoding.contentTypes", DefaultCompressibleTypes)
+
+	viper.SetDefault("proxy.accessLog.enabled", false)
+	viper.SetDefault("proxy.accessLog.format", AccessLogCombined)
+	viper.SetDefault("proxy.accessLog.output", "stdout")
+	viper.SetDefault("proxy.accessLog.sampleRate", 1.0)
+
+	viper.SetDefault("indexCache.ttl", "1m")
+	viper.SetDefault("indexCache.maxStale", "1h")
+	viper.SetDefault("indexCache.pollInterval", "5s")
 }
 
 const (
@@ -36,6 +85,80 @@ type Server struct {
 	Host      string
 	ProxyPort int
 	ApiPort   int
+
+	// MetricsPort is the port the proxy exposes its Prometheus metrics and
+	// its /healthz, /readyz and /version endpoints on. The listener is opt-in:
+	// it is disabled by default, with zero. /healthz and /readyz are served
+	// on the proxy port either way.
+	MetricsPort int
+
+	TLS ServerTLS
+}
+
+// ServerTLS configures the HTTPS listeners of the proxy and the API. The
+// certificate for a connection is chosen by SNI: the certificate of the page
+// serving the requested host (pages[].tls), or the default certificate
+// configured here. Certificate files are reloaded when they change.
+type ServerTLS struct {
+	Enabled   bool
+	ProxyPort int
+	ApiPort   int
+
+	// CertFile and KeyFile are the default certificate, used for hosts
+	// without a page certificate.
+	CertFile string
+	KeyFile  string
+
+	// ApiCertFile and ApiKeyFile are the certificate of the API listener,
+	// defaulting to CertFile and KeyFile. The API never obtains certificates
+	// through ACME; the proxy does so for the page domains.
+	ApiCertFile string
+	ApiKeyFile  string
+
+	// RedirectHTTP redirects requests on the plain HTTP ports to HTTPS
+	// instead of serving them.
+	RedirectHTTP bool
+
+	ACME ACME
+}
+
+// ACME configures automatic certificates for pages without a configured
+// certificate. They are obtained through the HTTP-01 or TLS-ALPN-01 challenge
+// and renewed before they expire.
+type ACME struct {
+	Enabled      bool
+	Email        string
+	DirectoryURL string
+
+	// OnDemand obtains certificates for preview hostnames on their first
+	// request, if the page index has a deployment for them. Otherwise only
+	// the page domains themselves get certificates.
+	OnDemand bool
+
+	Cache ACMECache
+}
+
+// ACMECacheType selects where issued certificates and the ACME account are
+// stored.
+type ACMECacheType string
+
+const (
+	ACMECacheDir    ACMECacheType = "dir"    // a local directory
+	ACMECacheBucket ACMECacheType = "bucket" // an S3 bucket shared by all replicas
+)
+
+type ACMECache struct {
+	Type ACMECacheType
+
+	// Dir is the directory of the dir cache.
+	Dir string
+
+	// Bucket and Prefix locate the objects of the bucket cache. The cache
+	// holds the private keys of the certificates, so Bucket must be a private
+	// bucket of its own; the bucket of a page is refused, as the proxy serves
+	// its objects.
+	Bucket BucketConfig
+	Prefix string
 }
 
 type Proxy struct {
@@ -49,13 +172,250 @@ type Proxy struct {
 	// treated as inconclusive (the object may still exist) rather than as a
 	// definitive "not found".
 	ProbeTimeout time.Duration
+
+	// DNS configures how the hostnames of origins are resolved.
+	DNS DNS
+
+	// Health configures how unhealthy origins are detected and skipped.
+	Health OriginHealth
+
+	// Cache configures the on-disk object cache in front of the storage
+	// backend.
+	Cache ObjectCache
+
+	// Limits throttles clients and bounds the load put on the origins.
+	Limits Limits
+
+	// AccessLog configures the access log of the proxy.
+	AccessLog AccessLog
+
+	// Encoding configures the compression of responses to clients.
+	Encoding Encoding
+}
+
+// DefaultCompressibleTypes are the media types compressed by default.
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/otf",
+	"font/ttf",
+}
+
+// Encoding configures the content encodings negotiated with clients through
+// Accept-Encoding. Compression enables compression between the proxy and its
+// origins instead.
+type Encoding struct {
+	// Precompressed serves the .br and .gz siblings of an object uploaded
+	// with it, when they exist and the client accepts them.
+	Precompressed bool
+
+	// Dynamic compresses responses with gzip or brotli while serving them,
+	// when there is no precompressed variant.
+	Dynamic bool
+
+	// MinSize is the size in bytes below which responses are not compressed
+	// dynamically.
+	MinSize int64
+
+	// ContentTypes are the compressible media types. A type ending in /*
+	// matches all of its subtypes.
+	ContentTypes []string
+}
+
+// AccessLogFormat selects the format of access log entries.
+type AccessLogFormat string
+
+const (
+	AccessLogJSON     AccessLogFormat = "json"     // one JSON object per request, with every field
+	AccessLogCombined AccessLogFormat = "combined" // the Apache combined log format
+	AccessLogCommon   AccessLogFormat = "common"   // the Common Log Format (CLF)
+)
+
+// AccessLog configures the log with one entry per request served by the
+// proxy, separate from the application log.
+type AccessLog struct {
+	Enabled bool
+	Format  AccessLogFormat
+
+	// Output is "stdout", "stderr" or the path of a file to append to.
+	Output string
+
+	// SampleRate is the fraction of requests logged, between 0 and 1. Server
+	// errors are always logged.
+	SampleRate float64
+}
+
+// Limits configures the throttling of the proxy. Clients exceeding a rate
+// limit are answered with 429 Too Many Requests; requests that cannot get a
+// slot to the backend in time with 503 Service Unavailable.
+type Limits struct {
+	// Client limits the requests of every client IP address.
+	Client RateLimit
+
+	// TrustedProxies are the addresses and networks (CIDR) of load balancers
+	// in front of the proxy. For requests through them, the client address is
+	// taken from X-Forwarded-For, for rate limits, the access log and
+	// pages[].preview.access.allowCIDRs.
+	TrustedProxies []string
+
+	// MaxInFlight bounds the requests resolved and proxied to the backend
+	// concurrently. Zero means no bound.
+	MaxInFlight int
+
+	// MaxQueued bounds the requests waiting for one of the MaxInFlight slots,
+	// and QueueTimeout how long each of them waits. With zero, requests are
+	// rejected right away when all slots are taken.
+	MaxQueued    int
+	QueueTimeout time.Duration
+}
+
+// RateLimit is a token bucket: Rate requests per second are allowed on
+// average, with bursts of up to Burst requests.
+type RateLimit struct {
+	// Rate is the number of requests per second. Zero disables the limit.
+	Rate float64 `yaml:"rate"`
+
+	// Burst defaults to Rate, rounded up.
+	Burst int `yaml:"burst"`
+}
+
+// Enabled reports whether the limit applies.
+func (r RateLimit) Enabled() bool {
+	return r.Rate > 0
+}
+
+// OriginHealth configures the health tracking of page origins. Every origin
+// has a circuit breaker: it opens after FailureThreshold consecutive failures,
+// upon which the origin is skipped for Cooldown before a single trial request
+// is let through again.
+type OriginHealth struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	// Interval is how often every origin is actively health checked. Zero
+	// disables active checks, leaving only failures of real requests.
+	Interval time.Duration
+}
+
+// DNSMode selects how origin hostnames are resolved.
+type DNSMode string
+
+const (
+	// DNSModeSystem uses the resolver of the host system.
+	DNSModeSystem DNSMode = "system"
+
+	// DNSModeCustom queries the configured DNS servers directly. This bypasses
+	// a local resolver that would answer with the IPs of a CDN in front of
+	// the proxy itself, which would make the proxy loop back to itself.
+	DNSModeCustom DNSMode = "custom"
+
+	// DNSModeStatic resolves origins from the configured hosts only.
+	DNSModeStatic DNSMode = "static"
+)
+
+// DNS configures the resolution of origin hostnames.
+type DNS struct {
+	Mode DNSMode
+
+	// Servers are the DNS servers (host:port) queried in custom mode, in
+	// order of preference.
+	Servers []string
+
+	// Hosts maps hostnames to fixed IP addresses. They take precedence over
+	// DNS in every mode and are the only source of addresses in static mode.
+	Hosts map[string][]string
+
+	// Timeout bounds a single lookup.
+	Timeout time.Duration
+
+	// MinTTL and MaxTTL clamp how long resolved addresses are cached. Record
+	// TTLs are honoured in custom mode; the system resolver does not expose
+	// them, so its answers are cached for MinTTL.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// Validate reports whether the DNS configuration can be used.
+func (d *DNS) Validate() humane.Error {
+	switch d.Mode {
+	case DNSModeSystem:
+		return nil
+
+	case DNSModeCustom:
+		if len(d.Servers) == 0 {
+			return humane.New("No DNS servers configured",
+				"Please provide 'proxy.dns.servers' when using the 'custom' DNS mode, e.g. [\"8.8.8.8:53\"]",
+				"Use the 'system' DNS mode to use the resolver of the host instead.")
+		}
+		for _, server := range d.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				return humane.Wrap(err, fmt.Sprintf("Invalid DNS server '%s'", server),
+					"Please provide 'proxy.dns.servers' as host:port, e.g. \"8.8.8.8:53\" or \"[2606:4700:4700::1111]:53\".")
+			}
+		}
+		return nil
+
+	case DNSModeStatic:
+		if len(d.Hosts) == 0 {
+			return humane.New("No DNS hosts configured",
+				"Please provide 'proxy.dns.hosts' when using the 'static' DNS mode.")
+		}
+		return nil
+
+	default:
+		return humane.New(fmt.Sprintf("Invalid DNS mode '%s'", d.Mode),
+			"Please configure 'proxy.dns.mode' as one of 'system', 'custom' or 'static'.")
+	}
+}
+
+// ObjectCache configures the proxy's on-disk cache of backend objects. Every
+// object lives under an immutable commit, so once fetched it can be served
+// from disk until it is evicted.
+type ObjectCache struct {
+	Enabled bool
+
+	// Dir is the directory the cache is persisted in. It survives restarts, so
+	// point it at a volume to keep a warm cache across deployments. Defaults
+	// to a folder in the system temp directory.
+	Dir string
+
+	// MaxSize is the upper bound of the cache in bytes. Least recently used
+	// objects are evicted once it is exceeded.
+	MaxSize int64
+}
+
+// IndexCache configures how long downloaded page indexes are kept in memory.
+type IndexCache struct {
+	// TTL is how long a downloaded page index is considered fresh.
+	TTL time.Duration
+
+	// MaxStale bounds how long an expired index keeps being served: while it
+	// is refreshed in the background, and while refreshing it fails because
+	// the storage backend is unavailable. Once exceeded, requests fail until
+	// the index can be downloaded again. Values below TTL are raised to TTL.
+	MaxStale time.Duration
+
+	// PollInterval is how often the proxy checks the bucket for changed page
+	// indexes, so uploads through any replica show up everywhere within
+	// seconds. Zero disables polling, leaving changes to surface after TTL.
+	PollInterval time.Duration
 }
 
 type StaticPagesConfig struct {
-	Server Server
-	Proxy  Proxy
-	Output Output
-	Pages  []*Page
+	Server     Server
+	Proxy      Proxy
+	IndexCache IndexCache
+	Output     Output
+	Pages      []*Page
 }
 
 func (s *StaticPagesConfig) ApiBindAddr() string {
@@ -65,3 +425,15 @@ func (s *StaticPagesConfig) ApiBindAddr() string {
 func (s *StaticPagesConfig) ProxyBindAddr() string {
 	return fmt.Sprintf("%s:%d", s.Server.Host, s.Server.ProxyPort)
 }
+
+func (s *StaticPagesConfig) ApiTLSBindAddr() string {
+	return fmt.Sprintf("%s:%d", s.Server.Host, s.Server.TLS.ApiPort)
+}
+
+func (s *StaticPagesConfig) ProxyTLSBindAddr() string {
+	return fmt.Sprintf("%s:%d", s.Server.Host, s.Server.TLS.ProxyPort)
+}
+
+func (s *StaticPagesConfig) MetricsBindAddr() string {
+	return fmt.Sprintf("%s:%d", s.Server.Host, s.Server.MetricsPort)
+}
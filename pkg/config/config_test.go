@@ -28,3 +28,30 @@ func TestProxyBindAddr(t *testing.T) {
 
 	assert.Equal(t, ":8080", config.ProxyBindAddr())
 }
+
+func TestDNSValidate(t *testing.T) {
+	tests := map[string]struct {
+		dns   config.DNS
+		valid bool
+	}{
+		"system":                {dns: config.DNS{Mode: config.DNSModeSystem}, valid: true},
+		"custom":                {dns: config.DNS{Mode: config.DNSModeCustom, Servers: []string{"8.8.8.8:53", "[2606:4700:4700::1111]:53"}}, valid: true},
+		"custom without server": {dns: config.DNS{Mode: config.DNSModeCustom}},
+		"server without port":   {dns: config.DNS{Mode: config.DNSModeCustom, Servers: []string{"8.8.8.8:53", "1.1.1.1"}}},
+		"IPv6 without port":     {dns: config.DNS{Mode: config.DNSModeCustom, Servers: []string{"2606:4700:4700::1111"}}},
+		"static":                {dns: config.DNS{Mode: config.DNSModeStatic, Hosts: map[string][]string{"origin.test": {"192.0.2.1"}}}, valid: true},
+		"static without hosts":  {dns: config.DNS{Mode: config.DNSModeStatic}},
+		"unknown mode":          {dns: config.DNS{Mode: "bogus"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.dns.Validate()
+			if test.valid {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
@@ -137,3 +137,28 @@ pages:
 	assert.Equal(t, "org/solo", cfg.Pages[0].Git.Repository)
 	assert.Equal(t, "https://cdn.specht-labs.de", cfg.Pages[0].Proxy.URL.String())
 }
+
+func TestLoad_LoginAllowlists(t *testing.T) {
+	cfg := load(t, `
+pages:
+  - domain: docs.specht-labs.de
+    auth:
+      oidc:
+        issuer: https://login.specht-labs.de
+      allowedEmailDomains: [specht-labs.de]
+      groupsClaim: roles
+    preview:
+      access:
+        oidc:
+          issuer: https://login.specht-labs.de
+        allowedGroups: [reviewers]
+`)
+
+	require.Len(t, cfg.Pages, 1)
+	p := cfg.Pages[0]
+
+	assert.Equal(t, []string{"specht-labs.de"}, p.Auth.AllowedEmailDomains)
+	assert.Equal(t, "roles", p.Auth.GroupsClaim)
+	assert.Equal(t, []string{"reviewers"}, p.Preview.Access.AllowedGroups)
+	assert.True(t, p.Preview.Access.LoginAllowlist.Configured())
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/sierrasoftworks/humane-errors-go"
+)
+
+// gitProvider are the defaults of a built-in Git provider.
+type gitProvider struct {
+	// issuer returns the issuer of the hosted service.
+	issuer func(g *GitConfig) (string, humane.Error)
+
+	// claims map the claims of its tokens. A provider without a commit claim
+	// leaves it empty; uploads then name the commit themselves.
+	claims ClaimMap
+
+	// audience is the audience upload tokens are requested for by default.
+	// Providers whose tokens carry an audience uploads cannot choose leave it
+	// empty; pages[].git.oidc.audience must be set for them.
+	audience string
+}
+
+// defaultOidcAudience is the audience upload tokens are requested for, unless
+// the page configures another one.
+const defaultOidcAudience = "staticpages"
+
+// githubClaims are the claims of GitHub Actions, which Gitea and Forgejo
+// Actions mirror. There is no pull request claim: GitHub only carries the
+// number in the ref of pull request events, refs/pull/<number>/merge.
+var githubClaims = ClaimMap{
+	RepositoryClaim:     "repository",
+	CommitClaim:         "sha",
+	BranchClaim:         "ref",
+	EnvironmentClaim:    "environment",
+	ActorClaim:          "actor",
+	WorkflowClaim:       "workflow",
+	RunIDClaim:          "run_id",
+	RunAttemptClaim:     "run_attempt",
+	EventNameClaim:      "event_name",
+	RefTypeClaim:        "ref_type",
+	JobWorkflowRefClaim: "job_workflow_ref",
+}
+
+var gitProviders = map[string]gitProvider{
+	"github": {
+		issuer:   fixedIssuer("https://token.actions.githubusercontent.com"),
+		claims:   githubClaims,
+		audience: defaultOidcAudience,
+	},
+
+	// GitLab names the repository project_path and carries the bare name of
+	// the branch or tag in ref, telling them apart in ref_type.
+	"gitlab": {
+		issuer: fixedIssuer("https://gitlab.com"),
+		claims: ClaimMap{
+			RepositoryClaim:     "project_path",
+			CommitClaim:         "sha",
+			BranchClaim:         "ref",
+			EnvironmentClaim:    "environment",
+			ActorClaim:          "user_login",
+			RunIDClaim:          "pipeline_id",
+			EventNameClaim:      "pipeline_source",
+			RefTypeClaim:        "ref_type",
+			JobWorkflowRefClaim: "ci_config_ref_uri",
+		},
+		audience: defaultOidcAudience,
+	},
+
+	"gitea": {
+		issuer:   fixedIssuer("https://gitea.com/api/actions"),
+		claims:   githubClaims,
+		audience: defaultOidcAudience,
+	},
+
+	"forgejo": {
+		issuer:   fixedIssuer("https://codeberg.org/api/actions"),
+		claims:   githubClaims,
+		audience: defaultOidcAudience,
+	},
+
+	// Bitbucket Pipelines identify the repository by its UUID only, see
+	// GitConfig.RepositoryID, and carry no commit at all; uploads name it
+	// themselves, and it is recorded as unverified. Such uploads may not
+	// replace a deployment of the commit made from another branch. Tokens only carry the
+	// UUID of the deployment environment, so environment previews are named
+	// by it. Their audience is the workspace, which has to be configured.
+	"bitbucket": {
+		issuer: bitbucketIssuer,
+		claims: ClaimMap{
+			RepositoryClaim:  "repositoryUuid",
+			CommitClaim:      "",
+			BranchClaim:      "branchName",
+			EnvironmentClaim: "deploymentEnvironmentUuid",
+			RunIDClaim:       "pipelineUuid",
+		},
+	},
+}
+
+// GitProviders returns the names of the supported Git providers.
+func GitProviders() []string {
+	return append(slices.Sorted(maps.Keys(gitProviders)), "custom")
+}
+
+func fixedIssuer(issuer string) func(*GitConfig) (string, humane.Error) {
+	return func(*GitConfig) (string, humane.Error) {
+		return issuer, nil
+	}
+}
+
+// bitbucketIssuer returns the issuer of the workspace of the repository, as
+// every Bitbucket workspace issues its own tokens.
+func bitbucketIssuer(g *GitConfig) (string, humane.Error) {
+	workspace, _, ok := strings.Cut(g.Repository, "/")
+	if !ok || workspace == "" {
+		return "", humane.New(fmt.Sprintf("cannot tell the Bitbucket workspace of repository %q", g.Repository),
+			"Set pages[].git.repository to '<workspace>/<repository>', or provide 'pages[].git.oidc.issuer'.")
+	}
+	return fmt.Sprintf("https://api.bitbucket.org/2.0/workspaces/%s/pipelines-config/identity/oidc", workspace), nil
+}
+
+// TokenRepository returns the repository as upload tokens name it.
+func (g *GitConfig) TokenRepository() string {
+	if g.RepositoryID != "" {
+		return g.RepositoryID
+	}
+	return g.Repository
+}
+
+// NormalizeRef returns the name of the branch of a fully qualified branch
+// ref. Other refs, tags among them, are returned as they are, so a tag never
+// passes for the branch of the same name; see RefType. Refs given by name, as
+// GitLab and Bitbucket do, are returned as they are as well.
+func NormalizeRef(ref string) string {
+	if name, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		return name
+	}
+	return ref
+}
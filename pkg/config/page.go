@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"maps"
+	"strings"
+	"time"
 
 	"github.com/sierrasoftworks/humane-errors-go"
 )
@@ -10,11 +13,22 @@ const exampleGitProviderOidcConfig = `
 provider:
   oidc:
     issuer: https://token.actions.githubusercontent.com
+    audience: staticpages
     claimMappings:
       Repository: repository
       Commit: sha
       Branch: ref
       Environment: environment
+      # Optional, recorded as the provenance of each deployment
+      actor: actor
+      workflow: workflow
+      run_id: run_id
+      run_attempt: run_attempt
+      event_name: event_name
+      ref_type: ref_type
+      job_workflow_ref: job_workflow_ref
+      # Optional, the repository of a pull request, to refuse forks
+      head_repository: head_repository
 `
 
 type Page struct {
@@ -24,6 +38,17 @@ type Page struct {
 	History int           `yaml:"history"`
 	Git     GitConfig     `yaml:"git"`
 	Preview PreviewConfig `yaml:"preview"`
+	TLS     PageTLS       `yaml:"tls"`
+	Auth    PageAuth      `yaml:"auth"`
+	Upload  PageUpload    `yaml:"upload"`
+}
+
+// PageTLS is the certificate served for the domain of a page when TLS is
+// enabled. With previews, it should be a wildcard certificate covering the
+// preview subdomains as well.
+type PageTLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
 }
 
 type BucketConfig struct {
@@ -32,6 +57,27 @@ type BucketConfig struct {
 	ApplicationID EnvValue `yaml:"applicationId"`
 	Secret        EnvValue `yaml:"secret"`
 	Region        EnvValue `yaml:"region"`
+
+	// ContentTypes maps file extensions, e.g. ".wasm", to the Content-Type
+	// their objects are stored with, taking precedence over the built-in
+	// table and content sniffing.
+	ContentTypes map[string]string `yaml:"contentTypes"`
+
+	// Retry configures how uploads of files to the bucket failing with a
+	// retryable error, such as the 503 "too busy" B2 answers under load, are
+	// retried. Other requests keep the default retries, so serving a page
+	// does not stall on a busy bucket.
+	Retry BucketRetry `yaml:"retry"`
+}
+
+// BucketRetry retries requests with exponential backoff and jitter.
+type BucketRetry struct {
+	// MaxAttempts is the number of attempts made per request, the first one
+	// included; 1 disables retries. Defaults to 5.
+	MaxAttempts int `yaml:"maxAttempts"`
+
+	// MaxBackoff bounds the delay between two attempts. Defaults to 20s.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
 }
 
 type PageProxy struct {
@@ -39,6 +85,32 @@ type PageProxy struct {
 	Path       EnvValue `yaml:"path"`
 	SearchPath []string `yaml:"searchPath"`
 	NotFound   string   `yaml:"notFound"`
+
+	// Origins are additional backends serving the same objects (e.g. the
+	// direct storage download URL behind a CDN, or a replica bucket). They are
+	// used in order when the ones before them, starting with URL, are
+	// unhealthy.
+	Origins []Origin `yaml:"origins"`
+
+	// RateLimit limits the requests to the page from all clients together,
+	// in addition to proxy.limits.client.
+	RateLimit RateLimit `yaml:"rateLimit"`
+}
+
+// Origin is a backend serving the objects of a page.
+type Origin struct {
+	URL  EnvValue `yaml:"url"`
+	Path EnvValue `yaml:"path"`
+}
+
+// AllOrigins returns the origins of the page in order of preference: URL and
+// Path first, followed by Origins.
+func (p *PageProxy) AllOrigins() []Origin {
+	origins := make([]Origin, 0, len(p.Origins)+1)
+	if p.URL != "" {
+		origins = append(origins, Origin{URL: p.URL, Path: p.Path})
+	}
+	return append(origins, p.Origins...)
 }
 
 type SubDomain struct {
@@ -51,11 +123,27 @@ type GitConfig struct {
 	Repository string      `yaml:"repository"`
 	MainBranch string      `yaml:"mainBranch"`
 	Oidc       GitProvider `yaml:"oidc"`
+
+	// RepositoryID identifies the repository in upload tokens when they do
+	// not carry its name, like the UUID of a Bitbucket repository.
+	RepositoryID string `yaml:"repositoryId"`
+
+	// Policy restricts which uploads from the repository may deploy the page.
+	Policy DeployPolicy `yaml:"policy"`
 }
 
 type GitProvider struct {
 	Issuer        string      `yaml:"issuer"`
 	ClaimMappings ClaimMapRaw `yaml:"claimMappings"`
+
+	// Audience is the audience upload tokens must be issued for, so tokens
+	// minted for other services are refused. Built-in providers default to
+	// "staticpages"; it is required for Bitbucket and custom providers.
+	Audience string `yaml:"audience"`
+
+	// AllowMissingJti accepts tokens without a jti claim. Tokens are only
+	// accepted once, which tokens without an ID cannot be checked for.
+	AllowMissingJti bool `yaml:"allowMissingJti"`
 }
 
 type Claim string
@@ -69,6 +157,21 @@ const (
 	EnvironmentClaim Claim = "environment"
 )
 
+// Provenance claims are optional. They record which workflow run produced a
+// deployment. Like all claim names they are lower case, as configuration keys
+// are case-insensitive.
+const (
+	ActorClaim          Claim = "actor"
+	WorkflowClaim       Claim = "workflow"
+	RunIDClaim          Claim = "run_id"
+	RunAttemptClaim     Claim = "run_attempt"
+	EventNameClaim      Claim = "event_name"
+	PullRequestClaim    Claim = "pull_request"
+	RefTypeClaim        Claim = "ref_type"
+	JobWorkflowRefClaim Claim = "job_workflow_ref"
+	HeadRepositoryClaim Claim = "head_repository"
+)
+
 var AllClaims = []Claim{
 	RepositoryClaim,
 	CommitClaim,
@@ -76,11 +179,16 @@ var AllClaims = []Claim{
 	EnvironmentClaim,
 }
 
-var githubClaimMap = ClaimMap{
-	RepositoryClaim:  "repository",
-	CommitClaim:      "sha",
-	BranchClaim:      "ref",
-	EnvironmentClaim: "environment",
+var ProvenanceClaims = []Claim{
+	ActorClaim,
+	WorkflowClaim,
+	RunIDClaim,
+	RunAttemptClaim,
+	EventNameClaim,
+	PullRequestClaim,
+	RefTypeClaim,
+	JobWorkflowRefClaim,
+	HeadRepositoryClaim,
 }
 
 func (cm ClaimMapRaw) AsTyped() ClaimMap {
@@ -91,12 +199,18 @@ func (cm ClaimMapRaw) AsTyped() ClaimMap {
 	return out
 }
 
+// GetOidcIssuer returns the issuer of the upload tokens of the page. Built-in
+// providers default to their hosted service; pages[].git.oidc.issuer points
+// them at a self-hosted instance.
 func (g *GitConfig) GetOidcIssuer() (string, humane.Error) {
-	switch g.Provider {
-	case "github":
-		return "https://token.actions.githubusercontent.com", nil
+	switch provider, ok := gitProviders[g.Provider]; {
+	case ok:
+		if g.Oidc.Issuer != "" {
+			return strings.TrimSuffix(g.Oidc.Issuer, "/"), nil
+		}
+		return provider.issuer(g)
 
-	case "custom":
+	case g.Provider == "custom":
 		if g.Oidc.Issuer == "" {
 			return "", humane.New("Invalid Git-Provider 'custom'",
 				"Please provide 'pages[].git.provider.oidc.issuer'",
@@ -107,16 +221,44 @@ func (g *GitConfig) GetOidcIssuer() (string, humane.Error) {
 
 	default:
 		return "", humane.New("Invalid Git-Provider configured",
-			"Please configure a valid Git-Provider in pages[].git.provider",
+			fmt.Sprintf("Please configure a valid Git-Provider in pages[].git.provider: %s", strings.Join(GitProviders(), ", ")),
 			"You can use a 'custom' provider to use your own Git-Provider and provide 'pages[].git.provider.oidc.issuer' and 'pages[].git.provider.oidc.claimMappings'")
 	}
 }
 
+// GetOidcAudience returns the audience upload tokens for the page must be
+// issued for. Tokens of any other audience are refused, so there is always
+// one.
+func (g *GitConfig) GetOidcAudience() (string, humane.Error) {
+	if g.Oidc.Audience != "" {
+		return g.Oidc.Audience, nil
+	}
+
+	if provider, ok := gitProviders[g.Provider]; ok && provider.audience != "" {
+		return provider.audience, nil
+	}
+
+	advice := "Please provide 'pages[].git.oidc.audience', the audience the upload tokens are requested for."
+	if g.Provider == "bitbucket" {
+		advice = "Please provide 'pages[].git.oidc.audience' as Bitbucket issues it: 'ari:cloud:bitbucket::workspace/<workspace UUID>'."
+	}
+	return "", humane.New(fmt.Sprintf("No OIDC audience configured for repository %q", g.Repository), advice)
+}
+
 func (g *GitConfig) GetOidcClaimMapping() (ClaimMap, humane.Error) {
-	switch g.Provider {
-	case "github":
-		return githubClaimMap, nil
+	if provider, ok := gitProviders[g.Provider]; ok {
+		// The provenance claims can be remapped, e.g. to record a custom claim
+		// as the actor.
+		claimMap := maps.Clone(provider.claims)
+		for _, claim := range ProvenanceClaims {
+			if name, ok := g.Oidc.ClaimMappings[string(claim)]; ok {
+				claimMap[claim] = name
+			}
+		}
+		return claimMap, nil
+	}
 
+	switch g.Provider {
 	case "custom":
 		if len(g.Oidc.ClaimMappings) == 0 {
 			return ClaimMap{}, humane.New("Invalid Git-Provider 'custom'",
@@ -138,7 +280,7 @@ func (g *GitConfig) GetOidcClaimMapping() (ClaimMap, humane.Error) {
 
 	default:
 		return ClaimMap{}, humane.New("Invalid Git-Provider configured",
-			"Please configure a valid Git-Provider in pages[].git.provider",
+			fmt.Sprintf("Please configure a valid Git-Provider in pages[].git.provider: %s", strings.Join(GitProviders(), ", ")),
 			"You can use a 'custom' provider to use your own Git-Provider and provide 'pages[].git.provider.oidc.issuer' and 'pages[].git.provider.oidc.claimMappings'")
 	}
 }
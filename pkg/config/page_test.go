@@ -5,6 +5,7 @@ import (
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGitConfig_GetOidcIssuer(t *testing.T) {
@@ -46,10 +47,51 @@ func TestGitConfig_GetOidcIssuer(t *testing.T) {
 			errorContains: "Invalid Git-Provider 'custom'",
 		},
 		{
-			name: "unsupported provider",
+			name: "gitlab provider",
 			gitConfig: config.GitConfig{
 				Provider: "gitlab",
 			},
+			expectedValue: "https://gitlab.com",
+		},
+		{
+			name: "self-hosted gitlab",
+			gitConfig: config.GitConfig{
+				Provider: "gitlab",
+				Oidc: config.GitProvider{
+					Issuer: "https://gitlab.example.com/",
+				},
+			},
+			expectedValue: "https://gitlab.example.com",
+		},
+		{
+			name: "forgejo provider",
+			gitConfig: config.GitConfig{
+				Provider: "forgejo",
+			},
+			expectedValue: "https://codeberg.org/api/actions",
+		},
+		{
+			name: "bitbucket provider",
+			gitConfig: config.GitConfig{
+				Provider:   "bitbucket",
+				Repository: "acme/site",
+			},
+			expectedValue: "https://api.bitbucket.org/2.0/workspaces/acme/pipelines-config/identity/oidc",
+		},
+		{
+			name: "bitbucket provider without workspace",
+			gitConfig: config.GitConfig{
+				Provider:   "bitbucket",
+				Repository: "site",
+			},
+			expectError:   true,
+			errorContains: "Bitbucket workspace",
+		},
+		{
+			name: "unsupported provider",
+			gitConfig: config.GitConfig{
+				Provider: "svn",
+			},
 			expectError:   true,
 			errorContains: "Invalid Git-Provider configured",
 		},
@@ -140,10 +182,23 @@ func TestGitConfig_GetOidcClaimMapping(t *testing.T) {
 			errorContains: "Invalid ClaimMapping",
 		},
 		{
-			name: "unsupported provider",
+			name: "gitlab provider",
 			gitConfig: config.GitConfig{
 				Provider: "gitlab",
 			},
+			expectedKeys: []config.Claim{
+				config.RepositoryClaim,
+				config.CommitClaim,
+				config.BranchClaim,
+				config.RefTypeClaim,
+			},
+			expectError: false,
+		},
+		{
+			name: "unsupported provider",
+			gitConfig: config.GitConfig{
+				Provider: "svn",
+			},
 			expectError:   true,
 			errorContains: "Invalid Git-Provider configured",
 		},
@@ -228,3 +283,94 @@ func TestClaimMapRaw_AsTyped(t *testing.T) {
 		})
 	}
 }
+
+func TestGetOidcClaimMapping_GitHubProvenance(t *testing.T) {
+	git := config.GitConfig{
+		Provider: "github",
+		Oidc: config.GitProvider{ClaimMappings: config.ClaimMapRaw{
+			"actor":      "triggering_actor",
+			"repository": "ignored",
+		}},
+	}
+
+	claimMap, err := git.GetOidcClaimMapping()
+	require.Nil(t, err)
+	assert.Equal(t, "triggering_actor", claimMap[config.ActorClaim])
+	assert.Equal(t, "run_id", claimMap[config.RunIDClaim])
+	assert.Equal(t, "repository", claimMap[config.RepositoryClaim])
+
+	// The defaults are not changed for other pages.
+	claimMap, err = (&config.GitConfig{Provider: "github"}).GetOidcClaimMapping()
+	require.Nil(t, err)
+	assert.Equal(t, "actor", claimMap[config.ActorClaim])
+}
+
+func TestGitConfig_GetOidcAudience(t *testing.T) {
+	tests := []struct {
+		name          string
+		git           config.GitConfig
+		expected      string
+		errorContains string
+	}{
+		{name: "github default", git: config.GitConfig{Provider: "github"}, expected: "staticpages"},
+		{name: "gitlab default", git: config.GitConfig{Provider: "gitlab"}, expected: "staticpages"},
+		{name: "configured", git: config.GitConfig{Provider: "github", Oidc: config.GitProvider{Audience: "https://pages.example.com"}}, expected: "https://pages.example.com"},
+		{name: "bitbucket requires one", git: config.GitConfig{Provider: "bitbucket", Repository: "ws/site"}, errorContains: "ari:cloud:bitbucket::workspace/"},
+		{name: "bitbucket configured", git: config.GitConfig{Provider: "bitbucket", Oidc: config.GitProvider{Audience: "ari:cloud:bitbucket::workspace/abc"}}, expected: "ari:cloud:bitbucket::workspace/abc"},
+		{name: "custom requires one", git: config.GitConfig{Provider: "custom", Repository: "org/site"}, errorContains: "pages[].git.oidc.audience"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			audience, err := tc.git.GetOidcAudience()
+			if tc.errorContains != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Display(), tc.errorContains)
+				}
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, tc.expected, audience)
+		})
+	}
+}
+
+func TestGitConfig_BuiltinProviders(t *testing.T) {
+	gitlab, err := (&config.GitConfig{Provider: "gitlab"}).GetOidcClaimMapping()
+	require.Nil(t, err)
+	assert.Equal(t, "project_path", gitlab[config.RepositoryClaim])
+	assert.Equal(t, "ref", gitlab[config.BranchClaim])
+	assert.Equal(t, "user_login", gitlab[config.ActorClaim])
+
+	gitea, err := (&config.GitConfig{Provider: "gitea"}).GetOidcClaimMapping()
+	require.Nil(t, err)
+	assert.Equal(t, "sha", gitea[config.CommitClaim])
+
+	bitbucket, err := (&config.GitConfig{Provider: "bitbucket"}).GetOidcClaimMapping()
+	require.Nil(t, err)
+	assert.Equal(t, "repositoryUuid", bitbucket[config.RepositoryClaim])
+	assert.Empty(t, bitbucket[config.CommitClaim])
+
+	assert.Equal(t, []string{"bitbucket", "forgejo", "gitea", "github", "gitlab", "custom"}, config.GitProviders())
+}
+
+func TestGitConfig_TokenRepository(t *testing.T) {
+	assert.Equal(t, "acme/site", (&config.GitConfig{Repository: "acme/site"}).TokenRepository())
+	assert.Equal(t, "{c5f3}", (&config.GitConfig{Repository: "acme/site", RepositoryID: "{c5f3}"}).TokenRepository())
+}
+
+func TestNormalizeRef(t *testing.T) {
+	for ref, want := range map[string]string{
+		"refs/heads/main":        "main",
+		"refs/heads/feature/x":   "feature/x",
+		"refs/tags/v1.2.0":       "refs/tags/v1.2.0",
+		"refs/tags/main":         "refs/tags/main",
+		"main":                   "main",
+		"v1.2.0":                 "v1.2.0",
+		"refs/pull/42/merge":     "refs/pull/42/merge",
+		"refs/heads/refs/tags/x": "refs/tags/x",
+	} {
+		assert.Equal(t, want, config.NormalizeRef(ref), ref)
+	}
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sierrasoftworks/humane-errors-go"
+)
+
+// pullRequestEvents are the events running workflows of pull requests, on
+// GitHub, Gitea and Forgejo, and on GitLab.
+var pullRequestEvents = []string{"pull_request", "pull_request_target", "merge_request_event"}
+
+// The kinds of refs an upload can be made from.
+const (
+	RefTypeBranch = "branch"
+	RefTypeTag    = "tag"
+)
+
+// RefType returns the kind of ref, RefTypeBranch or RefTypeTag. Fully
+// qualified refs tell it themselves; refs given by name, as GitLab does, are
+// told apart by the ref_type claim in refType, and are taken for branches
+// without one. Other refs, like the refs/pull/ of pull requests, are neither.
+func RefType(ref string, refType string) string {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return RefTypeBranch
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return RefTypeTag
+	case strings.HasPrefix(ref, "refs/"):
+		return ""
+	case refType == RefTypeTag:
+		return RefTypeTag
+	default:
+		return RefTypeBranch
+	}
+}
+
+// DeployPolicy restricts which uploads may deploy a page, beyond coming from
+// its repository. Uploads are matched against the rule for production when
+// they are made from one of the production branches, and against the rule
+// for previews otherwise. Tags are never production.
+type DeployPolicy struct {
+	Production DeployRule `yaml:"production"`
+	Preview    DeployRule `yaml:"preview"`
+
+	// AllowForkPullRequests accepts uploads from workflows triggered by pull
+	// requests from forks. They are refused by default, as they run code of
+	// the fork under the identity of the repository. Forks are told apart by
+	// the head_repository claim; none of the built-in Git providers issues
+	// it, so unless it is mapped to a claim of the provider, uploads from
+	// every pull request event are refused unless this is set.
+	AllowForkPullRequests bool `yaml:"allowForkPullRequests"`
+}
+
+// DeployRule are the claims an upload must present. Empty lists allow any
+// value.
+type DeployRule struct {
+	// Branches are path.Match patterns of the branches allowed, e.g.
+	// "release/*". For production they default to git.mainBranch.
+	Branches []string `yaml:"branches"`
+
+	// Environments are the deployment environments one of which the upload
+	// must have been made from, e.g. "production".
+	Environments []string `yaml:"environments"`
+
+	// JobWorkflowRefs are patterns of the workflows allowed to upload,
+	// matched against the job_workflow_ref claim. Unlike in branches, * also
+	// matches slashes, so "org/repo/.github/workflows/deploy.yml@*" allows
+	// the workflow from any ref.
+	JobWorkflowRefs []string `yaml:"jobWorkflowRefs"`
+}
+
+// DeployClaims are the verified claims of an upload a DeployPolicy is
+// evaluated against.
+type DeployClaims struct {
+	Branch         string
+	Environment    string
+	EventName      string
+	JobWorkflowRef string
+
+	// Repository is the repository the token was issued to, and
+	// HeadRepository the one the changes of a pull request come from.
+	Repository     string
+	HeadRepository string
+
+	// RefType is the kind of ref Branch names, see RefType. Only branches
+	// match branch rules, so a tag named after a production branch does not
+	// deploy production.
+	RefType string
+}
+
+// fromFork reports whether the upload may have been made for a pull request
+// from another repository. Without a head repository, that cannot be ruled
+// out for any pull request event: a pull_request_target run of a fork carries
+// the ref of the base branch, just like a push to it.
+func (c DeployClaims) fromFork() bool {
+	if !slices.Contains(pullRequestEvents, c.EventName) {
+		return false
+	}
+	return c.HeadRepository == "" || !strings.EqualFold(c.HeadRepository, c.Repository)
+}
+
+// productionBranches returns the branches whose uploads deploy production.
+func (g *GitConfig) productionBranches() []string {
+	if len(g.Policy.Production.Branches) > 0 {
+		return g.Policy.Production.Branches
+	}
+	return []string{g.MainBranch}
+}
+
+// AuthorizeDeploy checks an upload with claims against the policy of the
+// page. The error of a refused upload states the reason.
+func (g *GitConfig) AuthorizeDeploy(claims DeployClaims) humane.Error {
+	if !g.Policy.AllowForkPullRequests && claims.fromFork() {
+		if claims.HeadRepository == "" {
+			return humane.New(fmt.Sprintf("uploads from %s events are not allowed, as pull requests from forks cannot be told apart", claims.EventName),
+				"The token does not name the repository the pull request comes from.",
+				"Map the head_repository claim for the Git provider, or set pages[].git.policy.allowForkPullRequests to accept uploads from any pull request.")
+		}
+		return humane.New(fmt.Sprintf("uploads from %s events of forks are not allowed", claims.EventName),
+			fmt.Sprintf("Workflows triggered by pull requests from %s may not deploy the page.", claims.HeadRepository),
+			"Set pages[].git.policy.allowForkPullRequests to accept them.")
+	}
+
+	isBranch := claims.RefType == RefTypeBranch
+
+	kind, rule := "preview", &g.Policy.Preview
+	if isBranch && matchesAny(g.productionBranches(), claims.Branch) {
+		kind, rule = "production", &g.Policy.Production
+	} else if len(rule.Branches) > 0 && (!isBranch || !matchesAny(rule.Branches, claims.Branch)) {
+		ref := "branch"
+		if !isBranch {
+			ref = "ref"
+			if claims.RefType != "" {
+				ref = claims.RefType
+			}
+		}
+		return humane.New(fmt.Sprintf("%s %q may not deploy previews", ref, claims.Branch),
+			fmt.Sprintf("Allowed branches are %s; see pages[].git.policy.preview.branches.", strings.Join(rule.Branches, ", ")))
+	}
+
+	if len(rule.Environments) > 0 && !slices.Contains(rule.Environments, claims.Environment) {
+		if claims.Environment == "" {
+			return humane.New(fmt.Sprintf("%s deployments must be made from an environment", kind),
+				fmt.Sprintf("Run the deploy job in one of the environments %s; see pages[].git.policy.%s.environments.", strings.Join(rule.Environments, ", "), kind))
+		}
+		return humane.New(fmt.Sprintf("environment %q may not deploy %s", claims.Environment, kind),
+			fmt.Sprintf("Allowed environments are %s; see pages[].git.policy.%s.environments.", strings.Join(rule.Environments, ", "), kind))
+	}
+
+	if len(rule.JobWorkflowRefs) > 0 && !matchesAnyRef(rule.JobWorkflowRefs, claims.JobWorkflowRef) {
+		if claims.JobWorkflowRef == "" {
+			return humane.New(fmt.Sprintf("%s deployments require a job workflow ref, but the token has none", kind),
+				"Make sure the job_workflow_ref claim is mapped for the Git provider of the page.")
+		}
+		return humane.New(fmt.Sprintf("workflow %q may not deploy %s", claims.JobWorkflowRef, kind),
+			fmt.Sprintf("Allowed workflows are %s; see pages[].git.policy.%s.jobWorkflowRefs.", strings.Join(rule.JobWorkflowRefs, ", "), kind))
+	}
+
+	return nil
+}
+
+// matchesAny reports whether value matches any of the path.Match patterns.
+// Invalid patterns match nothing.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyRef is matchesAny with * matching slashes as well.
+func matchesAnyRef(patterns []string, value string) bool {
+	unslash := strings.NewReplacer("/", "\x00")
+	for _, pattern := range patterns {
+		if ok, err := path.Match(unslash.Replace(pattern), unslash.Replace(value)); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
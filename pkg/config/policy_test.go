@@ -0,0 +1,191 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitConfig_AuthorizeDeploy(t *testing.T) {
+	const deployWorkflow = "org/repo/.github/workflows/deploy.yml@refs/heads/main"
+
+	strict := config.GitConfig{
+		MainBranch: "main",
+		Policy: config.DeployPolicy{
+			Production: config.DeployRule{
+				Branches:        []string{"main", "release/*"},
+				Environments:    []string{"production"},
+				JobWorkflowRefs: []string{"org/repo/.github/workflows/deploy.yml@*"},
+			},
+			Preview: config.DeployRule{
+				Branches: []string{"feature/*", "renovate/*"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		git           config.GitConfig
+		claims        config.DeployClaims
+		errorContains string
+	}{
+		{
+			name:   "no policy allows any branch",
+			git:    config.GitConfig{MainBranch: "main"},
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "anything", EventName: "push"},
+		},
+		{
+			name:          "fork pull requests are refused by default",
+			git:           config.GitConfig{MainBranch: "main"},
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request", Repository: "org/repo", HeadRepository: "fork/repo"},
+			errorContains: "pull_request events of forks",
+		},
+		{
+			name:          "fork pull_request_target is refused",
+			git:           config.GitConfig{MainBranch: "main"},
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request_target", Repository: "org/repo", HeadRepository: "fork/repo"},
+			errorContains: "pull_request_target events of forks",
+		},
+		{
+			name:   "pull requests from the repository are allowed",
+			git:    config.GitConfig{MainBranch: "main"},
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request_target", Repository: "org/repo", HeadRepository: "Org/Repo"},
+		},
+		{
+			name:   "fork pull requests can be allowed",
+			git:    config.GitConfig{MainBranch: "main", Policy: config.DeployPolicy{AllowForkPullRequests: true}},
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request", Repository: "org/repo", HeadRepository: "fork/repo"},
+		},
+		{
+			name:          "pull requests without head repository are refused",
+			git:           config.GitConfig{MainBranch: "main"},
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request_target", Repository: "org/repo"},
+			errorContains: "cannot be told apart",
+		},
+		{
+			name:          "merge requests without head repository are refused",
+			git:           config.GitConfig{MainBranch: "main"},
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "feature", EventName: "merge_request_event", Repository: "org/repo"},
+			errorContains: "merge_request_event events are not allowed",
+		},
+		{
+			name:   "pull requests without head repository can be allowed",
+			git:    config.GitConfig{MainBranch: "main", Policy: config.DeployPolicy{AllowForkPullRequests: true}},
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "pull_request_target", Repository: "org/repo"},
+		},
+		{
+			name:   "pushes are no pull requests",
+			git:    config.GitConfig{MainBranch: "main"},
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", EventName: "push", Repository: "org/repo", HeadRepository: "fork/repo"},
+		},
+		{
+			name:   "production from the deploy workflow and environment",
+			git:    strict,
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", Environment: "production", JobWorkflowRef: deployWorkflow},
+		},
+		{
+			name:   "production branch glob",
+			git:    strict,
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "release/1.2", Environment: "production", JobWorkflowRef: deployWorkflow},
+		},
+		{
+			name:          "production without environment",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", JobWorkflowRef: deployWorkflow},
+			errorContains: "production deployments must be made from an environment",
+		},
+		{
+			name:          "production from another environment",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", Environment: "staging", JobWorkflowRef: deployWorkflow},
+			errorContains: `environment "staging" may not deploy production`,
+		},
+		{
+			name:          "production from another workflow",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", Environment: "production", JobWorkflowRef: "org/repo/.github/workflows/ci.yml@refs/heads/main"},
+			errorContains: "may not deploy production",
+		},
+		{
+			name:          "workflow from another repository",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", Environment: "production", JobWorkflowRef: "fork/repo/.github/workflows/deploy.yml@refs/heads/main"},
+			errorContains: "may not deploy production",
+		},
+		{
+			name:          "production without job workflow ref",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "main", Environment: "production"},
+			errorContains: "require a job workflow ref",
+		},
+		{
+			name:   "preview from an allowed branch",
+			git:    strict,
+			claims: config.DeployClaims{RefType: config.RefTypeBranch, Branch: "feature/login"},
+		},
+		{
+			name:          "preview from another branch",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "experiment"},
+			errorContains: `branch "experiment" may not deploy previews`,
+		},
+		{
+			name:          "tag named after the production branch",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeTag, Branch: "main", Environment: "production", JobWorkflowRef: deployWorkflow},
+			errorContains: `tag "main" may not deploy previews`,
+		},
+		{
+			name:   "tag named after the production branch without policy",
+			git:    config.GitConfig{MainBranch: "main", Policy: config.DeployPolicy{Production: config.DeployRule{Environments: []string{"production"}}}},
+			claims: config.DeployClaims{RefType: config.RefTypeTag, Branch: "main"},
+		},
+		{
+			name:          "pull request refs are not branches",
+			git:           strict,
+			claims:        config.DeployClaims{Branch: "refs/pull/1/merge"},
+			errorContains: `ref "refs/pull/1/merge" may not deploy previews`,
+		},
+		{
+			name:          "globs do not cross slashes",
+			git:           strict,
+			claims:        config.DeployClaims{RefType: config.RefTypeBranch, Branch: "feature/a/b"},
+			errorContains: "may not deploy previews",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.git.AuthorizeDeploy(tc.claims)
+			if tc.errorContains == "" {
+				assert.Nil(t, err)
+				return
+			}
+
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tc.errorContains)
+			}
+		})
+	}
+}
+
+func TestRefType(t *testing.T) {
+	tests := []struct {
+		ref     string
+		refType string
+		want    string
+	}{
+		{ref: "refs/heads/main", want: config.RefTypeBranch},
+		{ref: "refs/tags/main", want: config.RefTypeTag},
+		{ref: "refs/tags/main", refType: "branch", want: config.RefTypeTag},
+		{ref: "refs/pull/1/merge", want: ""},
+		{ref: "main", refType: "branch", want: config.RefTypeBranch},
+		{ref: "main", refType: "tag", want: config.RefTypeTag},
+		{ref: "main", want: config.RefTypeBranch},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, config.RefType(tc.ref, tc.refType), "%s (%s)", tc.ref, tc.refType)
+	}
+}
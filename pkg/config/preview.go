@@ -1,8 +1,74 @@
 package config
 
+import "time"
+
 type PreviewConfig struct {
-	Enabled      bool `yaml:"enabled"`
-	CommitSha    bool `yaml:"sha"`
-	Environments bool `yaml:"environment"`
-	Branch       bool `yaml:"branch"`
+	Enabled      bool          `yaml:"enabled"`
+	CommitSha    bool          `yaml:"sha"`
+	Environments bool          `yaml:"environment"`
+	Branch       bool          `yaml:"branch"`
+	Access       PreviewAccess `yaml:"access"`
+	Banner       PreviewBanner `yaml:"banner"`
+}
+
+// PreviewBanner is a notice injected into the HTML documents of previews, so
+// they are not mistaken for production.
+type PreviewBanner struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Template is an html/template rendered with .Domain, .Branch,
+	// .Environment, .SHA, .ShortSHA and .Date of the deployment. It defaults
+	// to a small bar at the bottom of the page.
+	Template string `yaml:"template"`
+}
+
+// PreviewAccess restricts who can read the previews of a page. A request is
+// allowed if it comes from one of AllowCIDRs or passes any of the configured
+// methods. Without any of them, previews are public. The production domain is
+// never restricted.
+type PreviewAccess struct {
+	// AllowCIDRs are networks whose clients need no credentials. Behind a load
+	// balancer listed in proxy.limits.trustedProxies, the client address is
+	// taken from X-Forwarded-For.
+	AllowCIDRs []string `yaml:"allowCIDRs"`
+
+	BasicAuth BasicAuth `yaml:"basicAuth"`
+
+	// Password is a shared secret entered on a login page.
+	Password EnvValue `yaml:"password"`
+
+	OIDC OIDCLogin `yaml:"oidc"`
+
+	// LoginAllowlist restricts who may log in through OIDC. It is required
+	// with OIDC, as the issuer may authenticate anyone with an account.
+	LoginAllowlist `yaml:",inline" mapstructure:",squash"`
+
+	// SessionSecret signs the session cookie set after a login through the
+	// password or OIDC. Required when either is configured.
+	SessionSecret EnvValue      `yaml:"sessionSecret"`
+	SessionTTL    time.Duration `yaml:"sessionTTL"`
+}
+
+// Configured reports whether any access restriction is configured.
+func (a *PreviewAccess) Configured() bool {
+	return len(a.AllowCIDRs) > 0 || a.BasicAuth.Username != "" || a.Password != "" || a.OIDC.Issuer != ""
+}
+
+// BasicAuth are the credentials accepted through HTTP basic authentication.
+type BasicAuth struct {
+	Username EnvValue `yaml:"username"`
+	Password EnvValue `yaml:"password"`
+}
+
+// OIDCLogin is an OpenID Connect client logging visitors in through the
+// authorization code flow.
+type OIDCLogin struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     EnvValue `yaml:"clientId"`
+	ClientSecret EnvValue `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+
+	// RedirectURL is the callback URL registered with the issuer. It defaults
+	// to /.staticpages/callback on the page domain.
+	RedirectURL string `yaml:"redirectURL"`
 }
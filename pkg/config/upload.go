@@ -0,0 +1,84 @@
+package config
+
+import (
+	"mime"
+	"strings"
+)
+
+// PageUpload configures how the files of a deployment are processed while
+// they are uploaded.
+type PageUpload struct {
+	// Precompress stores .br and .gz variants next to compressible files, for
+	// the proxy to serve to clients accepting them.
+	Precompress Precompress `yaml:"precompress"`
+
+	// CacheControl sets the Cache-Control metadata of uploaded files. The
+	// first matching rule applies; files matching none get no Cache-Control.
+	CacheControl []CacheControlRule `yaml:"cacheControl"`
+
+	// Concurrency is the number of files uploaded at once. Defaults to 10.
+	Concurrency int `yaml:"concurrency"`
+
+	// MultipartThreshold is the size in bytes from which files are uploaded
+	// in parts, so a large file is neither sent in one long request nor
+	// retried from scratch when a part fails. Defaults to 16 MiB.
+	MultipartThreshold int64 `yaml:"multipartThreshold"`
+
+	// PartSize is the size in bytes of the parts of multipart uploads. The
+	// storage backend imposes a minimum of 5 MiB. Defaults to 8 MiB.
+	PartSize int64 `yaml:"partSize"`
+
+	// IndexMigrated stops writing the legacy index.yaml next to index.json.
+	// Set it once every instance runs a release that reads index.json.
+	IndexMigrated bool `yaml:"indexMigrated"`
+}
+
+// Precompress configures the variants generated at upload time. Variants
+// shipped with the deployment are uploaded as they are instead.
+type Precompress struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MinSize is the size in bytes below which files are not compressed.
+	// Defaults to 1024.
+	MinSize int64 `yaml:"minSize"`
+
+	// ContentTypes are the compressible media types. Defaults to
+	// DefaultCompressibleTypes.
+	ContentTypes []string `yaml:"contentTypes"`
+}
+
+// CacheControlRule sets Cache-Control for the files it matches.
+type CacheControlRule struct {
+	// Pattern is a path.Match pattern. Patterns containing a slash are matched
+	// against the path relative to the deployment root, others against the
+	// file name, so "*.html" matches HTML files in every directory. An empty
+	// pattern matches every file.
+	Pattern string `yaml:"pattern"`
+
+	// Hashed restricts the rule to file names carrying a content hash as
+	// emitted by bundlers, e.g. app.3f9a1c2b.js or index-B1x9kQ2a.css.
+	Hashed bool `yaml:"hashed"`
+
+	// Value is the Cache-Control to set, e.g. "public, max-age=31536000,
+	// immutable".
+	Value string `yaml:"value"`
+}
+
+// MatchesMediaType reports whether the media type of contentType is one of
+// types. A type ending in /* matches all of its subtypes.
+func MatchesMediaType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// checkTimeout bounds a whole readiness evaluation.
+	checkTimeout = 5 * time.Second
+
+	// reportTTL is how long a readiness report is reused, so frequent probes
+	// from several kubelets do not hammer the buckets and issuers.
+	reportTTL = 5 * time.Second
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusOK     Status = "ok"
+	StatusFailed Status = "failed"
+)
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Name     string `json:"name"`
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of all readiness checks. Its status is only ok if
+// every check passed.
+type Report struct {
+	Status Status        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+var (
+	_buildInfoMu sync.RWMutex
+	_buildInfo   BuildInfo
+)
+
+// SetBuildInfo sets the build information served on /version. It is called
+// once on startup with the values linked into the binary.
+func SetBuildInfo(info BuildInfo) {
+	_buildInfoMu.Lock()
+	defer _buildInfoMu.Unlock()
+	_buildInfo = info
+}
+
+// GetBuildInfo returns the build information of the running binary.
+func GetBuildInfo() BuildInfo {
+	_buildInfoMu.RLock()
+	defer _buildInfoMu.RUnlock()
+	return _buildInfo
+}
+
+// Checker evaluates whether a server is ready to take traffic: the
+// configuration is loaded, and the bucket and page index of every page are
+// reachable. Optionally, every OIDC issuer must be discoverable as well.
+type Checker struct {
+	conf         config.StaticPagesConfig
+	checkIssuers bool
+	tracer       trace.Tracer
+
+	evaluations singleflight.Group
+
+	mu       sync.Mutex
+	last     Report
+	lastTime time.Time
+}
+
+type Option func(*Checker)
+
+// WithIssuerChecks makes readiness depend on every OIDC issuer being
+// discoverable. The API needs them to verify uploads; the proxy does not.
+func WithIssuerChecks() Option {
+	return func(c *Checker) {
+		c.checkIssuers = true
+	}
+}
+
+// NewChecker returns a Checker for the given configuration.
+func NewChecker(conf config.StaticPagesConfig, options ...Option) *Checker {
+	c := &Checker{
+		conf:   conf,
+		tracer: otel.Tracer("StaticPages-Health"),
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
+}
+
+// Ready runs the readiness checks, or returns the report of a recent run.
+// Concurrent callers share one evaluation.
+func (c *Checker) Ready(ctx context.Context) Report {
+	c.mu.Lock()
+	if !c.lastTime.IsZero() && time.Since(c.lastTime) < reportTTL {
+		report := c.last
+		c.mu.Unlock()
+		return report
+	}
+	c.mu.Unlock()
+
+	res := <-c.evaluations.DoChan("ready", func() (interface{}, error) {
+		report := c.evaluate(context.WithoutCancel(ctx))
+
+		c.mu.Lock()
+		c.last = report
+		c.lastTime = time.Now()
+		c.mu.Unlock()
+
+		return report, nil
+	})
+
+	return res.Val.(Report)
+}
+
+// evaluate runs every readiness check concurrently.
+func (c *Checker) evaluate(ctx context.Context) Report {
+	ctx, span := c.tracer.Start(ctx, "health.Ready")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"config": func(context.Context) error {
+			if len(c.conf.Pages) == 0 {
+				return fmt.Errorf("no pages configured")
+			}
+			return nil
+		},
+	}
+
+	issuers := make(map[string]bool)
+	for _, page := range c.conf.Pages {
+		page := page
+
+		checks["bucket:"+page.Domain.String()] = func(ctx context.Context) error {
+			if err := s3_client.NewS3PageClient(page).CheckBucket(ctx); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		checks["index:"+page.Domain.String()] = func(ctx context.Context) error {
+			_, err := s3_client.GetPageMetadata(ctx, page)
+			return err
+		}
+
+		if c.checkIssuers {
+			issuer, err := page.Git.GetOidcIssuer()
+			if err != nil {
+				checks["oidc:"+page.Domain.String()] = func(context.Context) error { return err }
+				continue
+			}
+			issuers[issuer] = true
+		}
+	}
+
+	for issuer := range issuers {
+		issuer := issuer
+		checks["oidc:"+issuer] = func(ctx context.Context) error {
+			_, err := oidc.NewProvider(ctx, issuer)
+			return err
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]CheckResult, 0, len(checks))
+	)
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := CheckResult{Name: name, Status: StatusOK, Duration: time.Since(start).Round(time.Millisecond).String()}
+			if err != nil {
+				result.Status = StatusFailed
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFailed
+			otelzap.L().Ctx(ctx).Warn("readiness check failed",
+				zap.String("check", result.Name),
+				zap.String("error", result.Error))
+		}
+	}
+
+	span.SetAttributes(attribute.String("health.status", string(report.Status)))
+	return report
+}
+
+// LivenessHandler answers as long as the process is able to serve requests.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]Status{"status": StatusOK})
+	})
+}
+
+// ReadinessHandler answers 200 with the report when every check passed, and
+// 503 otherwise.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Ready(r.Context())
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// VersionHandler serves the build information of the running binary.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, GetBuildInfo())
+	})
+}
+
+// Register adds /healthz, /readyz and /version to mux.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.Handle("/healthz", LivenessHandler())
+	mux.Handle("/readyz", c.ReadinessHandler())
+	mux.Handle("/version", VersionHandler())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		otelzap.L().WithError(err).Debug("unable to write health response")
+	}
+}
@@ -0,0 +1,155 @@
+package health_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/health"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIndex = `abc123:
+    environment: prod
+    branch: main
+    date: 2025-05-04T18:13:45.715404+02:00
+`
+
+// newBucketServer serves an S3 endpoint holding a bucket "test" with a page
+// index.
+func newBucketServer(t *testing.T) string {
+	t.Helper()
+
+	backend := s3mem.New()
+	require.NoError(t, backend.CreateBucket("test"))
+	_, err := backend.PutObject("test", "index.yaml", nil, strings.NewReader(testIndex), int64(len(testIndex)), nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(gofakes3.New(backend, gofakes3.WithHostBucket(false)).Server())
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// newIssuerServer serves a minimal OIDC discovery document.
+func newIssuerServer(t *testing.T) string {
+	t.Helper()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                server.URL,
+			"jwks_uri":                              server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func testPage(t *testing.T, bucketURL, bucketName, issuer string) *config.Page {
+	return &config.Page{
+		Domain: config.FromString(strings.ToLower(t.Name()) + ".example.com"),
+		Git: config.GitConfig{
+			Provider: "custom",
+			Oidc:     config.GitProvider{Issuer: issuer},
+		},
+		Bucket: config.BucketConfig{
+			URL: config.EnvValue(bucketURL), Name: config.EnvValue(bucketName),
+			ApplicationID: "test", Secret: "test", Region: "test",
+		},
+	}
+}
+
+func readiness(t *testing.T, checker *health.Checker) (int, health.Report) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report health.Report
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	return rr.Code, report
+}
+
+func checkStatuses(report health.Report) map[string]health.Status {
+	statuses := make(map[string]health.Status, len(report.Checks))
+	for _, check := range report.Checks {
+		name, _, _ := strings.Cut(check.Name, ":")
+		statuses[name] = check.Status
+	}
+	return statuses
+}
+
+func TestReadinessPasses(t *testing.T) {
+	page := testPage(t, newBucketServer(t), "test", newIssuerServer(t))
+	checker := health.NewChecker(config.StaticPagesConfig{Pages: []*config.Page{page}}, health.WithIssuerChecks())
+
+	code, report := readiness(t, checker)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Equal(t, map[string]health.Status{
+		"config": health.StatusOK,
+		"bucket": health.StatusOK,
+		"index":  health.StatusOK,
+		"oidc":   health.StatusOK,
+	}, checkStatuses(report))
+}
+
+func TestReadinessFailsPerCheck(t *testing.T) {
+	page := testPage(t, newBucketServer(t), "missing", "http://127.0.0.1:1")
+	checker := health.NewChecker(config.StaticPagesConfig{Pages: []*config.Page{page}}, health.WithIssuerChecks())
+
+	code, report := readiness(t, checker)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFailed, report.Status)
+
+	statuses := checkStatuses(report)
+	assert.Equal(t, health.StatusOK, statuses["config"])
+	assert.Equal(t, health.StatusFailed, statuses["bucket"])
+	assert.Equal(t, health.StatusFailed, statuses["oidc"])
+	for _, check := range report.Checks {
+		if check.Status == health.StatusFailed {
+			assert.NotEmpty(t, check.Error, "failed check %s must carry its error", check.Name)
+		}
+	}
+}
+
+func TestReadinessWithoutPages(t *testing.T) {
+	code, report := readiness(t, health.NewChecker(config.StaticPagesConfig{}))
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]health.Status{"config": health.StatusFailed}, checkStatuses(report))
+}
+
+func TestLivenessAndVersion(t *testing.T) {
+	health.SetBuildInfo(health.BuildInfo{Version: "1.2.3", Commit: "abc123", Date: "2026-01-01"})
+
+	mux := http.NewServeMux()
+	health.NewChecker(config.StaticPagesConfig{}).Register(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"version":"1.2.3","commit":"abc123","date":"2026-01-01"}`, rr.Body.String())
+}
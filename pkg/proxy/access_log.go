@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// clfTimeFormat is the timestamp format of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessEntry collects what is logged about a request while it is served.
+type accessEntry struct {
+	start  time.Time
+	page   string // domain of the page serving the request
+	user   string
+	target *resolvedTarget
+	cache  string // outcome of the object cache, if it was used
+}
+
+type ctxAccessEntry struct{}
+
+// accessEntryFrom returns the access log entry of the request of ctx, if any.
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	entry, _ := ctx.Value(ctxAccessEntry{}).(*accessEntry)
+	return entry
+}
+
+// accessLog writes one entry per request in the configured format.
+type accessLog struct {
+	format     config.AccessLogFormat
+	sampleRate float64
+
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer // set when out is a file opened by us
+}
+
+// newAccessLog opens the access log as configured. It returns nil when access
+// logging is disabled.
+func newAccessLog(conf config.AccessLog) (*accessLog, humane.Error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	l := &accessLog{format: conf.Format, sampleRate: conf.SampleRate}
+	switch conf.Format {
+	case config.AccessLogJSON, config.AccessLogCombined, config.AccessLogCommon:
+	case "":
+		l.format = config.AccessLogCombined
+	default:
+		return nil, humane.New(fmt.Sprintf("invalid access log format '%s'", conf.Format),
+			"Please configure 'proxy.accessLog.format' as one of 'json', 'combined' or 'common'.")
+	}
+
+	switch conf.Output {
+	case "", "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		file, err := os.OpenFile(conf.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, humane.Wrap(err, "unable to open access log",
+				"Make sure 'proxy.accessLog.output' is a writable file, 'stdout' or 'stderr'.")
+		}
+		l.out, l.closer = file, file
+	}
+
+	return l, nil
+}
+
+// sampled reports whether a request answered with status is logged.
+func (l *accessLog) sampled(status int) bool {
+	return status >= http.StatusInternalServerError || l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+// log writes the entry of req, answered as recorded by rec.
+func (l *accessLog) log(req *http.Request, rec *statusRecorder, entry *accessEntry, client string) {
+	status := rec.statusCode()
+	if !l.sampled(status) {
+		return
+	}
+
+	var line []byte
+	switch l.format {
+	case config.AccessLogJSON:
+		line = l.json(req, rec, entry, client)
+	default:
+		line = l.clf(req, rec, entry, client)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+// clf formats the entry in the Common Log Format, followed by the referer and
+// user agent in the combined format.
+func (l *accessLog) clf(req *http.Request, rec *statusRecorder, entry *accessEntry, client string) []byte {
+	var b strings.Builder
+
+	b.WriteString(client)
+	b.WriteString(" - ")
+	b.WriteString(orDash(entry.user))
+	b.WriteString(" [")
+	b.WriteString(entry.start.Format(clfTimeFormat))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(req.Method + " " + req.URL.RequestURI() + " " + req.Proto))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(rec.statusCode()))
+	b.WriteString(" ")
+	if rec.bytes > 0 {
+		b.WriteString(strconv.FormatInt(rec.bytes, 10))
+	} else {
+		b.WriteString("-")
+	}
+
+	if l.format == config.AccessLogCombined {
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(orDash(req.Referer())))
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(orDash(req.UserAgent())))
+	}
+
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// accessRecord is an entry of the JSON access log.
+type accessRecord struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query,omitempty"`
+	Protocol    string    `json:"protocol"`
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	DurationMS  float64   `json:"duration_ms"`
+	ClientIP    string    `json:"client_ip"`
+	User        string    `json:"user,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Referer     string    `json:"referer,omitempty"`
+	Page        string    `json:"page,omitempty"`
+	Repository  string    `json:"repository,omitempty"`
+	SHA         string    `json:"sha,omitempty"`
+	Origin      string    `json:"origin,omitempty"`
+	BackendPath string    `json:"backend_path,omitempty"`
+	NotFound    bool      `json:"not_found,omitempty"`
+	Cache       string    `json:"cache,omitempty"`
+	TraceID     string    `json:"trace_id,omitempty"`
+}
+
+func (l *accessLog) json(req *http.Request, rec *statusRecorder, entry *accessEntry, client string) []byte {
+	record := accessRecord{
+		Time:       entry.start,
+		Host:       req.Host,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Query:      req.URL.RawQuery,
+		Protocol:   req.Proto,
+		Status:     rec.statusCode(),
+		Bytes:      rec.bytes,
+		DurationMS: float64(time.Since(entry.start).Microseconds()) / 1000,
+		ClientIP:   client,
+		User:       entry.user,
+		UserAgent:  req.UserAgent(),
+		Referer:    req.Referer(),
+		Page:       entry.page,
+		Cache:      entry.cache,
+	}
+
+	if target := entry.target; target != nil {
+		record.Repository = target.repository
+		record.SHA = target.sha
+		record.Origin = target.origin.String()
+		record.BackendPath = target.path
+		record.NotFound = target.isNotFound
+	}
+
+	if spanContext := trace.SpanContextFromContext(req.Context()); spanContext.HasTraceID() {
+		record.TraceID = spanContext.TraceID().String()
+	}
+
+	line, _ := json.Marshal(record)
+	return append(line, '\n')
+}
+
+// Close closes the file the access log is written to, if any.
+func (l *accessLog) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
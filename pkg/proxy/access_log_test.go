@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://feature.example.com/docs/?q=1", nil)
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	req.Header.Set("Referer", "https://example.com/")
+
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	_, _ = rec.Write([]byte("hello"))
+
+	entry := &accessEntry{
+		start: time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+		page:  "example.com",
+		user:  "alice",
+		cache: "hit",
+		target: &resolvedTarget{
+			origin:     &origin{url: &url.URL{Scheme: "https", Host: "cdn.example.net"}},
+			path:       "/repo/abc/docs/index.html",
+			repository: "org/repo",
+			sha:        "abc",
+		},
+	}
+
+	common := &accessLog{format: config.AccessLogCommon}
+	assert.Equal(t, `198.51.100.1 - alice [04/Mar/2026:05:06:07 +0000] "GET /docs/?q=1 HTTP/1.1" 200 5`+"\n",
+		string(common.clf(req, rec, entry, "198.51.100.1")))
+
+	combined := &accessLog{format: config.AccessLogCombined}
+	assert.Equal(t, `198.51.100.1 - alice [04/Mar/2026:05:06:07 +0000] "GET /docs/?q=1 HTTP/1.1" 200 5 "https://example.com/" "curl/8.0 \"quoted\""`+"\n",
+		string(combined.clf(req, rec, entry, "198.51.100.1")))
+
+	var record accessRecord
+	require.NoError(t, json.Unmarshal((&accessLog{format: config.AccessLogJSON}).json(req, rec, entry, "198.51.100.1"), &record))
+	assert.Equal(t, "feature.example.com", record.Host)
+	assert.Equal(t, "/docs/", record.Path)
+	assert.Equal(t, "q=1", record.Query)
+	assert.Equal(t, http.StatusOK, record.Status)
+	assert.Equal(t, int64(5), record.Bytes)
+	assert.Equal(t, "example.com", record.Page)
+	assert.Equal(t, "org/repo", record.Repository)
+	assert.Equal(t, "abc", record.SHA)
+	assert.Equal(t, "https://cdn.example.net/", record.Origin)
+	assert.Equal(t, "/repo/abc/docs/index.html", record.BackendPath)
+	assert.Equal(t, "hit", record.Cache)
+	assert.Equal(t, "alice", record.User)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLog{format: config.AccessLogCommon, sampleRate: 0, out: &out}
+	entry := &accessEntry{start: time.Now()}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusBadGateway} {
+		rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+		rec.WriteHeader(status)
+		l.log(httptest.NewRequest(http.MethodGet, "/", nil), rec, entry, "192.0.2.1")
+	}
+
+	// Server errors are logged regardless of the sample rate.
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), " 502 ")
+}
+
+func TestNewAccessLog(t *testing.T) {
+	l, err := newAccessLog(config.AccessLog{})
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+
+	_, err = newAccessLog(config.AccessLog{Enabled: true, Format: "xml"})
+	assert.NotNil(t, err)
+
+	_, err = newAccessLog(config.AccessLog{Enabled: true, Output: filepath.Join(t.TempDir(), "missing", "access.log")})
+	assert.NotNil(t, err)
+}
+
+func TestProxyWritesAccessLog(t *testing.T) {
+	initLogger()
+
+	file := filepath.Join(t.TempDir(), "access.log")
+	proxy := NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{AccessLog: config.AccessLog{
+			Enabled:    true,
+			Format:     config.AccessLogJSON,
+			Output:     file,
+			SampleRate: 1,
+		}},
+		Pages: []*config.Page{{Domain: config.FromString("example.com")}},
+	})
+	defer proxy.accessLog.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://unknown.org/missing", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	var record accessRecord
+	require.NoError(t, json.Unmarshal(data, &record))
+	assert.Equal(t, "unknown.org", record.Host)
+	assert.Equal(t, "/missing", record.Path)
+	assert.Equal(t, http.StatusNotFound, record.Status)
+	assert.Equal(t, "203.0.113.9", record.ClientIP)
+	assert.Equal(t, unknownDomain, record.Page)
+	assert.Positive(t, record.Bytes)
+}
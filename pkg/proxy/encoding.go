@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/andybalholm/brotli"
+	"github.com/jellydator/ttlcache/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// variantCacheTTL is how long the outcome of probing for a precompressed
+	// variant is remembered. Deployments are immutable, so it only bounds
+	// how long a variant uploaded late goes unnoticed.
+	variantCacheTTL      = 10 * time.Minute
+	variantCacheCapacity = 10000
+
+	brotliLevel = 5
+)
+
+// contentEncoding is an encoding the proxy negotiates with clients.
+type contentEncoding struct {
+	name string // as in Accept-Encoding and Content-Encoding
+	ext  string // file extension of precompressed variants
+}
+
+// contentEncodings are the supported encodings, in order of preference.
+var contentEncodings = []contentEncoding{
+	{name: "br", ext: ".br"},
+	{name: "gzip", ext: ".gz"},
+}
+
+// encoder negotiates the encoding of responses as configured in
+// proxy.encoding.
+type encoder struct {
+	conf config.Encoding
+
+	// variants remembers whether an object has a precompressed variant, by
+	// origin and variant path.
+	variants *ttlcache.Cache[string, bool]
+}
+
+// newEncoder returns the encoder of conf, or nil when nothing is to be
+// negotiated.
+func newEncoder(conf config.Encoding) *encoder {
+	if !conf.Precompressed && !conf.Dynamic {
+		return nil
+	}
+
+	return &encoder{
+		conf: conf,
+		variants: ttlcache.New[string, bool](
+			ttlcache.WithTTL[string, bool](variantCacheTTL),
+			ttlcache.WithCapacity[string, bool](variantCacheCapacity),
+		),
+	}
+}
+
+// compressible reports whether responses of contentType are compressed.
+func (e *encoder) compressible(contentType string) bool {
+	return config.MatchesMediaType(contentType, e.conf.ContentTypes)
+}
+
+// negotiateEncoding picks the encoding of the response to req. When a
+// precompressed variant of target is acceptable, the returned target is that
+// variant. Otherwise, with dynamic compression, the returned writer compresses
+// the response; it must be closed once the response is complete.
+func (p *Proxy) negotiateEncoding(ctx context.Context, w http.ResponseWriter, req *http.Request, target *resolvedTarget) (*resolvedTarget, http.ResponseWriter) {
+	e := p.encoder
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	accepted := acceptedEncodings(req.Header.Values("Accept-Encoding"))
+	if len(accepted) == 0 {
+		return target, w
+	}
+
+	span := trace.SpanFromContext(ctx)
+	if e.conf.Precompressed && e.compressible(s3_client.ContentTypeByExtension(target.path, target.contentTypes)) {
+		for _, encoding := range accepted {
+			if p.hasVariant(ctx, target, encoding) {
+				span.SetAttributes(attribute.String("proxy.encoding", encoding.name+" (precompressed)"))
+
+				variant := *target
+				variant.path += encoding.ext
+				variant.objectPath += encoding.ext
+				variant.encoding = encoding
+				return &variant, w
+			}
+		}
+	}
+
+	if e.conf.Dynamic {
+		span.SetAttributes(attribute.String("proxy.encoding", accepted[0].name))
+		stripETagSuffix(req.Header, accepted[0])
+		return target, &compressWriter{ResponseWriter: w, encoding: accepted[0], encoder: e}
+	}
+
+	return target, w
+}
+
+// hasVariant reports whether target has a variant precompressed with
+// encoding, probing the origin if it is not known yet.
+func (p *Proxy) hasVariant(ctx context.Context, target *resolvedTarget, encoding contentEncoding) bool {
+	variantPath := target.path + encoding.ext
+	if p.objectCache != nil && p.objectCache.has(objectCacheKey(target.repository, target.sha, target.objectPath+encoding.ext)) {
+		return true
+	}
+
+	key := target.origin.String() + "\x00" + variantPath
+	if item := p.encoder.variants.Get(key); item != nil {
+		return item.Value()
+	}
+
+	status, err := p.probePath(ctx, target.origin.url, variantPath)
+	if status == statusProbeInconclusive || (err != nil && status >= http.StatusInternalServerError) {
+		// Not known either way; serve the object itself this time.
+		return false
+	}
+
+	exists := err == nil && status >= http.StatusOK && status < http.StatusBadRequest
+	p.encoder.variants.Set(key, exists, ttlcache.DefaultTTL)
+	return exists
+}
+
+// applyEncoding labels the response for a precompressed variant: it carries
+// the encoding, and the media type of the object it is a variant of. Variants
+// uploaded by us are stored with that media type; others, e.g. compressed by
+// a build tool, are labelled by the extension of the original. Its ETag is
+// the one of the variant, so it differs from the identity response as is.
+func applyEncoding(r *http.Response, target *resolvedTarget) {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusNotModified {
+		return
+	}
+
+	r.Header.Set("Content-Encoding", target.encoding.name)
+	if !genericContentType(r.Header.Get("Content-Type")) {
+		return
+	}
+
+	if contentType := s3_client.ContentTypeByExtension(strings.TrimSuffix(target.path, target.encoding.ext), target.contentTypes); contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+}
+
+// genericContentType reports whether contentType says nothing about the
+// content beyond it being compressed.
+func genericContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch mediaType {
+	case "application/octet-stream", "binary/octet-stream",
+		"application/gzip", "application/x-gzip", "application/brotli", "application/x-brotli":
+		return true
+	}
+	return false
+}
+
+// acceptedEncodings returns the supported encodings the Accept-Encoding
+// header values accept, most preferred first. Ties are broken by our own
+// preference.
+func acceptedEncodings(values []string) []contentEncoding {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				parsed, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+				q = parsed
+			}
+
+			if name == "*" {
+				wildcard = q
+			} else {
+				qualities[name] = q
+			}
+		}
+	}
+
+	type candidate struct {
+		encoding contentEncoding
+		q        float64
+	}
+
+	var candidates []candidate
+	for _, encoding := range contentEncodings {
+		q, ok := qualities[encoding.name]
+		if !ok {
+			q = wildcard
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{encoding, q})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	accepted := make([]contentEncoding, 0, len(candidates))
+	for _, c := range candidates {
+		accepted = append(accepted, c.encoding)
+	}
+	return accepted
+}
+
+// setETagSuffix marks the ETag of a dynamically encoded response, as it must
+// differ from the one of the identity response.
+func setETagSuffix(h http.Header, encoding contentEncoding) {
+	etag := h.Get("ETag")
+	if etag == "" || !strings.HasSuffix(etag, `"`) {
+		return
+	}
+	h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding.name+`"`)
+}
+
+// stripETagSuffix removes the suffix added by setETagSuffix from the entity
+// tags of If-None-Match, so the origin and the object cache can compare them
+// with their own.
+func stripETagSuffix(h http.Header, encoding contentEncoding) {
+	value := h.Get("If-None-Match")
+	if value == "" {
+		return
+	}
+
+	suffix := "-" + encoding.name + `"`
+	tags := strings.Split(value, ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if strings.HasSuffix(tag, suffix) {
+			tag = strings.TrimSuffix(tag, suffix) + `"`
+		}
+		tags[i] = tag
+	}
+	h.Set("If-None-Match", strings.Join(tags, ", "))
+}
+
+var (
+	gzipWriters   = sync.Pool{New: func() any { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	brotliWriters = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, brotliLevel) }}
+)
+
+// compressWriter compresses the response when its status and content type
+// allow it. It decides once the header is written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding contentEncoding
+	encoder  *encoder
+
+	decided bool
+	w       io.WriteCloser // nil unless compressing
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.decided = true
+
+	h := c.Header()
+	switch {
+	case code == http.StatusNotModified:
+		setETagSuffix(h, c.encoding)
+
+	case code != http.StatusOK && code != http.StatusNotFound,
+		h.Get("Content-Encoding") != "",
+		h.Get("Content-Range") != "",
+		!c.encoder.compressible(h.Get("Content-Type")):
+
+	default:
+		if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length < c.encoder.conf.MinSize {
+			break
+		}
+
+		h.Set("Content-Encoding", c.encoding.name)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		setETagSuffix(h, c.encoding)
+
+		switch c.encoding.name {
+		case "br":
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(c.ResponseWriter)
+			c.w = bw
+		default:
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(c.ResponseWriter)
+			c.w = gw
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.w != nil {
+		return c.w.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush flushes the data compressed so far to the client.
+func (c *compressWriter) Flush() {
+	if flusher, ok := c.w.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Close completes the compressed stream.
+func (c *compressWriter) Close() error {
+	if c.w == nil {
+		return nil
+	}
+
+	err := c.w.Close()
+	switch w := c.w.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(w)
+	case *gzip.Writer:
+		gzipWriters.Put(w)
+	}
+	c.w = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// isPrecompressed reports whether r is the response for a precompressed
+// variant.
+func isPrecompressed(r *http.Response) bool {
+	target, ok := r.Request.Context().Value(ctxResolvedTarget{}).(*resolvedTarget)
+	return ok && target != nil && target.encoding.name != ""
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+	names := func(values ...string) []string {
+		var names []string
+		for _, encoding := range acceptedEncodings(values) {
+			names = append(names, encoding.name)
+		}
+		return names
+	}
+
+	assert.Empty(t, names())
+	assert.Empty(t, names("identity"))
+	assert.Equal(t, []string{"br", "gzip"}, names("gzip, deflate, br"))
+	assert.Equal(t, []string{"gzip", "br"}, names("br;q=0.5, gzip"))
+	assert.Equal(t, []string{"gzip"}, names("gzip", "br;q=0"))
+	assert.Equal(t, []string{"br", "gzip"}, names("*"))
+	assert.Equal(t, []string{"gzip"}, names("*;q=0.1, br;q=0, GZIP"))
+}
+
+func TestETagSuffix(t *testing.T) {
+	gz := contentEncoding{name: "gzip", ext: ".gz"}
+
+	h := http.Header{"Etag": {`"abc"`}}
+	setETagSuffix(h, gz)
+	assert.Equal(t, `"abc-gzip"`, h.Get("ETag"))
+
+	h = http.Header{"If-None-Match": {`"abc-gzip", W/"def-gzip", "ghi-br"`}}
+	stripETagSuffix(h, gz)
+	assert.Equal(t, `"abc", W/"def", "ghi-br"`, h.Get("If-None-Match"))
+}
+
+func TestCompressible(t *testing.T) {
+	e := newEncoder(config.Encoding{Dynamic: true, ContentTypes: config.DefaultCompressibleTypes})
+
+	assert.True(t, e.compressible("text/html; charset=utf-8"))
+	assert.True(t, e.compressible("application/javascript"))
+	assert.True(t, e.compressible("image/svg+xml"))
+	assert.False(t, e.compressible("image/png"))
+	assert.False(t, e.compressible(""))
+}
+
+func TestApplyEncoding(t *testing.T) {
+	br := contentEncoding{name: "br", ext: ".br"}
+	overrides := map[string]string{".js": "application/javascript"}
+
+	tests := []struct {
+		name      string
+		path      string
+		stored    string
+		overrides map[string]string
+		expected  string
+	}{
+		{name: "stored type of the original", path: "/c/app.js.br", stored: "text/plain; charset=utf-8", overrides: overrides, expected: "text/plain; charset=utf-8"},
+		{name: "generic type", path: "/c/app.js.br", stored: "application/octet-stream", expected: "text/javascript; charset=utf-8"},
+		{name: "compression type", path: "/c/app.js.br", stored: "application/x-brotli", expected: "text/javascript; charset=utf-8"},
+		{name: "generic type with override", path: "/c/app.js.br", stored: "binary/octet-stream", overrides: overrides, expected: "application/javascript"},
+		{name: "no type", path: "/c/app.js.br", overrides: overrides, expected: "application/javascript"},
+		{name: "unknown extension", path: "/c/app.unknown.br", stored: "application/octet-stream", expected: "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+			if test.stored != "" {
+				r.Header.Set("Content-Type", test.stored)
+			}
+
+			applyEncoding(r, &resolvedTarget{path: test.path, encoding: br, contentTypes: test.overrides})
+			assert.Equal(t, "br", r.Header.Get("Content-Encoding"))
+			assert.Equal(t, test.expected, r.Header.Get("Content-Type"))
+		})
+	}
+}
+
+// encodingOrigin serves a script with a brotli variant, and a JSON document
+// without variants.
+func encodingOrigin(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var variantProbes int32
+	objects := map[string]struct{ contentType, etag, body string }{
+		"/" + mockCommit + "/app.js":     {"text/javascript; charset=utf-8", `"js"`, "console.log('identity')"},
+		"/" + mockCommit + "/app.js.br":  {"application/octet-stream", `"js-br-object"`, "BROTLI"},
+		"/" + mockCommit + "/data.json":  {"application/json", `"json"`, strings.Repeat(`{"key":"value"}`, 200)},
+		"/" + mockCommit + "/small.json": {"application/json", `"small"`, `{}`},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && (strings.HasSuffix(r.URL.Path, ".br") || strings.HasSuffix(r.URL.Path, ".gz")) {
+			atomic.AddInt32(&variantProbes, 1)
+		}
+
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("ETag", object.etag)
+		if r.Header.Get("If-None-Match") == object.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(object.body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &variantProbes
+}
+
+func TestProxyNegotiatesEncoding(t *testing.T) {
+	initLogger()
+
+	origin, variantProbes := encodingOrigin(t)
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{Encoding: config.Encoding{
+			Precompressed: true,
+			Dynamic:       true,
+			MinSize:       1024,
+			ContentTypes:  config.DefaultCompressibleTypes,
+		}},
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy:  config.PageProxy{URL: config.EnvValue(origin.URL)},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3Backend.URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+
+	serve := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("precompressed variant", func(t *testing.T) {
+		for range 2 {
+			rr := serve("/app.js", http.Header{"Accept-Encoding": {"gzip, br"}})
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+			assert.Equal(t, "text/javascript; charset=utf-8", rr.Header().Get("Content-Type"))
+			assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+			assert.Equal(t, `"js-br-object"`, rr.Header().Get("ETag"))
+			assert.Equal(t, "BROTLI", rr.Body.String())
+		}
+
+		// The outcome of probing for the variant is remembered.
+		assert.Equal(t, int32(1), atomic.LoadInt32(variantProbes))
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		rr := serve("/app.js", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+		assert.Equal(t, "console.log('identity')", rr.Body.String())
+	})
+
+	t.Run("dynamic gzip", func(t *testing.T) {
+		rr := serve("/data.json", http.Header{"Accept-Encoding": {"gzip"}})
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, `"json-gzip"`, rr.Header().Get("ETag"))
+		assert.Empty(t, rr.Header().Get("Content-Length"))
+
+		reader, err := gzip.NewReader(rr.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat(`{"key":"value"}`, 200), string(body))
+
+		// Revalidating the encoded response works against the origin's ETag.
+		rr = serve("/data.json", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {`"json-gzip"`}})
+		assert.Equal(t, http.StatusNotModified, rr.Code)
+		assert.Equal(t, `"json-gzip"`, rr.Header().Get("ETag"))
+	})
+
+	t.Run("dynamic brotli", func(t *testing.T) {
+		rr := serve("/data.json", http.Header{"Accept-Encoding": {"br"}})
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+
+		body, err := io.ReadAll(brotli.NewReader(rr.Body))
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat(`{"key":"value"}`, 200), string(body))
+	})
+
+	t.Run("small and partial responses", func(t *testing.T) {
+		rr := serve("/small.json", http.Header{"Accept-Encoding": {"gzip"}})
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "{}", rr.Body.String())
+
+		rr = serve("/data.json", http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}})
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	})
+}
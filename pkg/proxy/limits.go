@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/clientip"
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueueTimeout = 10 * time.Second
+
+	// limiterSweepInterval is how often buckets of clients that went quiet are
+	// dropped.
+	limiterSweepInterval = time.Minute
+)
+
+// limits throttles requests as configured in proxy.limits and
+// pages[].proxy.rateLimit.
+type limits struct {
+	clients *rateLimiter                        // per client address; nil when disabled
+	pages   map[config.DomainScope]*rateLimiter // per page, for all clients together
+	trusted []*net.IPNet
+	slots   *slots // nil when the backend requests are not bounded
+}
+
+// newLimits sets up the limits of conf. Invalid trusted proxies are reported
+// and skipped.
+func newLimits(conf config.StaticPagesConfig) *limits {
+	l := &limits{
+		pages:   make(map[config.DomainScope]*rateLimiter),
+		trusted: parseNetworks(conf.Proxy.Limits.TrustedProxies),
+	}
+
+	if conf.Proxy.Limits.Client.Enabled() {
+		l.clients = newRateLimiter(conf.Proxy.Limits.Client)
+	}
+
+	for _, page := range conf.Pages {
+		if page.Proxy.RateLimit.Enabled() {
+			l.pages[page.Domain] = newRateLimiter(page.Proxy.RateLimit)
+		}
+	}
+
+	if conf.Proxy.Limits.MaxInFlight > 0 {
+		l.slots = newSlots(conf.Proxy.Limits.MaxInFlight, conf.Proxy.Limits.MaxQueued, conf.Proxy.Limits.QueueTimeout)
+	}
+
+	return l
+}
+
+// allow applies the rate limits to req for page, which may be nil. Otherwise
+// it has answered with 429 Too Many Requests and reports false.
+func (l *limits) allow(w http.ResponseWriter, req *http.Request, page *config.Page) bool {
+	domain := unknownDomain
+	if page != nil {
+		domain = page.Domain.String()
+	}
+
+	if l.clients != nil {
+		client := clientip.FromRequest(req, l.trusted)
+		if ok, retry := l.clients.allow(client); !ok {
+			otelzap.L().Ctx(req.Context()).Debug("client rate limited",
+				zap.String("client", client),
+				zap.String("domain", domain))
+			tooManyRequests(w, req, domain, "client", retry)
+			return false
+		}
+	}
+
+	if page != nil {
+		if limiter := l.pages[page.Domain]; limiter != nil {
+			if ok, retry := limiter.allow(""); !ok {
+				tooManyRequests(w, req, domain, "page", retry)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func tooManyRequests(w http.ResponseWriter, req *http.Request, domain, reason string, retry time.Duration) {
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("proxy.rate_limited", reason))
+	_rateLimited.WithLabelValues(domain, reason).Inc()
+
+	w.Header().Set("Retry-After", retryAfter(retry))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// retryAfter formats d as the value of a Retry-After header: whole seconds,
+// at least one.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+// acquire waits for a slot to send req to the backend. It returns the function
+// releasing the slot, or reports false after answering with 503 Service
+// Unavailable when no slot became available in time.
+func (l *limits) acquire(w http.ResponseWriter, req *http.Request, domain string) (func(), bool) {
+	if l.slots == nil {
+		return func() {}, true
+	}
+
+	release, err := l.slots.acquire(req.Context())
+	if err != nil {
+		if req.Context().Err() == nil {
+			otelzap.L().WithError(err).Ctx(req.Context()).Warn("no backend slot available; rejecting request",
+				zap.String("domain", domain))
+			trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("proxy.rate_limited", "queue"))
+			_rateLimited.WithLabelValues(domain, "queue").Inc()
+
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return nil, false
+	}
+	return release, true
+}
+
+// rateLimiter keeps a token bucket for every key.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // capacity of a bucket
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(conf config.RateLimit) *rateLimiter {
+	burst := float64(conf.Burst)
+	if burst <= 0 {
+		burst = math.Ceil(conf.Rate)
+	}
+
+	return &rateLimiter{
+		rate:    conf.Rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket of key. Without one, it returns how long
+// until the next token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled completely, as they are no
+// different from a new one. This bounds the memory held for clients that
+// stopped sending requests.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// slots bounds the number of concurrent requests to the backend. Requests
+// beyond it wait in a bounded queue for a limited time.
+type slots struct {
+	sem       chan struct{}
+	queued    atomic.Int64
+	maxQueued int64
+	timeout   time.Duration
+}
+
+func newSlots(size, maxQueued int, timeout time.Duration) *slots {
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+
+	return &slots{sem: make(chan struct{}, size), maxQueued: int64(maxQueued), timeout: timeout}
+}
+
+// limitedTransport holds a backend slot while a request is sent to the
+// backend, until its response headers arrived. The body is streamed to the
+// client without one, so slow clients do not hold up the backend requests of
+// others.
+type limitedTransport struct {
+	base  http.RoundTripper
+	slots *slots // nil when the backend requests are not bounded
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.slots == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	release, err := t.slots.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return t.base.RoundTrip(req)
+}
+
+var (
+	errQueueFull    = errors.New("backend request queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a backend slot")
+)
+
+// acquire takes a slot, waiting for one if necessary. The returned function
+// gives it back.
+func (s *slots) acquire(ctx context.Context) (func(), error) {
+	release := func() {
+		<-s.sem
+		_inFlight.Dec()
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		_inFlight.Inc()
+		return release, nil
+	default:
+	}
+
+	if s.queued.Add(1) > s.maxQueued {
+		s.queued.Add(-1)
+		return nil, errQueueFull
+	}
+	_queued.Inc()
+	defer func() {
+		s.queued.Add(-1)
+		_queued.Dec()
+	}()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.sem <- struct{}{}:
+		_inFlight.Inc()
+		return release, nil
+	case <-timer.C:
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseNetworks parses addresses and networks in CIDR notation. Invalid
+// entries are reported and skipped.
+func parseNetworks(values []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, err := clientip.ParseNetwork(value)
+		if err != nil {
+			otelzap.L().WithError(err).Error("invalid proxy.limits.trustedProxies entry; skipping it",
+				zap.String("network", value))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(config.RateLimit{Rate: 2, Burst: 3})
+	limiter.now = func() time.Time { return now }
+
+	for range 3 {
+		ok, _ := limiter.allow("a")
+		assert.True(t, ok)
+	}
+
+	ok, retry := limiter.allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	// Buckets are independent.
+	ok, _ = limiter.allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.allow("a")
+	assert.True(t, ok)
+	ok, _ = limiter.allow("a")
+	assert.False(t, ok)
+
+	// Buckets that refilled are dropped on the next sweep.
+	now = now.Add(limiterSweepInterval)
+	limiter.allow("c")
+	assert.Len(t, limiter.buckets, 1)
+
+	// Burst defaults to the rate.
+	assert.Equal(t, 3.0, newRateLimiter(config.RateLimit{Rate: 2.5}).burst)
+}
+
+func TestParseNetworks(t *testing.T) {
+	trusted := parseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "invalid"})
+	require.Len(t, trusted, 2, "invalid entries are skipped")
+	assert.Equal(t, "192.0.2.1/32", trusted[1].String())
+}
+
+func TestSlots(t *testing.T) {
+	s := newSlots(1, 1, 50*time.Millisecond)
+
+	release, err := s.acquire(context.Background())
+	require.NoError(t, err)
+
+	// One request may wait; it gets the slot once it is released.
+	acquired := make(chan error)
+	go func() {
+		release, err := s.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	require.Eventually(t, func() bool { return s.queued.Load() == 1 }, time.Second, time.Millisecond)
+	_, err = s.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueFull)
+
+	release()
+	assert.NoError(t, <-acquired)
+
+	// Waiting is bounded.
+	release, err = s.acquire(context.Background())
+	require.NoError(t, err)
+	_, err = s.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueTimeout)
+	release()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// The backend slot is held for the round trip only, not while the body is
+// streamed to a possibly slow client.
+func TestLimitedTransport(t *testing.T) {
+	s := newSlots(1, 0, 50*time.Millisecond)
+
+	var held bool
+	transport := &limitedTransport{slots: s, base: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		held = len(s.sem) == 1
+		body, _ := io.Pipe() // never finishes
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	})}
+
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	assert.True(t, held, "the slot must be held during the round trip")
+
+	release, err := s.acquire(context.Background())
+	require.NoError(t, err, "the slot must be free while the body is streamed")
+
+	// Without a free slot and room to wait for one, the round trip fails.
+	_, err = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.ErrorIs(t, err, errQueueFull)
+	release()
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	initLogger()
+
+	page := &config.Page{Domain: config.FromString("example.com")}
+	page.Proxy.RateLimit = config.RateLimit{Rate: 0.01, Burst: 2}
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{Limits: config.Limits{
+			Client:         config.RateLimit{Rate: 0.5, Burst: 1},
+			TrustedProxies: []string{"10.0.0.0/8"},
+		}},
+		Pages: []*config.Page{page},
+	})
+
+	serve := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.NotEqual(t, http.StatusTooManyRequests, serve("198.51.100.1").Code)
+
+	rr := serve("198.51.100.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+
+	// Another client has its own limit, but the page limit is exhausted next.
+	assert.NotEqual(t, http.StatusTooManyRequests, serve("198.51.100.2").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("198.51.100.3").Code)
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// unknownDomain labels requests for hosts that match no page, so scanners
+// probing random hostnames cannot blow up the label cardinality.
+const unknownDomain = "unknown"
+
+var (
+	// _requests counts proxied requests by page and response status.
+	_requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "requests_total",
+		Help:      "Number of requests handled by the proxy.",
+	}, []string{"domain", "code"})
+
+	// _requestDuration observes the time taken to answer a request.
+	_requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to answer a request, including path resolution.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"domain"})
+
+	// _probes counts HEAD probes by outcome: hit, miss, inconclusive or error.
+	_probes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "probes_total",
+		Help:      "Number of HEAD probes sent to origins, by outcome.",
+	}, []string{"outcome"})
+
+	// _lookups counts path lookups by outcome: cached, found,
+	// inconclusive_proxied, not_found, unreachable or timeout.
+	_lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "lookups_total",
+		Help:      "Number of path lookups against origins, by outcome.",
+	}, []string{"domain", "outcome"})
+
+	// _notFoundFallbacks counts requests answered with the page's not-found
+	// document.
+	_notFoundFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "not_found_fallbacks_total",
+		Help:      "Number of requests answered with the configured not-found document.",
+	}, []string{"domain"})
+
+	// _dnsErrors counts failed resolutions of origin hostnames.
+	_dnsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "dns_errors_total",
+		Help:      "Number of failed resolutions of origin hostnames.",
+	}, []string{"host"})
+
+	// _rateLimited counts rejected requests by page and reason: client, page
+	// or queue.
+	_rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected by rate and concurrency limits, by reason.",
+	}, []string{"domain", "reason"})
+
+	// _inFlight and _queued track the requests holding and waiting for one of
+	// the proxy.limits.maxInFlight backend slots.
+	_inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "backend_in_flight",
+		Help:      "Number of requests holding a backend slot.",
+	})
+	_queued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "backend_queued",
+		Help:      "Number of requests waiting for a backend slot.",
+	})
+
+	// _dialErrors counts failed connection attempts to origin addresses.
+	_dialErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "proxy",
+		Name:      "dial_errors_total",
+		Help:      "Number of failed connection attempts to origin addresses.",
+	}, []string{"host"})
+)
+
+// statusRecorder captures the status code and the size of the body written
+// to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) code() string {
+	return strconv.Itoa(r.statusCode())
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyRecordsMetrics(t *testing.T) {
+	initLogger()
+
+	test := testProxyServer{
+		domain:              "metrics.example.com",
+		requestPathResponse: http.StatusNotFound,
+		notFound:            "404.html",
+		searchPathResponses: map[string]int{"/404.html": http.StatusOK},
+	}
+
+	backend := setupMockServer(&test)
+	defer backend.Close()
+
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Pages: []*config.Page{{
+			Domain: config.FromString(test.domain),
+			Proxy: config.PageProxy{
+				URL:      config.EnvValue(backend.URL),
+				NotFound: test.notFound,
+			},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3Backend.URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+
+	requests := testutil.ToFloat64(_requests.WithLabelValues(test.domain, "404"))
+	fallbacks := testutil.ToFloat64(_notFoundFallbacks.WithLabelValues(test.domain))
+	notFound := testutil.ToFloat64(_lookups.WithLabelValues(test.domain, "not_found"))
+	unknown := testutil.ToFloat64(_requests.WithLabelValues(unknownDomain, "404"))
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://metrics.example.com/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://scanner.invalid/wp-admin", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.Equal(t, requests+1, testutil.ToFloat64(_requests.WithLabelValues(test.domain, "404")))
+	assert.Equal(t, fallbacks+1, testutil.ToFloat64(_notFoundFallbacks.WithLabelValues(test.domain)))
+	assert.Equal(t, notFound+1, testutil.ToFloat64(_lookups.WithLabelValues(test.domain, "not_found")))
+	assert.Equal(t, unknown+1, testutil.ToFloat64(_requests.WithLabelValues(unknownDomain, "404")),
+		"requests for unknown hosts must share a single label")
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(_requestDuration), 2, "latency must be observed per domain")
+}
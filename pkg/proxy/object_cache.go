@@ -0,0 +1,481 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+)
+
+// objectCache is a persistent, size-bounded LRU cache of backend objects.
+//
+// Objects are keyed by (repository, sha, path). Because a deployment is
+// immutable once uploaded, a cached object never goes stale: it only leaves
+// the cache when it is evicted to make room. Bodies and their response headers
+// are stored side by side on disk, so the cache survives restarts.
+type objectCache struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // key -> element holding a *cacheEntry
+	lru      *list.List               // front is the most recently used entry
+	size     int64
+	inflight map[string]chan struct{} // key -> closed once the running fill finished
+
+	// lookups remembers which object a requested path resolved to, so the
+	// backend need not be probed again for it. Only lookups whose outcome is
+	// ordered, i.e. no candidate of higher priority can exist, are remembered.
+	// They are kept in memory only and forgotten together with the object.
+	lookups map[string]cachedLookup
+}
+
+type cacheEntry struct {
+	key     string
+	size    int64
+	lookups []string // keys of the lookups that resolved to this object
+}
+
+// cachedLookup is the object a lookup resolved to.
+type cachedLookup struct {
+	key  string
+	path string // path of the object, as in cachedObjectMeta.Path
+}
+
+// cachedObjectMeta is persisted next to every cached body.
+type cachedObjectMeta struct {
+	Repository string      `json:"repository"`
+	SHA        string      `json:"sha"`
+	Path       string      `json:"path"`
+	Header     http.Header `json:"header"`
+	Size       int64       `json:"size"`
+	Stored     time.Time   `json:"stored"`
+}
+
+// objectCacheKey derives the on-disk key of an object.
+func objectCacheKey(repository, sha, objectPath string) string {
+	sum := sha256.Sum256([]byte(repository + "\x00" + sha + "\x00" + objectPath))
+	return hex.EncodeToString(sum[:])
+}
+
+// newObjectCache opens (or creates) the cache in dir and loads the objects it
+// already holds from a previous run.
+func newObjectCache(dir string, maxSize int64) (*objectCache, humane.Error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "staticpages-cache")
+	}
+
+	if maxSize <= 0 {
+		return nil, humane.New("object cache size must be positive", "Set proxy.cache.maxSize to the cache size in bytes.")
+	}
+
+	c := &objectCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]chan struct{}),
+		lookups:  make(map[string]cachedLookup),
+	}
+
+	// Left-over partial downloads from a previous run are useless.
+	if err := os.RemoveAll(c.tmpDir()); err != nil {
+		return nil, humane.Wrap(err, "unable to clean object cache", "Make sure proxy.cache.dir is writable.")
+	}
+
+	for _, d := range []string{c.tmpDir(), filepath.Join(c.dir, "objects")} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, humane.Wrap(err, "unable to create object cache directory", "Make sure proxy.cache.dir is writable.")
+		}
+	}
+
+	if err := c.load(); err != nil {
+		return nil, humane.Wrap(err, "unable to load object cache", "Make sure proxy.cache.dir is readable or remove it to start with an empty cache.")
+	}
+
+	otelzap.L().Info("object cache ready",
+		zap.String("dir", c.dir),
+		zap.Int("objects", c.lru.Len()),
+		zap.Int64("size", c.size),
+		zap.Int64("max_size", c.maxSize))
+
+	return c, nil
+}
+
+func (c *objectCache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *objectCache) bodyPath(key string) string {
+	return filepath.Join(c.dir, "objects", key[:2], key)
+}
+
+func (c *objectCache) metaPath(key string) string {
+	return c.bodyPath(key) + ".json"
+}
+
+// load rebuilds the LRU list from the objects on disk, ordered by their last
+// access time (recorded as the body's modification time).
+func (c *objectCache) load() error {
+	type found struct {
+		key      string
+		size     int64
+		accessed time.Time
+	}
+	var objects []found
+
+	err := filepath.WalkDir(filepath.Join(c.dir, "objects"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+
+		key := strings.TrimSuffix(filepath.Base(p), ".json")
+		info, err := os.Stat(c.bodyPath(key))
+		if err != nil {
+			// A metadata file without a body is a torn write; drop it.
+			_ = os.Remove(p)
+			return nil
+		}
+
+		objects = append(objects, found{key: key, size: info.Size(), accessed: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].accessed.Before(objects[j].accessed) })
+	for _, o := range objects {
+		c.entries[o.key] = c.lru.PushFront(&cacheEntry{key: o.key, size: o.size})
+		c.size += o.size
+	}
+
+	c.evictLocked()
+
+	return nil
+}
+
+// has reports whether key is cached, without touching its recency.
+func (c *objectCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+// resolved returns the path of the cached object lookup resolved to.
+func (c *objectCache) resolved(lookup string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resolved, ok := c.lookups[lookup]
+	if !ok {
+		return "", false
+	}
+	if _, ok := c.entries[resolved.key]; !ok {
+		return "", false
+	}
+	return resolved.path, true
+}
+
+// open returns the cached body and metadata for key and marks it as recently
+// used. The caller must close the returned file.
+func (c *objectCache) open(key string) (*os.File, *cachedObjectMeta, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	raw, err := os.ReadFile(c.metaPath(key))
+	if err != nil {
+		c.remove(key)
+		return nil, nil, false
+	}
+
+	var meta cachedObjectMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		c.remove(key)
+		return nil, nil, false
+	}
+
+	f, err := os.Open(c.bodyPath(key))
+	if err != nil {
+		c.remove(key)
+		return nil, nil, false
+	}
+
+	// Persist the access so LRU order survives a restart.
+	now := time.Now()
+	_ = os.Chtimes(c.bodyPath(key), now, now)
+
+	return f, &meta, true
+}
+
+// serve writes the cached object for key to w. It reports false on a miss, in
+// which case nothing has been written. When notFound is set the object is the
+// page's not-found document and is served with a 404 status.
+func (c *objectCache) serve(w http.ResponseWriter, req *http.Request, key string, notFound bool) bool {
+	f, meta, ok := c.open(key)
+	if !ok {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	for name, values := range meta.Header {
+		if name == "Vary" {
+			// Keep what the proxy itself varies the response by.
+			w.Header()[name] = append(w.Header()[name], values...)
+			continue
+		}
+		w.Header()[name] = values
+	}
+
+	if notFound {
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.Copy(w, f)
+		return true
+	}
+
+	modTime, _ := http.ParseTime(meta.Header.Get("Last-Modified"))
+	http.ServeContent(w, req, "", modTime, f)
+	return true
+}
+
+// begin registers a fill for key. The first caller becomes the leader and must
+// call finish once done; everybody else receives a channel that is closed when
+// the leader finished.
+func (c *objectCache) begin(key string) (<-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch, ok := c.inflight[key]; ok {
+		return ch, false
+	}
+
+	ch := make(chan struct{})
+	c.inflight[key] = ch
+	return ch, true
+}
+
+// finish releases the waiters of the fill started with begin.
+func (c *objectCache) finish(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch, ok := c.inflight[key]; ok {
+		delete(c.inflight, key)
+		close(ch)
+	}
+}
+
+// fill wraps a backend response body so that it is streamed into the cache
+// while it is being proxied. The object is only committed if the body was
+// read completely; the lookup that resolved to it, if any, is remembered
+// along with it.
+func (c *objectCache) fill(key, lookup string, meta cachedObjectMeta, body io.ReadCloser, contentLength int64) io.ReadCloser {
+	if contentLength > c.maxSize {
+		return body
+	}
+
+	tmp, err := os.CreateTemp(c.tmpDir(), key+"-*")
+	if err != nil {
+		otelzap.L().WithError(err).Warn("unable to create object cache file", zap.String("path", meta.Path))
+		return body
+	}
+
+	meta.Header = cacheableHeader(meta.Header)
+	return &cacheFill{
+		cache:    c,
+		key:      key,
+		lookup:   lookup,
+		meta:     meta,
+		body:     body,
+		tmp:      tmp,
+		expected: contentLength,
+	}
+}
+
+// cacheFill tees a backend body into a temporary file.
+type cacheFill struct {
+	cache    *objectCache
+	key      string
+	lookup   string
+	meta     cachedObjectMeta
+	body     io.ReadCloser
+	tmp      *os.File
+	expected int64
+	written  int64
+	complete bool
+	failed   bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.body.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.tmp.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+		f.written += int64(n)
+		if f.written > f.cache.maxSize {
+			f.failed = true
+		}
+	}
+
+	if err == io.EOF {
+		f.complete = true
+	}
+
+	return n, err
+}
+
+func (f *cacheFill) Close() error {
+	err := f.body.Close()
+
+	ok := f.complete && !f.failed && (f.expected < 0 || f.written == f.expected)
+	if cerr := f.tmp.Close(); cerr != nil {
+		ok = false
+	}
+
+	if !ok {
+		_ = os.Remove(f.tmp.Name())
+		return err
+	}
+
+	f.meta.Size = f.written
+	f.meta.Stored = time.Now()
+	if cerr := f.cache.commit(f.key, f.lookup, f.tmp.Name(), f.meta); cerr != nil {
+		otelzap.L().WithError(cerr).Warn("unable to store object in cache", zap.String("path", f.meta.Path))
+		_ = os.Remove(f.tmp.Name())
+	}
+
+	return err
+}
+
+// commit moves a completely downloaded body into place and accounts for it.
+func (c *objectCache) commit(key, lookup, tmpBody string, meta cachedObjectMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.bodyPath(key)), 0o755); err != nil {
+		return err
+	}
+
+	// Write the body first: load() only picks up objects with metadata, so a
+	// crash in between leaves an orphaned body at worst, never a torn entry.
+	if err := os.Rename(tmpBody, c.bodyPath(key)); err != nil {
+		return err
+	}
+
+	tmpMeta := tmpBody + ".json"
+	if err := os.WriteFile(tmpMeta, raw, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpMeta, c.metaPath(key)); err != nil {
+		_ = os.Remove(tmpMeta)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok {
+		entry := el.Value.(*cacheEntry)
+		c.size += meta.Size - entry.size
+		entry.size = meta.Size
+		c.lru.MoveToFront(el)
+	} else {
+		el = c.lru.PushFront(&cacheEntry{key: key, size: meta.Size})
+		c.entries[key] = el
+		c.size += meta.Size
+	}
+
+	if _, known := c.lookups[lookup]; lookup != "" && !known {
+		entry := el.Value.(*cacheEntry)
+		entry.lookups = append(entry.lookups, lookup)
+		c.lookups[lookup] = cachedLookup{key: key, path: meta.Path}
+	}
+
+	c.evictLocked()
+	return nil
+}
+
+// remove drops key from the cache.
+func (c *objectCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *objectCache) removeLocked(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	for _, lookup := range entry.lookups {
+		delete(c.lookups, lookup)
+	}
+
+	_ = os.Remove(c.metaPath(entry.key))
+	_ = os.Remove(c.bodyPath(entry.key))
+}
+
+// evictLocked removes least recently used objects until the cache fits.
+func (c *objectCache) evictLocked() {
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+
+		otelzap.L().Debug("evicting object from cache", zap.String("key", el.Value.(*cacheEntry).key))
+		c.removeLocked(el)
+	}
+}
+
+// cacheableHeader returns the response headers worth replaying on a cache hit:
+// everything but hop-by-hop and per-response headers.
+func cacheableHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range []string{
+		"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+		"Content-Length", "Date", "Set-Cookie", "Age",
+	} {
+		out.Del(name)
+	}
+	return out
+}
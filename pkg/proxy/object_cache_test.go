@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachingProxy(t *testing.T, backendURL, s3URL string) *Proxy {
+	t.Helper()
+
+	return NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{
+			Cache: config.ObjectCache{Enabled: true, Dir: t.TempDir(), MaxSize: 1 << 20},
+		},
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy: config.PageProxy{
+				URL:        config.EnvValue(backendURL),
+				SearchPath: []string{".html"},
+			},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+}
+
+// Once an object of an immutable commit has been fetched, later requests must
+// be answered from disk with the original headers, even if the backend is gone.
+func TestObjectCacheServesHitsWithoutBackend(t *testing.T) {
+	initLogger()
+
+	var getHits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath, _ := strings.CutPrefix(r.URL.Path, "/"+mockCommit)
+		if reqPath != "/page.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&getHits, 1)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Hello from backend"))
+	}))
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newCachingProxy(t, backend.URL, s3Backend.URL)
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "Hello from backend", rr.Body.String())
+		assert.Equal(t, "text/html", rr.Header().Get("Content-Type"))
+		assert.Equal(t, `"v1"`, rr.Header().Get("ETag"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&getHits), "second request must be served from the cache")
+
+	backend.Close()
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	assert.Equal(t, http.StatusOK, rr.Code, "cached object must survive a backend outage")
+	assert.Equal(t, "Hello from backend", rr.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code, "cache hits must honour conditional requests")
+}
+
+// Concurrent misses for the same object must result in a single backend GET.
+func TestObjectCacheCoalescesConcurrentMisses(t *testing.T) {
+	initLogger()
+
+	var getHits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath, _ := strings.CutPrefix(r.URL.Path, "/"+mockCommit)
+		if reqPath != "/page.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&getHits, 1)
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Hello from backend"))
+	}))
+	defer backend.Close()
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newCachingProxy(t, backend.URL, s3Backend.URL)
+
+	const n = 5
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	bodies := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+			codes[i] = rr.Code
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		assert.Equal(t, http.StatusOK, codes[i], "request %d", i)
+		assert.Equal(t, "Hello from backend", bodies[i], "request %d", i)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&getHits), "concurrent misses must be coalesced")
+}
+
+// A response to HEAD must never fill the cache: its empty body would be
+// replayed for the object.
+func TestObjectCacheIsNotFilledByHead(t *testing.T) {
+	initLogger()
+
+	proxy := newCachingProxy(t, "http://backend.test", "http://s3.test")
+	target := &resolvedTarget{repository: "repo", sha: mockCommit, objectPath: "/page.html"}
+	key := target.cacheKey()
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		ctx := context.WithValue(context.Background(), ctxResolvedTarget{}, target)
+		ctx = context.WithValue(ctx, ctxCacheFill{}, key)
+
+		body := "Hello from backend"
+		if method == http.MethodHead {
+			body = ""
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"text/html"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: -1,
+			Request:       httptest.NewRequest(method, "http://example.com/page", nil).WithContext(ctx),
+		}
+		require.NoError(t, proxy.ModifyResponse(resp))
+		_, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, method == http.MethodGet, proxy.objectCache.has(key), method)
+	}
+}
+
+// A cached candidate must not shadow a candidate of higher priority that is
+// only on the backend.
+func TestObjectCacheHonoursSearchPathPriority(t *testing.T) {
+	initLogger()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath, _ := strings.CutPrefix(r.URL.Path, "/"+mockCommit)
+		switch reqPath {
+		case "/page":
+			_, _ = w.Write([]byte("page"))
+		case "/page.html":
+			_, _ = w.Write([]byte("page.html"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newCachingProxy(t, backend.URL, s3Backend.URL)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page.html", nil))
+	require.Equal(t, "page.html", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "page", rr.Body.String(), "the exact path takes precedence over the cached search path candidate")
+}
+
+func fillObjectCache(t *testing.T, c *objectCache, key, body string) {
+	t.Helper()
+
+	fillObjectCacheFromLookup(t, c, key, "", body)
+}
+
+func fillObjectCacheFromLookup(t *testing.T, c *objectCache, key, lookup, body string) {
+	t.Helper()
+
+	r := c.fill(key, lookup, cachedObjectMeta{Path: "/" + body, Header: http.Header{"Content-Type": {"text/plain"}}}, io.NopCloser(strings.NewReader(body)), int64(len(body)))
+	_, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+}
+
+func TestObjectCachePersistsAcrossRestarts(t *testing.T) {
+	initLogger()
+	dir := t.TempDir()
+
+	c, err := newObjectCache(dir, 1<<20)
+	require.Nil(t, err)
+	fillObjectCache(t, c, objectCacheKey("repo", "sha", "/a"), "content")
+
+	reopened, err := newObjectCache(dir, 1<<20)
+	require.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	ok := reopened.serve(rr, httptest.NewRequest(http.MethodGet, "/a", nil), objectCacheKey("repo", "sha", "/a"), false)
+	assert.True(t, ok)
+	assert.Equal(t, "content", rr.Body.String())
+	assert.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+}
+
+func TestObjectCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	initLogger()
+
+	c, err := newObjectCache(t.TempDir(), 10)
+	require.Nil(t, err)
+
+	a := objectCacheKey("repo", "sha", "/a")
+	b := objectCacheKey("repo", "sha", "/b")
+	d := objectCacheKey("repo", "sha", "/d")
+
+	fillObjectCache(t, c, a, "aaaa")
+	fillObjectCacheFromLookup(t, c, b, "lookup-b", "bbbb")
+
+	path, ok := c.resolved("lookup-b")
+	assert.True(t, ok)
+	assert.Equal(t, "/bbbb", path)
+
+	// Touch a so that b becomes the least recently used object.
+	assert.True(t, c.serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil), a, false))
+
+	fillObjectCache(t, c, d, "dddd")
+
+	assert.True(t, c.has(a))
+	assert.False(t, c.has(b), "least recently used object must be evicted")
+	assert.True(t, c.has(d))
+
+	_, ok = c.resolved("lookup-b")
+	assert.False(t, ok, "lookups must be forgotten with their object")
+}
+
+// An interrupted download must never end up in the cache.
+func TestObjectCacheDiscardsIncompleteBodies(t *testing.T) {
+	initLogger()
+
+	c, err := newObjectCache(t.TempDir(), 1<<20)
+	require.Nil(t, err)
+
+	key := objectCacheKey("repo", "sha", "/a")
+	r := c.fill(key, "", cachedObjectMeta{}, io.NopCloser(strings.NewReader("short")), 100)
+	_, _ = io.ReadAll(r)
+	require.NoError(t, r.Close())
+
+	assert.False(t, c.has(key))
+}
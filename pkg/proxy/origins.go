@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// errOriginUnreachable reports that an origin did not answer at all.
+var errOriginUnreachable = errors.New("origin unreachable")
+
+const (
+	defaultOriginFailureThreshold = 3
+	defaultOriginCooldown         = 30 * time.Second
+)
+
+// origin is a backend serving the objects of one or more pages. Origins with
+// the same URL and path are shared between pages, and so is their health.
+type origin struct {
+	url     *url.URL
+	path    string // configured path on the origin, as in pages[].proxy.path
+	breaker *circuitBreaker
+}
+
+func (o *origin) String() string {
+	return strings.TrimSuffix(o.url.String(), "/") + o.root()
+}
+
+// root returns the path of the origin as an absolute, cleaned path.
+func (o *origin) root() string {
+	return path.Clean("/" + o.path)
+}
+
+// objectPath strips the origin path from a path resolved on this origin,
+// leaving the location of the object that is the same on every origin.
+func (o *origin) objectPath(resolved string) string {
+	if root := o.root(); root != "/" && strings.HasPrefix(resolved, root+"/") {
+		return strings.TrimPrefix(resolved, root)
+	}
+	return resolved
+}
+
+// pathFor returns the path of an object (as returned by objectPath) on this
+// origin.
+func (o *origin) pathFor(object string) string {
+	return path.Join(o.root(), object)
+}
+
+// newOrigins parses the origins of every page. Origins that are configured for
+// several pages are created once. Invalid origins are reported and skipped.
+func newOrigins(pages []*config.Page, health config.OriginHealth) map[config.DomainScope][]*origin {
+	if health.FailureThreshold <= 0 {
+		health.FailureThreshold = defaultOriginFailureThreshold
+	}
+	if health.Cooldown <= 0 {
+		health.Cooldown = defaultOriginCooldown
+	}
+
+	shared := make(map[string]*origin)
+	origins := make(map[config.DomainScope][]*origin, len(pages))
+
+	for _, page := range pages {
+		for _, conf := range page.Proxy.AllOrigins() {
+			u, err := url.Parse(conf.URL.String())
+			if err != nil || u.Host == "" {
+				otelzap.L().WithError(err).Error("invalid origin url; skipping origin",
+					zap.String("domain", page.Domain.String()),
+					zap.String("backend_url", conf.URL.String()))
+				continue
+			}
+
+			key := u.String() + "\x00" + conf.Path.String()
+			o, ok := shared[key]
+			if !ok {
+				o = &origin{
+					url:     u,
+					path:    conf.Path.String(),
+					breaker: newCircuitBreaker(health.FailureThreshold, health.Cooldown),
+				}
+				shared[key] = o
+			}
+
+			origins[page.Domain] = append(origins[page.Domain], o)
+		}
+	}
+
+	return origins
+}
+
+// pickOrigins returns the origins of page to try, in order, starting with the
+// first one whose circuit breaker lets requests through. When every breaker is
+// open, all origins are returned: trying a possibly unhealthy origin beats
+// failing the request outright.
+func pickOrigins(origins []*origin) []*origin {
+	for i, o := range origins {
+		if o.breaker.allow() {
+			return origins[i:]
+		}
+	}
+	return origins
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // requests flow normally
+	breakerOpen                         // requests are rejected until the cooldown passed
+	breakerHalfOpen                     // a single trial request decides whether to close again
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks the health of an origin. It opens after threshold
+// consecutive failures, rejecting requests for cooldown. Afterwards a single
+// trial request is let through: success closes the breaker, failure opens it
+// again. Not every request allowed through ends in either, e.g. when its
+// result comes from a cache, so a trial that has not been decided within
+// another cooldown makes way for the next one.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial request is in flight
+	trialAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent to the origin.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial, b.trialAt = true, time.Now()
+		return true
+
+	case breakerHalfOpen:
+		if b.trial && time.Since(b.trialAt) < b.cooldown {
+			return false
+		}
+		b.trial, b.trialAt = true, time.Now()
+		return true
+
+	default:
+		return true
+	}
+}
+
+// success records a request the origin answered.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a request the origin failed. It reports whether the breaker
+// opened as a result.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerOpen || (b.state == breakerClosed && b.failures < b.threshold) {
+		return false
+	}
+
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.trial = false
+	return true
+}
+
+func (b *circuitBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// recordOriginResult feeds the outcome of a request against o into its circuit
+// breaker. Server errors and failed connections count as failures; any other
+// response shows the origin is up.
+func recordOriginResult(ctx context.Context, o *origin, statusCode int, err error) {
+	if err == nil && statusCode < http.StatusInternalServerError {
+		o.breaker.success()
+		return
+	}
+
+	if o.breaker.failure() {
+		otelzap.L().WithError(err).Ctx(ctx).Warn("origin unhealthy; skipping it until cooldown passed",
+			zap.String("origin", o.String()),
+			zap.Int("status_code", statusCode),
+			zap.Duration("cooldown", o.breaker.cooldown))
+	}
+}
+
+// failoverTransport sends proxied requests to the origin chosen by
+// resolveTarget and retries them on the next origins of the page when it
+// fails. Only GET requests reach it, so retrying is safe.
+type failoverTransport struct {
+	base http.RoundTripper
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	target, ok := ctx.Value(ctxResolvedTarget{}).(*resolvedTarget)
+	if !ok || target == nil || target.origin == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	candidates := append([]*origin{target.origin}, target.fallbacks...)
+
+	for i, o := range candidates {
+		last := i == len(candidates)-1
+
+		attempt := req
+		if i > 0 {
+			if !o.breaker.allow() && !last {
+				continue
+			}
+
+			attempt = req.Clone(ctx)
+			attempt.URL.Scheme = o.url.Scheme
+			attempt.URL.Host = o.url.Host
+			attempt.URL.Path = o.pathFor(target.objectPath)
+			attempt.Host = o.url.Host
+			attempt.Header.Set("X-Origin-Host", o.url.Host)
+		}
+
+		resp, err := t.base.RoundTrip(attempt)
+
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		if ctx.Err() == nil {
+			recordOriginResult(ctx, o, statusCode, err)
+		}
+
+		if (err == nil && statusCode < http.StatusInternalServerError) || last || ctx.Err() != nil {
+			span.SetAttributes(
+				attribute.String("proxy.origin", o.String()),
+				attribute.Int("proxy.origin.attempts", i+1),
+			)
+			return resp, err
+		}
+
+		otelzap.L().WithError(err).Ctx(ctx).Warn("origin failed; retrying on next origin",
+			zap.String("origin", o.String()),
+			zap.Int("status_code", statusCode))
+
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	// Unreachable: the last candidate always returns.
+	return t.base.RoundTrip(req)
+}
+
+// checkOrigins actively health checks every origin each interval, so an
+// origin that went down is skipped before requests fail on it, and one that
+// recovered is used again without waiting for a trial request. It blocks
+// until ctx is cancelled and returns immediately if interval is not positive.
+func (p *Proxy) checkOrigins(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.checkOriginHealth(ctx)
+	}
+}
+
+// checkOriginHealth sends a HEAD request to the root of every origin. Any
+// response below 500 counts as healthy: the root of a bucket rarely exists,
+// but an answer shows the origin is serving.
+func (p *Proxy) checkOriginHealth(ctx context.Context) {
+	checked := make(map[*origin]bool)
+	for _, origins := range p.origins {
+		for _, o := range origins {
+			if checked[o] {
+				continue
+			}
+			checked[o] = true
+
+			statusCode, err := p.probePath(ctx, o.url, o.root()+"/")
+
+			before := o.breaker.current()
+			recordOriginResult(ctx, o, statusCode, err)
+			if after := o.breaker.current(); before != after {
+				otelzap.L().Ctx(ctx).Info("origin health changed",
+					zap.String("origin", o.String()),
+					zap.Stringer("from", before),
+					zap.Stringer("to", after))
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultiOriginProxy(t *testing.T, s3URL string, health config.OriginHealth, primary string, origins ...config.Origin) *Proxy {
+	t.Helper()
+
+	return NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{Health: health},
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy: config.PageProxy{
+				URL:     config.EnvValue(primary),
+				Origins: origins,
+			},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+}
+
+// originServer serves body for the page object below prefix and counts GETs.
+func originServer(t *testing.T, prefix, body string, getStatus int) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != prefix+"/"+mockCommit+"/page" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+			w.WriteHeader(getStatus)
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &gets
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, 50*time.Millisecond)
+
+	assert.True(t, b.allow())
+	assert.False(t, b.failure())
+	assert.True(t, b.allow(), "breaker must stay closed below the threshold")
+	assert.True(t, b.failure(), "breaker must open at the threshold")
+	assert.False(t, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+
+	assert.True(t, b.allow(), "a trial request must be let through after the cooldown")
+	assert.False(t, b.allow(), "only a single trial request may be in flight")
+	assert.True(t, b.failure(), "a failed trial must open the breaker again")
+	assert.False(t, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+
+	assert.True(t, b.allow())
+	b.success()
+	assert.Equal(t, breakerClosed, b.current())
+	assert.True(t, b.allow())
+}
+
+// A trial request whose outcome is never recorded must not keep the breaker
+// half-open for good.
+func TestCircuitBreakerUndecidedTrial(t *testing.T) {
+	b := newCircuitBreaker(1, 50*time.Millisecond)
+
+	assert.True(t, b.failure())
+	time.Sleep(60 * time.Millisecond)
+
+	assert.True(t, b.allow(), "a trial request must be let through after the cooldown")
+	assert.False(t, b.allow(), "only a single trial request may be in flight")
+
+	time.Sleep(60 * time.Millisecond)
+
+	assert.True(t, b.allow(), "an undecided trial must make way for another one")
+	assert.Equal(t, breakerHalfOpen, b.current())
+}
+
+// An origin answering the trial request of its half-open breaker with a
+// missing object is up, and must be used again.
+func TestProxyTrialNotFoundClosesBreaker(t *testing.T) {
+	initLogger()
+
+	server, _ := originServer(t, "", "page", http.StatusOK)
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newMultiOriginProxy(t, s3Backend.URL, config.OriginHealth{FailureThreshold: 1, Cooldown: 50 * time.Millisecond}, server.URL)
+	o := proxy.origins[config.FromString("example.com")][0]
+
+	assert.True(t, o.breaker.failure())
+	time.Sleep(60 * time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, breakerClosed, o.breaker.current())
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "page", rr.Body.String())
+}
+
+func TestOriginPaths(t *testing.T) {
+	bucket := &origin{path: "file/bucket"}
+	replica := &origin{path: "/replica/"}
+	root := &origin{}
+
+	object := bucket.objectPath("/file/bucket/repo/sha/index.html")
+	assert.Equal(t, "/repo/sha/index.html", object)
+	assert.Equal(t, "/replica/repo/sha/index.html", replica.pathFor(object))
+	assert.Equal(t, "/repo/sha/index.html", root.pathFor(object))
+	assert.Equal(t, "/repo/sha/index.html", root.objectPath("/repo/sha/index.html"))
+}
+
+// A GET failing on the primary origin must be retried on the next one, using
+// that origin's path.
+func TestProxyRetriesGetOnNextOrigin(t *testing.T) {
+	initLogger()
+
+	primary, primaryGets := originServer(t, "", "primary", http.StatusServiceUnavailable)
+	replica, replicaGets := originServer(t, "/replica", "replica", http.StatusOK)
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newMultiOriginProxy(t, s3Backend.URL, config.OriginHealth{}, primary.URL,
+		config.Origin{URL: config.EnvValue(replica.URL), Path: "replica"})
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "replica", rr.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(primaryGets))
+	assert.Equal(t, int32(1), atomic.LoadInt32(replicaGets))
+}
+
+// An origin that cannot be reached must be skipped while resolving the
+// request, and be avoided altogether once its circuit breaker opened.
+func TestProxyFailsOverUnreachableOrigin(t *testing.T) {
+	initLogger()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	replica, replicaGets := originServer(t, "", "replica", http.StatusOK)
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := newMultiOriginProxy(t, s3Backend.URL, config.OriginHealth{FailureThreshold: 1, Cooldown: time.Minute}, down.URL,
+		config.Origin{URL: config.EnvValue(replica.URL)})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "replica", rr.Body.String())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(replicaGets))
+
+	origins := proxy.origins[config.FromString("example.com")]
+	require.Len(t, origins, 2)
+	assert.Equal(t, breakerOpen, origins[0].breaker.current())
+	assert.Equal(t, breakerClosed, origins[1].breaker.current())
+}
+
+// Active health checks must open the breaker of an origin that is down and
+// close it again once the origin recovered.
+func TestCheckOriginHealth(t *testing.T) {
+	initLogger()
+
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	proxy := newMultiOriginProxy(t, "http://s3.invalid", config.OriginHealth{FailureThreshold: 1, Cooldown: time.Minute}, server.URL)
+	o := proxy.origins[config.FromString("example.com")][0]
+
+	proxy.checkOriginHealth(context.Background())
+	assert.Equal(t, breakerOpen, o.breaker.current())
+
+	healthy.Store(true)
+	proxy.checkOriginHealth(context.Background())
+	assert.Equal(t, breakerClosed, o.breaker.current(), "a 404 on the origin root still means the origin is up")
+	assert.True(t, strings.HasPrefix(o.String(), server.URL))
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+)
+
+// maxBannerDocumentSize bounds the HTML documents a banner is injected into,
+// as they are buffered in memory. Larger documents are served unchanged.
+const maxBannerDocumentSize = 8 << 20
+
+const robotsDisallowAll = "User-agent: *\nDisallow: /\n"
+
+var defaultBannerTemplate = template.Must(template.New("banner").Parse(
+	`<div id="staticpages-preview-banner" style="position:fixed;left:0;right:0;bottom:0;z-index:2147483647;` +
+		`padding:.35em 1em;background:#ffd33d;color:#24292f;font:13px/1.4 system-ui,sans-serif;text-align:center">` +
+		`Preview of {{.Domain}}{{if .Branch}} &middot; branch <b>{{.Branch}}</b>{{end}}` +
+		`{{if .Environment}} &middot; environment <b>{{.Environment}}</b>{{end}}` +
+		` &middot; commit <code>{{.ShortSHA}}</code>{{if not .Date.IsZero}} &middot; deployed {{.Date.Format "2006-01-02 15:04 MST"}}{{end}}` +
+		`</div>`))
+
+// bannerData is what a banner template is rendered with.
+type bannerData struct {
+	Domain      string
+	Branch      string
+	Environment string
+	SHA         string
+	ShortSHA    string
+	Date        time.Time
+}
+
+// isPreview reports whether host is a preview: a subdomain of a page with
+// previews enabled serving anything but its main branch.
+func (p *Proxy) isPreview(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	page := p.pagesMap.Lookup(host)
+	if page == nil || !page.Preview.Enabled {
+		return false
+	}
+
+	sub, err := page.Domain.Subdomain(host)
+	return err == nil && sub != "" && sub != page.Git.MainBranch
+}
+
+// serveRobots serves a robots.txt disallowing everything.
+func serveRobots(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(robotsDisallowAll)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		_, _ = io.WriteString(w, robotsDisallowAll)
+	}
+}
+
+// mayBeHTML reports whether target may be an HTML document, judging by its
+// extension. Only those are requested unencoded and bypass the object cache
+// for the banner; whether the banner is injected is decided on the Content-Type
+// of the response, see injectBanner.
+func mayBeHTML(target *resolvedTarget) bool {
+	contentType := s3_client.ContentTypeByExtension(target.path, target.contentTypes)
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err != nil || mediaType == "text/html"
+}
+
+// newBanners parses the banner template of every page with banners enabled.
+// A page with an invalid template gets the default banner.
+func newBanners(pages []*config.Page) map[config.DomainScope]*template.Template {
+	banners := make(map[config.DomainScope]*template.Template)
+	for _, page := range pages {
+		if !page.Preview.Enabled || !page.Preview.Banner.Enabled {
+			continue
+		}
+
+		banners[page.Domain] = defaultBannerTemplate
+		if page.Preview.Banner.Template == "" {
+			continue
+		}
+
+		tmpl, err := template.New("banner").Parse(page.Preview.Banner.Template)
+		if err != nil {
+			otelzap.L().WithError(err).Error("invalid preview.banner.template; using the default banner",
+				zap.String("domain", page.Domain.String()))
+			continue
+		}
+		banners[page.Domain] = tmpl
+	}
+	return banners
+}
+
+// setProvenanceHeaders describes the deployment served by target in the
+// response headers, so it can be traced back to the workflow run producing
+// it. Unknown values are left out.
+func setProvenanceHeaders(h http.Header, target *resolvedTarget) {
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+
+	set("X-StaticPages-Commit", target.sha)
+
+	d := target.deployment
+	if d == nil {
+		return
+	}
+
+	set("X-StaticPages-Branch", d.Branch)
+	set("X-StaticPages-Environment", d.Environment)
+	if !d.Date.IsZero() {
+		set("X-StaticPages-Deployed", d.Date.UTC().Format(time.RFC3339))
+	}
+	set("X-StaticPages-Actor", d.Provenance.Actor)
+	set("X-StaticPages-Workflow", d.Provenance.Workflow)
+	set("X-StaticPages-Run-Id", d.Provenance.RunID)
+	set("X-StaticPages-Run-Attempt", d.Provenance.RunAttempt)
+	set("X-StaticPages-Event", d.Provenance.EventName)
+	set("X-StaticPages-Pull-Request", d.Provenance.PullRequest)
+	set("X-StaticPages-Ref-Type", d.Provenance.RefType)
+	set("X-StaticPages-Job-Workflow-Ref", d.Provenance.JobWorkflowRef)
+	if d.Provenance.CommitUnverified {
+		set("X-StaticPages-Commit-Verified", "false")
+	}
+}
+
+// renderBanner renders the banner of page for the deployment of target.
+func renderBanner(tmpl *template.Template, page *config.Page, target *resolvedTarget) ([]byte, error) {
+	data := bannerData{Domain: page.Domain.String(), SHA: target.sha, ShortSHA: target.sha}
+	if len(data.ShortSHA) > 7 {
+		data.ShortSHA = data.ShortSHA[:7]
+	}
+	if d := target.deployment; d != nil {
+		data.Branch, data.Environment, data.Date = d.Branch, d.Environment, d.Date
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// injectBanner inserts banner into the HTML document of r before the closing
+// body tag, or at its end. Encoded, partial and oversized documents are left
+// unchanged.
+func injectBanner(r *http.Response, banner []byte) error {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusNotFound {
+		return nil
+	}
+	if r.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(r.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if r.ContentLength > maxBannerDocumentSize {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBannerDocumentSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(body) > maxBannerDocumentSize {
+		// Too large after all: serve what was read followed by the rest.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	_ = r.Body.Close()
+
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		i = len(body)
+	}
+
+	injected := make([]byte, 0, len(body)+len(banner))
+	injected = append(injected, body[:i]...)
+	injected = append(injected, banner...)
+	injected = append(injected, body[i:]...)
+
+	r.Body = io.NopCloser(bytes.NewReader(injected))
+	r.ContentLength = int64(len(injected))
+	r.Header.Set("Content-Length", strconv.Itoa(len(injected)))
+
+	// The banner makes the document differ from the stored object.
+	if etag := r.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		r.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// privateResponseWriter marks responses as private before they are sent,
+// whether they come from the backend or the object cache.
+type privateResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *privateResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Cache-Control", privateCacheControl(w.Header().Get("Cache-Control")))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *privateResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *privateResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// privateCacheControl rewrites a Cache-Control value so only the browser may
+// cache the response, keeping its other directives.
+func privateCacheControl(value string) string {
+	directives := []string{"private"}
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		name, _, _ := strings.Cut(strings.ToLower(directive), "=")
+
+		switch name {
+		case "", "public", "private", "s-maxage":
+			continue
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, ", ")
+}
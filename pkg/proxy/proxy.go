@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
@@ -11,12 +12,17 @@ import (
 	"net/url"
 	"path"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/api"
+	"github.com/SpechtLabs/StaticPages/pkg/auth"
+	"github.com/SpechtLabs/StaticPages/pkg/clientip"
 	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/health"
 	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/SpechtLabs/StaticPages/pkg/tlsserver"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sierrasoftworks/humane-errors-go"
 	"github.com/spechtlabs/go-otel-utils/otelzap"
 	"go.opentelemetry.io/otel"
@@ -25,6 +31,7 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 // Proxy represents a reverse proxy server with logging, page management, and request handling capabilities.
@@ -32,39 +39,67 @@ type Proxy struct {
 	pagesMap config.DomainMapper
 	conf     config.StaticPagesConfig
 	proxy    *httputil.ReverseProxy
-	server   *http.Server
+	server   *tlsserver.Server
+	admin    *http.Server // Serves metrics and health endpoints on server.metricsPort
+	health   *health.Checker
 	tracer   trace.Tracer
 
-	originCache sync.Map      // Cache of hostname -> resolved IP (thread-safe map)
-	dnsResolver *net.Resolver // Custom DNS resolver using external DNS servers
+	resolver *originResolver // Resolves origin hostnames as configured in proxy.dns
+	origins  map[config.DomainScope][]*origin
+	access   map[config.DomainScope]*auth.PreviewAccess // Pages whose previews are not public
+	sites    map[config.DomainScope]*auth.SiteAuth      // Pages requiring a login altogether
+	banners  map[config.DomainScope]*template.Template  // Banners injected into previews
+	limits   *limits                                    // Rate limits and the bound on backend requests
+
+	accessLog *accessLog // nil when access logging is disabled
+	encoder   *encoder   // nil when responses are not compressed
+
+	objectCache *objectCache       // On-disk cache of backend objects; nil when disabled
+	lookups     singleflight.Group // Coalesces identical concurrent path lookups
+
+	stopBackground context.CancelFunc // Stops index polling and origin health checks
 }
 
 // NewProxy initializes and returns a new Proxy instance configured with the provided logger and page definitions.
 func NewProxy(conf config.StaticPagesConfig) *Proxy {
-	// Create custom DNS resolver using external DNS servers (Google DNS and Cloudflare DNS)
-	// This helps bypass local DNS that might return CDN IPs
-	dnsResolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: 5 * time.Second,
-			}
-			// Try Google DNS first (8.8.8.8), fallback to Cloudflare DNS (1.1.1.1)
-			conn, err := d.DialContext(ctx, "udp", "8.8.8.8:53")
-			if err != nil {
-				conn, err = d.DialContext(ctx, "udp", "1.1.1.1:53")
-			}
-			return conn, err
-		},
+	// Resolve origins as configured. By default, external DNS servers are
+	// queried to bypass a local DNS that might return CDN IPs.
+	resolver, err := newOriginResolver(conf.Proxy.DNS)
+	if err != nil {
+		otelzap.L().WithError(err).Error("invalid proxy.dns configuration; using default DNS servers")
 	}
 
+	limits := newLimits(conf)
+
 	p := &Proxy{
-		pagesMap:    config.NewDomainMapperFromPages(conf.Pages),
-		proxy:       nil,
-		conf:        conf,
-		server:      nil,
-		tracer:      otel.Tracer("StaticPages-Proxy"),
-		dnsResolver: dnsResolver,
+		pagesMap: config.NewDomainMapperFromPages(conf.Pages),
+		proxy:    nil,
+		conf:     conf,
+		server:   nil,
+		tracer:   otel.Tracer("StaticPages-Proxy"),
+		resolver: resolver,
+		origins:  newOrigins(conf.Pages, conf.Proxy.Health),
+		access:   newPreviewAccess(conf.Pages, limits.trusted),
+		sites:    newSiteAuth(conf.Pages),
+		banners:  newBanners(conf.Pages),
+		limits:   limits,
+		encoder:  newEncoder(conf.Proxy.Encoding),
+		health:   health.NewChecker(conf),
+	}
+
+	if accessLog, err := newAccessLog(conf.Proxy.AccessLog); err != nil {
+		otelzap.L().WithError(err).Error("unable to set up the access log; serving without it")
+	} else {
+		p.accessLog = accessLog
+	}
+
+	if conf.Proxy.Cache.Enabled {
+		cache, err := newObjectCache(conf.Proxy.Cache.Dir, conf.Proxy.Cache.MaxSize)
+		if err != nil {
+			otelzap.L().WithError(err).Error("unable to open object cache; serving without it")
+		} else {
+			p.objectCache = cache
+		}
 	}
 
 	// Create custom dialer for origin IP support
@@ -78,21 +113,29 @@ func NewProxy(conf config.StaticPagesConfig) *Proxy {
 		ErrorHandler:   p.ErrorHandler,   // Add error handler to log errors
 		ModifyResponse: p.ModifyResponse, // Add response modifier to log response status
 
-		// Allow transport configuration provided by user
-		Transport: &http.Transport{
-			DialContext:         p.createDialContext(dialer),
-			MaxIdleConns:        conf.Proxy.MaxIdleConns,
-			MaxIdleConnsPerHost: conf.Proxy.MaxIdleConnsPerHost,
-			IdleConnTimeout:     conf.Proxy.Timeout,
-			DisableCompression:  !conf.Proxy.Compression,
+		// Allow transport configuration provided by user. Failed requests are
+		// retried on the next origin of the page.
+		Transport: &limitedTransport{
+			slots: p.limits.slots,
+			base: &failoverTransport{
+				base: &http.Transport{
+					DialContext:         p.createDialContext(dialer),
+					MaxIdleConns:        conf.Proxy.MaxIdleConns,
+					MaxIdleConnsPerHost: conf.Proxy.MaxIdleConnsPerHost,
+					IdleConnTimeout:     conf.Proxy.Timeout,
+					DisableCompression:  !conf.Proxy.Compression,
+				},
+			},
 		},
 	}
 
 	return p
 }
 
-// createDialContext creates a custom DialContext function that bypasses local DNS
-// by using external DNS servers (Google DNS, Cloudflare DNS) to avoid CDN loops
+// createDialContext creates a custom DialContext function that resolves origins
+// through the configured resolver instead of the local DNS (which may point
+// back at a CDN in front of the proxy). It tries every resolved address in
+// rotation until one accepts the connection.
 func (p *Proxy) createDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
 		ctx, span := p.tracer.Start(ctx, "proxy.DialContext", trace.WithAttributes(
@@ -108,76 +151,122 @@ func (p *Proxy) createDialContext(dialer *net.Dialer) func(ctx context.Context,
 			return nil, err
 		}
 
-		// Always use external DNS resolution to avoid CloudFlare loops
-		// This resolves the hostname using external DNS servers instead of local DNS
-		originIP, err := p.resolveOriginIP(ctx, host)
+		ips, err := p.resolveOrigin(ctx, host)
 		if err != nil {
+			if !p.resolver.fallbackToSystem() {
+				span.SetStatus(codes.Error, "DNS resolution failed")
+				return nil, err
+			}
+
 			otelzap.L().WithError(err).Ctx(ctx).Warn("failed to resolve origin IP via external DNS, using default DNS",
 				zap.String("host", host))
 			// Fall back to default DNS resolution
-			return dialer.DialContext(ctx, network, addr)
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil && ctx.Err() == nil {
+				_dialErrors.WithLabelValues(host).Inc()
+			}
+			return conn, err
 		}
 
-		// Use the resolved IP
-		resolvedAddr := net.JoinHostPort(originIP, port)
-		span.SetAttributes(
-			attribute.String("origin_ip", originIP),
-			attribute.String("resolved_addr", resolvedAddr),
-		)
-		otelzap.L().Ctx(ctx).Debug("resolved origin IP via external DNS",
-			zap.String("host", host),
-			zap.String("origin_ip", originIP))
+		ips = filterIPs(network, ips)
+		if len(ips) == 0 {
+			span.SetStatus(codes.Error, "No usable IPs found")
+			return nil, fmt.Errorf("no %s address found for %s", network, host)
+		}
+
+		// The dial timeout covers all addresses, so an unresponsive one does
+		// not use up the time of the ones after it.
+		var deadline time.Time
+		if dialer.Timeout > 0 {
+			deadline = time.Now().Add(dialer.Timeout)
+		}
+		if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+			deadline = ctxDeadline
+		}
+
+		var dialErr error
+		for i, ip := range ips {
+			resolvedAddr := net.JoinHostPort(ip.String(), port)
+
+			dialCtx, cancel := ctx, context.CancelFunc(func() {})
+			if !deadline.IsZero() {
+				dialCtx, cancel = context.WithTimeout(ctx, addressDialTimeout(deadline, len(ips)-i))
+			}
+			conn, err := dialer.DialContext(dialCtx, network, resolvedAddr)
+			cancel()
+			if err == nil {
+				span.SetAttributes(
+					attribute.String("origin_ip", ip.String()),
+					attribute.String("resolved_addr", resolvedAddr),
+				)
+				otelzap.L().Ctx(ctx).Debug("dialed origin",
+					zap.String("host", host),
+					zap.String("origin_ip", ip.String()))
+				return conn, nil
+			}
+
+			dialErr = err
+			if ctx.Err() != nil {
+				break
+			}
+
+			_dialErrors.WithLabelValues(host).Inc()
+			otelzap.L().WithError(err).Ctx(ctx).Warn("failed to dial origin address; trying next",
+				zap.String("host", host),
+				zap.String("origin_ip", ip.String()))
+		}
 
-		return dialer.DialContext(ctx, network, resolvedAddr)
+		span.SetStatus(codes.Error, "dial failed")
+		return nil, dialErr
 	}
 }
 
-// resolveOriginIP resolves the origin IP for a hostname using external DNS servers
-// Results are cached to avoid repeated lookups
-func (p *Proxy) resolveOriginIP(ctx context.Context, hostname string) (string, error) {
-	ctx, span := p.tracer.Start(ctx, "proxy.resolveOriginIP", trace.WithAttributes(
+// minDialTimeout is the least time a dial of a single origin address gets.
+const minDialTimeout = 2 * time.Second
+
+// addressDialTimeout splits the time left until deadline evenly among the
+// remaining addresses of an origin, granting each at least minDialTimeout
+// while time is left, like net.Dialer does for the addresses of a hostname.
+func addressDialTimeout(deadline time.Time, remaining int) time.Duration {
+	left := time.Until(deadline)
+	timeout := left / time.Duration(max(remaining, 1))
+	if timeout < minDialTimeout {
+		timeout = min(minDialTimeout, left)
+	}
+	return timeout
+}
+
+// resolveOrigin resolves the addresses of an origin hostname in the order
+// they should be dialed.
+func (p *Proxy) resolveOrigin(ctx context.Context, hostname string) ([]net.IP, error) {
+	ctx, span := p.tracer.Start(ctx, "proxy.resolveOrigin", trace.WithAttributes(
 		attribute.String("hostname", hostname),
+		attribute.String("dns.mode", string(p.resolver.conf.Mode)),
 	))
 	defer span.End()
 
-	// Check cache first (fast path)
-	if cachedIP, ok := p.originCache.Load(hostname); ok {
-		if ip, ok := cachedIP.(string); ok {
-			span.SetAttributes(attribute.String("cached_ip", ip))
-			return ip, nil
-		}
-	}
-
-	// Resolve using external DNS
-	ips, err := p.dnsResolver.LookupIP(ctx, "ip4", hostname)
+	ips, cached, err := p.resolver.resolve(ctx, hostname)
 	if err != nil {
+		_dnsErrors.WithLabelValues(hostname).Inc()
 		span.SetStatus(codes.Error, "DNS resolution failed")
-		return "", fmt.Errorf("failed to resolve %s: %w", hostname, err)
-	}
-
-	if len(ips) == 0 {
-		span.SetStatus(codes.Error, "No IPs found")
-		return "", fmt.Errorf("no IPs found for %s", hostname)
+		return nil, err
 	}
 
-	// Use the first IP
-	resolvedIP := ips[0].String()
-
-	// Cache the result using LoadOrStore to avoid race condition
-	// If another goroutine already cached it, use that value instead
-	if actualIP, loaded := p.originCache.LoadOrStore(hostname, resolvedIP); loaded {
-		if ip, ok := actualIP.(string); ok {
-			span.SetAttributes(attribute.String("cached_ip", ip))
-			return ip, nil
-		}
+	resolved := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		resolved = append(resolved, ip.String())
 	}
 
-	span.SetAttributes(attribute.String("resolved_ip", resolvedIP))
-	otelzap.L().Ctx(ctx).Debug("resolved origin IP",
+	span.SetAttributes(
+		attribute.StringSlice("resolved_ips", resolved),
+		attribute.Bool("cached", cached),
+	)
+	otelzap.L().Ctx(ctx).Debug("resolved origin IPs",
 		zap.String("hostname", hostname),
-		zap.String("ip", resolvedIP))
+		zap.Strings("ips", resolved),
+		zap.Bool("cached", cached))
 
-	return resolvedIP, nil
+	return ips, nil
 }
 
 // ctxResolvedTarget is the context key under which ServeHTTP stashes the
@@ -187,14 +276,65 @@ type ctxResolvedTarget struct{}
 // resolvedTarget is the outcome of mapping an inbound request to a concrete
 // object on the storage backend.
 type resolvedTarget struct {
-	backendURL *url.URL
-	path       string
+	origin     *origin
+	path       string // path of the object on origin
+	objectPath string // path of the object relative to the origin path
+	repository string
+	sha        string
+
+	// lookup identifies the lookup that resolved the requested path to the
+	// object, for the object cache to remember.
+	lookup string
+
+	// contentTypes are the page's media type overrides by file extension.
+	contentTypes map[string]string
+
+	// deployment is the index entry of the commit served, if known, and
+	// preview is true when it was resolved through a preview subdomain.
+	deployment *s3_client.PageIndexData
+	preview    bool
+
+	// banner is the rendered preview banner to inject into HTML documents;
+	// nil when the page has no banner, this is not a preview or the object is
+	// known not to be an HTML document.
+	banner []byte
+
+	// encoding is set when the target is a precompressed variant of the
+	// requested object.
+	encoding contentEncoding
+
+	// fallbacks are the origins to retry the request on, in order, when
+	// origin fails.
+	fallbacks []*origin
+
 	// isNotFound is true when we fell back to the page's configured not-found
 	// document rather than the requested object. The response status is then
 	// rewritten to 404 so the fallback is not mistaken for a valid page.
 	isNotFound bool
 }
 
+// cacheKey returns the key of the target in the object cache.
+func (t *resolvedTarget) cacheKey() string {
+	return objectCacheKey(t.repository, t.sha, t.objectPath)
+}
+
+// lookupCacheKey returns the key under which the object cache remembers what
+// targetPath on origin o resolved to. Like objects, it does not depend on the
+// origin serving them.
+func lookupCacheKey(page *config.Page, o *origin, sha, targetPath string) string {
+	return objectCacheKey(page.Git.Repository, sha, strings.Join(append([]string{o.objectPath(targetPath)}, page.Proxy.SearchPath...), "\x00"))
+}
+
+// cacheKey returns the key under which the object cache remembers the outcome
+// of the lookup of targetPath, or "" when the outcome is not ordered: a
+// candidate of higher priority might still exist, so it must be probed again.
+func (r lookupResult) cacheKey(page *config.Page, o *origin, sha, targetPath string) string {
+	if !r.ordered {
+		return ""
+	}
+	return lookupCacheKey(page, o, sha, targetPath)
+}
+
 // resolveTarget maps an inbound request to a concrete backend object: it finds
 // the page for the host, resolves the commit to serve, and probes for the
 // requested path (falling back to the page's not-found document). It returns a
@@ -228,10 +368,9 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 		return nil, humane.New("no page configured for host", "Make sure a page is configured for this domain.")
 	}
 
-	backendUrl, err := url.Parse(page.Proxy.URL.String())
-	if err != nil {
-		otelzap.L().WithError(err).Ctx(ctx).Error("unable to parse proxy.url", zap.String("backend_url", page.Proxy.URL.String()))
-		return nil, humane.Wrap(err, "unable to parse configured proxy url", "Make sure pages[].proxy.url is a valid URL.")
+	origins := p.origins[page.Domain]
+	if len(origins) == 0 {
+		return nil, humane.New("no valid origin configured for page", "Make sure pages[].proxy.url is a valid URL.")
 	}
 
 	metadata, mErr := s3_client.GetPageMetadata(ctx, page)
@@ -240,7 +379,7 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 	}
 
 	// Find the actual html document we are looking for
-	lookupPath := path.Join(path.Clean(page.Proxy.Path.String()), path.Clean(page.Git.Repository))
+	lookupPath := path.Clean(page.Git.Repository)
 
 	sub, err := page.Domain.Subdomain(requestUrl)
 	if err != nil {
@@ -248,28 +387,31 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 	}
 
 	var resolvedSHA string
+	var deployment *s3_client.PageIndexData
+	preview := false
 	if !page.Preview.Enabled || sub == "" {
 		sub = page.Git.MainBranch
 
-		sha, _, err := metadata.GetLatestForBranch(sub)
+		sha, data, err := metadata.GetLatestForBranch(sub)
 		if err != nil {
 			return nil, humane.Wrap(err, "could not find a commit to serve page for",
 				"Make sure the page has been published for its main branch.")
 		}
 
-		resolvedSHA = sha
+		resolvedSHA, deployment = sha, data
 		lookupPath = path.Join(lookupPath, path.Clean(sha))
 	} else {
-		if sha, _, err := metadata.GetLatestForBranch(sub); err == nil {
-			resolvedSHA = sha
+		if sha, data, err := metadata.GetLatestForBranch(sub); err == nil {
+			resolvedSHA, deployment = sha, data
 			lookupPath = path.Join(lookupPath, path.Clean(sha))
-		} else if _, err := metadata.GetBySHA(sub); err == nil {
-			resolvedSHA = sub
+		} else if data, err := metadata.GetBySHA(sub); err == nil {
+			resolvedSHA, deployment = sub, data
 			lookupPath = path.Join(lookupPath, path.Clean(sub))
 		} else {
 			return nil, humane.New("could not find a commit to serve page for",
 				"Make sure the requested branch or commit has been published.")
 		}
+		preview = sub != page.Git.MainBranch
 	}
 
 	span.SetAttributes(
@@ -284,10 +426,55 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 		zap.String("sha", resolvedSHA),
 		zap.String("base_lookup_path", lookupPath))
 
+	// Resolve the request on the first healthy origin. Only when it cannot be
+	// reached at all is the next one tried; a definitive answer (including a
+	// missing object) is final.
+	candidates := pickOrigins(origins)
+	for i, o := range candidates {
+		last := i == len(candidates)-1
+		if i > 0 && !o.breaker.allow() && !last {
+			continue
+		}
+
+		target, reachable, herr := p.resolveOnOrigin(ctx, page, o, resolvedSHA, requestUrl, lookupPath, originalPath)
+		if herr == nil {
+			target.fallbacks = candidates[i+1:]
+			target.deployment, target.preview = deployment, preview
+			if tmpl := p.banners[page.Domain]; tmpl != nil && preview && mayBeHTML(target) {
+				if banner, err := renderBanner(tmpl, page, target); err != nil {
+					otelzap.L().WithError(err).Ctx(ctx).Warn("unable to render preview banner",
+						zap.String("domain", page.Domain.String()))
+				} else {
+					target.banner = banner
+				}
+			}
+			span.SetAttributes(attribute.String("proxy.origin", o.String()))
+			return target, nil
+		}
+
+		if reachable || last || ctx.Err() != nil {
+			return nil, herr
+		}
+
+		otelzap.L().WithError(herr).Ctx(ctx).Warn("origin unreachable; resolving request on next origin",
+			zap.String("origin", o.String()))
+	}
+
+	return nil, humane.New("no origin available", "Make sure at least one origin of the page is reachable.")
+}
+
+// resolveOnOrigin probes origin o for the requested path below basePath (the
+// repository and commit directory), falling back to the page's not-found
+// document. It reports whether the origin could be reached, so the caller can
+// tell a missing object from an origin that is down.
+func (p *Proxy) resolveOnOrigin(ctx context.Context, page *config.Page, o *origin, resolvedSHA, requestUrl, basePath, originalPath string) (*resolvedTarget, bool, humane.Error) {
+	span := trace.SpanFromContext(ctx)
+	lookupPath := path.Join(path.Clean(o.path), basePath)
+
 	// When Proxy.Path is empty, we need to handle paths starting with / differently
 	// path.Join treats paths starting with / as absolute and ignores previous components
 	var lookupRequestPath string
-	if page.Proxy.Path.String() == "" {
+	if o.path == "" {
 		cleanedPath := path.Clean(originalPath)
 		// Strip leading / if present to make it relative
 		cleanedPath = strings.TrimPrefix(cleanedPath, "/")
@@ -299,10 +486,12 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 	otelzap.L().Ctx(ctx).Debug("constructed lookup path",
 		zap.String("original_path", originalPath),
 		zap.String("lookup_request_path", lookupRequestPath),
-		zap.String("proxy_path", page.Proxy.Path.String()),
+		zap.String("proxy_path", o.path),
 		zap.Strings("search_paths", page.Proxy.SearchPath))
 
-	if targetPath, lErr := p.lookupPath(ctx, page, requestUrl, backendUrl, lookupRequestPath); lErr == nil {
+	result, lErr := p.lookupPath(ctx, page, o, resolvedSHA, requestUrl, lookupRequestPath)
+	if lErr == nil {
+		targetPath := result.path
 		span.SetAttributes(
 			attribute.String("proxy.resolved_path", targetPath),
 			attribute.Bool("proxy.not_found_fallback", false),
@@ -310,7 +499,10 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 		otelzap.L().Ctx(ctx).Debug("successfully resolved path",
 			zap.String("request_path", originalPath),
 			zap.String("target_path", targetPath))
-		return &resolvedTarget{backendURL: backendUrl, path: targetPath}, nil
+		return &resolvedTarget{origin: o, path: targetPath, objectPath: o.objectPath(targetPath), repository: page.Git.Repository, sha: resolvedSHA, lookup: result.cacheKey(page, o, resolvedSHA, lookupRequestPath), contentTypes: page.Bucket.ContentTypes}, true, nil
+	}
+	if !result.reachable {
+		return nil, false, lErr
 	}
 
 	// Requested path not found — fall back to the page's configured 404 document.
@@ -319,7 +511,7 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 		zap.String("lookup_path", lookupRequestPath))
 
 	var lookup404Path string
-	if page.Proxy.Path.String() == "" {
+	if o.path == "" {
 		cleanedNotFound := path.Clean(page.Proxy.NotFound)
 		cleanedNotFound = strings.TrimPrefix(cleanedNotFound, "/")
 		lookup404Path = path.Join(lookupPath, cleanedNotFound)
@@ -331,20 +523,22 @@ func (p *Proxy) resolveTarget(ctx context.Context, req *http.Request) (*resolved
 		zap.String("not_found_page", page.Proxy.NotFound),
 		zap.String("lookup_404_path", lookup404Path))
 
-	targetPath, err404 := p.lookupPath(ctx, page, requestUrl, backendUrl, lookup404Path)
+	result, err404 := p.lookupPath(ctx, page, o, resolvedSHA, requestUrl, lookup404Path)
 	if err404 != nil {
-		return nil, humane.New("no path found and 404 page not available",
+		return nil, result.reachable, humane.New("no path found and 404 page not available",
 			"Configure a valid pages[].proxy.notFound document to serve for missing paths.")
 	}
 
+	targetPath := result.path
 	span.SetAttributes(
 		attribute.String("proxy.resolved_path", targetPath),
 		attribute.Bool("proxy.not_found_fallback", true),
 	)
+	_notFoundFallbacks.WithLabelValues(page.Domain.String()).Inc()
 	otelzap.L().Ctx(ctx).Info("serving 404 page",
 		zap.String("request_path", originalPath),
 		zap.String("404_path", targetPath))
-	return &resolvedTarget{backendURL: backendUrl, path: targetPath, isNotFound: true}, nil
+	return &resolvedTarget{origin: o, path: targetPath, objectPath: o.objectPath(targetPath), repository: page.Git.Repository, sha: resolvedSHA, lookup: result.cacheKey(page, o, resolvedSHA, lookup404Path), contentTypes: page.Bucket.ContentTypes, isNotFound: true}, true, nil
 }
 
 // Director applies the target resolved by resolveTarget to the outgoing
@@ -362,15 +556,15 @@ func (p *Proxy) Director(req *http.Request) {
 	// Save original host for logging and forwarding headers
 	originalHost := req.Host
 
-	req.URL.Scheme = target.backendURL.Scheme
-	req.URL.Host = target.backendURL.Host
+	req.URL.Scheme = target.origin.url.Scheme
+	req.URL.Host = target.origin.url.Host
 	req.URL.Path = target.path
 
 	// Clear the RequestURI as it's required for s3_client requests
 	req.RequestURI = ""
 
 	// Set Host header to backend host for virtual hosting (critical for CDNs)
-	req.Host = target.backendURL.Host
+	req.Host = target.origin.url.Host
 
 	// Set or update headers
 	if _, ok := req.Header["User-Agent"]; !ok {
@@ -378,7 +572,12 @@ func (p *Proxy) Director(req *http.Request) {
 	}
 
 	req.Header.Set("X-Forwarded-Host", originalHost)
-	req.Header.Set("X-Origin-Host", target.backendURL.Host)
+	req.Header.Set("X-Origin-Host", target.origin.url.Host)
+
+	// The banner is injected into the plain document; ask for one.
+	if target.banner != nil {
+		req.Header.Del("Accept-Encoding")
+	}
 
 	// Inject trace context headers for the backend call
 	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
@@ -386,7 +585,7 @@ func (p *Proxy) Director(req *http.Request) {
 	otelzap.L().Ctx(ctx).Debug("proxying request",
 		zap.String("original_host", originalHost),
 		zap.String("proxy_url", req.URL.String()),
-		zap.String("backend_host", target.backendURL.Host),
+		zap.String("backend_host", target.origin.url.Host),
 		zap.String("backend_path", target.path),
 		zap.Bool("not_found_fallback", target.isNotFound))
 }
@@ -402,9 +601,15 @@ func (p *Proxy) ErrorHandler(w http.ResponseWriter, req *http.Request, err error
 
 	responseCode := http.StatusBadGateway
 
-	switch err.Error() {
-	case "context canceled":
+	switch {
+	case err.Error() == "context canceled":
 		responseCode = api.StatusRequestContextCanceled // Nginx non-standard code for when a s3_client closes the connection
+
+	case errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout):
+		span.SetAttributes(attribute.String("proxy.rate_limited", "queue"))
+		_rateLimited.WithLabelValues(p.metricsDomain(req.Host), "queue").Inc()
+		w.Header().Set("Retry-After", "1")
+		responseCode = http.StatusServiceUnavailable
 	}
 
 	otelzap.L().WithError(err).Ctx(ctx).Error("proxy error",
@@ -467,6 +672,26 @@ func (p *Proxy) ModifyResponse(r *http.Response) error {
 			zap.Int64("content_length", r.ContentLength))
 	}
 
+	if target, ok := r.Request.Context().Value(ctxResolvedTarget{}).(*resolvedTarget); ok && target != nil && target.encoding.name != "" {
+		applyEncoding(r, target)
+	}
+
+	// Stream successful responses into the object cache while proxying them.
+	// Encoded bodies are skipped, as the cache replays a body to every client
+	// regardless of the encodings it accepts, unless they are precompressed
+	// variants: those are only ever served to clients accepting them. HEAD
+	// responses have no body to cache.
+	if key, ok := r.Request.Context().Value(ctxCacheFill{}).(string); ok && r.Request.Method != http.MethodHead && r.StatusCode == http.StatusOK && (r.Header.Get("Content-Encoding") == "" || isPrecompressed(r)) {
+		if target, ok := r.Request.Context().Value(ctxResolvedTarget{}).(*resolvedTarget); ok && target != nil {
+			r.Body = p.objectCache.fill(key, target.lookup, cachedObjectMeta{
+				Repository: target.repository,
+				SHA:        target.sha,
+				Path:       target.objectPath,
+				Header:     r.Header,
+			}, r.Body, r.ContentLength)
+		}
+	}
+
 	// When we served the page's configured not-found document, report it
 	// honestly as a 404 instead of passing through the storage backend's 200.
 	// A soft-404 (200 body for a missing page) poisons CDN/browser caches and
@@ -478,11 +703,28 @@ func (p *Proxy) ModifyResponse(r *http.Response) error {
 		r.Status = http.StatusText(http.StatusNotFound)
 	}
 
+	if target, ok := r.Request.Context().Value(ctxResolvedTarget{}).(*resolvedTarget); ok && target != nil && target.banner != nil {
+		if err := injectBanner(r, target.banner); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // ServeHTTP handles incoming HTTP requests and proxies them to the configured backend, allowing only GET requests.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Probes of the liveness and readiness of the proxy are answered on any
+	// host, so they work on the proxy listener without the metrics listener.
+	switch req.URL.Path {
+	case "/healthz":
+		health.LivenessHandler().ServeHTTP(w, req)
+		return
+	case "/readyz":
+		p.health.ReadinessHandler().ServeHTTP(w, req)
+		return
+	}
+
 	ctx, span := p.tracer.Start(req.Context(), "proxy.ServeHTTP", trace.WithAttributes(
 		attribute.String("http.method", req.Method),
 		attribute.String("http.url", req.Host),
@@ -491,14 +733,68 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	))
 	defer span.End()
 
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	entry := &accessEntry{start: start, page: p.metricsDomain(req.Host)}
+	req = req.WithContext(context.WithValue(ctx, ctxAccessEntry{}, entry))
+	defer func() {
+		_requests.WithLabelValues(entry.page, rec.code()).Inc()
+		_requestDuration.WithLabelValues(entry.page).Observe(time.Since(start).Seconds())
+		if p.accessLog != nil {
+			p.accessLog.log(req, rec, entry, clientip.FromRequest(req, p.limits.trusted))
+		}
+	}()
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !p.limits.allow(w, req, p.pagesMap.Lookup(host)) {
+		return
+	}
+
+	req, ok := p.authenticate(w, req)
+	if !ok || !p.authorizePreview(w, req) {
+		return
+	}
+	ctx = req.Context()
+
+	// Responses to logged-in visitors depend on who asked; keep shared caches
+	// in front of the proxy from storing them.
+	if session := auth.SessionFromContext(ctx); session != nil {
+		entry.user = session.Subject
+		w = &privateResponseWriter{ResponseWriter: w}
+	}
+
+	// Keep previews out of search engines, including their error pages.
+	preview := p.isPreview(req.Host)
+	if preview {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+
+	if preview && req.URL.Path == "/robots.txt" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		serveRobots(w, req)
+		return
+	}
+
 	// Only allow GET requests
 	switch req.Method {
 	case http.MethodGet:
+		// Resolving the request probes the backend, so it takes a backend
+		// slot. Serving the response does not; the round trip to the backend
+		// takes one of its own, see limitedTransport.
+		release, ok := p.limits.acquire(w, req, p.metricsDomain(req.Host))
+		if !ok {
+			return
+		}
+
 		// Resolve the request to a concrete backend object before proxying.
 		// If it cannot be resolved (unknown host, unpublished branch/commit,
 		// missing path with no 404 document) serve a clean 404 rather than
 		// letting the reverse proxy fail on a half-built request with a 502.
 		target, herr := p.resolveTarget(ctx, req)
+		release()
 		if herr != nil {
 			otelzap.L().WithError(herr).Ctx(ctx).Warn("unable to resolve request; serving 404",
 				zap.String("http.url", req.Host),
@@ -507,7 +803,28 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if target.preview {
+			setProvenanceHeaders(w.Header(), target)
+		}
+
+		// Negotiate the encoding. Partial and bannered responses are always
+		// served as they are stored.
+		if p.encoder != nil && req.Header.Get("Range") == "" && target.banner == nil {
+			target, w = p.negotiateEncoding(ctx, w, req, target)
+			if c, ok := w.(io.Closer); ok {
+				defer func() { _ = c.Close() }()
+			}
+		}
+
+		entry.target = target
 		req = req.WithContext(context.WithValue(ctx, ctxResolvedTarget{}, target))
+		// Bannered documents are not cached: a commit is served with and
+		// without a banner under the same key.
+		if p.objectCache != nil && req.Header.Get("Range") == "" && target.banner == nil {
+			p.serveThroughCache(w, req, target)
+			return
+		}
+
 		p.proxy.ServeHTTP(w, req)
 
 	default:
@@ -522,6 +839,206 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// newPreviewAccess sets up the access rules of every page with protected
+// previews. A page whose rules are invalid denies all preview requests rather
+// than serving them publicly. trusted are the proxies whose X-Forwarded-For
+// is matched against allowCIDRs.
+func newPreviewAccess(pages []*config.Page, trusted []*net.IPNet) map[config.DomainScope]*auth.PreviewAccess {
+	access := make(map[config.DomainScope]*auth.PreviewAccess)
+	for _, page := range pages {
+		if page.Auth.Enabled() {
+			if page.Preview.Access.Configured() {
+				otelzap.L().Warn("pages[].auth protects the whole page; ignoring preview.access",
+					zap.String("domain", page.Domain.String()))
+			}
+			continue
+		}
+
+		a, err := auth.NewPreviewAccess(page, trusted)
+		if err != nil {
+			otelzap.L().WithError(err).Error("invalid preview access configuration; denying all preview requests",
+				zap.String("domain", page.Domain.String()))
+			a = auth.DenyAll(page.Domain)
+		}
+
+		if a != nil {
+			access[page.Domain] = a
+		}
+	}
+	return access
+}
+
+// newSiteAuth sets up the login of every page configuring pages[].auth. A page
+// whose configuration is invalid denies all requests rather than serving them
+// publicly.
+func newSiteAuth(pages []*config.Page) map[config.DomainScope]*auth.SiteAuth {
+	sites := make(map[config.DomainScope]*auth.SiteAuth)
+	for _, page := range pages {
+		site, err := auth.NewSiteAuth(page)
+		if err != nil {
+			otelzap.L().WithError(err).Error("invalid auth configuration; denying all requests",
+				zap.String("domain", page.Domain.String()))
+			sites[page.Domain] = nil
+			continue
+		}
+
+		if site != nil {
+			sites[page.Domain] = site
+		}
+	}
+	return sites
+}
+
+// authenticate requires a login for pages configuring pages[].auth, and serves
+// their login endpoints. It reports whether req may be served, and returns it
+// with the session of the visitor in its context; otherwise a response has
+// been written.
+func (p *Proxy) authenticate(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	page := p.pagesMap.Lookup(host)
+	if page == nil {
+		return req, true
+	}
+
+	site, protected := p.sites[page.Domain]
+	if !protected {
+		return req, true
+	}
+
+	if site == nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return req, false
+	}
+
+	if strings.HasPrefix(req.URL.Path, auth.PathPrefix) {
+		site.ServeHTTP(w, req)
+		return req, false
+	}
+
+	session, ok := site.Authenticate(w, req)
+	if !ok {
+		return req, false
+	}
+
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(attribute.String("proxy.auth.subject", session.Subject))
+
+	// Whatever a client claims about its identity is never passed on.
+	auth.SetIdentityHeaders(req.Header, nil)
+	if site.IdentityHeaders() {
+		auth.SetIdentityHeaders(req.Header, session)
+	}
+
+	return req.WithContext(auth.WithSession(req.Context(), session)), true
+}
+
+// authorizePreview enforces the preview access rules of the page serving req,
+// and serves their login endpoints. Requests for the production domain are
+// always allowed. It reports whether req may be served; otherwise a response
+// has been written.
+func (p *Proxy) authorizePreview(w http.ResponseWriter, req *http.Request) bool {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	page := p.pagesMap.Lookup(host)
+	if page == nil {
+		return true
+	}
+
+	access := p.access[page.Domain]
+	if access == nil {
+		return true
+	}
+
+	if strings.HasPrefix(req.URL.Path, auth.PathPrefix) {
+		access.ServeHTTP(w, req)
+		return false
+	}
+
+	// Mirrors resolveTarget: only subdomains of a page with previews enabled
+	// are previews.
+	sub, err := page.Domain.Subdomain(host)
+	if err != nil || sub == "" || !page.Preview.Enabled {
+		return true
+	}
+
+	if !access.Allow(w, req) {
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.Bool("proxy.preview.denied", true))
+		return false
+	}
+	return true
+}
+
+// metricsDomain returns the page domain to label metrics of a request to host
+// with.
+func (p *Proxy) metricsDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if page := p.pagesMap.Lookup(host); page != nil {
+		return page.Domain.String()
+	}
+	return unknownDomain
+}
+
+// ctxCacheFill is the context key under which serveThroughCache marks a
+// request whose response ModifyResponse should stream into the object cache.
+type ctxCacheFill struct{}
+
+// setCacheOutcome records how the object cache served the request of ctx.
+func setCacheOutcome(ctx context.Context, outcome string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("proxy.cache.outcome", outcome))
+	if entry := accessEntryFrom(ctx); entry != nil {
+		entry.cache = outcome
+	}
+}
+
+// serveThroughCache serves the request from the object cache, filling it from
+// the backend on a miss. Concurrent misses for the same object are coalesced:
+// one request streams the object from the backend into the cache while the
+// others wait for it and are then served from disk.
+func (p *Proxy) serveThroughCache(w http.ResponseWriter, req *http.Request, target *resolvedTarget) {
+	ctx := req.Context()
+	key := target.cacheKey()
+
+	if p.objectCache.serve(w, req, key, target.isNotFound) {
+		setCacheOutcome(ctx, "hit")
+		return
+	}
+
+	wait, leader := p.objectCache.begin(key)
+	if leader {
+		defer p.objectCache.finish(key)
+
+		setCacheOutcome(ctx, "miss")
+		p.proxy.ServeHTTP(w, req.WithContext(context.WithValue(ctx, ctxCacheFill{}, key)))
+		return
+	}
+
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		return
+	}
+
+	if p.objectCache.serve(w, req, key, target.isNotFound) {
+		setCacheOutcome(ctx, "coalesced")
+		return
+	}
+
+	// The leader could not cache the object (e.g. the backend failed); proxy
+	// this request on its own rather than queueing behind another fill.
+	setCacheOutcome(ctx, "bypass")
+	p.proxy.ServeHTTP(w, req)
+}
+
 // ServeAsync starts the reverse proxy server on the specified address and logs the startup message.
 // It runs the server in a separate goroutine and handles failure to start by logging a fatal error.
 // It Panics when the Proxy Server could not start
@@ -538,22 +1055,52 @@ func (p *Proxy) ServeAsync(addr string) {
 func (p *Proxy) Serve(addr string) humane.Error {
 	otelzap.L().Info("starting reverse proxy", zap.String("addr", addr))
 
-	p.server = &http.Server{
-		Addr:    addr,
-		Handler: p,
+	server, herr := tlsserver.New(p.conf, addr, p.conf.ProxyTLSBindAddr(), p)
+	if herr != nil {
+		return herr
+	}
+	p.server = server
+
+	// Pick up uploads handled by other replicas without waiting for the index
+	// cache to expire, and keep track of which origins are healthy.
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	p.stopBackground = stopBackground
+	go s3_client.WatchPageIndexes(backgroundCtx, p.conf.Pages, p.conf.IndexCache.PollInterval)
+	go p.checkOrigins(backgroundCtx, p.conf.Proxy.Health.Interval)
+
+	if p.conf.Server.MetricsPort > 0 {
+		p.serveAdmin(p.conf.MetricsBindAddr())
 	}
 
 	if err := p.server.ListenAndServe(); err != nil {
-		if strings.Contains(err.Error(), http.ErrServerClosed.Error()) {
-			otelzap.L().Info("proxy server stopped", zap.String("addr", addr))
-			return nil
-		}
 		return humane.Wrap(err, "Unable to start proxy", "Make sure the proxy is not already running and try again.")
 	}
 
+	otelzap.L().Info("proxy server stopped", zap.String("addr", addr))
 	return nil
 }
 
+// serveAdmin exposes the Prometheus metrics and the health, readiness and
+// version endpoints on a separate listener, as every other path on the proxy
+// listener belongs to the pages being served.
+func (p *Proxy) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	p.health.Register(mux)
+
+	p.admin = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		otelzap.L().Info("serving proxy metrics and health endpoints", zap.String("addr", addr))
+		if err := p.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			otelzap.L().WithError(err).Error("unable to serve proxy admin endpoints", zap.String("addr", addr))
+		}
+	}()
+}
+
 // Shutdown gracefully stops the proxy server if it is running, releasing any resources and handling in-progress requests.
 // It returns a humane.Error if the server fails to stop.
 func (p *Proxy) Shutdown() humane.Error {
@@ -565,10 +1112,24 @@ func (p *Proxy) Shutdown() humane.Error {
 	defer cancel()
 
 	otelzap.L().Info("shutting down proxy")
+	if p.stopBackground != nil {
+		p.stopBackground()
+	}
+
+	if p.admin != nil {
+		if err := p.admin.Shutdown(ctx); err != nil {
+			otelzap.L().WithError(err).Warn("unable to shutdown admin server")
+		}
+	}
+
 	if err := p.server.Shutdown(ctx); err != nil {
 		return humane.Wrap(err, "Unable to shutdown proxy", "Make sure the proxy is running and try again.")
 	}
 
+	if err := p.accessLog.Close(); err != nil {
+		otelzap.L().WithError(err).Warn("unable to close access log")
+	}
+
 	return nil
 }
 
@@ -678,6 +1239,7 @@ func (p *Proxy) probePath(ctx context.Context, url *url.URL, location string) (i
 		// 404. A definitive negative only comes from an actual HTTP response.
 		if isProbeTimeout(err) {
 			span.SetAttributes(attribute.String("proxy.probe.outcome", "inconclusive"))
+			_probes.WithLabelValues("inconclusive").Inc()
 			otelzap.L().Ctx(ctx).Debug("path probe timed out (inconclusive)",
 				zap.String("full_url", fullURLString),
 				zap.Duration("probe_timeout", probeTimeout))
@@ -686,6 +1248,7 @@ func (p *Proxy) probePath(ctx context.Context, url *url.URL, location string) (i
 
 		span.SetAttributes(attribute.String("proxy.probe.outcome", "error"))
 		if !errors.Is(err, context.Canceled) {
+			_probes.WithLabelValues("error").Inc()
 			otelzap.L().WithError(err).Ctx(ctx).Warn("failed to probe path",
 				zap.String("proxy_host", url.String()),
 				zap.String("target_path", location),
@@ -709,6 +1272,7 @@ func (p *Proxy) probePath(ctx context.Context, url *url.URL, location string) (i
 		attribute.Int("http.status_code", resp.StatusCode),
 		attribute.String("proxy.probe.outcome", probeOutcome),
 	)
+	_probes.WithLabelValues(probeOutcome).Inc()
 
 	if resp.StatusCode >= 400 {
 		otelzap.L().Ctx(ctx).Debug("path probe returned unsuccessful status",
@@ -750,16 +1314,95 @@ func buildProbePath(proxyPathEmpty bool, targetPath, lookup string) string {
 	}
 }
 
-func (p *Proxy) lookupPath(ctx context.Context, page *config.Page, sourceHost string, backendURL *url.URL, targetPath string) (string, humane.Error) {
+// lookupResult is the outcome of a probe fan-out shared between lookups.
+type lookupResult struct {
+	path string
+
+	// reachable is false when no probe got an answer from the origin, telling
+	// an origin that is down apart from a missing object.
+	reachable bool
+
+	// ordered is true when every candidate of higher priority than path is
+	// known to be missing, so the object cache may remember the outcome.
+	ordered bool
+}
+
+// lookupPath resolves targetPath on origin o to the first search-path
+// candidate that exists. It also reports whether the origin could be reached.
+func (p *Proxy) lookupPath(ctx context.Context, page *config.Page, o *origin, sha, sourceHost string, targetPath string) (lookupResult, humane.Error) {
 	ctx, span := p.tracer.Start(ctx, "proxy.lookupPath", trace.WithAttributes(
-		attribute.String("proxy_host", backendURL.String()),
+		attribute.String("proxy_host", o.url.String()),
 		attribute.String("target_path", targetPath),
 		attribute.String("source_host", sourceHost),
 	))
 	defer span.End()
 
 	searchPaths := append([]string{""}, page.Proxy.SearchPath...)
-	foundPath := make(chan string, 1)
+
+	// A path resolved before, or requested exactly as it is in the object
+	// cache, exists for sure; skip probing the backend for it altogether. Any
+	// other cached candidate might be shadowed by a candidate of higher
+	// priority that is only on the backend, so it is probed for all the same.
+	if p.objectCache != nil {
+		object, cached := p.objectCache.resolved(lookupCacheKey(page, o, sha, targetPath))
+		if !cached {
+			exact := buildProbePath(o.path == "", targetPath, "")
+			if !strings.HasPrefix(exact, "/") {
+				exact = "/" + exact
+			}
+
+			object = o.objectPath(exact)
+			cached = p.objectCache.has(objectCacheKey(page.Git.Repository, sha, object))
+		}
+
+		if cached {
+			candidate := o.pathFor(object)
+			span.SetAttributes(
+				attribute.String("proxy.lookup.outcome", "cached"),
+				attribute.String("proxy.lookup.resolved_path", candidate),
+			)
+			_lookups.WithLabelValues(page.Domain.String(), "cached").Inc()
+			return lookupResult{path: candidate, reachable: true, ordered: true}, nil
+		}
+	}
+
+	// Identical concurrent lookups share one probe fan-out. The probes must
+	// outlive the request that started them, as others may be waiting on it;
+	// they remain bounded by the lookup deadline.
+	key := strings.Join(append([]string{o.String(), targetPath}, searchPaths...), "\x00")
+	lookup := p.lookups.DoChan(key, func() (interface{}, error) {
+		result, err := p.probeCandidates(context.WithoutCancel(ctx), page, o, targetPath, searchPaths)
+		if err != nil {
+			return result, err
+		}
+		return result, nil
+	})
+
+	select {
+	case res := <-lookup:
+		span.SetAttributes(attribute.Bool("proxy.lookup.shared", res.Shared))
+		result := res.Val.(lookupResult)
+		if res.Err != nil {
+			if herr, ok := res.Err.(humane.Error); ok {
+				return result, herr
+			}
+			return result, humane.Wrap(res.Err, "No valid path found", "Make sure the path exists and is accessible.")
+		}
+		return result, nil
+
+	case <-ctx.Done():
+		return lookupResult{reachable: true}, humane.Wrap(ctx.Err(), "Context cancelled", "Make sure the path exists and is accessible.")
+	}
+}
+
+// probeCandidates probes every search-path candidate of targetPath
+// concurrently and returns the candidate of the highest priority the backend
+// confirms: a confirmed candidate is only returned once every candidate before
+// it came back without a hit. Outcome attributes are recorded on the span in
+// ctx, and the outcome is fed into the circuit breaker of the origin.
+func (p *Proxy) probeCandidates(ctx context.Context, page *config.Page, o *origin, targetPath string, searchPaths []string) (lookupResult, humane.Error) {
+	backendURL := o.url
+	span := trace.SpanFromContext(ctx)
 
 	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 5*time.Second)
 	defer cancelTimeout()
@@ -767,40 +1410,39 @@ func (p *Proxy) lookupPath(ctx context.Context, page *config.Page, sourceHost st
 	probeCtx, cancelProbes := context.WithCancel(timeoutCtx)
 	defer cancelProbes()
 
-	var wg sync.WaitGroup
-	var testedPaths []string
-	var testedPathsMu sync.Mutex
+	testedPaths := make([]string, len(searchPaths))
+	for i, lookup := range searchPaths {
+		testedPaths[i] = buildProbePath(o.path == "", targetPath, lookup)
+	}
+
+	// Every probe reports exactly one outcome, so the buffer keeps probes
+	// that finish after the lookup returned from blocking.
+	outcomes := make(chan probeOutcome, len(searchPaths))
 
-	// inconclusivePrimary holds the exact requested path when its probe could
-	// not be confirmed (origin too slow). It is used as a last resort so a
-	// slow-but-existing object is still proxied rather than 404'd.
-	var inconclusivePrimary string
-	var inconclusiveMu sync.Mutex
+	// reachable is set once any probe got an answer (or at least did not fail
+	// outright), i.e. the origin is up. answered is only set for definitive
+	// answers.
+	var reachable, answered atomic.Bool
 
 	otelzap.L().Ctx(ctx).Debug("starting path lookup",
 		zap.String("target_path", targetPath),
 		zap.Strings("search_paths", searchPaths),
 		zap.String("backend_url", backendURL.String()))
 
-	for _, lookup := range searchPaths {
-		wg.Add(1)
-
-		go func(lookup string) {
-			defer wg.Done()
-
-			testPath := buildProbePath(page.Proxy.Path.String() == "", targetPath, lookup)
-
-			// Track what we're testing
-			testedPathsMu.Lock()
-			testedPaths = append(testedPaths, testPath)
-			testedPathsMu.Unlock()
-
+	for i, testPath := range testedPaths {
+		go func() {
 			statusCode, err := p.probePath(probeCtx, backendURL, testPath)
+			if statusCode == statusProbeInconclusive || (err == nil && statusCode < http.StatusInternalServerError) {
+				reachable.Store(true)
+			}
+			if err == nil && statusCode != statusProbeInconclusive && statusCode < http.StatusInternalServerError {
+				answered.Store(true)
+			}
 
 			// Ensure any path we hand back has a leading / for a valid HTTP URL.
-			pathToReturn := testPath
-			if !strings.HasPrefix(pathToReturn, "/") {
-				pathToReturn = "/" + pathToReturn
+			outcome := probeOutcome{index: i, path: testPath}
+			if !strings.HasPrefix(outcome.path, "/") {
+				outcome.path = "/" + outcome.path
 			}
 
 			switch {
@@ -808,24 +1450,17 @@ func (p *Proxy) lookupPath(ctx context.Context, page *config.Page, sourceHost st
 				// Definitive success: the origin confirmed this path exists.
 				otelzap.L().Ctx(ctx).Debug("found valid path",
 					zap.String("test_path", testPath),
-					zap.String("path_to_return", pathToReturn),
+					zap.String("path_to_return", outcome.path),
 					zap.Int("status_code", statusCode))
+				outcome.found = true
 
-				select {
-				case foundPath <- pathToReturn:
-				case <-probeCtx.Done():
-				}
+			case statusCode == statusProbeInconclusive:
+				// The origin was too slow to confirm or deny the path.
+				outcome.inconclusive = true
 
-			case statusCode == statusProbeInconclusive && lookup == "":
-				// The exact requested object could not be confirmed (origin
-				// too slow). Remember it so it can still be proxied if no
-				// other path resolves, instead of 404'ing a file that may
-				// well exist.
-				inconclusiveMu.Lock()
-				if inconclusivePrimary == "" {
-					inconclusivePrimary = pathToReturn
-				}
-				inconclusiveMu.Unlock()
+			case err == nil && statusCode < http.StatusInternalServerError:
+				// Definitive miss: the origin confirmed this path is absent.
+				outcome.missing = true
 
 			case err != nil:
 				// Definitive probe failure (e.g. connection refused). This
@@ -833,63 +1468,119 @@ func (p *Proxy) lookupPath(ctx context.Context, page *config.Page, sourceHost st
 				otelzap.L().Ctx(ctx).Debug("probe did not resolve",
 					zap.String("test_path", testPath))
 			}
-		}(lookup)
+
+			outcomes <- outcome
+		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(foundPath)
-	}()
+	results := make([]*probeOutcome, len(searchPaths))
+	for pending := len(searchPaths); pending > 0; pending-- {
+		select {
+		case outcome := <-outcomes:
+			results[outcome.index] = &outcome
+
+			best, ordered, ok := bestCandidate(results)
+			if !ok {
+				continue
+			}
 
-	select {
-	case p, ok := <-foundPath:
-		if ok {
 			cancelProbes()
+			o.breaker.success()
 			span.SetAttributes(
 				attribute.String("proxy.lookup.outcome", "found"),
-				attribute.String("proxy.lookup.resolved_path", p),
+				attribute.String("proxy.lookup.resolved_path", best),
+				attribute.Bool("proxy.lookup.ordered", ordered),
 			)
-			return p, nil
-		}
-
-		// All probes finished without a definitive hit. If the exact requested
-		// object probe was merely inconclusive (origin too slow), proxy it
-		// anyway: the downstream GET uses the longer proxy timeout and will
-		// return the real content — or a real error — instead of us inventing
-		// a 404 for a file that may exist.
-		inconclusiveMu.Lock()
-		primary := inconclusivePrimary
-		inconclusiveMu.Unlock()
-		if primary != "" {
+			_lookups.WithLabelValues(page.Domain.String(), "found").Inc()
+			return lookupResult{path: best, reachable: true, ordered: ordered}, nil
+
+		case <-probeCtx.Done():
 			span.SetAttributes(
-				attribute.String("proxy.lookup.outcome", "inconclusive_proxied"),
-				attribute.String("proxy.lookup.resolved_path", primary),
+				attribute.String("proxy.lookup.outcome", "timeout"),
+				attribute.StringSlice("proxy.lookup.tested_paths", testedPaths),
 			)
-			otelzap.L().Ctx(ctx).Info("primary path probe inconclusive; proxying object without confirmation",
+			_lookups.WithLabelValues(page.Domain.String(), "timeout").Inc()
+			otelzap.L().Ctx(ctx).Warn("path lookup timed out",
 				zap.String("target_path", targetPath),
-				zap.String("path_to_return", primary))
-			return primary, nil
+				zap.Strings("tested_paths", testedPaths))
+
+			return lookupResult{reachable: reachable.Load()}, humane.New("Context cancelled", "Make sure the path exists and is accessible.")
 		}
+	}
 
-		span.SetAttributes(
-			attribute.String("proxy.lookup.outcome", "not_found"),
-			attribute.StringSlice("proxy.lookup.tested_paths", testedPaths),
-		)
-		otelzap.L().Ctx(ctx).Warn("no valid path found after testing all options",
+	if !reachable.Load() {
+		recordOriginResult(ctx, o, 0, errOriginUnreachable)
+		span.SetAttributes(attribute.String("proxy.lookup.outcome", "unreachable"))
+		_lookups.WithLabelValues(page.Domain.String(), "unreachable").Inc()
+		otelzap.L().Ctx(ctx).Warn("origin did not answer any probe",
 			zap.String("target_path", targetPath),
-			zap.Strings("tested_paths", testedPaths),
-			zap.String("backend_url", backendURL.String()))
+			zap.String("origin", o.String()))
+
+		return lookupResult{}, humane.Wrap(errOriginUnreachable, "No valid path found", "Make sure the origin is reachable.")
+	}
 
-		return "", humane.New("No valid path found", "Make sure the path exists and is accessible.")
-	case <-probeCtx.Done():
+	// All probes finished without a definitive hit. If the exact requested
+	// object probe was merely inconclusive (origin too slow), proxy it
+	// anyway: the downstream GET uses the longer proxy timeout and will
+	// return the real content — or a real error — instead of us inventing
+	// a 404 for a file that may exist. It is the candidate of the highest
+	// priority, so the outcome is ordered should the object turn out to exist.
+	if primary := results[0]; primary.inconclusive {
 		span.SetAttributes(
-			attribute.String("proxy.lookup.outcome", "timeout"),
-			attribute.StringSlice("proxy.lookup.tested_paths", testedPaths),
+			attribute.String("proxy.lookup.outcome", "inconclusive_proxied"),
+			attribute.String("proxy.lookup.resolved_path", primary.path),
 		)
-		otelzap.L().Ctx(ctx).Warn("path lookup timed out",
+		_lookups.WithLabelValues(page.Domain.String(), "inconclusive_proxied").Inc()
+		otelzap.L().Ctx(ctx).Info("primary path probe inconclusive; proxying object without confirmation",
 			zap.String("target_path", targetPath),
-			zap.Strings("tested_paths", testedPaths))
+			zap.String("path_to_return", primary.path))
+		return lookupResult{path: primary.path, reachable: true, ordered: true}, nil
+	}
 
-		return "", humane.New("Context cancelled", "Make sure the path exists and is accessible.")
+	// The origin answered that the object is missing, which shows it is
+	// up as much as finding it would have.
+	if answered.Load() {
+		o.breaker.success()
+	}
+
+	span.SetAttributes(
+		attribute.String("proxy.lookup.outcome", "not_found"),
+		attribute.StringSlice("proxy.lookup.tested_paths", testedPaths),
+	)
+	_lookups.WithLabelValues(page.Domain.String(), "not_found").Inc()
+	otelzap.L().Ctx(ctx).Warn("no valid path found after testing all options",
+		zap.String("target_path", targetPath),
+		zap.Strings("tested_paths", testedPaths),
+		zap.String("backend_url", backendURL.String()))
+
+	return lookupResult{reachable: true}, humane.New("No valid path found", "Make sure the path exists and is accessible.")
+}
+
+// probeOutcome is the answer of the origin to the probe of one candidate.
+type probeOutcome struct {
+	index int    // priority of the candidate, 0 being the requested path
+	path  string // path of the candidate on the origin
+
+	found        bool // the origin confirmed the candidate exists
+	missing      bool // the origin confirmed the candidate does not exist
+	inconclusive bool // the origin did not answer in time
+}
+
+// bestCandidate returns the path of the confirmed candidate of the highest
+// priority, once no candidate before it can still be confirmed. ordered
+// reports whether every candidate before it was confirmed missing; a candidate
+// before it whose probe failed or timed out might exist after all.
+func bestCandidate(results []*probeOutcome) (path string, ordered, ok bool) {
+	ordered = true
+	for _, result := range results {
+		switch {
+		case result == nil:
+			return "", false, false
+		case result.found:
+			return result.path, ordered, true
+		case !result.missing:
+			ordered = false
+		}
 	}
+	return "", false, false
 }
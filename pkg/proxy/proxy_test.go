@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,10 +17,12 @@ import (
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/spechtlabs/go-otel-utils/otelzap"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -136,6 +139,140 @@ func TestProxyConcurrentSamePathBothResolve(t *testing.T) {
 	}
 }
 
+// Identical concurrent requests must share a single probe fan-out instead of
+// each sending its own HEADs to the backend.
+func TestProxyCoalescesConcurrentProbes(t *testing.T) {
+	initLogger()
+
+	var headHits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath, _ := strings.CutPrefix(r.URL.Path, "/"+mockCommit)
+		if reqPath == "/coalesced.html" {
+			if r.Method == http.MethodHead {
+				atomic.AddInt32(&headHits, 1)
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy: config.PageProxy{
+				URL:        config.EnvValue(backend.URL),
+				SearchPath: []string{".html"},
+			},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3Backend.URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+
+	const n = 5
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/coalesced", nil))
+			codes[i] = rr.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		assert.Equal(t, http.StatusOK, codes[i], "request %d should resolve the page", i)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&headHits), "concurrent lookups must share one probe")
+}
+
+func TestProxyPrefersHigherPriorityCandidate(t *testing.T) {
+	initLogger()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath, _ := strings.CutPrefix(r.URL.Path, "/"+mockCommit)
+		switch reqPath {
+		case "/page":
+			// The requested path answers last, yet takes precedence.
+			if r.Method == http.MethodHead {
+				time.Sleep(100 * time.Millisecond)
+			}
+			_, _ = w.Write([]byte("page"))
+		case "/page.html":
+			_, _ = w.Write([]byte("page.html"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy: config.PageProxy{
+				URL:        config.EnvValue(backend.URL),
+				SearchPath: []string{".html"},
+			},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3Backend.URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+		}},
+	})
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "page", rr.Body.String())
+}
+
+func TestBestCandidate(t *testing.T) {
+	found := func(i int) *probeOutcome { return &probeOutcome{index: i, path: fmt.Sprint(i), found: true} }
+	missing := &probeOutcome{missing: true}
+	inconclusive := &probeOutcome{inconclusive: true}
+	failed := &probeOutcome{}
+
+	tests := []struct {
+		name        string
+		results     []*probeOutcome
+		wantPath    string
+		wantOrdered bool
+		wantOK      bool
+	}{
+		{"requested path found", []*probeOutcome{found(0), nil}, "0", true, true},
+		{"higher priority still pending", []*probeOutcome{nil, found(1)}, "", false, false},
+		{"higher priority missing", []*probeOutcome{missing, found(1)}, "1", true, true},
+		{"higher priority found too", []*probeOutcome{found(0), found(1)}, "0", true, true},
+		{"higher priority inconclusive", []*probeOutcome{inconclusive, found(1)}, "1", false, true},
+		{"higher priority failed", []*probeOutcome{failed, missing, found(2)}, "2", false, true},
+		{"nothing found", []*probeOutcome{missing, inconclusive}, "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, ordered, ok := bestCandidate(tt.results)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantPath, path)
+			assert.Equal(t, tt.wantOrdered, ordered)
+		})
+	}
+}
+
 // Cloudflare injects a `Speculation-Rules: "/cdn-cgi/speculation"` response
 // header. Forwarding it makes the browser fetch /cdn-cgi/speculation from the
 // proxy origin, which 404s (and the rules drive prefetch that races
@@ -593,3 +730,335 @@ func writeAndOpenTempFile(content string) (io.Reader, int64, error) {
 
 	return fileReader, stat.Size(), nil
 }
+
+// Protected previews must be rejected before anything is resolved, while the
+// production domain stays public.
+func TestProxyProtectsPreviews(t *testing.T) {
+	initLogger()
+
+	page := &config.Page{
+		Domain:  config.FromString("example.com"),
+		Preview: config.PreviewConfig{Enabled: true, Branch: true},
+	}
+	page.Preview.Access.BasicAuth = config.BasicAuth{Username: "review", Password: "s3cret"}
+
+	broken := &config.Page{
+		Domain:  config.FromString("broken.org"),
+		Preview: config.PreviewConfig{Enabled: true, Branch: true},
+	}
+	broken.Preview.Access.AllowCIDRs = []string{"not-a-network"}
+
+	proxy := NewProxy(config.StaticPagesConfig{Pages: []*config.Page{page, broken}})
+
+	serve := func(host string, authorize bool) int {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if authorize {
+			req.SetBasicAuth("review", "s3cret")
+		}
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("feature.example.com", false))
+	assert.NotEqual(t, http.StatusUnauthorized, serve("feature.example.com", true))
+	assert.NotEqual(t, http.StatusUnauthorized, serve("example.com", false))
+
+	// An invalid configuration must not make previews public.
+	assert.Equal(t, http.StatusForbidden, serve("feature.broken.org", false))
+	assert.NotEqual(t, http.StatusForbidden, serve("broken.org", false))
+}
+
+// Pages with pages[].auth require a login on every host, and deny everything
+// when misconfigured.
+func TestProxyRequiresLogin(t *testing.T) {
+	initLogger()
+
+	page := &config.Page{Domain: config.FromString("internal.example.com")}
+	page.Auth.OIDC = config.OIDCLogin{Issuer: "http://127.0.0.1:1", ClientID: "client"}
+	page.Auth.SessionSecret = "secret"
+
+	broken := &config.Page{Domain: config.FromString("broken.org")}
+	broken.Auth.OIDC = config.OIDCLogin{Issuer: "http://127.0.0.1:1"}
+
+	proxy := NewProxy(config.StaticPagesConfig{Pages: []*config.Page{page, broken}})
+
+	for _, host := range []string{"internal.example.com", "feature.internal.example.com"} {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://"+host+"/runbook", nil))
+		assert.Equal(t, http.StatusFound, rr.Code, host)
+		assert.Equal(t, "/.staticpages/login?rd=%2Frunbook", rr.Header().Get("Location"), host)
+	}
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://broken.org/", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// Liveness and readiness are answered on the proxy listener for any host,
+// without the metrics listener.
+func TestProxyServesHealthEndpoints(t *testing.T) {
+	initLogger()
+
+	proxy := NewProxy(config.StaticPagesConfig{})
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "a proxy without pages is not ready")
+	assert.Contains(t, rr.Body.String(), "no pages configured")
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/version", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code, "only the metrics listener serves the build information")
+}
+
+func TestPrivateCacheControl(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "private",
+		"public, max-age=3600":             "private, max-age=3600",
+		"max-age=60, s-maxage=600, public": "private, max-age=60",
+		"private, no-cache":                "private, no-cache",
+	}
+
+	for value, expected := range tests {
+		assert.Equal(t, expected, privateCacheControl(value), value)
+	}
+}
+
+// Previews are kept out of search engines; production is not affected.
+func TestProxyNoindexesPreviews(t *testing.T) {
+	initLogger()
+
+	page := &config.Page{
+		Domain:  config.FromString("example.com"),
+		Git:     config.GitConfig{MainBranch: "main"},
+		Preview: config.PreviewConfig{Enabled: true, Branch: true},
+	}
+	proxy := NewProxy(config.StaticPagesConfig{Pages: []*config.Page{page}})
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr
+	}
+
+	rr := serve("http://feature.example.com/robots.txt")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", rr.Body.String())
+	assert.Equal(t, "noindex", rr.Header().Get("X-Robots-Tag"))
+
+	// Crawlers checking for it first get it too.
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "http://feature.example.com/robots.txt", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.Equal(t, strconv.Itoa(len("User-agent: *\nDisallow: /\n")), rr.Header().Get("Content-Length"))
+	assert.Equal(t, "noindex", rr.Header().Get("X-Robots-Tag"))
+
+	rr = serve("http://feature.example.com:8080/missing")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "noindex", rr.Header().Get("X-Robots-Tag"))
+
+	for _, url := range []string{"http://example.com/robots.txt", "http://main.example.com/robots.txt"} {
+		rr = serve(url)
+		assert.Empty(t, rr.Header().Get("X-Robots-Tag"), url)
+		assert.NotEqual(t, "User-agent: *\nDisallow: /\n", rr.Body.String(), url)
+	}
+}
+
+func TestPreviewBanner(t *testing.T) {
+	initLogger()
+
+	page := &config.Page{Domain: config.FromString("example.com")}
+	page.Preview = config.PreviewConfig{Enabled: true, Banner: config.PreviewBanner{Enabled: true}}
+
+	custom := &config.Page{Domain: config.FromString("example.org")}
+	custom.Preview = config.PreviewConfig{Enabled: true, Banner: config.PreviewBanner{
+		Enabled:  true,
+		Template: `<p>{{.Branch}}@{{.ShortSHA}}</p>`,
+	}}
+
+	broken := &config.Page{Domain: config.FromString("example.net")}
+	broken.Preview = config.PreviewConfig{Enabled: true, Banner: config.PreviewBanner{Enabled: true, Template: "{{.Branch"}}
+
+	banners := newBanners([]*config.Page{page, custom, broken, {Domain: config.FromString("plain.com")}})
+	assert.Len(t, banners, 3)
+	assert.Same(t, defaultBannerTemplate, banners[broken.Domain])
+
+	target := &resolvedTarget{
+		sha:        "0123456789abcdef",
+		deployment: s3_client.NewPageCommitMetadata("repo", "0123456789abcdef", "feature/<x>", "", time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)),
+	}
+
+	banner, err := renderBanner(banners[custom.Domain], custom, target)
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>feature/&lt;x&gt;@0123456</p>", string(banner))
+
+	banner, err = renderBanner(banners[page.Domain], page, target)
+	assert.NoError(t, err)
+	assert.Contains(t, string(banner), "example.com")
+	assert.Contains(t, string(banner), "<code>0123456</code>")
+	assert.Contains(t, string(banner), "2026-01-02 03:04 UTC")
+
+	response := func(contentType, encoding, body string) *http.Response {
+		r := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body)), ContentLength: int64(len(body))}
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("ETag", `"abc"`)
+		if encoding != "" {
+			r.Header.Set("Content-Encoding", encoding)
+		}
+		return r
+	}
+	read := func(r *http.Response) string {
+		body, _ := io.ReadAll(r.Body)
+		return string(body)
+	}
+
+	r := response("text/html; charset=utf-8", "", "<html><BODY>x</BODY></html>")
+	assert.NoError(t, injectBanner(r, []byte("<b>!</b>")))
+	assert.Equal(t, "<html><BODY>x<b>!</b></BODY></html>", read(r))
+	assert.Equal(t, "35", r.Header.Get("Content-Length"))
+	assert.Equal(t, `W/"abc"`, r.Header.Get("ETag"))
+
+	r = response("text/html", "", "fragment")
+	assert.NoError(t, injectBanner(r, []byte("<b>!</b>")))
+	assert.Equal(t, "fragment<b>!</b>", read(r))
+
+	for _, r := range []*http.Response{response("text/css", "", "body{}"), response("text/html", "gzip", "<body></body>")} {
+		original := r.Header.Get("ETag")
+		assert.NoError(t, injectBanner(r, []byte("<b>!</b>")))
+		assert.NotContains(t, read(r), "<b>!</b>")
+		assert.Equal(t, original, r.Header.Get("ETag"))
+	}
+}
+
+func TestMayBeHTML(t *testing.T) {
+	tests := []struct {
+		path      string
+		overrides map[string]string
+		expected  bool
+	}{
+		{path: "/c/index.html", expected: true},
+		{path: "/c/page.HTM", expected: true},
+		{path: "/c/LICENSE", expected: true},
+		{path: "/c/style.css"},
+		{path: "/c/app.js"},
+		{path: "/c/logo.png"},
+		{path: "/c/page.php", overrides: map[string]string{".php": "text/html"}, expected: true},
+		{path: "/c/page.html", overrides: map[string]string{".html": "text/plain"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, mayBeHTML(&resolvedTarget{path: test.path, contentTypes: test.overrides}), test.path)
+	}
+}
+
+// Preview banners only concern HTML documents: other objects are served
+// through the object cache as usual.
+func TestProxyInjectsBannerIntoHTMLOnly(t *testing.T) {
+	initLogger()
+
+	var gets sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objects := map[string]struct{ contentType, body string }{
+			"/" + mockCommit + "/index.html": {"text/html; charset=utf-8", "<html><body>hi</body></html>"},
+			"/" + mockCommit + "/style.css":  {"text/css; charset=utf-8", "body{}"},
+		}
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			count, _ := gets.LoadOrStore(r.URL.Path, new(atomic.Int32))
+			count.(*atomic.Int32).Add(1)
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		_, _ = w.Write([]byte(object.body))
+	}))
+	defer backend.Close()
+
+	test := testProxyServer{domain: "example.com"}
+	s3Backend := setupMockS3(&test)
+	defer s3Backend.Close()
+
+	proxy := NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{Cache: config.ObjectCache{Enabled: true, Dir: t.TempDir(), MaxSize: 1 << 20}},
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			Proxy:  config.PageProxy{URL: config.EnvValue(backend.URL)},
+			Bucket: config.BucketConfig{
+				URL: config.EnvValue(s3Backend.URL), Name: "test",
+				ApplicationID: "test", Secret: "test", Region: "test",
+			},
+			Preview: config.PreviewConfig{
+				Enabled:   true,
+				CommitSha: true,
+				Banner:    config.PreviewBanner{Enabled: true, Template: "<b>preview</b>"},
+			},
+		}},
+	})
+
+	gotGets := func(path string) int32 {
+		count, ok := gets.Load("/" + mockCommit + path)
+		if !ok {
+			return 0
+		}
+		return count.(*atomic.Int32).Load()
+	}
+
+	for range 2 {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://"+mockCommit+".example.com/style.css", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "body{}", rr.Body.String())
+
+		rr = httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://"+mockCommit+".example.com/index.html", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "<html><body>hi<b>preview</b></body></html>", rr.Body.String())
+	}
+
+	assert.Equal(t, int32(1), gotGets("/style.css"), "assets of previews are cached")
+	assert.Equal(t, int32(2), gotGets("/index.html"), "bannered documents are not cached")
+}
+
+func TestSetProvenanceHeaders(t *testing.T) {
+	deployment := s3_client.NewPageCommitMetadata("repo", "0123456789abcdef", "feature", "", time.Date(2026, 1, 2, 3, 4, 0, 0, time.FixedZone("CET", 3600)))
+	deployment.Provenance = s3_client.Provenance{
+		Actor:       "octocat",
+		Workflow:    "Deploy",
+		RunID:       "42",
+		RunAttempt:  "2",
+		EventName:   "pull_request",
+		PullRequest: "7",
+	}
+
+	h := http.Header{}
+	setProvenanceHeaders(h, &resolvedTarget{sha: "0123456789abcdef", deployment: deployment})
+	assert.Equal(t, "0123456789abcdef", h.Get("X-StaticPages-Commit"))
+	assert.Equal(t, "feature", h.Get("X-StaticPages-Branch"))
+	assert.Equal(t, "2026-01-02T02:04:00Z", h.Get("X-StaticPages-Deployed"))
+	assert.Equal(t, "octocat", h.Get("X-StaticPages-Actor"))
+	assert.Equal(t, "42", h.Get("X-StaticPages-Run-Id"))
+	assert.Equal(t, "2", h.Get("X-StaticPages-Run-Attempt"))
+	assert.Equal(t, "7", h.Get("X-StaticPages-Pull-Request"))
+	assert.NotContains(t, h, "X-Staticpages-Environment")
+	assert.NotContains(t, h, "X-Staticpages-Job-Workflow-Ref")
+	assert.NotContains(t, h, "X-Staticpages-Commit-Verified")
+
+	deployment.Provenance = s3_client.Provenance{CommitUnverified: true}
+	h = http.Header{}
+	setProvenanceHeaders(h, &resolvedTarget{sha: "0123456789abcdef", deployment: deployment})
+	assert.Equal(t, "false", h.Get("X-StaticPages-Commit-Verified"))
+
+	h = http.Header{}
+	setProvenanceHeaders(h, &resolvedTarget{sha: "abc"})
+	assert.Equal(t, http.Header{"X-Staticpages-Commit": {"abc"}}, h)
+}
@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	defaultDNSMinTTL  = 5 * time.Second
+	defaultDNSMaxTTL  = 5 * time.Minute
+)
+
+var defaultDNSServers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// originResolver resolves the hostnames of origins according to proxy.dns.
+// Answers are cached for their record TTL (clamped to the configured bounds)
+// and handed out in rotating order, so dials spread across and fail over
+// between every address of an origin.
+type originResolver struct {
+	conf config.DNS
+
+	// lookup performs the actual resolution; it is chosen by the DNS mode.
+	lookup func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+
+	mu    sync.Mutex
+	cache map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+	next    int // index of the address to try first on the next dial
+}
+
+// newOriginResolver returns a resolver for conf. An unset configuration uses
+// the default DNS servers; an invalid one falls back to them as well, with the
+// error reported.
+func newOriginResolver(conf config.DNS) (*originResolver, error) {
+	if conf.Mode == "" {
+		conf.Mode = config.DNSModeCustom
+	}
+	if conf.Mode == config.DNSModeCustom && len(conf.Servers) == 0 {
+		conf.Servers = defaultDNSServers
+	}
+
+	var confErr error
+	if err := conf.Validate(); err != nil {
+		confErr = err
+		conf.Mode = config.DNSModeCustom
+		conf.Servers = defaultDNSServers
+	}
+
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultDNSTimeout
+	}
+	if conf.MinTTL <= 0 {
+		conf.MinTTL = defaultDNSMinTTL
+	}
+	if conf.MaxTTL < conf.MinTTL {
+		conf.MaxTTL = max(defaultDNSMaxTTL, conf.MinTTL)
+	}
+
+	hosts := make(map[string][]string, len(conf.Hosts))
+	for host, ips := range conf.Hosts {
+		hosts[strings.ToLower(host)] = ips
+	}
+	conf.Hosts = hosts
+
+	r := &originResolver{
+		conf:  conf,
+		cache: make(map[string]*resolvedHost),
+	}
+
+	switch conf.Mode {
+	case config.DNSModeSystem:
+		r.lookup = r.lookupSystem
+	case config.DNSModeStatic:
+		r.lookup = func(_ context.Context, host string) ([]net.IP, time.Duration, error) {
+			return nil, 0, fmt.Errorf("no static address configured for %s", host)
+		}
+	default:
+		r.lookup = r.lookupCustom
+	}
+
+	return r, confErr
+}
+
+// fallbackToSystem reports whether a failed resolution may fall back to
+// dialing the hostname through the system resolver. Only the custom mode does
+// so: it keeps origins reachable when the public resolvers are not.
+func (r *originResolver) fallbackToSystem() bool {
+	return r.conf.Mode == config.DNSModeCustom
+}
+
+// resolve returns the addresses of host, starting with the one that is next in
+// rotation.
+func (r *originResolver) resolve(ctx context.Context, host string) ([]net.IP, bool, error) {
+	host = strings.ToLower(host)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, false, nil
+	}
+
+	if static, ok := r.conf.Hosts[host]; ok {
+		ips := make([]net.IP, 0, len(static))
+		for _, s := range static {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, false, fmt.Errorf("no valid static address configured for %s", host)
+		}
+		return r.rotate(host, ips, time.Time{}), false, nil
+	}
+
+	r.mu.Lock()
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		ips := rotated(entry)
+		r.mu.Unlock()
+		return ips, true, nil
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, r.conf.Timeout)
+	defer cancel()
+
+	ips, ttl, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(ips) == 0 {
+		return nil, false, fmt.Errorf("no IPs found for %s", host)
+	}
+
+	ttl = min(max(ttl, r.conf.MinTTL), r.conf.MaxTTL)
+	return r.rotate(host, ips, time.Now().Add(ttl)), false, nil
+}
+
+// rotate stores ips for host and returns them in rotation order. Static
+// addresses never expire, as signalled by a zero expiry.
+func (r *originResolver) rotate(host string, ips []net.IP, expires time.Time) []net.IP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[host]
+	if !ok || !sameIPs(entry.ips, ips) {
+		// Start at a random address so replicas do not all pile onto the first.
+		entry = &resolvedHost{ips: ips, next: rand.IntN(len(ips))}
+		r.cache[host] = entry
+	}
+	entry.expires = expires
+
+	return rotated(entry)
+}
+
+// rotated returns the addresses of entry starting at entry.next and advances
+// it. The caller must hold the lock.
+func rotated(entry *resolvedHost) []net.IP {
+	n := len(entry.ips)
+	out := make([]net.IP, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, entry.ips[(entry.next+i)%n])
+	}
+	entry.next = (entry.next + 1) % n
+	return out
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupSystem resolves host through the system resolver. It does not expose
+// record TTLs, so the minimum TTL is used.
+func (r *originResolver) lookupSystem(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, r.conf.MinTTL, nil
+}
+
+// lookupCustom queries the configured DNS servers for the A and AAAA records
+// of host, trying the servers in order until one answers.
+func (r *originResolver) lookupCustom(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var errs []error
+	for _, server := range r.conf.Servers {
+		ips, ttl, err := queryAddresses(ctx, server, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+
+	return nil, 0, fmt.Errorf("failed to resolve %s: %w", host, errors.Join(errs...))
+}
+
+// queryAddresses asks server for the A and AAAA records of host at the same
+// time, so an origin without IPv6 does not pay for two round trips. It returns
+// all addresses with their lowest TTL, and fails if either question does.
+func queryAddresses(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Go(func() {
+			ips, ttl, err := queryDNS(ctx, server, host, qtype)
+			answers[i] = answer{ips: ips, ttl: ttl, err: err}
+		})
+	}
+	wg.Wait()
+
+	var (
+		ips []net.IP
+		ttl time.Duration
+	)
+	for _, answer := range answers {
+		if answer.err != nil {
+			return nil, 0, answer.err
+		}
+
+		if len(answer.ips) > 0 && (len(ips) == 0 || answer.ttl < ttl) {
+			ttl = answer.ttl
+		}
+		ips = append(ips, answer.ips...)
+	}
+	return ips, ttl, nil
+}
+
+// queryDNS sends a single question to server over UDP, retrying over TCP when
+// the answer was truncated. It returns the addresses in the answer together
+// with their lowest TTL.
+func queryDNS(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+
+	if msg.Truncated {
+		if resp, err = exchangeDNS(ctx, "tcp", server, query); err != nil {
+			return nil, 0, err
+		}
+		if err := msg.Unpack(resp); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if msg.ID != id {
+		return nil, 0, errors.New("DNS response does not match query")
+	}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		// The name does not exist: a definite answer without addresses, not a
+		// failure of the server that asks for the next one.
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS query failed: %s", msg.RCode)
+	}
+
+	var (
+		ips []net.IP
+		ttl time.Duration
+	)
+	for _, answer := range msg.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			// CNAMEs leading to the addresses are part of the answer as well.
+			continue
+		}
+
+		recordTTL := time.Duration(answer.Header.TTL) * time.Second
+		if len(ips) == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, ttl, nil
+}
+
+// exchangeDNS sends a packed DNS message to server and reads the response.
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// DNS over TCP prefixes every message with its length.
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func dnsFQDN(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+// filterIPs returns the addresses usable for network ("tcp", "tcp4" or
+// "tcp6").
+func filterIPs(network string, ips []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		switch {
+		case strings.HasSuffix(network, "4") && !isV4:
+		case strings.HasSuffix(network, "6") && isV4:
+		default:
+			out = append(out, ip)
+		}
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startFakeDNS answers every A and AAAA question for host with the given
+// addresses and TTL, and counts the questions it received.
+func startFakeDNS(t *testing.T, host string, v4, v6 string, ttl uint32) (string, *int32) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	var queries int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+
+			q := msg.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: msg.ID, Response: true, RecursionAvailable: true},
+				Questions: msg.Questions,
+			}
+
+			if q.Name.String() != host+"." {
+				resp.RCode = dnsmessage.RCodeNameError
+			} else {
+				header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+				switch q.Type {
+				case dnsmessage.TypeA:
+					a := dnsmessage.AResource{}
+					copy(a.A[:], net.ParseIP(v4).To4())
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &a})
+				case dnsmessage.TypeAAAA:
+					aaaa := dnsmessage.AAAAResource{}
+					copy(aaaa.AAAA[:], net.ParseIP(v6).To16())
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &aaaa})
+				}
+			}
+
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestOriginResolverCustomHonoursTTL(t *testing.T) {
+	server, queries := startFakeDNS(t, "origin.test", "192.0.2.1", "2001:db8::1", 1)
+
+	r, err := newOriginResolver(config.DNS{
+		Mode:    config.DNSModeCustom,
+		Servers: []string{server},
+		MinTTL:  100 * time.Millisecond,
+		MaxTTL:  time.Minute,
+	})
+	require.NoError(t, err)
+
+	ips, cached, err := r.resolve(context.Background(), "origin.test")
+	require.NoError(t, err)
+	assert.False(t, cached)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "2001:db8::1"}, ipStrings(ips), "both IPv4 and IPv6 must be resolved")
+
+	_, cached, err = r.resolve(context.Background(), "origin.test")
+	require.NoError(t, err)
+	assert.True(t, cached, "answer must be cached within its TTL")
+	assert.Equal(t, int32(2), atomic.LoadInt32(queries))
+
+	time.Sleep(1100 * time.Millisecond)
+
+	_, cached, err = r.resolve(context.Background(), "origin.test")
+	require.NoError(t, err)
+	assert.False(t, cached, "answer must be resolved again once its TTL passed")
+	assert.Equal(t, int32(4), atomic.LoadInt32(queries))
+
+	_, _, err = r.resolve(context.Background(), "unknown.test")
+	assert.Error(t, err)
+}
+
+// A name that does not exist is a definite answer: it is not looked up on the
+// next server as if the first one had failed.
+func TestOriginResolverCustomNameError(t *testing.T) {
+	first, firstQueries := startFakeDNS(t, "origin.test", "192.0.2.1", "2001:db8::1", 60)
+	second, secondQueries := startFakeDNS(t, "unknown.test", "192.0.2.2", "2001:db8::2", 60)
+
+	r, err := newOriginResolver(config.DNS{
+		Mode:    config.DNSModeCustom,
+		Servers: []string{first, second},
+	})
+	require.NoError(t, err)
+
+	_, _, err = r.resolve(context.Background(), "unknown.test")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no IPs found")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(firstQueries))
+	assert.Zero(t, atomic.LoadInt32(secondQueries))
+}
+
+func TestOriginResolverInvalidServerFallsBack(t *testing.T) {
+	r, err := newOriginResolver(config.DNS{Mode: config.DNSModeCustom, Servers: []string{"1.1.1.1"}})
+	assert.Error(t, err)
+	assert.Equal(t, defaultDNSServers, r.conf.Servers)
+}
+
+func TestAddressDialTimeout(t *testing.T) {
+	deadline := time.Now().Add(30 * time.Second)
+
+	assert.InDelta(t, 10*time.Second, addressDialTimeout(deadline, 3), float64(time.Second))
+	assert.InDelta(t, 30*time.Second, addressDialTimeout(deadline, 1), float64(time.Second))
+	assert.Equal(t, minDialTimeout, addressDialTimeout(deadline, 100), "every address gets a minimum")
+
+	assert.LessOrEqual(t, addressDialTimeout(time.Now().Add(time.Second), 3), time.Second, "the deadline is never exceeded")
+}
+
+func TestOriginResolverStaticHosts(t *testing.T) {
+	r, err := newOriginResolver(config.DNS{
+		Mode:  config.DNSModeStatic,
+		Hosts: map[string][]string{"Origin.Test": {"192.0.2.1", "192.0.2.2"}},
+	})
+	require.NoError(t, err)
+	assert.False(t, r.fallbackToSystem())
+
+	first, _, err := r.resolve(context.Background(), "origin.test")
+	require.NoError(t, err)
+	second, _, err := r.resolve(context.Background(), "origin.test")
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2"}, ipStrings(first))
+	assert.NotEqual(t, first[0].String(), second[0].String(), "addresses must be rotated between dials")
+
+	_, _, err = r.resolve(context.Background(), "other.test")
+	assert.Error(t, err, "static mode must not resolve unknown hosts")
+}
+
+func TestOriginResolverInvalidModeFallsBack(t *testing.T) {
+	r, err := newOriginResolver(config.DNS{Mode: "bogus"})
+	assert.Error(t, err)
+	assert.Equal(t, config.DNSModeCustom, r.conf.Mode)
+	assert.Equal(t, defaultDNSServers, r.conf.Servers)
+}
+
+// A dial must fail over to the next address when one of them refuses the
+// connection.
+func TestDialFailsOverAcrossAddresses(t *testing.T) {
+	initLogger()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	// Nothing listens on 127.0.0.2, so the first address refuses.
+	p := NewProxy(config.StaticPagesConfig{
+		Proxy: config.Proxy{
+			DNS: config.DNS{
+				Mode:  config.DNSModeStatic,
+				Hosts: map[string][]string{"origin.test": {"127.0.0.2", "127.0.0.1"}},
+			},
+		},
+	})
+
+	origin, err := url.Parse("http://origin.test:" + backendURL.Port())
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		code, err := p.probePath(context.Background(), origin, "/")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+	}
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
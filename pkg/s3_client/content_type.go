@@ -0,0 +1,395 @@
+package s3_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// sniffLength is the number of leading bytes used to sniff the content type
+// of files with an unknown extension.
+const sniffLength = 512
+
+const defaultContentType = "application/octet-stream"
+
+// contentTypes maps file extensions to the media types objects are stored
+// with. It does not depend on the mime.types of the machine uploading, so a
+// deployment is typed the same wherever it is uploaded from.
+var contentTypes = map[string]string{
+	// Documents
+	".html":     "text/html",
+	".htm":      "text/html",
+	".xhtml":    "application/xhtml+xml",
+	".css":      "text/css",
+	".txt":      "text/plain",
+	".text":     "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".tsv":      "text/tab-separated-values",
+	".ics":      "text/calendar",
+	".vtt":      "text/vtt",
+	".xml":      "application/xml",
+	".xsl":      "application/xslt+xml",
+	".xslt":     "application/xslt+xml",
+	".rss":      "application/rss+xml",
+	".atom":     "application/atom+xml",
+	".pdf":      "application/pdf",
+	".rtf":      "application/rtf",
+	".epub":     "application/epub+zip",
+	".doc":      "application/msword",
+	".docx":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":      "application/vnd.ms-excel",
+	".xlsx":     "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":      "application/vnd.ms-powerpoint",
+	".pptx":     "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":      "application/vnd.oasis.opendocument.text",
+	".ods":      "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":      "application/vnd.oasis.opendocument.presentation",
+
+	// Scripts and data
+	".js":          "text/javascript",
+	".mjs":         "text/javascript",
+	".cjs":         "text/javascript",
+	".map":         "application/json",
+	".json":        "application/json",
+	".jsonld":      "application/ld+json",
+	".geojson":     "application/geo+json",
+	".webmanifest": "application/manifest+json",
+	".wasm":        "application/wasm",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+	".toml":        "application/toml",
+	".wgsl":        "text/wgsl",
+
+	// Images
+	".png":  "image/png",
+	".apng": "image/apng",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jfif": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".jxl":  "image/jxl",
+	".svg":  "image/svg+xml",
+	".ico":  "image/vnd.microsoft.icon",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+
+	// Fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+
+	// Audio and video
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".weba": "audio/webm",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".mpeg": "video/mpeg",
+	".ts":   "video/mp2t",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+
+	// Archives and binaries
+	".zip": "application/zip",
+	".gz":  "application/gzip",
+	".tgz": "application/gzip",
+	".tar": "application/x-tar",
+	".bz2": "application/x-bzip2",
+	".xz":  "application/x-xz",
+	".zst": "application/zstd",
+	".7z":  "application/x-7z-compressed",
+	".br":  "application/x-brotli",
+	".bin": "application/octet-stream",
+	".exe": "application/vnd.microsoft.portable-executable",
+	".dmg": "application/x-apple-diskimage",
+	".deb": "application/vnd.debian.binary-package",
+	".rpm": "application/x-rpm",
+	".apk": "application/vnd.android.package-archive",
+	".jar": "application/java-archive",
+
+	// Misc
+	".pem": "application/x-pem-file",
+	".crt": "application/x-x509-ca-cert",
+	".asc": "application/pgp-signature",
+	".sig": "application/pgp-signature",
+	".gpx": "application/gpx+xml",
+	".kml": "application/vnd.google-earth.kml+xml",
+}
+
+// textTypes are the media types outside of text/* that carry text, and are
+// stored with a charset.
+var textTypes = map[string]bool{
+	"application/xhtml+xml":         true,
+	"application/xml":               true,
+	"application/xslt+xml":          true,
+	"application/rss+xml":           true,
+	"application/atom+xml":          true,
+	"application/json":              true,
+	"application/ld+json":           true,
+	"application/geo+json":          true,
+	"application/manifest+json":     true,
+	"application/yaml":              true,
+	"application/toml":              true,
+	"application/dash+xml":          true,
+	"application/gpx+xml":           true,
+	"application/vnd.apple.mpegurl": true,
+	"image/svg+xml":                 true,
+}
+
+// ContentTypeByExtension returns the media type of files with the extension
+// of name, or an empty string when the extension is unknown. overrides maps
+// extensions, with or without their leading dot, to the media types used for
+// them instead; those are used as they are.
+func ContentTypeByExtension(name string, overrides map[string]string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+
+	for key, value := range overrides {
+		if strings.EqualFold("."+strings.TrimPrefix(key, "."), ext) {
+			return value
+		}
+	}
+
+	if contentType, ok := contentTypes[ext]; ok {
+		return withCharset(contentType)
+	}
+	return ""
+}
+
+// sniffContentType returns the media type of content starting with head, as
+// far as it can be told from it.
+func sniffContentType(head []byte) string {
+	if len(head) == 0 {
+		return defaultContentType
+	}
+	return withCharset(http.DetectContentType(head))
+}
+
+// withCharset adds charset=utf-8 to text media types that do not declare a
+// charset yet. Static sites are all but universally UTF-8, and browsers
+// guess differently without it.
+func withCharset(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return contentType
+	}
+	if !strings.HasPrefix(mediaType, "text/") && !textTypes[mediaType] {
+		return contentType
+	}
+
+	params["charset"] = "utf-8"
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// fileContentType returns the Content-Type of the file at filePath, read from
+// r. The content is only sniffed when the extension is unknown, after which r
+// is rewound.
+func (c *S3PageClient) fileContentType(filePath string, r io.ReadSeeker) (string, error) {
+	if contentType := ContentTypeByExtension(filePath, c.page.Bucket.ContentTypes); contentType != "" {
+		return contentType, nil
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return sniffContentType(head[:n]), nil
+}
+
+// maxCopySize is the largest object a single CopyObject can rewrite.
+var maxCopySize int64 = 5 << 30
+
+// ContentTypeChange is the Content-Type of an object corrected by
+// RewriteContentTypes.
+type ContentTypeChange struct {
+	Key  string
+	From string
+	To   string
+
+	// Skipped is why the change was not applied; empty if it was.
+	Skipped string
+}
+
+// RewriteContentTypes corrects the Content-Type of the objects of all
+// deployments of the repository to the one they would be uploaded with now.
+// Objects are copied onto themselves with their other metadata kept. The page
+// index and the manifests are left alone, and objects too large for
+// CopyObject are skipped and reported as such. With dryRun, the changes are
+// only reported.
+func (c *S3PageClient) RewriteContentTypes(ctx context.Context, dryRun bool) ([]ContentTypeChange, humane.Error) {
+	ctx, span := c.tracer.Start(ctx, "s3Client.RewriteContentTypes", trace.WithAttributes(
+		attribute.String("s3.bucket", c.s3BucketName),
+		attribute.String("repository", c.repository),
+		attribute.Bool("dry_run", dryRun),
+	))
+	defer span.End()
+
+	if c.repository == "" {
+		return nil, humane.New("no repository configured for the page",
+			"Set pages[].git.repository; only the deployments of the repository are rewritten.")
+	}
+
+	changes := make([]ContentTypeChange, 0)
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.s3BucketName),
+		Prefix: aws.String(c.repository + "/"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return changes, humane.Wrap(err, "failed to list objects", "Make sure the bucket exists and you have access to it.")
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if c.isMetadataKey(key) {
+				continue
+			}
+
+			change, herr := c.rewriteContentType(ctx, key, dryRun)
+			if herr != nil {
+				span.RecordError(herr)
+				span.SetStatus(codes.Error, herr.Error())
+				return changes, herr
+			}
+			if change != nil {
+				changes = append(changes, *change)
+			}
+		}
+	}
+
+	span.SetAttributes(attribute.Int("changes", len(changes)))
+	span.SetStatus(codes.Ok, "")
+	return changes, nil
+}
+
+// rewriteContentType corrects the Content-Type of the object at key, and
+// returns the change, if any.
+func (c *S3PageClient) rewriteContentType(ctx context.Context, key string, dryRun bool) (*ContentTypeChange, humane.Error) {
+	head, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.s3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, humane.Wrap(err, fmt.Sprintf("failed to look up object %s", key))
+	}
+
+	// Precompressed variants are typed as the object they are a variant of.
+	name, encoded := key, aws.ToString(head.ContentEncoding)
+	for _, v := range []struct{ ext, encoding string }{{".br", "br"}, {".gz", "gzip"}} {
+		if encoded == v.encoding {
+			name = strings.TrimSuffix(name, v.ext)
+		}
+	}
+
+	contentType := ContentTypeByExtension(name, c.page.Bucket.ContentTypes)
+	if contentType == "" {
+		if encoded != "" {
+			// The content of the original cannot be sniffed from its variant.
+			return nil, nil
+		}
+
+		data, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.s3BucketName),
+			Key:    aws.String(key),
+			Range:  aws.String(fmt.Sprintf("bytes=0-%d", sniffLength-1)),
+		})
+		if err != nil {
+			return nil, humane.Wrap(err, fmt.Sprintf("failed to download object %s", key))
+		}
+		defer func() { _ = data.Body.Close() }()
+
+		sniffed, err := io.ReadAll(io.LimitReader(data.Body, sniffLength))
+		if err != nil {
+			return nil, humane.Wrap(err, fmt.Sprintf("failed to read object %s", key))
+		}
+		contentType = sniffContentType(sniffed)
+	}
+
+	current := aws.ToString(head.ContentType)
+	if current == contentType {
+		return nil, nil
+	}
+
+	change := &ContentTypeChange{Key: key, From: current, To: contentType}
+	if aws.ToInt64(head.ContentLength) > maxCopySize {
+		change.Skipped = fmt.Sprintf("larger than %d bytes, which CopyObject cannot rewrite; upload it again instead", maxCopySize)
+		otelzap.L().Ctx(ctx).Warn("object too large to rewrite its content type",
+			zap.String("key", key),
+			zap.Int64("size", aws.ToInt64(head.ContentLength)),
+		)
+		return change, nil
+	}
+
+	if dryRun {
+		return change, nil
+	}
+
+	_, err = c.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:             aws.String(c.s3BucketName),
+		Key:                aws.String(key),
+		CopySource:         aws.String(c.s3BucketName + "/" + (&url.URL{Path: key}).EscapedPath()),
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		ContentType:        aws.String(contentType),
+		ContentEncoding:    head.ContentEncoding,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		Metadata:           head.Metadata,
+	})
+	if err != nil {
+		return nil, humane.Wrap(err, fmt.Sprintf("failed to rewrite the metadata of object %s", key),
+			"Make sure the credentials have write access to the bucket.")
+	}
+
+	otelzap.L().Ctx(ctx).Info("rewrote content type",
+		zap.String("key", key),
+		zap.String("from", current),
+		zap.String("to", contentType),
+	)
+	return change, nil
+}
@@ -0,0 +1,165 @@
+package s3_client_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentTypeByExtension(t *testing.T) {
+	tests := map[string]string{
+		"index.html":               "text/html; charset=utf-8",
+		"app.mjs":                  "text/javascript; charset=utf-8",
+		"app.js.map":               "application/json; charset=utf-8",
+		"site.webmanifest":         "application/manifest+json; charset=utf-8",
+		"image.svg":                "image/svg+xml; charset=utf-8",
+		"module.wasm":              "application/wasm",
+		"font.WOFF2":               "font/woff2",
+		"photo.avif":               "image/avif",
+		"photo.webp":               "image/webp",
+		"clip.mp4":                 "video/mp4",
+		"assets/chunk.3f9a1c2b.js": "text/javascript; charset=utf-8",
+		"LICENSE":                  "",
+		"data.unknown":             "",
+	}
+
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, want, s3_client.ContentTypeByExtension(name, nil))
+		})
+	}
+
+	overrides := map[string]string{"wasm": "application/x-custom", ".data": "text/plain"}
+	assert.Equal(t, "application/x-custom", s3_client.ContentTypeByExtension("module.wasm", overrides))
+	assert.Equal(t, "text/plain", s3_client.ContentTypeByExtension("table.DATA", overrides))
+	assert.Equal(t, "text/html; charset=utf-8", s3_client.ContentTypeByExtension("index.html", overrides))
+}
+
+func TestUploadFolder_ContentTypes(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Bucket.ContentTypes = map[string]string{".dat": "application/x-custom"}
+
+	source := writeFiles(t, map[string]string{
+		"index.html":   "<html></html>",
+		"module.wasm":  "\x00asm\x01\x00\x00\x00",
+		"LICENSE":      "Permission is hereby granted, free of charge",
+		"favicon":      "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+		"empty":        "",
+		"table.dat":    "1,2,3",
+		"unknown.blob": "<!DOCTYPE html><html></html>",
+	})
+	uploadFolder(t, s3_client.NewS3PageClient(page), source)
+
+	for key, want := range map[string]string{
+		"index.html":   "text/html; charset=utf-8",
+		"module.wasm":  "application/wasm",
+		"LICENSE":      "text/plain; charset=utf-8",
+		"favicon":      "image/png",
+		"empty":        "application/octet-stream",
+		"table.dat":    "application/x-custom",
+		"unknown.blob": "text/html; charset=utf-8",
+	} {
+		assert.Equal(t, want, bucket.header("repo/sha/"+key).Get("Content-Type"), key)
+	}
+
+	// Sniffing rewinds the file before it is uploaded.
+	assert.Equal(t, "Permission is hereby granted, free of charge", string(bucket.body(t, "repo/sha/LICENSE")))
+}
+
+func TestRewriteContentTypes(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Upload.Precompress = config.Precompress{Enabled: true}
+
+	// Upload a deployment typed like before the extension table existed.
+	page.Bucket.ContentTypes = map[string]string{".mjs": "text/plain", ".wasm": "application/octet-stream"}
+	source := writeFiles(t, map[string]string{
+		"index.html":  "<html></html>",
+		"app.mjs":     strings.Repeat("export const a = 1;\n", 100),
+		"module.wasm": "\x00asm\x01\x00\x00\x00",
+	})
+	uploadFolder(t, s3_client.NewS3PageClient(page, s3_client.WithRepository("repo")), source)
+	require.NotNil(t, bucket.header("repo/sha/app.mjs.br"))
+
+	page.Bucket.ContentTypes = nil
+	client := s3_client.NewS3PageClient(page, s3_client.WithRepository("repo"))
+
+	changes, err := client.RewriteContentTypes(context.Background(), true)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []s3_client.ContentTypeChange{
+		{Key: "repo/sha/app.mjs", From: "text/plain", To: "text/javascript; charset=utf-8"},
+		{Key: "repo/sha/app.mjs.br", From: "text/plain", To: "text/javascript; charset=utf-8"},
+		{Key: "repo/sha/app.mjs.gz", From: "text/plain", To: "text/javascript; charset=utf-8"},
+		{Key: "repo/sha/module.wasm", From: "application/octet-stream", To: "application/wasm"},
+	}, changes)
+
+	// A dry run changes nothing.
+	object, herr := bucket.backend.HeadObject("test", "repo/sha/module.wasm")
+	require.NoError(t, herr)
+	assert.Equal(t, "application/octet-stream", object.Metadata["Content-Type"])
+
+	changes, err = client.RewriteContentTypes(context.Background(), false)
+	require.Nil(t, err)
+	assert.Len(t, changes, 4)
+
+	object, herr = bucket.backend.HeadObject("test", "repo/sha/app.mjs.br")
+	require.NoError(t, herr)
+	assert.Equal(t, "text/javascript; charset=utf-8", object.Metadata["Content-Type"])
+	assert.Equal(t, "br", object.Metadata["Content-Encoding"])
+
+	// Once corrected, there is nothing left to rewrite.
+	changes, err = client.RewriteContentTypes(context.Background(), false)
+	require.Nil(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestRewriteContentTypes_SkipsMetadataAndLargeObjects(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	client := s3_client.NewS3PageClient(page, s3_client.WithRepository("repo"))
+
+	for key, body := range map[string]string{
+		"repo/index.yaml":          "deployments: []",
+		"repo/manifests/sha.json":  "{}",
+		"repo/sha/module.wasm":     "\x00asm\x01\x00\x00\x00",
+		"repo/sha/small/page.html": "<p>",
+	} {
+		_, err := bucket.backend.PutObject("test", key, map[string]string{"Content-Type": "application/octet-stream"}, strings.NewReader(body), int64(len(body)), nil)
+		require.NoError(t, err)
+	}
+
+	// Objects CopyObject cannot rewrite are reported, not failing the run.
+	s3_client.SetMaxCopySize(t, 4)
+
+	changes, err := client.RewriteContentTypes(context.Background(), false)
+	require.Nil(t, err)
+	require.Len(t, changes, 2)
+	assert.ElementsMatch(t, []string{"repo/sha/module.wasm", "repo/sha/small/page.html"}, []string{changes[0].Key, changes[1].Key})
+	for _, change := range changes {
+		if change.Key == "repo/sha/module.wasm" {
+			assert.Contains(t, change.Skipped, "CopyObject")
+		} else {
+			assert.Empty(t, change.Skipped)
+		}
+	}
+
+	object, herr := bucket.backend.HeadObject("test", "repo/sha/module.wasm")
+	require.NoError(t, herr)
+	assert.Equal(t, "application/octet-stream", object.Metadata["Content-Type"])
+
+	for _, key := range []string{"repo/index.yaml", "repo/manifests/sha.json"} {
+		object, herr := bucket.backend.HeadObject("test", key)
+		require.NoError(t, herr)
+		assert.Equal(t, "application/octet-stream", object.Metadata["Content-Type"], key)
+	}
+}
+
+func TestRewriteContentTypes_RequiresRepository(t *testing.T) {
+	page, _ := newUploadBucket(t)
+
+	_, err := s3_client.NewS3PageClient(page).RewriteContentTypes(context.Background(), true)
+	assert.NotNil(t, err)
+}
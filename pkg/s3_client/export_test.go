@@ -0,0 +1,26 @@
+package s3_client
+
+import (
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+)
+
+// SetMaxCopySize lowers the size of the largest object CopyObject rewrites
+// for the duration of the test.
+func SetMaxCopySize(t *testing.T, size int64) {
+	previous := maxCopySize
+	maxCopySize = size
+	t.Cleanup(func() { maxCopySize = previous })
+}
+
+// MaxAttempts returns the attempts made per request by c, and per request
+// uploading the files of a deployment.
+func (c *S3PageClient) MaxAttempts() (requests, uploads int) {
+	return c.client.Options().Retryer.MaxAttempts(), c.uploadClient().Options().Retryer.MaxAttempts()
+}
+
+// IndexCacheConf returns the index cache configuration in effect.
+func IndexCacheConf() config.IndexCache {
+	return indexCacheConf()
+}
@@ -2,6 +2,7 @@ package s3_client
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
@@ -9,25 +10,62 @@ import (
 	"github.com/sierrasoftworks/humane-errors-go"
 	"github.com/spechtlabs/go-otel-utils/otelzap"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	defaultIndexTTL      = 1 * time.Minute
+	defaultIndexMaxStale = 1 * time.Hour
+
+	// maxIndexRetryInterval caps how often a failing index refresh is retried
+	// while a stale index is being served.
+	maxIndexRetryInterval = 10 * time.Second
+)
+
+// cachedIndex is a page index together with the time it was downloaded.
+type cachedIndex struct {
+	index   PageIndex
+	fetched time.Time
+	etag    string
+
+	// retryAt defers the next background refresh after a failed one, so an
+	// unavailable backend is not hammered by every request.
+	retryAt time.Time
+}
+
 var (
-	_metadataCache *ttlcache.Cache[config.DomainScope, PageIndex]
+	// _metadataCache holds each index until its maximum staleness is reached;
+	// whether it is still fresh is decided on read.
+	_metadataCache *ttlcache.Cache[config.DomainScope, cachedIndex]
+
+	// _metadataFetches coalesces concurrent index downloads per domain, so a
+	// cache expiry under load results in a single GET against the bucket.
+	_metadataFetches singleflight.Group
+
+	// _indexGenerations counts the invalidations of each index. A download
+	// only stores its index if none happened while it was in flight, so an
+	// index read before an upload cannot replace the one after it.
+	_indexGenerationsMu sync.Mutex
+	_indexGenerations   = make(map[config.DomainScope]uint64)
+
+	_indexCacheMu   sync.RWMutex
+	_indexCacheConf = config.IndexCache{TTL: defaultIndexTTL, MaxStale: defaultIndexMaxStale}
 )
 
 func init() {
-	_metadataCache = ttlcache.New[config.DomainScope, PageIndex](
-		ttlcache.WithTTL[config.DomainScope, PageIndex](1 * time.Minute),
-		// TODO: evaluate if touch on hit might cause problems before disabling
-		// ttlcache.WithDisableTouchOnHit[config.DomainScope, PageIndex](),
+	_metadataCache = ttlcache.New[config.DomainScope, cachedIndex](
+		ttlcache.WithTTL[config.DomainScope, cachedIndex](defaultIndexMaxStale),
+		// An entry must expire once it reached its maximum staleness, no
+		// matter how often it is read in the meantime.
+		ttlcache.WithDisableTouchOnHit[config.DomainScope, cachedIndex](),
 	)
 
 	// Set up some debug logging
-	_metadataCache.OnInsertion(func(ctx context.Context, item *ttlcache.Item[config.DomainScope, PageIndex]) {
+	_metadataCache.OnInsertion(func(ctx context.Context, item *ttlcache.Item[config.DomainScope, cachedIndex]) {
 		otelzap.L().Ctx(ctx).Debug("Page metadata inserted", zap.String("domain", item.Key().String()))
 	})
 
-	_metadataCache.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[config.DomainScope, PageIndex]) {
+	_metadataCache.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[config.DomainScope, cachedIndex]) {
 		switch reason {
 		case ttlcache.EvictionReasonExpired:
 			otelzap.L().Ctx(ctx).Debug("Page metadata expired", zap.String("domain", item.Key().String()))
@@ -44,26 +82,203 @@ func init() {
 	go _metadataCache.Start()
 }
 
+// ConfigureIndexCache sets the freshness and maximum staleness of cached page
+// indexes. Unset values fall back to the defaults; a maximum staleness below
+// the TTL is raised to the TTL, as indexes are served at least while fresh.
+func ConfigureIndexCache(conf config.IndexCache) {
+	if conf.TTL <= 0 {
+		conf.TTL = defaultIndexTTL
+	}
+
+	switch {
+	case conf.MaxStale <= 0:
+		conf.MaxStale = max(defaultIndexMaxStale, conf.TTL)
+
+	case conf.MaxStale < conf.TTL:
+		otelzap.L().Warn("Index cache max stale is below its TTL, using the TTL",
+			zap.Duration("max_stale", conf.MaxStale),
+			zap.Duration("ttl", conf.TTL),
+		)
+		conf.MaxStale = conf.TTL
+	}
+
+	_indexCacheMu.Lock()
+	defer _indexCacheMu.Unlock()
+	_indexCacheConf = conf
+}
+
+func indexCacheConf() config.IndexCache {
+	_indexCacheMu.RLock()
+	defer _indexCacheMu.RUnlock()
+	return _indexCacheConf
+}
+
+// GetPageMetadata returns the page index of page.
+//
+// A fresh index is served from memory. An expired one is still served while
+// it is refreshed in the background (stale-while-revalidate), and keeps being
+// served if refreshing fails (stale-if-error), until it exceeds the configured
+// maximum staleness. Only without a usable cached index does the caller wait
+// for the download.
 func GetPageMetadata(ctx context.Context, page *config.Page) (PageIndex, error) {
+	conf := indexCacheConf()
+
 	// Check in memory cache
-	if index := _metadataCache.Get(page.Domain); index != nil {
-		return index.Value(), nil
+	if item := _metadataCache.Get(page.Domain); item != nil && time.Since(item.Value().fetched) < conf.MaxStale {
+		cached := item.Value()
+		age := time.Since(cached.fetched)
+		if age < conf.TTL {
+			_indexLookups.WithLabelValues(page.Domain.String(), "fresh").Inc()
+			return cached.index, nil
+		}
+
+		_indexLookups.WithLabelValues(page.Domain.String(), "stale").Inc()
+		_staleIndexServed.WithLabelValues(page.Domain.String()).Inc()
+		if time.Now().After(cached.retryAt) {
+			otelzap.L().Ctx(ctx).Debug("Page metadata stale; refreshing in background",
+				zap.String("domain", page.Domain.String()),
+				zap.Duration("age", age))
+			refreshPageMetadata(ctx, page)
+		}
+
+		return cached.index, nil
 	}
 
-	// In case of cache miss, we fetch the index from S3
-	s3Client := NewS3PageClient(page)
-	metadata, err := s3Client.DownloadPageIndex(ctx)
-	if err != nil {
-		return nil, humane.Wrap(err, "unable to get page metadata",
-			"Make sure the bucket exists and you have access to it.",
-			"Make sure the page index exists and you have access to it.",
-		)
+	// In case of cache miss, we fetch the index from S3. Concurrent misses
+	// share a single download.
+	_indexLookups.WithLabelValues(page.Domain.String(), "miss").Inc()
+	select {
+	case res := <-refreshPageMetadata(ctx, page):
+		if res.Err != nil {
+			return nil, humane.Wrap(res.Err, "unable to get page metadata",
+				"Make sure the bucket exists and you have access to it.",
+				"Make sure the page index exists and you have access to it.",
+			)
+		}
+
+		otelzap.L().Ctx(ctx).Debug("Page metadata fetched", zap.String("domain", page.Domain.String()), zap.Bool("shared", res.Shared))
+		return res.Val.(PageIndex), nil
+
+	case <-ctx.Done():
+		return nil, humane.Wrap(ctx.Err(), "request cancelled while waiting for page metadata")
 	}
+}
+
+// refreshPageMetadata downloads the index of page into the cache, joining a
+// download that is already in flight. The download must not be cancelled when
+// the request that happened to start it goes away, as others may be waiting
+// for it or it may run in the background.
+func refreshPageMetadata(ctx context.Context, page *config.Page) <-chan singleflight.Result {
+	return _metadataFetches.DoChan(page.Domain.String(), func() (interface{}, error) {
+		ctx := context.WithoutCancel(ctx)
+		conf := indexCacheConf()
+		generation := indexGeneration(page.Domain)
 
-	_metadataCache.Set(page.Domain, metadata, ttlcache.DefaultTTL)
-	return metadata, nil
+		doc, etag, err := NewS3PageClient(page).downloadPageIndex(ctx)
+		if err != nil {
+			_indexRefreshFailures.WithLabelValues(page.Domain.String()).Inc()
+
+			// Keep serving the last known index, but back off before trying again.
+			if item := _metadataCache.Get(page.Domain); item != nil {
+				cached := item.Value()
+				remaining := conf.MaxStale - time.Since(cached.fetched)
+				if remaining > 0 {
+					cached.retryAt = time.Now().Add(min(conf.TTL, maxIndexRetryInterval))
+					setIndex(page.Domain, generation, cached, remaining)
+				}
+
+				otelzap.L().WithError(err).Ctx(ctx).Warn("Unable to refresh page metadata; serving stale index",
+					zap.String("domain", page.Domain.String()),
+					zap.Duration("age", time.Since(cached.fetched)),
+					zap.Duration("max_stale", conf.MaxStale))
+			}
+
+			return nil, err
+		}
+
+		metadata := doc.Index()
+		setIndex(page.Domain, generation, cachedIndex{index: metadata, fetched: time.Now(), etag: etag}, conf.MaxStale)
+		return metadata, nil
+	})
+}
+
+func indexGeneration(domain config.DomainScope) uint64 {
+	_indexGenerationsMu.Lock()
+	defer _indexGenerationsMu.Unlock()
+	return _indexGenerations[domain]
 }
 
+// setIndex caches the index of domain downloaded at generation, unless it
+// was invalidated since.
+func setIndex(domain config.DomainScope, generation uint64, index cachedIndex, ttl time.Duration) {
+	_indexGenerationsMu.Lock()
+	defer _indexGenerationsMu.Unlock()
+
+	if _indexGenerations[domain] != generation {
+		return
+	}
+	_metadataCache.Set(domain, index, ttl)
+}
+
+// InvalidatePageMetadata drops the cached index of page. Downloads in flight
+// are forgotten as well: they may have read the index before it changed, so
+// later lookups start a new one, and their result is not cached.
 func InvalidatePageMetadata(page *config.Page) {
+	_indexGenerationsMu.Lock()
+	defer _indexGenerationsMu.Unlock()
+
+	_indexGenerations[page.Domain]++
 	_metadataCache.Delete(page.Domain)
+	_metadataFetches.Forget(page.Domain.String())
+}
+
+// WatchPageIndexes polls the ETag of every cached page index each interval and
+// refreshes the ones that changed in the bucket. This propagates uploads
+// handled by another replica (or a separate API deployment) within one
+// interval instead of one TTL. It blocks until ctx is cancelled and returns
+// immediately if interval is not positive.
+func WatchPageIndexes(ctx context.Context, pages []*config.Page, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, page := range pages {
+			checkPageIndex(ctx, page)
+		}
+	}
+}
+
+// checkPageIndex refreshes the cached index of page if it changed in the
+// bucket. Indexes that are not cached are left alone; they are loaded on their
+// next use anyway.
+func checkPageIndex(ctx context.Context, page *config.Page) {
+	item := _metadataCache.Get(page.Domain)
+	if item == nil {
+		return
+	}
+
+	etag, err := NewS3PageClient(page).PageIndexETag(ctx)
+	if err != nil {
+		otelzap.L().WithError(err).Ctx(ctx).Debug("Unable to check page metadata for changes", zap.String("domain", page.Domain.String()))
+		return
+	}
+
+	if etag == item.Value().etag {
+		return
+	}
+
+	otelzap.L().Ctx(ctx).Info("Page metadata changed in bucket; refreshing",
+		zap.String("domain", page.Domain.String()),
+		zap.String("etag", etag))
+	<-refreshPageMetadata(ctx, page)
 }
@@ -0,0 +1,319 @@
+package s3_client_test
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIndex = `abc123:
+    environment: prod
+    branch: main
+    date: 2025-05-04T18:13:45.715404+02:00
+`
+
+type indexBucket struct {
+	backend *s3mem.Backend
+	gets    int32
+	failing atomic.Bool
+}
+
+func (b *indexBucket) putIndex(t *testing.T, index string) {
+	t.Helper()
+
+	// Metadata must not be nil, as it is merged with that of an existing
+	// object.
+	_, err := b.backend.PutObject("test", "index.yaml", map[string]string{}, strings.NewReader(index), int64(len(index)), nil)
+	require.NoError(t, err)
+}
+
+// newIndexBucket serves a bucket holding testIndex and counts the GETs of the
+// index. Every GET is delayed to widen the window for concurrent misses.
+func newIndexBucket(t *testing.T, delay time.Duration) (*config.Page, *indexBucket) {
+	t.Helper()
+
+	bucket := &indexBucket{backend: s3mem.New()}
+	require.NoError(t, bucket.backend.CreateBucket("test"))
+	bucket.putIndex(t, testIndex)
+
+	faker := gofakes3.New(bucket.backend, gofakes3.WithHostBucket(false)).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/index.yaml") {
+			faker.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt32(&bucket.gets, 1)
+		if bucket.failing.Load() {
+			time.Sleep(delay)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// The index is read before the delay, as a slow response would.
+		rr := httptest.NewRecorder()
+		faker.ServeHTTP(rr, r)
+		time.Sleep(delay)
+
+		maps.Copy(w.Header(), rr.Header())
+		w.WriteHeader(rr.Code)
+		_, _ = w.Write(rr.Body.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	page := &config.Page{
+		Domain: config.FromString(strings.ToLower(t.Name()) + ".example.com"),
+		Bucket: config.BucketConfig{
+			URL: config.EnvValue(server.URL), Name: "test",
+			ApplicationID: "test", Secret: "test", Region: "test",
+		},
+	}
+	s3_client.InvalidatePageMetadata(page)
+
+	return page, bucket
+}
+
+// configureIndexCache applies conf for the duration of the test.
+func configureIndexCache(t *testing.T, conf config.IndexCache) {
+	t.Helper()
+
+	s3_client.ConfigureIndexCache(conf)
+	t.Cleanup(func() { s3_client.ConfigureIndexCache(config.IndexCache{}) })
+}
+
+func TestConfigureIndexCache(t *testing.T) {
+	tests := map[string]struct {
+		conf     config.IndexCache
+		expected config.IndexCache
+	}{
+		"defaults":              {config.IndexCache{}, config.IndexCache{TTL: time.Minute, MaxStale: time.Hour}},
+		"long TTL":              {config.IndexCache{TTL: 2 * time.Hour}, config.IndexCache{TTL: 2 * time.Hour, MaxStale: 2 * time.Hour}},
+		"configured":            {config.IndexCache{TTL: time.Second, MaxStale: time.Minute}, config.IndexCache{TTL: time.Second, MaxStale: time.Minute}},
+		"max stale below TTL":   {config.IndexCache{TTL: 10 * time.Minute, MaxStale: time.Minute}, config.IndexCache{TTL: 10 * time.Minute, MaxStale: 10 * time.Minute}},
+		"max stale without TTL": {config.IndexCache{MaxStale: 30 * time.Second}, config.IndexCache{TTL: time.Minute, MaxStale: time.Minute}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			configureIndexCache(t, test.conf)
+			assert.Equal(t, test.expected, s3_client.IndexCacheConf())
+		})
+	}
+}
+
+func TestGetPageMetadata_CoalescesConcurrentMisses(t *testing.T) {
+	page, bucket := newIndexBucket(t, 200*time.Millisecond)
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			index, err := s3_client.GetPageMetadata(context.Background(), page)
+			if err == nil {
+				_, err = index.GetBySHA("abc123")
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		assert.NoError(t, errs[i], "request %d", i)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bucket.gets), "concurrent misses must share one index download")
+}
+
+// An invalidation must win over a download that started before it: neither
+// the lookups after it nor the cache may get the index that download read.
+func TestInvalidatePageMetadata_DropsDownloadInFlight(t *testing.T) {
+	page, bucket := newIndexBucket(t, 200*time.Millisecond)
+
+	stale := make(chan error, 1)
+	go func() {
+		_, err := s3_client.GetPageMetadata(context.Background(), page)
+		stale <- err
+	}()
+
+	// Upload a new deployment while the first download is in flight.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&bucket.gets) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	bucket.putIndex(t, "def456:\n    branch: main\n    date: 2025-05-05T18:13:45+02:00\n")
+	s3_client.InvalidatePageMetadata(page)
+
+	index, err := s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+	_, err = index.GetBySHA("def456")
+	assert.NoError(t, err, "a lookup after the invalidation must not join the stale download")
+
+	require.NoError(t, <-stale)
+	index, err = s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+	_, err = index.GetBySHA("def456")
+	assert.NoError(t, err, "the stale download must not be cached")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&bucket.gets))
+}
+
+// A waiter that gives up must not cancel the download others are waiting on.
+func TestGetPageMetadata_CancelledWaiterDoesNotAbortFetch(t *testing.T) {
+	page, bucket := newIndexBucket(t, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var cancelledErr, err error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, cancelledErr = s3_client.GetPageMetadata(ctx, page)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err = s3_client.GetPageMetadata(context.Background(), page)
+	}()
+	wg.Wait()
+
+	assert.Error(t, cancelledErr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bucket.gets))
+}
+
+// An expired index is served immediately while a fresh one is downloaded in
+// the background.
+func TestGetPageMetadata_StaleWhileRevalidate(t *testing.T) {
+	configureIndexCache(t, config.IndexCache{TTL: 100 * time.Millisecond, MaxStale: time.Hour})
+	page, bucket := newIndexBucket(t, 0)
+
+	_, err := s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+
+	bucket.putIndex(t, strings.ReplaceAll(testIndex, "abc123", "def456"))
+	time.Sleep(150 * time.Millisecond)
+
+	index, err := s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+	_, herr := index.GetBySHA("abc123")
+	assert.NoError(t, herr, "stale index must be served while it is refreshed")
+
+	assert.Eventually(t, func() bool {
+		index, err := s3_client.GetPageMetadata(context.Background(), page)
+		if err != nil {
+			return false
+		}
+		_, herr := index.GetBySHA("def456")
+		return herr == nil
+	}, 2*time.Second, 20*time.Millisecond, "refreshed index must replace the stale one")
+}
+
+// When the storage backend fails, the last known index keeps being served
+// until it exceeds its maximum staleness.
+func TestGetPageMetadata_StaleIfError(t *testing.T) {
+	configureIndexCache(t, config.IndexCache{TTL: 50 * time.Millisecond, MaxStale: 300 * time.Millisecond})
+	page, bucket := newIndexBucket(t, 0)
+	// Staleness is bounded by time; retrying the failing backend would only
+	// stretch the test.
+	page.Bucket.Retry = config.BucketRetry{MaxAttempts: 1}
+
+	_, err := s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+
+	bucket.failing.Store(true)
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		index, err := s3_client.GetPageMetadata(context.Background(), page)
+		require.NoError(t, err, "stale index must be served while the backend fails")
+		_, herr := index.GetBySHA("abc123")
+		assert.NoError(t, herr)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	_, err = s3_client.GetPageMetadata(context.Background(), page)
+	assert.Error(t, err, "index older than the maximum staleness must not be served")
+}
+
+// An index uploaded through another replica must replace the cached one
+// within a poll interval, long before the cached one expires.
+func TestWatchPageIndexes_RefreshesChangedIndex(t *testing.T) {
+	configureIndexCache(t, config.IndexCache{TTL: time.Hour, MaxStale: time.Hour})
+	page, bucket := newIndexBucket(t, 0)
+
+	_, err := s3_client.GetPageMetadata(context.Background(), page)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s3_client.WatchPageIndexes(ctx, []*config.Page{page}, 50*time.Millisecond)
+
+	// An unchanged index must not be downloaded again.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bucket.gets))
+
+	bucket.putIndex(t, strings.ReplaceAll(testIndex, "abc123", "def456"))
+
+	assert.Eventually(t, func() bool {
+		index, err := s3_client.GetPageMetadata(context.Background(), page)
+		if err != nil {
+			return false
+		}
+		_, herr := index.GetBySHA("def456")
+		return herr == nil
+	}, 2*time.Second, 20*time.Millisecond, "changed index must be picked up by the watcher")
+}
+
+// lookupCount returns the page index lookups recorded for domain and result.
+func lookupCount(t *testing.T, domain, result string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != "staticpages_page_index_lookups_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["domain"] == domain && labels["result"] == result {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestGetPageMetadata_RecordsLookups(t *testing.T) {
+	configureIndexCache(t, config.IndexCache{TTL: time.Minute, MaxStale: time.Hour})
+	page, _ := newIndexBucket(t, 0)
+	domain := page.Domain.String()
+
+	for i := 0; i < 3; i++ {
+		_, err := s3_client.GetPageMetadata(context.Background(), page)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, float64(1), lookupCount(t, domain, "miss"))
+	assert.Equal(t, float64(2), lookupCount(t, domain, "fresh"))
+}
@@ -0,0 +1,305 @@
+package s3_client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const manifestSchemaVersion = 1
+
+// Manifest records the objects of a deployment together with their SHA-256
+// digests, so the deployment can be verified against storage later on.
+type Manifest struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Repository    string    `json:"repository"`
+	SHA           string    `json:"sha"`
+	CreatedAt     time.Time `json:"createdAt"`
+
+	// Files maps the keys of the objects, relative to the deployment folder,
+	// to their digests. Precompressed variants are listed on their own.
+	Files map[string]ManifestFile `json:"files"`
+}
+
+// ManifestFile is an object of a deployment.
+type ManifestFile struct {
+	SHA256          string `json:"sha256"` // hex encoded
+	Size            int64  `json:"size"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+}
+
+// NewManifest returns an empty manifest of the deployment of commit sha.
+func NewManifest(repository, sha string) *Manifest {
+	return &Manifest{
+		SchemaVersion: manifestSchemaVersion,
+		Repository:    repository,
+		SHA:           sha,
+		CreatedAt:     time.Now().UTC(),
+		Files:         make(map[string]ManifestFile),
+	}
+}
+
+// Verification is the outcome of verifying a deployment against its
+// manifest.
+type Verification struct {
+	// Verified is the number of objects matching the manifest.
+	Verified int
+
+	// Mismatched are the objects whose content differs from the manifest,
+	// Missing the ones listed in the manifest but absent from storage, and
+	// Unexpected the ones in storage the manifest does not list.
+	Mismatched []string
+	Missing    []string
+	Unexpected []string
+}
+
+// OK reports whether the deployment matches its manifest.
+func (v *Verification) OK() bool {
+	return len(v.Mismatched) == 0 && len(v.Missing) == 0 && len(v.Unexpected) == 0
+}
+
+// WithChecksums verifies the files uploaded against digests, which maps
+// their paths relative to the folder uploaded, with forward slashes, to their
+// hex encoded SHA-256 digests. A file whose digest differs fails the upload.
+func WithChecksums(digests map[string]string) UploadOption {
+	return func(o *uploadOptions) {
+		o.checksums = digests
+	}
+}
+
+// WithManifest records every object uploaded in m.
+func WithManifest(m *Manifest) UploadOption {
+	return func(o *uploadOptions) {
+		o.manifest = m
+	}
+}
+
+// digest is the SHA-256 digest of an object.
+type digest [sha256.Size]byte
+
+func sha256Of(data []byte) digest {
+	return sha256.Sum256(data)
+}
+
+func (d digest) hex() string {
+	return hex.EncodeToString(d[:])
+}
+
+// base64 returns the digest as S3 expects it in ChecksumSHA256.
+func (d digest) base64() string {
+	return base64.StdEncoding.EncodeToString(d[:])
+}
+
+// fileDigest returns the digest of the content read from r, which is
+// rewound afterwards.
+func fileDigest(r io.ReadSeeker) (digest, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return digest{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return digest{}, err
+	}
+
+	var d digest
+	h.Sum(d[:0])
+	return d, nil
+}
+
+// UploadManifest stores m next to the page index.
+func (c *S3PageClient) UploadManifest(ctx context.Context, m *Manifest) humane.Error {
+	ctx, span := c.tracer.Start(ctx, "s3Client.UploadManifest", trace.WithAttributes(
+		attribute.String("sha", m.SHA),
+		attribute.Int("manifest.files", len(m.Files)),
+	))
+	defer span.End()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return humane.Wrap(err, "failed to marshal deployment manifest")
+	}
+
+	if _, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(c.s3BucketName),
+		Key:           aws.String(c.manifestKey(m.SHA)),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String("application/json"),
+	}); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return humane.Wrap(err, "failed to upload deployment manifest", "Make sure the bucket exists and you have write access to it.")
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// DownloadManifest returns the manifest of the deployment of commit sha.
+func (c *S3PageClient) DownloadManifest(ctx context.Context, sha string) (*Manifest, humane.Error) {
+	ctx, span := c.tracer.Start(ctx, "s3Client.DownloadManifest", trace.WithAttributes(attribute.String("sha", sha)))
+	defer span.End()
+
+	data, err := c.GetObject(ctx, c.manifestKey(sha))
+	if err != nil {
+		if err == ErrObjectNotFound {
+			return nil, humane.New(fmt.Sprintf("no manifest found for deployment %s", sha),
+				"Deployments uploaded before manifests were introduced cannot be verified; redeploy the commit to record one.")
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, humane.Wrap(err, "failed to download deployment manifest")
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, humane.Wrap(err, "failed to parse deployment manifest")
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return &m, nil
+}
+
+// VerifyDeployment downloads every object of the deployment of commit sha
+// and compares it against the manifest recorded when it was uploaded.
+func (c *S3PageClient) VerifyDeployment(ctx context.Context, sha string) (*Verification, humane.Error) {
+	ctx, span := c.tracer.Start(ctx, "s3Client.VerifyDeployment", trace.WithAttributes(attribute.String("sha", sha)))
+	defer span.End()
+
+	manifest, herr := c.DownloadManifest(ctx, sha)
+	if herr != nil {
+		return nil, herr
+	}
+
+	prefix := path.Join(c.repository, sha) + "/"
+	stored := make(map[string]bool)
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.s3BucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, humane.Wrap(err, "failed to list objects", "Make sure the bucket exists and you have access to it.")
+		}
+
+		for _, object := range page.Contents {
+			stored[strings.TrimPrefix(aws.ToString(object.Key), prefix)] = true
+		}
+	}
+
+	result := &Verification{}
+	for name := range stored {
+		if _, ok := manifest.Files[name]; !ok {
+			result.Unexpected = append(result.Unexpected, name)
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		errOnce   sync.Once
+		errResult humane.Error
+	)
+	semaphore := make(chan struct{}, uploadConcurrency(c.page.Upload))
+
+	for name, file := range manifest.Files {
+		if !stored[name] {
+			result.Missing = append(result.Missing, name)
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, file ManifestFile) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			match, herr := c.objectMatches(ctx, prefix+name, file)
+			if herr != nil {
+				errOnce.Do(func() { errResult = herr })
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if match {
+				result.Verified++
+			} else {
+				result.Mismatched = append(result.Mismatched, name)
+			}
+		}(name, file)
+	}
+	wg.Wait()
+
+	if errResult != nil {
+		span.RecordError(errResult)
+		span.SetStatus(codes.Error, errResult.Error())
+		return nil, errResult
+	}
+
+	slices.Sort(result.Mismatched)
+	slices.Sort(result.Missing)
+	slices.Sort(result.Unexpected)
+
+	span.SetAttributes(
+		attribute.Int("verify.verified", result.Verified),
+		attribute.Int("verify.mismatched", len(result.Mismatched)),
+		attribute.Int("verify.missing", len(result.Missing)),
+		attribute.Int("verify.unexpected", len(result.Unexpected)),
+	)
+	span.SetStatus(codes.Ok, "")
+	return result, nil
+}
+
+// objectMatches reports whether the object at key has the size and digest
+// of file.
+func (c *S3PageClient) objectMatches(ctx context.Context, key string, file ManifestFile) (bool, humane.Error) {
+	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.s3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, humane.Wrap(err, fmt.Sprintf("failed to download object %s", key))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	h := sha256.New()
+	size, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return false, humane.Wrap(err, fmt.Sprintf("failed to read object %s", key))
+	}
+
+	return size == file.Size && hex.EncodeToString(h.Sum(nil)) == file.SHA256, nil
+}
+
+// manifestKey returns the object key of the manifest of the deployment of
+// commit sha. It lives outside the deployment folder, so it is not served.
+func (c *S3PageClient) manifestKey(sha string) string {
+	return path.Join(c.repository, "manifests", sha+".json")
+}
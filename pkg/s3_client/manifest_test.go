@@ -0,0 +1,103 @@
+package s3_client_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadFolder_RecordsManifest(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Upload.Precompress = config.Precompress{Enabled: true}
+
+	script := strings.Repeat("console.log('hello world');\n", 100)
+	source := writeFiles(t, map[string]string{
+		"index.html":    "<html></html>",
+		"assets/app.js": script,
+	})
+
+	manifest := s3_client.NewManifest("repo", "sha")
+	client := s3_client.NewS3PageClient(page, s3_client.WithRepository("repo"))
+	_, err := client.UploadFolder(context.Background(), source, "repo/sha",
+		s3_client.WithChecksums(map[string]string{"index.html": strings.ToUpper(sha256Hex("<html></html>"))}),
+		s3_client.WithManifest(manifest))
+	require.Nil(t, err)
+
+	assert.Equal(t, s3_client.ManifestFile{SHA256: sha256Hex("<html></html>"), Size: 13}, manifest.Files["index.html"])
+	assert.Equal(t, s3_client.ManifestFile{SHA256: sha256Hex(script), Size: int64(len(script))}, manifest.Files["assets/app.js"])
+	assert.Equal(t, sha256Hex(string(bucket.body(t, "repo/sha/assets/app.js.br"))), manifest.Files["assets/app.js.br"].SHA256)
+	assert.Equal(t, "br", manifest.Files["assets/app.js.br"].ContentEncoding)
+	assert.Len(t, manifest.Files, 4)
+
+	// The digests are passed on for the bucket to verify.
+	sum := sha256.Sum256([]byte("<html></html>"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), bucket.header("repo/sha/index.html").Get("X-Amz-Checksum-Sha256"))
+
+	require.Nil(t, client.UploadManifest(context.Background(), manifest))
+	downloaded, err := client.DownloadManifest(context.Background(), "sha")
+	require.Nil(t, err)
+	assert.Equal(t, manifest.Files, downloaded.Files)
+	assert.Equal(t, "repo", downloaded.Repository)
+}
+
+func TestUploadFolder_RejectsChangedFiles(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	source := writeFiles(t, map[string]string{"index.html": "<html></html>"})
+
+	_, err := s3_client.NewS3PageClient(page).UploadFolder(context.Background(), source, "repo/sha",
+		s3_client.WithChecksums(map[string]string{"index.html": sha256Hex("<html>original</html>")}))
+	require.NotNil(t, err)
+	assert.Nil(t, bucket.header("repo/sha/index.html"))
+}
+
+func TestVerifyDeployment(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	client := s3_client.NewS3PageClient(page, s3_client.WithRepository("repo"))
+
+	source := writeFiles(t, map[string]string{
+		"index.html": "<html></html>",
+		"about.html": "<html>about</html>",
+		"app.js":     "console.log(1)",
+	})
+	manifest := s3_client.NewManifest("repo", "sha")
+	_, err := client.UploadFolder(context.Background(), source, "repo/sha", s3_client.WithManifest(manifest))
+	require.Nil(t, err)
+	require.Nil(t, client.UploadManifest(context.Background(), manifest))
+
+	result, err := client.VerifyDeployment(context.Background(), "sha")
+	require.Nil(t, err)
+	assert.True(t, result.OK())
+	assert.Equal(t, 3, result.Verified)
+
+	// Corrupt, remove and add objects behind the manifest's back.
+	_, perr := bucket.backend.PutObject("test", "repo/sha/app.js", map[string]string{}, strings.NewReader("console.log(2)"), 14, nil)
+	require.NoError(t, perr)
+	_, derr := bucket.backend.DeleteObject("test", "repo/sha/about.html")
+	require.NoError(t, derr)
+	_, perr = bucket.backend.PutObject("test", "repo/sha/extra.html", map[string]string{}, strings.NewReader("extra"), 5, nil)
+	require.NoError(t, perr)
+
+	result, err = client.VerifyDeployment(context.Background(), "sha")
+	require.Nil(t, err)
+	assert.False(t, result.OK())
+	assert.Equal(t, 1, result.Verified)
+	assert.Equal(t, []string{"app.js"}, result.Mismatched)
+	assert.Equal(t, []string{"about.html"}, result.Missing)
+	assert.Equal(t, []string{"extra.html"}, result.Unexpected)
+
+	_, err = client.VerifyDeployment(context.Background(), "unknown")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,61 @@
+package s3_client
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// _staleIndexServed counts requests answered from an expired page index.
+	_staleIndexServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "page_index",
+		Name:      "stale_served_total",
+		Help:      "Number of lookups served from an expired page index.",
+	}, []string{"domain"})
+
+	// _indexRefreshFailures counts failed page index downloads.
+	_indexRefreshFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "page_index",
+		Name:      "refresh_failures_total",
+		Help:      "Number of page index downloads that failed.",
+	}, []string{"domain"})
+
+	// _indexLookups counts page index lookups by result: fresh, stale or miss.
+	// The ratio of fresh and stale lookups to all of them is the cache hit
+	// ratio.
+	_indexLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "staticpages",
+		Subsystem: "page_index",
+		Name:      "lookups_total",
+		Help:      "Number of page index lookups, by whether the cached index was fresh, stale or missing.",
+	}, []string{"domain", "result"})
+)
+
+var _indexAgeDesc = prometheus.NewDesc(
+	"staticpages_page_index_age_seconds",
+	"Time since the cached page index was downloaded.",
+	[]string{"domain"}, nil,
+)
+
+func init() {
+	prometheus.MustRegister(indexAgeCollector{})
+}
+
+// indexAgeCollector reports the age of every cached page index at scrape
+// time, so staleness shows even while no requests arrive.
+type indexAgeCollector struct{}
+
+func (indexAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- _indexAgeDesc
+}
+
+func (indexAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	for domain, item := range _metadataCache.Items() {
+		ch <- prometheus.MustNewConstMetric(_indexAgeDesc, prometheus.GaugeValue,
+			time.Since(item.Value().fetched).Seconds(), domain.String())
+	}
+}
@@ -1,11 +1,21 @@
 package s3_client
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/sierrasoftworks/humane-errors-go"
+	"gopkg.in/yaml.v3"
 )
 
+// PageIndexSchemaVersion is the version of the page index document written by
+// this release. Documents of a newer version are refused rather than
+// misread.
+const PageIndexSchemaVersion = 1
+
 // PageIndex is a map[commit-sha]
 type PageIndex map[string]*PageIndexData
 
@@ -15,8 +25,45 @@ type PageIndexData struct {
 	Environment string    `yaml:"environment"`
 	Branch      string    `yaml:"branch"`
 	Date        time.Time `yaml:"date"`
-	sha         string
-	repository  string
+
+	// Uploader is the subject of the token the deployment was uploaded with.
+	Uploader string `yaml:"-"`
+
+	// Provenance records the workflow run the deployment was uploaded from.
+	Provenance Provenance `yaml:"-"`
+
+	sha        string
+	repository string
+}
+
+// Provenance are the claims of the token a deployment was uploaded with that
+// identify the workflow run producing it. Claims the provider does not issue
+// are left empty.
+type Provenance struct {
+	Actor          string `json:"actor,omitempty"`
+	Workflow       string `json:"workflow,omitempty"`
+	RunID          string `json:"runId,omitempty"`
+	RunAttempt     string `json:"runAttempt,omitempty"`
+	EventName      string `json:"eventName,omitempty"`
+	PullRequest    string `json:"pullRequest,omitempty"`
+	RefType        string `json:"refType,omitempty"`
+	JobWorkflowRef string `json:"jobWorkflowRef,omitempty"`
+	HeadRepository string `json:"headRepository,omitempty"`
+
+	// CommitUnverified is set when the commit was named by the upload, as
+	// the token carried none, and so cannot be trusted.
+	CommitUnverified bool `json:"commitUnverified,omitempty"`
+}
+
+// pageIndexDataJSON is the persisted form of PageIndexData.
+type pageIndexDataJSON struct {
+	SHA         string      `json:"sha"`
+	Repository  string      `json:"repository"`
+	Branch      string      `json:"branch"`
+	Environment string      `json:"environment,omitempty"`
+	Date        time.Time   `json:"date"`
+	Uploader    string      `json:"uploader,omitempty"`
+	Provenance  *Provenance `json:"provenance,omitempty"`
 }
 
 func NewPageCommitMetadata(repository, sha, branch, environment string, date time.Time) *PageIndexData {
@@ -29,6 +76,13 @@ func NewPageCommitMetadata(repository, sha, branch, environment string, date tim
 	}
 }
 
+// WithIdentity returns a copy of m deploying commit sha of repository.
+func (m *PageIndexData) WithIdentity(repository, sha string) *PageIndexData {
+	c := *m
+	c.repository, c.sha = repository, sha
+	return &c
+}
+
 func (m *PageIndexData) Repository() string {
 	return m.repository
 }
@@ -37,6 +91,136 @@ func (m *PageIndexData) SHA() string {
 	return m.sha
 }
 
+func (m *PageIndexData) MarshalJSON() ([]byte, error) {
+	v := pageIndexDataJSON{
+		SHA:         m.sha,
+		Repository:  m.repository,
+		Branch:      m.Branch,
+		Environment: m.Environment,
+		Date:        m.Date,
+		Uploader:    m.Uploader,
+	}
+	if m.Provenance != (Provenance{}) {
+		v.Provenance = &m.Provenance
+	}
+	return json.Marshal(v)
+}
+
+func (m *PageIndexData) UnmarshalJSON(data []byte) error {
+	var v pageIndexDataJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*m = PageIndexData{
+		Environment: v.Environment,
+		Branch:      v.Branch,
+		Date:        v.Date,
+		Uploader:    v.Uploader,
+		sha:         v.SHA,
+		repository:  v.Repository,
+	}
+	if v.Provenance != nil {
+		m.Provenance = *v.Provenance
+	}
+	return nil
+}
+
+// PageIndexDocument is the page index as it is stored in the bucket.
+type PageIndexDocument struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Deployments are ordered by date, oldest first.
+	Deployments []*PageIndexData `json:"deployments"`
+}
+
+// NewPageIndexDocument returns an empty page index document.
+func NewPageIndexDocument() *PageIndexDocument {
+	return &PageIndexDocument{
+		SchemaVersion: PageIndexSchemaVersion,
+		Deployments:   make([]*PageIndexData, 0),
+	}
+}
+
+// ParsePageIndexDocument parses a page index document in JSON.
+func ParsePageIndexDocument(data []byte) (*PageIndexDocument, humane.Error) {
+	var doc PageIndexDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, humane.Wrap(err, "failed to parse page index")
+	}
+
+	switch {
+	case doc.SchemaVersion < 1:
+		return nil, humane.New("page index has no schema version",
+			"Make sure the page index was written by StaticPages.")
+	case doc.SchemaVersion > PageIndexSchemaVersion:
+		return nil, humane.New(fmt.Sprintf("page index schema version %d is not supported, the latest known version is %d", doc.SchemaVersion, PageIndexSchemaVersion),
+			"Upgrade StaticPages to a release that supports the page index written by your other instances.")
+	}
+
+	if doc.Deployments == nil {
+		doc.Deployments = make([]*PageIndexData, 0)
+	}
+	return &doc, nil
+}
+
+// parseLegacyPageIndex converts the legacy YAML page index, a map of commit
+// sha to deployment, into a page index document. The legacy format does not
+// record the repository, so every deployment is attributed to repository.
+func parseLegacyPageIndex(data []byte, repository string) (*PageIndexDocument, humane.Error) {
+	legacy := make(PageIndex)
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
+		return nil, humane.Wrap(err, "failed to parse legacy page index")
+	}
+
+	doc := NewPageIndexDocument()
+	for sha, entry := range legacy {
+		if entry == nil {
+			continue
+		}
+
+		entry.sha = sha
+		entry.repository = repository
+		doc.Add(entry)
+	}
+	return doc, nil
+}
+
+// Marshal returns the document in JSON.
+func (d *PageIndexDocument) Marshal() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// marshalLegacy returns the document as a legacy YAML page index, for
+// releases that do not read the JSON index yet.
+func (d *PageIndexDocument) marshalLegacy() ([]byte, error) {
+	return yaml.Marshal(d.Index())
+}
+
+// Add records deployment, replacing an earlier deployment of the same commit.
+func (d *PageIndexDocument) Add(deployment *PageIndexData) {
+	d.Deployments = slices.DeleteFunc(d.Deployments, func(existing *PageIndexData) bool {
+		return existing.sha == deployment.sha
+	})
+	d.Deployments = append(d.Deployments, deployment)
+
+	slices.SortStableFunc(d.Deployments, func(a, b *PageIndexData) int {
+		if c := a.Date.Compare(b.Date); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.sha, b.sha)
+	})
+}
+
+// Index returns the deployments of the document by commit sha.
+func (d *PageIndexDocument) Index() PageIndex {
+	index := make(PageIndex, len(d.Deployments))
+	for _, deployment := range d.Deployments {
+		index[deployment.sha] = deployment
+	}
+	return index
+}
+
 // GetBySHA retrieves metadata for a specific domain and commit SHA
 func (c PageIndex) GetBySHA(sha string) (*PageIndexData, humane.Error) {
 	entry, exists := c[sha]
@@ -1,11 +1,14 @@
 package s3_client_test
 
 import (
+	"context"
+	"io"
 	"testing"
 	"time"
 
 	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPageIndex_GetBySHA(t *testing.T) {
@@ -116,6 +119,114 @@ func TestPageIndex_GetLatestForBranch(t *testing.T) {
 	}
 }
 
+func TestPageIndexDocument_RoundTrip(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	doc := s3_client.NewPageIndexDocument()
+	doc.Add(s3_client.NewPageCommitMetadata("org/repo", "sha2", "main", "prod", base.Add(time.Hour)))
+	doc.Add(s3_client.NewPageCommitMetadata("org/repo", "sha1", "main", "prod", base))
+
+	redeployed := s3_client.NewPageCommitMetadata("org/repo", "sha2", "main", "prod", base.Add(2*time.Hour))
+	redeployed.Uploader = "repo:org/repo:ref:refs/heads/main"
+	redeployed.Provenance = s3_client.Provenance{Actor: "octocat", Workflow: "Deploy", RunID: "42", RunAttempt: "1", EventName: "push", RefType: "branch"}
+	doc.Add(redeployed)
+
+	data, err := doc.Marshal()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"schemaVersion": 1`)
+
+	parsed, herr := s3_client.ParsePageIndexDocument(data)
+	require.Nil(t, herr)
+	require.Len(t, parsed.Deployments, 2)
+	assert.Equal(t, doc, parsed)
+
+	// Every field survives, including the unexported ones.
+	latest := parsed.Deployments[1]
+	assert.Equal(t, "sha2", latest.SHA())
+	assert.Equal(t, "org/repo", latest.Repository())
+	assert.Equal(t, "repo:org/repo:ref:refs/heads/main", latest.Uploader)
+	assert.Equal(t, "42", latest.Provenance.RunID)
+	assert.NotContains(t, string(data), `"provenance": {}`)
+
+	index := parsed.Index()
+	assert.Len(t, index, 2)
+	assert.Equal(t, "sha1", index["sha1"].SHA())
+}
+
+func TestParsePageIndexDocument_SchemaVersion(t *testing.T) {
+	_, err := s3_client.ParsePageIndexDocument([]byte(`{"schemaVersion": 2, "deployments": []}`))
+	assert.NotNil(t, err)
+
+	_, err = s3_client.ParsePageIndexDocument([]byte(`{"deployments": []}`))
+	assert.NotNil(t, err)
+
+	doc, err := s3_client.ParsePageIndexDocument([]byte(`{"schemaVersion": 1}`))
+	require.Nil(t, err)
+	assert.Empty(t, doc.Deployments)
+}
+
+func TestPageIndex_MigratesLegacyYAML(t *testing.T) {
+	page, bucket := newIndexBucket(t, 0)
+	client := s3_client.NewS3PageClient(page)
+
+	legacyETag, herr := client.PageIndexETag(context.Background())
+	require.Nil(t, herr)
+	require.NotEmpty(t, legacyETag)
+
+	// The legacy index is read as long as no JSON index exists.
+	doc, herr := client.DownloadPageIndexDocument(context.Background())
+	require.Nil(t, herr)
+	require.Len(t, doc.Deployments, 1)
+	assert.Equal(t, "abc123", doc.Deployments[0].SHA())
+	assert.Equal(t, "main", doc.Deployments[0].Branch)
+
+	// Uploading it migrates the index.
+	doc.Add(s3_client.NewPageCommitMetadata("", "def456", "main", "prod", time.Now()))
+	require.Nil(t, client.UploadPageIndex(context.Background(), doc))
+
+	object, err := bucket.backend.GetObject("test", "index.json", nil)
+	require.NoError(t, err)
+	data, err := io.ReadAll(object.Contents)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"sha": "abc123"`)
+
+	// The legacy index is kept up to date for older releases.
+	object, err = bucket.backend.GetObject("test", "index.yaml", nil)
+	require.NoError(t, err)
+	data, err = io.ReadAll(object.Contents)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "def456:")
+
+	etag, herr := client.PageIndexETag(context.Background())
+	require.Nil(t, herr)
+	assert.NotEqual(t, legacyETag, etag)
+
+	// From then on, changes to the legacy index are ignored.
+	bucket.putIndex(t, "ghi789:\n    branch: main\n")
+	index, herr := client.DownloadPageIndex(context.Background())
+	require.Nil(t, herr)
+	assert.Len(t, index, 2)
+	assert.Contains(t, index, "def456")
+	assert.NotContains(t, index, "ghi789")
+}
+
+func TestPageIndex_StopsWritingLegacyYAMLOnceMigrated(t *testing.T) {
+	page, bucket := newIndexBucket(t, 0)
+	page.Upload.IndexMigrated = true
+	client := s3_client.NewS3PageClient(page)
+
+	doc, herr := client.DownloadPageIndexDocument(context.Background())
+	require.Nil(t, herr)
+	doc.Add(s3_client.NewPageCommitMetadata("", "def456", "main", "prod", time.Now()))
+	require.Nil(t, client.UploadPageIndex(context.Background(), doc))
+
+	object, err := bucket.backend.GetObject("test", "index.yaml", nil)
+	require.NoError(t, err)
+	data, err := io.ReadAll(object.Contents)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "def456", "the legacy index is left as it was")
+}
+
 // Optional: Performance test (benchmark)
 func BenchmarkPageIndex_GetLatestForBranch(b *testing.B) {
 	index := s3_client.PageIndex{}
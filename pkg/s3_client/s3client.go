@@ -6,14 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/SpechtLabs/StaticPages/pkg/config"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	tmtypes "github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
 	"github.com/sierrasoftworks/humane-errors-go"
@@ -24,9 +28,11 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 )
 
+// ErrObjectNotFound is returned by GetObject for a missing object.
+var ErrObjectNotFound = errors.New("object not found")
+
 type S3PageClient struct {
 	client       *s3.Client
 	page         *config.Page
@@ -35,6 +41,10 @@ type S3PageClient struct {
 	s3Options    s3.Options
 	s3Endpoint   string
 	s3BucketName string
+
+	// retry configures the retries of uploads; other requests, such as those
+	// made while serving a page, keep the SDK defaults so they fail fast.
+	retry config.BucketRetry
 }
 
 func NewS3PageClient(page *config.Page, options ...S3ClientOption) *S3PageClient {
@@ -79,6 +89,7 @@ func WithBucketConf(bucketConf *config.BucketConfig) S3ClientOption {
 	return func(c *S3PageClient) {
 		c.s3Endpoint = bucketConf.URL.String()
 		c.s3BucketName = bucketConf.Name.String()
+		c.retry = bucketConf.Retry
 		c.s3Options = s3.Options{
 			BaseEndpoint:  &c.s3Endpoint,
 			Region:        bucketConf.Region.String(), // required even if arbitrary
@@ -95,10 +106,17 @@ func WithBucketConf(bucketConf *config.BucketConfig) S3ClientOption {
 	}
 }
 
-func (c *S3PageClient) UploadFolder(ctx context.Context, source, target string) humane.Error {
+// UploadFolder uploads the files below source to the folder target of the
+// bucket, and returns the progress made: all of it, unless an error occurred.
+func (c *S3PageClient) UploadFolder(ctx context.Context, source, target string, options ...UploadOption) (UploadProgress, humane.Error) {
 	ctx, span := c.tracer.Start(ctx, "s3Client.uploadArtifactsToS3")
 	defer span.End()
 
+	opts := uploadOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
 	otelzap.L().Ctx(ctx).Debug("start uploading artifacts to s3",
 		zap.String("bucket", c.s3BucketName),
 		zap.String("source_folder", source),
@@ -106,71 +124,101 @@ func (c *S3PageClient) UploadFolder(ctx context.Context, source, target string)
 	)
 
 	// Walk through directory recursively to collect all files
-	files := make([]string, 0)
+	var progress UploadProgress
+	files := make(map[string]int64)
 	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
-			files = append(files, path)
+			files[path] = info.Size()
+			progress.FilesTotal++
+			progress.BytesTotal += info.Size()
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		return humane.Wrap(err, "failed to walk upload directory")
+		return progress, humane.Wrap(err, "failed to walk upload directory")
 	}
 
+	span.SetAttributes(
+		attribute.Int("upload.files", progress.FilesTotal),
+		attribute.Int64("upload.bytes", progress.BytesTotal),
+	)
+
+	uploader := newUploader(c.uploadClient(), c.page.Upload)
+
 	// Use a worker pool pattern
-	concurrency := 10 // Adjust later...
-	semaphore := make(chan struct{}, concurrency)
+	semaphore := make(chan struct{}, uploadConcurrency(c.page.Upload))
 	errChan := make(chan error, len(files))
 	var wg sync.WaitGroup
+	var progressMu sync.Mutex
 
 	// Upload files
-	for _, filePath := range files {
+	for filePath, size := range files {
 		wg.Add(1)
-		go func(path string) {
+		go func(path string, size int64) {
 			defer wg.Done()
 
 			// Acquire semaphore
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
-			err := c.uploadFileInFolder(ctx, source, path, target)
+			uploaded, err := c.uploadFileInFolder(ctx, uploader, source, path, target, opts.checksums)
 			if err != nil {
 				errChan <- err
+				return
 			}
-		}(filePath)
+
+			progressMu.Lock()
+			defer progressMu.Unlock()
+
+			progress.Files++
+			progress.Bytes += size
+			if uploaded.multipart {
+				progress.MultipartFiles++
+			}
+			if opts.manifest != nil {
+				maps.Copy(opts.manifest.Files, uploaded.objects)
+			}
+			if opts.progress != nil {
+				opts.progress(progress)
+			}
+		}(filePath, size)
 	}
 
 	// Wait for all uploads to complete
 	wg.Wait()
 	close(errChan)
 
+	span.SetAttributes(attribute.Int("upload.multipart_files", progress.MultipartFiles))
+
 	// Handle errors (if any)
 	for err := range errChan {
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			return humane.Wrap(err, "failed to upload artifacts to S3")
+			return progress, humane.Wrap(err, "failed to upload artifacts to S3")
 		}
 	}
 
 	span.SetStatus(codes.Ok, "")
-	return nil
+	return progress, nil
 }
 
-func (c *S3PageClient) uploadFileInFolder(ctx context.Context, source, file, target string) humane.Error {
+// uploadFileInFolder uploads file, below source, to the folder target of the
+// bucket with uploader. A file listed in checksums must match its digest.
+func (c *S3PageClient) uploadFileInFolder(ctx context.Context, uploader *transfermanager.Client, source, file, target string, checksums map[string]string) (*uploadedFile, humane.Error) {
 	// Open file for reading
 	f, err := os.Open(file)
 	if err != nil {
-		return humane.Wrap(err, "failed to open file for S3 upload")
+		return nil, humane.Wrap(err, "failed to open file for S3 upload")
 	}
 
 	defer func() { _ = f.Close() }()
 
 	relPath, err := filepath.Rel(source, file)
 	if err != nil {
-		return humane.Wrap(err, "failed to determine relative path for upload")
+		return nil, humane.Wrap(err, "failed to determine relative path for upload")
 	}
 
 	// Construct target path
@@ -181,101 +229,172 @@ func (c *S3PageClient) uploadFileInFolder(ctx context.Context, source, file, tar
 	// Get file size for Content-Length
 	fileInfo, err := f.Stat()
 	if err != nil {
-		return humane.Wrap(err, "failed to get file stats for S3 upload")
+		return nil, humane.Wrap(err, "failed to get file stats for S3 upload")
 	}
 
-	// Upload the file to S3
-	_, err = c.client.PutObject(ctx, &s3.PutObjectInput{
+	contentType, err := c.fileContentType(file, f)
+	if err != nil {
+		return nil, humane.Wrap(err, fmt.Sprintf("failed to determine the content type of file %s", file))
+	}
+
+	input := &transfermanager.UploadObjectInput{
 		Bucket:        aws.String(c.s3BucketName),
 		Key:           aws.String(s3Key),
 		Body:          f,
 		ContentLength: aws.Int64(fileInfo.Size()),
-		ContentType:   aws.String(determineContentType(file)),
-	})
+		ContentType:   aws.String(contentType),
+	}
+	if value := cacheControl(c.page.Upload.CacheControl, relPath); value != "" {
+		input.CacheControl = aws.String(value)
+	}
 
-	if err != nil {
-		return humane.Wrap(err, fmt.Sprintf("failed to upload file %s to S3", file))
+	var variants []variant
+	var sum digest
+	if shouldPrecompress(c.page.Upload.Precompress, file, contentType, fileInfo.Size()) {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, humane.Wrap(err, "failed to read file for S3 upload")
+		}
+
+		if variants, err = precompress(file, data); err != nil {
+			return nil, humane.Wrap(err, fmt.Sprintf("failed to compress file %s", file))
+		}
+		input.Body = bytes.NewReader(data)
+		sum = sha256Of(data)
+	} else if sum, err = fileDigest(f); err != nil {
+		return nil, humane.Wrap(err, "failed to read file for S3 upload")
 	}
 
-	return nil
-}
+	// The file is verified right before it is uploaded, so the digest covers
+	// its whole way from the client to the bucket.
+	name := filepath.ToSlash(relPath)
+	if expected, ok := checksums[name]; ok && !strings.EqualFold(expected, sum.hex()) {
+		return nil, humane.New(fmt.Sprintf("checksum mismatch for file %s", name),
+			"The file changed after it was received; retry the upload.")
+	}
 
-// determineContentType returns the appropriate Content-Type for a file
-func determineContentType(filePath string) string {
-	ext := filepath.Ext(filePath)
-	switch ext {
-	case ".html", ".htm":
-		return "text/html"
-	case ".css":
-		return "text/css"
-	case ".js":
-		return "application/javascript"
-	case ".json":
-		return "application/json"
-	case ".png":
-		return "image/png"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".gif":
-		return "image/gif"
-	case ".svg":
-		return "image/svg+xml"
-	case ".pdf":
-		return "application/pdf"
-	case ".xml":
-		return "application/xml"
-	case ".zip":
-		return "application/zip"
-	case ".ico":
-		return "image/x-icon"
-	case ".txt":
-		return "text/plain"
-	case ".md":
-		return "text/markdown"
-	case ".yaml", ".yml":
-		return "application/x-yaml"
-	default:
-		return "application/octet-stream"
+	// S3 verifies the digest of single part uploads as a whole. Parts of
+	// multipart uploads are verified on their own, as S3 only accepts
+	// digests of the parts' digests for the whole object.
+	uploaded := &uploadedFile{
+		multipart: fileInfo.Size() >= multipartThreshold(c.page.Upload),
+		objects:   map[string]ManifestFile{name: {SHA256: sum.hex(), Size: fileInfo.Size()}},
+	}
+	input.ChecksumAlgorithm = tmtypes.ChecksumAlgorithmSha256
+	if !uploaded.multipart {
+		input.ChecksumSHA256 = aws.String(sum.base64())
+	}
+
+	// Upload the file to S3
+	if _, err = uploader.UploadObject(ctx, input); err != nil {
+		return nil, humane.Wrap(err, fmt.Sprintf("failed to upload file %s to S3", file))
+	}
+
+	// Variants carry the media type of the file, so they can be served in its
+	// place with just the encoding added.
+	for _, v := range variants {
+		variantSum := sha256Of(v.data)
+		_, err = c.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:          aws.String(c.s3BucketName),
+			Key:             aws.String(s3Key + v.ext),
+			Body:            bytes.NewReader(v.data),
+			ContentLength:   aws.Int64(int64(len(v.data))),
+			ContentType:     aws.String(contentType),
+			ContentEncoding: aws.String(v.encoding),
+			CacheControl:    input.CacheControl,
+			ChecksumSHA256:  aws.String(variantSum.base64()),
+		})
+		if err != nil {
+			return nil, humane.Wrap(err, fmt.Sprintf("failed to upload %s variant of file %s to S3", v.encoding, file))
+		}
+
+		uploaded.objects[name+v.ext] = ManifestFile{SHA256: variantSum.hex(), Size: int64(len(v.data)), ContentEncoding: v.encoding}
 	}
+
+	return uploaded, nil
 }
 
-func (c *S3PageClient) UploadPageIndex(ctx context.Context, metadata PageIndex) humane.Error {
+// UploadPageIndex stores doc as the page index. Unless the page sets
+// upload.indexMigrated, the legacy YAML index is written as well, so
+// instances of older releases keep seeing new deployments.
+func (c *S3PageClient) UploadPageIndex(ctx context.Context, doc *PageIndexDocument) humane.Error {
 	ctx, span := c.tracer.Start(ctx, "s3Client.UploadPageIndex")
 	defer span.End()
 
-	data, err := yaml.Marshal(metadata)
+	doc.SchemaVersion = PageIndexSchemaVersion
+	data, err := doc.Marshal()
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		return humane.Wrap(err, "failed to marshal metadata for S3 upload")
 	}
 
-	s3Key := filepath.ToSlash(path.Join(c.repository, "index.yaml"))
+	if herr := c.putPageIndexObject(ctx, c.pageIndexKey(), data, "application/json"); herr != nil {
+		span.RecordError(herr)
+		span.SetStatus(codes.Error, herr.Error())
+		return herr
+	}
+
+	span.SetAttributes(attribute.Bool("page_index.legacy", !c.page.Upload.IndexMigrated))
+	if !c.page.Upload.IndexMigrated {
+		legacy, err := doc.marshalLegacy()
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return humane.Wrap(err, "failed to marshal legacy page index")
+		}
 
-	_, err = c.client.PutObject(ctx, &s3.PutObjectInput{
+		if herr := c.putPageIndexObject(ctx, c.legacyPageIndexKey(), legacy, "application/x-yaml"); herr != nil {
+			span.RecordError(herr)
+			span.SetStatus(codes.Error, herr.Error())
+			return humane.Wrap(herr, "failed to upload legacy page index",
+				"Set pages[].upload.indexMigrated once every instance reads index.json, to stop writing index.yaml.")
+		}
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// putPageIndexObject stores a page index at key.
+func (c *S3PageClient) putPageIndexObject(ctx context.Context, key string, data []byte, contentType string) humane.Error {
+	_, err := c.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(c.s3BucketName),
-		Key:           aws.String(s3Key),
+		Key:           aws.String(key),
 		Body:          bytes.NewReader(data),
 		ContentLength: aws.Int64(int64(len(data))),
-		ContentType:   aws.String("application/x-yaml"),
+		ContentType:   aws.String(contentType),
 	})
-
 	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
 		return humane.Wrap(err, "failed to upload metadata to S3")
 	}
-
-	span.SetStatus(codes.Ok, "")
 	return nil
 }
 
 func (c *S3PageClient) DownloadPageIndex(ctx context.Context) (PageIndex, humane.Error) {
+	doc, _, err := c.downloadPageIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Index(), nil
+}
+
+// DownloadPageIndexDocument returns the page index document. A legacy YAML
+// index is converted, and is only migrated the next time the index is
+// uploaded, as readers like the proxy need not be able to write to the bucket.
+func (c *S3PageClient) DownloadPageIndexDocument(ctx context.Context) (*PageIndexDocument, humane.Error) {
+	doc, _, err := c.downloadPageIndex(ctx)
+	return doc, err
+}
+
+// downloadPageIndex downloads the page index together with its ETag. It falls
+// back to the legacy YAML index while no JSON index has been uploaded. The
+// ETag is empty when there is neither.
+func (c *S3PageClient) downloadPageIndex(ctx context.Context) (*PageIndexDocument, string, humane.Error) {
 	ctx, span := c.tracer.Start(ctx, "s3Client.DownloadPageIndex")
 	defer span.End()
 
-	// Convert Windows path separators to forward slashes
-	s3Key := filepath.ToSlash(path.Join(c.repository, "index.yaml"))
+	s3Key := c.pageIndexKey()
 
 	span.SetAttributes(
 		attribute.String("s3.endpoint", c.s3Endpoint),
@@ -283,45 +402,209 @@ func (c *S3PageClient) DownloadPageIndex(ctx context.Context) (PageIndex, humane
 		attribute.String("s3.key", s3Key),
 	)
 
+	data, etag, herr := c.getPageIndexObject(ctx, s3Key)
+	if herr != nil {
+		span.RecordError(herr)
+		span.SetStatus(codes.Error, herr.Error())
+		return nil, "", herr
+	}
+
+	var doc *PageIndexDocument
+	switch {
+	case data != nil:
+		doc, herr = ParsePageIndexDocument(data)
+
+	default:
+		data, etag, herr = c.getPageIndexObject(ctx, c.legacyPageIndexKey())
+		if herr != nil {
+			span.RecordError(herr)
+			span.SetStatus(codes.Error, herr.Error())
+			return nil, "", herr
+		}
+
+		if data == nil {
+			span.SetStatus(codes.Ok, "")
+			return NewPageIndexDocument(), "", nil
+		}
+
+		span.SetAttributes(attribute.Bool("page_index.legacy", true))
+		doc, herr = parseLegacyPageIndex(data, c.repository)
+	}
+
+	if herr != nil {
+		span.RecordError(herr)
+		span.SetStatus(codes.Error, herr.Error())
+		return nil, "", herr
+	}
+
+	span.SetAttributes(attribute.Int("page_index.entries", len(doc.Deployments)))
+	span.SetStatus(codes.Ok, "")
+	return doc, etag, nil
+}
+
+// getPageIndexObject returns the content and ETag of the page index at key,
+// or no content when it does not exist.
+func (c *S3PageClient) getPageIndexObject(ctx context.Context, key string) ([]byte, string, humane.Error) {
 	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(c.s3BucketName),
-		Key:    aws.String(s3Key),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", humane.Wrap(err, "failed to download metadata from S3")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", humane.Wrap(err, "failed to read metadata from S3 response")
+	}
+
+	return data, aws.ToString(resp.ETag), nil
+}
+
+// PageIndexETag returns the ETag of the page index without downloading it.
+// It is empty when no index has been uploaded yet.
+func (c *S3PageClient) PageIndexETag(ctx context.Context) (string, humane.Error) {
+	ctx, span := c.tracer.Start(ctx, "s3Client.PageIndexETag")
+	defer span.End()
+
+	for _, key := range []string{c.pageIndexKey(), c.legacyPageIndexKey()} {
+		resp, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(c.s3BucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return "", humane.Wrap(err, "failed to look up page index", "Make sure the bucket exists and you have access to it.")
+		}
 
-	metadata := make(PageIndex)
+		span.SetStatus(codes.Ok, "")
+		return aws.ToString(resp.ETag), nil
+	}
 
+	span.SetStatus(codes.Ok, "")
+	return "", nil
+}
+
+// GetObject returns the content of the object at key. A missing object is
+// reported as ErrObjectNotFound.
+func (c *S3PageClient) GetObject(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := c.tracer.Start(ctx, "s3Client.GetObject", trace.WithAttributes(attribute.String("key", key)))
+	defer span.End()
+
+	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.s3BucketName),
+		Key:    aws.String(key),
+	})
 	if err != nil {
 		if isNotFound(err) {
-			return metadata, nil
+			return nil, ErrObjectNotFound
 		}
 
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return nil, humane.Wrap(err, "failed to download metadata from S3")
+		return nil, humane.Wrap(err, "failed to download object", "Make sure the bucket exists and you have access to it.")
 	}
-
 	defer func() { _ = resp.Body.Close() }()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return nil, humane.Wrap(err, "failed to read object")
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return data, nil
+}
+
+// PutObject stores data at key.
+func (c *S3PageClient) PutObject(ctx context.Context, key string, data []byte) humane.Error {
+	ctx, span := c.tracer.Start(ctx, "s3Client.PutObject", trace.WithAttributes(attribute.String("key", key)))
+	defer span.End()
+
+	if _, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(c.s3BucketName),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return nil, humane.Wrap(err, "failed to read metadata from S3 response")
+		return humane.Wrap(err, "failed to upload object", "Make sure the bucket exists and you have write access to it.")
 	}
 
-	err = yaml.Unmarshal(data, &metadata)
-	if err != nil {
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// DeleteObject removes the object at key. Deleting a missing object succeeds.
+func (c *S3PageClient) DeleteObject(ctx context.Context, key string) humane.Error {
+	ctx, span := c.tracer.Start(ctx, "s3Client.DeleteObject", trace.WithAttributes(attribute.String("key", key)))
+	defer span.End()
+
+	if _, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.s3BucketName),
+		Key:    aws.String(key),
+	}); err != nil && !isNotFound(err) {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return nil, humane.Wrap(err, "failed to unmarshal metadata from S3")
+		return humane.Wrap(err, "failed to delete object", "Make sure the bucket exists and you have write access to it.")
 	}
 
-	span.SetAttributes(attribute.Int("page_index.entries", len(metadata)))
 	span.SetStatus(codes.Ok, "")
-	return metadata, nil
+	return nil
+}
+
+// CheckBucket verifies that the bucket of the page exists and is accessible
+// with the configured credentials.
+func (c *S3PageClient) CheckBucket(ctx context.Context) humane.Error {
+	ctx, span := c.tracer.Start(ctx, "s3Client.CheckBucket")
+	defer span.End()
+
+	if _, err := c.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.s3BucketName)}); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return humane.Wrap(err, "bucket is not reachable",
+			"Make sure pages[].bucket.url points to a reachable S3 endpoint.",
+			"Make sure the bucket exists and the credentials have access to it.")
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+// pageIndexKey returns the object key of the page index.
+func (c *S3PageClient) pageIndexKey() string {
+	// Convert Windows path separators to forward slashes
+	return filepath.ToSlash(path.Join(c.repository, "index.json"))
+}
+
+// legacyPageIndexKey returns the object key of the page index written before
+// it was versioned.
+func (c *S3PageClient) legacyPageIndexKey() string {
+	return filepath.ToSlash(path.Join(c.repository, "index.yaml"))
+}
+
+// isMetadataKey reports whether key is the page index, in either format, or
+// the manifest of a deployment rather than a deployed file.
+func (c *S3PageClient) isMetadataKey(key string) bool {
+	return key == c.pageIndexKey() || key == c.legacyPageIndexKey() ||
+		strings.HasPrefix(key, path.Join(c.repository, "manifests")+"/")
 }
 
 func isNotFound(err error) bool {
 	var apiErr smithy.APIError
-	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey"
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	// HeadObject carries no error body, so a missing key surfaces as NotFound.
+	return apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound"
 }
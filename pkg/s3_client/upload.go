@@ -0,0 +1,235 @@
+package s3_client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultPrecompressMinSize = 1024
+	defaultUploadConcurrency  = 10
+	defaultMultipartThreshold = 16 << 20
+	defaultPartSize           = 8 << 20
+	defaultRetryMaxAttempts   = 5
+)
+
+// brotliUploadLevel trades compression ratio for speed: variants are built
+// once per deployment, but a deployment should not take minutes either.
+const brotliUploadLevel = 9
+
+// hashedName matches file names carrying a content hash of at least eight
+// characters before their extension, as emitted by bundlers. The hash must
+// contain a digit, so ordinary words are not mistaken for one.
+var hashedName = regexp.MustCompile(`[.-]([A-Za-z0-9_-]*[0-9][A-Za-z0-9_-]*)\.[A-Za-z0-9]+$`)
+
+// UploadProgress reports how far UploadFolder has got.
+type UploadProgress struct {
+	Files          int   `json:"files"`
+	FilesTotal     int   `json:"files_total"`
+	Bytes          int64 `json:"bytes"`
+	BytesTotal     int64 `json:"bytes_total"`
+	MultipartFiles int   `json:"multipart_files"`
+}
+
+// UploadOption configures a single UploadFolder call.
+type UploadOption func(*uploadOptions)
+
+type uploadOptions struct {
+	progress  func(UploadProgress)
+	checksums map[string]string
+	manifest  *Manifest
+}
+
+// uploadedFile is a file uploaded by uploadFileInFolder.
+type uploadedFile struct {
+	multipart bool
+
+	// objects are the objects stored for the file, by their keys relative to
+	// the folder uploaded to.
+	objects map[string]ManifestFile
+}
+
+// WithProgress calls report each time a file has been uploaded. Calls are
+// serialized.
+func WithProgress(report func(UploadProgress)) UploadOption {
+	return func(o *uploadOptions) {
+		o.progress = report
+	}
+}
+
+// newRetryer returns the retryer of requests to a bucket configured with
+// conf.
+func newRetryer(conf config.BucketRetry) aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = defaultRetryMaxAttempts
+		if conf.MaxAttempts > 0 {
+			o.MaxAttempts = conf.MaxAttempts
+		}
+		if conf.MaxBackoff > 0 {
+			o.MaxBackoff = conf.MaxBackoff
+		}
+
+		// The client-side retry quota is meant to stop retry storms against
+		// AWS. B2 answers 503 under load as a matter of course and expects
+		// every request to be retried, so a deploy of many files would run
+		// out of quota exactly when retrying matters.
+		o.RateLimiter = ratelimit.None
+	})
+}
+
+// uploadClient returns the client of the uploads of files, which retries
+// with the configured backoff: a deployment should survive a busy backend,
+// but requests made while serving a page must not wait out its retries.
+func (c *S3PageClient) uploadClient() *s3.Client {
+	return s3.New(c.client.Options(), func(o *s3.Options) {
+		o.Retryer = newRetryer(c.retry)
+	})
+}
+
+// uploadConcurrency returns the number of files uploaded at once.
+func uploadConcurrency(conf config.PageUpload) int {
+	if conf.Concurrency > 0 {
+		return conf.Concurrency
+	}
+	return defaultUploadConcurrency
+}
+
+// minPartSize is the smallest part size S3 accepts, but for the last part.
+const minPartSize = 5 << 20
+
+// newUploader returns the uploader of the files of a deployment, which
+// uploads files of at least the multipart threshold of conf in parts.
+func newUploader(client *s3.Client, conf config.PageUpload) *transfermanager.Client {
+	return transfermanager.New(client, func(o *transfermanager.Options) {
+		o.MultipartUploadThreshold = multipartThreshold(conf)
+		o.PartSizeBytes = defaultPartSize
+		if conf.PartSize > 0 {
+			o.PartSizeBytes = max(conf.PartSize, minPartSize)
+		}
+	})
+}
+
+// multipartThreshold returns the size from which files are uploaded in parts.
+func multipartThreshold(conf config.PageUpload) int64 {
+	if conf.MultipartThreshold > 0 {
+		return conf.MultipartThreshold
+	}
+	return defaultMultipartThreshold
+}
+
+// variant is a precompressed variant of an uploaded file.
+type variant struct {
+	ext      string // appended to the key of the file
+	encoding string // Content-Encoding of the variant
+	data     []byte
+}
+
+// cacheControl returns the Cache-Control of the file at relPath, relative to
+// the deployment root, as configured in rules.
+func cacheControl(rules []config.CacheControlRule, relPath string) string {
+	relPath = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	name := path.Base(relPath)
+
+	for _, rule := range rules {
+		if rule.Hashed && !isHashed(name) {
+			continue
+		}
+
+		if rule.Pattern != "" {
+			subject := name
+			if strings.Contains(rule.Pattern, "/") {
+				subject = relPath
+			}
+
+			if ok, err := path.Match(strings.TrimPrefix(rule.Pattern, "/"), subject); err != nil || !ok {
+				continue
+			}
+		}
+
+		return rule.Value
+	}
+	return ""
+}
+
+// isHashed reports whether the file name carries a content hash.
+func isHashed(name string) bool {
+	match := hashedName.FindStringSubmatch(name)
+	return match != nil && len(match[1]) >= 8
+}
+
+// shouldPrecompress reports whether variants are generated for the file at
+// filePath, of contentType and size bytes.
+func shouldPrecompress(conf config.Precompress, filePath, contentType string, size int64) bool {
+	if !conf.Enabled {
+		return false
+	}
+
+	minSize := conf.MinSize
+	if minSize <= 0 {
+		minSize = defaultPrecompressMinSize
+	}
+	if size < minSize {
+		return false
+	}
+
+	types := conf.ContentTypes
+	if len(types) == 0 {
+		types = config.DefaultCompressibleTypes
+	}
+	return config.MatchesMediaType(contentType, types)
+}
+
+// precompress returns the brotli and gzip variants of data that are smaller
+// than data itself, skipping those shipped with the deployment next to
+// filePath.
+func precompress(filePath string, data []byte) ([]variant, error) {
+	variants := make([]variant, 0, 2)
+
+	for _, v := range []struct {
+		ext      string
+		encoding string
+		compress func(*bytes.Buffer) error
+	}{
+		{".br", "br", func(buf *bytes.Buffer) error {
+			w := brotli.NewWriterLevel(buf, brotliUploadLevel)
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			return w.Close()
+		}},
+		{".gz", "gzip", func(buf *bytes.Buffer) error {
+			w, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			return w.Close()
+		}},
+	} {
+		if _, err := os.Stat(filePath + v.ext); err == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := v.compress(&buf); err != nil {
+			return nil, err
+		}
+
+		if buf.Len() < len(data) {
+			variants = append(variants, variant{ext: v.ext, encoding: v.encoding, data: buf.Bytes()})
+		}
+	}
+
+	return variants, nil
+}
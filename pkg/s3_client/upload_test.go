@@ -0,0 +1,233 @@
+package s3_client_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/andybalholm/brotli"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadBucket records the headers of every object uploaded to it.
+type uploadBucket struct {
+	backend *s3mem.Backend
+
+	mu      sync.Mutex
+	headers map[string]http.Header
+
+	// busy is the number of uploads still to be refused as B2 does under
+	// load.
+	busy atomic.Int32
+}
+
+func (b *uploadBucket) header(key string) http.Header {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.headers[key]
+}
+
+func (b *uploadBucket) body(t *testing.T, key string) []byte {
+	t.Helper()
+
+	object, err := b.backend.GetObject("test", key, nil)
+	require.NoError(t, err)
+	defer object.Contents.Close()
+
+	data, err := io.ReadAll(object.Contents)
+	require.NoError(t, err)
+	return data
+}
+
+func newUploadBucket(t *testing.T) (*config.Page, *uploadBucket) {
+	t.Helper()
+
+	bucket := &uploadBucket{backend: s3mem.New(), headers: make(map[string]http.Header)}
+	require.NoError(t, bucket.backend.CreateBucket("test"))
+
+	faker := gofakes3.New(bucket.backend, gofakes3.WithHostBucket(false)).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && bucket.busy.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`<Error><Code>ServiceUnavailable</Code><Message>c001_v0001000_t0000 is too busy</Message></Error>`))
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			bucket.mu.Lock()
+			bucket.headers[strings.TrimPrefix(r.URL.Path, "/test/")] = r.Header.Clone()
+			bucket.mu.Unlock()
+		}
+		faker.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return &config.Page{
+		Domain: config.FromString("example.com"),
+		Bucket: config.BucketConfig{
+			URL: config.EnvValue(server.URL), Name: "test",
+			ApplicationID: "test", Secret: "test", Region: "test",
+		},
+	}, bucket
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	}
+	return dir
+}
+
+// uploadFolder uploads source to repo/sha with client.
+func uploadFolder(t *testing.T, client *s3_client.S3PageClient, source string) s3_client.UploadProgress {
+	t.Helper()
+
+	progress, err := client.UploadFolder(context.Background(), source, "repo/sha")
+	require.Nil(t, err)
+	return progress
+}
+
+func TestUploadFolder_PrecompressesAndSetsCacheControl(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Upload = config.PageUpload{
+		Precompress: config.Precompress{Enabled: true},
+		CacheControl: []config.CacheControlRule{
+			{Pattern: "assets/*", Hashed: true, Value: "public, max-age=31536000, immutable"},
+			{Pattern: "*.html", Value: "no-cache"},
+		},
+	}
+
+	script := strings.Repeat("console.log('hello world');\n", 100)
+	source := writeFiles(t, map[string]string{
+		"index.html":                "<html><body>short</body></html>",
+		"docs/guide.html":           strings.Repeat("<p>guide</p>", 200),
+		"assets/index-B1x9kQ2a.js":  script,
+		"assets/vendor.js":          script,
+		"assets/logo.png":           strings.Repeat("\x89PNG", 500),
+		"assets/shipped.css":        strings.Repeat("body{color:red}", 100),
+		"assets/shipped.css.br":     "shipped variant",
+		"assets/incompressible.txt": "x",
+	})
+
+	client := s3_client.NewS3PageClient(page)
+	uploadFolder(t, client, source)
+
+	// Cache-Control follows the first matching rule.
+	assert.Equal(t, "no-cache", bucket.header("repo/sha/index.html").Get("Cache-Control"))
+	assert.Equal(t, "no-cache", bucket.header("repo/sha/docs/guide.html").Get("Cache-Control"))
+	assert.Equal(t, "public, max-age=31536000, immutable", bucket.header("repo/sha/assets/index-B1x9kQ2a.js").Get("Cache-Control"))
+	assert.Empty(t, bucket.header("repo/sha/assets/vendor.js").Get("Cache-Control"))
+
+	// Compressible files above the threshold get both variants.
+	br := bucket.header("repo/sha/assets/index-B1x9kQ2a.js.br")
+	require.NotNil(t, br)
+	assert.Equal(t, "br", br.Get("Content-Encoding"))
+	assert.Equal(t, "text/javascript; charset=utf-8", br.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=31536000, immutable", br.Get("Cache-Control"))
+
+	decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(bucket.body(t, "repo/sha/assets/index-B1x9kQ2a.js.br"))))
+	require.NoError(t, err)
+	assert.Equal(t, script, string(decoded))
+
+	gz := bucket.header("repo/sha/docs/guide.html.gz")
+	require.NotNil(t, gz)
+	assert.Equal(t, "gzip", gz.Get("Content-Encoding"))
+	reader, err := gzip.NewReader(bytes.NewReader(bucket.body(t, "repo/sha/docs/guide.html.gz")))
+	require.NoError(t, err)
+	decoded, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("<p>guide</p>", 200), string(decoded))
+
+	// Small, incompressible and already compressed files are left alone.
+	assert.Nil(t, bucket.header("repo/sha/index.html.br"))
+	assert.Nil(t, bucket.header("repo/sha/assets/logo.png.br"))
+	assert.Nil(t, bucket.header("repo/sha/assets/incompressible.txt.gz"))
+	assert.Equal(t, "shipped variant", string(bucket.body(t, "repo/sha/assets/shipped.css.br")))
+	assert.NotNil(t, bucket.header("repo/sha/assets/shipped.css.gz"))
+}
+
+func TestUploadFolder_WithoutProcessing(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+
+	source := writeFiles(t, map[string]string{"app.js": strings.Repeat("x", 4096)})
+	uploadFolder(t, s3_client.NewS3PageClient(page), source)
+
+	assert.Empty(t, bucket.header("repo/sha/app.js").Get("Cache-Control"))
+	assert.Nil(t, bucket.header("repo/sha/app.js.br"))
+	assert.Equal(t, strings.Repeat("x", 4096), string(bucket.body(t, "repo/sha/app.js")))
+}
+
+func TestUploadFolder_Multipart(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Upload = config.PageUpload{MultipartThreshold: 1 << 20, PartSize: 1 << 20, Concurrency: 2}
+
+	video := strings.Repeat("0123456789abcdef", 6<<20/16)
+	source := writeFiles(t, map[string]string{
+		"index.html": "<html></html>",
+		"clip.mp4":   video,
+	})
+
+	var reports []s3_client.UploadProgress
+	progress, err := s3_client.NewS3PageClient(page).UploadFolder(context.Background(), source, "repo/sha",
+		s3_client.WithProgress(func(p s3_client.UploadProgress) { reports = append(reports, p) }))
+	require.Nil(t, err)
+
+	assert.Equal(t, s3_client.UploadProgress{
+		Files: 2, FilesTotal: 2,
+		Bytes: int64(len(video)) + 13, BytesTotal: int64(len(video)) + 13,
+		MultipartFiles: 1,
+	}, progress)
+	require.Len(t, reports, 2)
+	assert.Equal(t, 1, reports[0].Files)
+	assert.Equal(t, progress, reports[1])
+
+	assert.Equal(t, video, string(bucket.body(t, "repo/sha/clip.mp4")))
+	object, herr := bucket.backend.HeadObject("test", "repo/sha/clip.mp4")
+	require.NoError(t, herr)
+	assert.Equal(t, "video/mp4", object.Metadata["Content-Type"])
+}
+
+func TestUploadFolder_RetriesBusyBackend(t *testing.T) {
+	page, bucket := newUploadBucket(t)
+	page.Bucket.Retry = config.BucketRetry{MaxAttempts: 4, MaxBackoff: 10 * time.Millisecond}
+	source := writeFiles(t, map[string]string{"index.html": "<html></html>"})
+
+	bucket.busy.Store(3)
+	progress := uploadFolder(t, s3_client.NewS3PageClient(page), source)
+	assert.Equal(t, 1, progress.Files)
+	assert.Equal(t, "<html></html>", string(bucket.body(t, "repo/sha/index.html")))
+
+	// Only uploads retry that patiently, so requests made while serving
+	// pages do not stall on a busy bucket.
+	requests, uploads := s3_client.NewS3PageClient(page).MaxAttempts()
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 4, uploads)
+
+	// Retries are bounded.
+	page.Bucket.Retry.MaxAttempts = 2
+	bucket.busy.Store(2)
+	progress, err := s3_client.NewS3PageClient(page).UploadFolder(context.Background(), source, "repo/other")
+	assert.NotNil(t, err)
+	assert.Zero(t, progress.Files)
+	assert.Equal(t, 1, progress.FilesTotal)
+}
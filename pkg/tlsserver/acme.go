@@ -0,0 +1,202 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns the manager obtaining certificates for the pages
+// without a configured certificate.
+//
+// Certificates are validated through the HTTP-01 challenge on the plain HTTP
+// listener or the TLS-ALPN-01 challenge on the HTTPS listener. DNS-01 is not
+// supported, so there are no wildcard certificates: preview hostnames each get
+// their own certificate on their first request, and only if the page index has
+// a deployment for them. Pages that need a wildcard certificate configure it in
+// pages[].tls.
+func newACMEManager(conf config.StaticPagesConfig, pages config.DomainMapper) (*autocert.Manager, humane.Error) {
+	acmeConf := conf.Server.TLS.ACME
+
+	cache, err := newACMECache(acmeConf.Cache, conf.Pages)
+	if err != nil {
+		return nil, err
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		HostPolicy: hostPolicy(pages, acmeConf.OnDemand),
+		Email:      acmeConf.Email,
+		Client:     &acme.Client{DirectoryURL: acmeConf.DirectoryURL},
+	}, nil
+}
+
+// hostPolicy allows certificates for every page domain and, with onDemand, for
+// the preview hostnames of pages that have a deployment for them. Checking the
+// page index keeps arbitrary subdomains from exhausting the rate limits of the
+// certificate authority.
+func hostPolicy(pages config.DomainMapper, onDemand bool) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		page := pages.Lookup(host)
+		if page == nil {
+			return fmt.Errorf("no page configured for %q", host)
+		}
+
+		sub, err := page.Domain.Subdomain(host)
+		if err != nil {
+			return err
+		}
+
+		if sub == "" {
+			return nil
+		}
+
+		if !onDemand || !page.Preview.Enabled {
+			return fmt.Errorf("%q is a preview of %s, which does not get certificates", host, page.Domain)
+		}
+
+		metadata, err := s3_client.GetPageMetadata(ctx, page)
+		if err != nil {
+			return fmt.Errorf("unable to check the deployments of %s: %w", page.Domain, err)
+		}
+
+		if _, _, err := metadata.GetLatestForBranch(sub); err == nil {
+			return nil
+		}
+		if _, err := metadata.GetBySHA(sub); err == nil {
+			return nil
+		}
+
+		return fmt.Errorf("%q has no deployment on %s", sub, page.Domain)
+	}
+}
+
+// Prefetch obtains the certificate of every page domain without a configured
+// certificate, so the first visitor does not wait for the certificate
+// authority. Failures are logged; the certificate is requested again on the
+// first request for the domain. It blocks until every domain was attempted or
+// ctx is cancelled; autocert bounds each attempt to five minutes.
+func (s *Store) Prefetch(ctx context.Context) {
+	if s.acme == nil {
+		return
+	}
+
+	for _, domain := range s.acmeDomains {
+		if ctx.Err() != nil {
+			return
+		}
+
+		hello := &tls.ClientHelloInfo{
+			ServerName:       domain.String(),
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+
+		if _, err := s.acme.GetCertificate(hello); err != nil {
+			otelzap.L().WithError(err).Warn("unable to obtain ACME certificate", zap.String("domain", domain.String()))
+		} else {
+			otelzap.L().Info("ACME certificate ready", zap.String("domain", domain.String()))
+		}
+	}
+}
+
+// newACMECache returns the cache holding the ACME account and the issued
+// certificates. The bucket cache lets every replica share them. It holds the
+// private keys, so it needs a bucket of its own: every page bucket is readable
+// through the proxy, and a cache in one of them would publish the keys.
+func newACMECache(conf config.ACMECache, pages []*config.Page) (autocert.Cache, humane.Error) {
+	switch conf.Type {
+	case config.ACMECacheDir, "":
+		return autocert.DirCache(conf.Dir), nil
+
+	case config.ACMECacheBucket:
+		if conf.Bucket.Name == "" {
+			return nil, humane.New("no bucket configured for the ACME cache",
+				"Configure server.tls.acme.cache.bucket with a private bucket that is not the bucket of any page.")
+		}
+
+		for _, page := range pages {
+			if sameBucket(conf.Bucket, page.Bucket) {
+				return nil, humane.New(fmt.Sprintf("the ACME cache must not use the bucket of %s", page.Domain),
+					"The cache holds the private keys of the certificates and page buckets are served by the proxy.",
+					"Configure server.tls.acme.cache.bucket with a private bucket that is not the bucket of any page.")
+			}
+		}
+
+		return NewBucketCache(s3_client.NewS3PageClient(&config.Page{Bucket: conf.Bucket}), conf.Prefix), nil
+
+	default:
+		return nil, humane.New(fmt.Sprintf("unknown ACME cache type %q", conf.Type),
+			"Set server.tls.acme.cache.type to \"dir\" or \"bucket\".")
+	}
+}
+
+// sameBucket reports whether a and b name the same bucket on the same
+// endpoint.
+func sameBucket(a, b config.BucketConfig) bool {
+	return a.Name.String() == b.Name.String() &&
+		strings.TrimSuffix(a.URL.String(), "/") == strings.TrimSuffix(b.URL.String(), "/")
+}
+
+// ObjectStore is the part of the S3 client the bucket cache needs.
+type ObjectStore interface {
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	PutObject(ctx context.Context, key string, data []byte) humane.Error
+	DeleteObject(ctx context.Context, key string) humane.Error
+}
+
+// BucketCache is an autocert.Cache storing its entries as objects below a
+// prefix of a bucket.
+type BucketCache struct {
+	store  ObjectStore
+	prefix string
+}
+
+var _ autocert.Cache = (*BucketCache)(nil)
+
+// NewBucketCache returns a cache storing its entries in store below prefix.
+func NewBucketCache(store ObjectStore, prefix string) *BucketCache {
+	return &BucketCache{store: store, prefix: prefix}
+}
+
+func (c *BucketCache) key(name string) string {
+	return path.Join(c.prefix, strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+// Get returns the entry stored under name, or autocert.ErrCacheMiss.
+func (c *BucketCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.store.GetObject(ctx, c.key(name))
+	if errors.Is(err, s3_client.ErrObjectNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put stores data under name.
+func (c *BucketCache) Put(ctx context.Context, name string, data []byte) error {
+	if err := c.store.PutObject(ctx, c.key(name), data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete removes the entry stored under name.
+func (c *BucketCache) Delete(ctx context.Context, name string) error {
+	if err := c.store.DeleteObject(ctx, c.key(name)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/SpechtLabs/StaticPages/pkg/s3_client"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeACME is a minimal RFC 8555 certificate authority in the spirit of
+// Pebble. It offers the HTTP-01 challenge only, validates it against the plain
+// HTTP listener of the server under test, and signs certificates with its own
+// CA. Signatures on requests are not verified.
+type fakeACME struct {
+	*httptest.Server
+	t *testing.T
+
+	// challengeAddr is the address HTTP-01 challenges are validated against.
+	challengeAddr string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu     sync.Mutex
+	nonce  int
+	orders map[string]*fakeOrder
+}
+
+type fakeOrder struct {
+	domain string
+	token  string
+	status string
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	f := &fakeACME{t: t, caKey: caKey, caCert: caCert, orders: make(map[string]*fakeOrder)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeACME) directoryURL() string { return f.URL + "/directory" }
+
+func (f *fakeACME) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(f.caCert)
+	return pool
+}
+
+func (f *fakeACME) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonce))
+	f.mu.Unlock()
+
+	if r.URL.Path == "/directory" {
+		writeACME(w, http.StatusOK, map[string]any{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+			"revokeCert": f.URL + "/revoke",
+			"keyChange":  f.URL + "/key-change",
+		})
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	payload := f.payload(r)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch parts[0] {
+	case "account":
+		w.Header().Set("Location", f.URL+"/account/1")
+		writeACME(w, http.StatusCreated, map[string]any{"status": "valid"})
+
+	case "order":
+		if len(parts) == 1 {
+			f.newOrder(w, payload)
+			return
+		}
+		f.writeOrder(w, http.StatusOK, parts[1])
+
+	case "authz":
+		f.writeAuthz(w, parts[1])
+
+	case "challenge":
+		f.validate(parts[1])
+		f.writeChallenge(w, parts[1])
+
+	case "finalize":
+		f.finalize(w, parts[1], payload)
+
+	case "cert":
+		f.mu.Lock()
+		order := f.orders[parts[1]]
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(order.cert)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// payload decodes the payload of a JWS request body.
+func (f *fakeACME) payload(r *http.Request) []byte {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&jws))
+
+	data, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	require.NoError(f.t, err)
+	return data
+}
+
+func (f *fakeACME) newOrder(w http.ResponseWriter, payload []byte) {
+	var req struct {
+		Identifiers []struct{ Value string } `json:"identifiers"`
+	}
+	require.NoError(f.t, json.Unmarshal(payload, &req))
+	require.Len(f.t, req.Identifiers, 1)
+
+	f.mu.Lock()
+	id := fmt.Sprint(len(f.orders) + 1)
+	f.orders[id] = &fakeOrder{domain: req.Identifiers[0].Value, token: "token-" + id, status: "pending"}
+	f.mu.Unlock()
+
+	f.writeOrder(w, http.StatusCreated, id)
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, status int, id string) {
+	f.mu.Lock()
+	order := *f.orders[id]
+	f.mu.Unlock()
+
+	body := map[string]any{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{f.URL + "/authz/" + id},
+		"finalize":       f.URL + "/finalize/" + id,
+	}
+	if order.cert != nil {
+		body["certificate"] = f.URL + "/cert/" + id
+	}
+
+	w.Header().Set("Location", f.URL+"/order/"+id)
+	writeACME(w, status, body)
+}
+
+func (f *fakeACME) authzStatus(order fakeOrder) string {
+	switch order.status {
+	case "pending", "invalid":
+		return order.status
+	default:
+		return "valid"
+	}
+}
+
+func (f *fakeACME) writeAuthz(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	order := *f.orders[id]
+	f.mu.Unlock()
+
+	writeACME(w, http.StatusOK, map[string]any{
+		"status":     f.authzStatus(order),
+		"identifier": map[string]string{"type": "dns", "value": order.domain},
+		"challenges": []map[string]string{{
+			"type":   "http-01",
+			"url":    f.URL + "/challenge/" + id,
+			"token":  order.token,
+			"status": f.authzStatus(order),
+		}},
+	})
+}
+
+func (f *fakeACME) writeChallenge(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	order := *f.orders[id]
+	f.mu.Unlock()
+
+	writeACME(w, http.StatusOK, map[string]string{
+		"type":   "http-01",
+		"url":    f.URL + "/challenge/" + id,
+		"token":  order.token,
+		"status": f.authzStatus(order),
+	})
+}
+
+// validate fetches the HTTP-01 key authorization from the server under test,
+// the way a certificate authority would.
+func (f *fakeACME) validate(id string) {
+	f.mu.Lock()
+	order := f.orders[id]
+	domain, token := order.domain, order.token
+	f.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+f.challengeAddr+"/.well-known/acme-challenge/"+token, nil)
+	require.NoError(f.t, err)
+	req.Host = domain
+
+	status := "invalid"
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), token+".") {
+			status = "ready"
+		}
+	}
+
+	f.mu.Lock()
+	order.status = status
+	f.mu.Unlock()
+}
+
+func (f *fakeACME) finalize(w http.ResponseWriter, id string, payload []byte) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	require.NoError(f.t, json.Unmarshal(payload, &req))
+
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	require.NoError(f.t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	require.NoError(f.t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(f.t, err)
+
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, f.caCert, csr.PublicKey, f.caKey)
+	require.NoError(f.t, err)
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+
+	f.mu.Lock()
+	f.orders[id].status = "valid"
+	f.orders[id].cert = chain
+	f.mu.Unlock()
+
+	f.writeOrder(w, http.StatusOK, id)
+}
+
+func writeACME(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+const acmeTestIndex = `abc123:
+    environment: prod
+    branch: main
+    date: 2025-05-04T18:13:45.715404+02:00
+def456:
+    environment: preview
+    branch: feature
+    date: 2025-05-05T18:13:45.715404+02:00
+`
+
+// newTestBucket serves an S3 endpoint holding a bucket "test" with a page
+// index, and returns its configuration.
+func newTestBucket(t *testing.T) config.BucketConfig {
+	t.Helper()
+
+	backend := s3mem.New()
+	require.NoError(t, backend.CreateBucket("test"))
+	_, err := backend.PutObject("test", "index.yaml", nil, strings.NewReader(acmeTestIndex), int64(len(acmeTestIndex)), nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(gofakes3.New(backend, gofakes3.WithHostBucket(false)).Server())
+	t.Cleanup(server.Close)
+
+	return config.BucketConfig{
+		URL: config.EnvValue(server.URL), Name: "test",
+		ApplicationID: "test", Secret: "test", Region: "test",
+	}
+}
+
+func TestACMEIssuesCertificatesForPagesAndPreviews(t *testing.T) {
+	ca := newFakeACME(t)
+	cacheDir := t.TempDir()
+
+	conf := config.StaticPagesConfig{
+		Server: config.Server{TLS: config.ServerTLS{
+			Enabled:      true,
+			RedirectHTTP: true,
+			ACME: config.ACME{
+				Enabled:      true,
+				DirectoryURL: ca.directoryURL(),
+				OnDemand:     true,
+				Cache:        config.ACMECache{Type: config.ACMECacheDir, Dir: cacheDir},
+			},
+		}},
+		Pages: []*config.Page{{
+			Domain:  config.FromString("acme.example.com"),
+			Preview: config.PreviewConfig{Enabled: true, Branch: true},
+			Git:     config.GitConfig{MainBranch: "main"},
+			Bucket:  newTestBucket(t),
+		}},
+	}
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	secure, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ca.challengeAddr = plain.Addr().String()
+
+	srv, herr := New(conf, plain.Addr().String(), secure.Addr().String(), http.NotFoundHandler())
+	require.Nil(t, herr)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(plain, secure) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		<-done
+	})
+
+	handshake := func(serverName string) (*x509.Certificate, error) {
+		conn, err := tls.Dial("tcp", secure.Addr().String(), &tls.Config{ServerName: serverName, RootCAs: ca.roots()})
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	// The page domain itself is prefetched on startup.
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(cacheDir)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "acme.example.com") {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cert, err := handshake("acme.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme.example.com"}, cert.DNSNames)
+
+	// A preview with a deployment gets its certificate on demand.
+	cert, err = handshake("feature.acme.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"feature.acme.example.com"}, cert.DNSNames)
+
+	// Without a deployment, or for another domain, nothing is issued.
+	_, err = handshake("unknown.acme.example.com")
+	assert.Error(t, err)
+	_, err = handshake("other.example.org")
+	assert.Error(t, err)
+}
+
+func TestHostPolicy(t *testing.T) {
+	page := &config.Page{
+		Domain:  config.FromString("policy.example.com"),
+		Preview: config.PreviewConfig{Enabled: true},
+		Bucket:  newTestBucket(t),
+	}
+	pages := config.NewDomainMapperFromPages([]*config.Page{page})
+	ctx := context.Background()
+
+	onDemand := hostPolicy(pages, true)
+	assert.NoError(t, onDemand(ctx, "policy.example.com"))
+	assert.NoError(t, onDemand(ctx, "feature.policy.example.com"))
+	assert.NoError(t, onDemand(ctx, "abc123.policy.example.com"))
+	assert.Error(t, onDemand(ctx, "missing.policy.example.com"))
+	assert.Error(t, onDemand(ctx, "example.org"))
+
+	domainsOnly := hostPolicy(pages, false)
+	assert.NoError(t, domainsOnly(ctx, "policy.example.com"))
+	assert.Error(t, domainsOnly(ctx, "feature.policy.example.com"))
+}
+
+func TestBucketCache(t *testing.T) {
+	bucket := newTestBucket(t)
+	cache := NewBucketCache(s3_client.NewS3PageClient(&config.Page{Bucket: bucket}), "acme/")
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+
+	require.NoError(t, cache.Put(ctx, "example.com", []byte("certificate")))
+
+	data, err := cache.Get(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "certificate", string(data))
+
+	require.NoError(t, cache.Delete(ctx, "example.com"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+
+	// Entries must stay below the prefix.
+	assert.Equal(t, "acme/etc/passwd", cache.key("../../etc/passwd"))
+}
+
+func TestNewACMECacheRefusesPageBuckets(t *testing.T) {
+	pageBucket := config.BucketConfig{URL: "https://s3.example.com/", Name: "pages"}
+	pages := []*config.Page{{Domain: config.FromString("example.com"), Bucket: pageBucket}}
+
+	_, err := newACMECache(config.ACMECache{Type: config.ACMECacheBucket, Prefix: "acme/"}, pages)
+	require.Error(t, err, "the cache must not fall back to a page bucket")
+
+	_, err = newACMECache(config.ACMECache{
+		Type:   config.ACMECacheBucket,
+		Bucket: config.BucketConfig{URL: "https://s3.example.com", Name: "pages"},
+		Prefix: "acme/",
+	}, pages)
+	require.Error(t, err, "the cache must not share the bucket of a page")
+
+	cache, err := newACMECache(config.ACMECache{
+		Type:   config.ACMECacheBucket,
+		Bucket: config.BucketConfig{URL: "https://s3.example.com", Name: "certificates"},
+		Prefix: "acme/",
+	}, pages)
+	require.Nil(t, err)
+	assert.IsType(t, &BucketCache{}, cache)
+}
@@ -0,0 +1,161 @@
+package tlsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+)
+
+// Server serves a handler on a plain HTTP address and, when TLS is enabled, on
+// an HTTPS address as well. With TLS and server.tls.redirectHTTP enabled, the
+// plain HTTP listener only redirects to HTTPS.
+type Server struct {
+	plain  *http.Server
+	secure *http.Server // nil when TLS is disabled
+
+	store     *Store
+	watchCtx  context.Context
+	stopWatch context.CancelFunc
+}
+
+// New creates the servers of the proxy for handler according to
+// conf.Server.TLS, serving the certificates of the pages.
+func New(conf config.StaticPagesConfig, httpAddr, httpsAddr string, handler http.Handler) (*Server, humane.Error) {
+	return newServer(conf, httpAddr, httpsAddr, handler, NewStore)
+}
+
+// NewAPI creates the servers of the API for handler, serving the API
+// certificate only. See NewAPIStore.
+func NewAPI(conf config.StaticPagesConfig, httpAddr, httpsAddr string, handler http.Handler) (*Server, humane.Error) {
+	return newServer(conf, httpAddr, httpsAddr, handler, NewAPIStore)
+}
+
+func newServer(conf config.StaticPagesConfig, httpAddr, httpsAddr string, handler http.Handler,
+	newStore func(config.StaticPagesConfig) (*Store, humane.Error)) (*Server, humane.Error) {
+	s := &Server{
+		plain: &http.Server{Addr: httpAddr, Handler: handler},
+	}
+
+	if !conf.Server.TLS.Enabled {
+		return s, nil
+	}
+
+	store, err := newStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+	s.watchCtx, s.stopWatch = context.WithCancel(context.Background())
+
+	s.secure = &http.Server{
+		Addr:      httpsAddr,
+		Handler:   handler,
+		TLSConfig: store.TLSConfig(),
+	}
+
+	if conf.Server.TLS.RedirectHTTP {
+		s.plain.Handler = RedirectHandler(httpsAddr)
+	}
+	s.plain.Handler = store.HTTPHandler(s.plain.Handler)
+
+	return s, nil
+}
+
+// ListenAndServe listens on the configured addresses and serves until the
+// server is shut down or one of the listeners fails.
+func (s *Server) ListenAndServe() error {
+	plain, err := net.Listen("tcp", s.plain.Addr)
+	if err != nil {
+		return err
+	}
+
+	var secure net.Listener
+	if s.secure != nil {
+		if secure, err = net.Listen("tcp", s.secure.Addr); err != nil {
+			_ = plain.Close()
+			return err
+		}
+	}
+
+	return s.Serve(plain, secure)
+}
+
+// Serve serves on the given listeners. secure is ignored when TLS is disabled.
+// It returns nil once the server was shut down.
+func (s *Server) Serve(plain, secure net.Listener) error {
+	errs := make(chan error, 2)
+
+	if s.secure != nil {
+		go s.store.Watch(s.watchCtx)
+		go s.store.Prefetch(s.watchCtx)
+
+		otelzap.L().Info("serving HTTPS", zap.String("addr", secure.Addr().String()))
+		go func() { errs <- s.secure.ServeTLS(secure, "", "") }()
+	}
+
+	go func() { errs <- s.plain.Serve(plain) }()
+
+	err := <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	// One listener failed; do not leave the other one serving on its own.
+	_ = s.Close()
+	return err
+}
+
+// Shutdown gracefully stops all listeners.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+
+	var errs []error
+	if s.secure != nil {
+		errs = append(errs, s.secure.Shutdown(ctx))
+	}
+	errs = append(errs, s.plain.Shutdown(ctx))
+
+	return errors.Join(errs...)
+}
+
+// Close immediately stops all listeners.
+func (s *Server) Close() error {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+
+	var errs []error
+	if s.secure != nil {
+		errs = append(errs, s.secure.Close())
+	}
+	errs = append(errs, s.plain.Close())
+
+	return errors.Join(errs...)
+}
+
+// RedirectHandler permanently redirects every request to the same URL on the
+// HTTPS address. 308 is used so API uploads keep their method and body.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,255 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate for names into dir and returns
+// the paths of the certificate and key.
+func writeCert(t *testing.T, dir, name string, names ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func certNames(t *testing.T, cert *tls.Certificate) []string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.DNSNames
+}
+
+func testConfig(t *testing.T, dir string) config.StaticPagesConfig {
+	t.Helper()
+
+	defaultCert, defaultKey := writeCert(t, dir, "default", "api.example.org")
+	pageCert, pageKey := writeCert(t, dir, "page", "example.com", "*.example.com")
+
+	return config.StaticPagesConfig{
+		Server: config.Server{TLS: config.ServerTLS{
+			Enabled:      true,
+			CertFile:     defaultCert,
+			KeyFile:      defaultKey,
+			RedirectHTTP: true,
+		}},
+		Pages: []*config.Page{{
+			Domain: config.FromString("example.com"),
+			TLS:    config.PageTLS{CertFile: pageCert, KeyFile: pageKey},
+		}},
+	}
+}
+
+func TestStoreSelectsCertificateBySNI(t *testing.T) {
+	store, err := NewStore(testConfig(t, t.TempDir()))
+	require.Nil(t, err)
+
+	tests := map[string][]string{
+		"example.com":         {"example.com", "*.example.com"},
+		"feature.example.com": {"example.com", "*.example.com"},
+		"api.example.org":     {"api.example.org"},
+		"":                    {"api.example.org"},
+	}
+
+	for serverName, expected := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err, serverName)
+		assert.Equal(t, expected, certNames(t, cert), serverName)
+	}
+}
+
+func TestStoreReloadsChangedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(t, dir)
+
+	store, herr := NewStore(conf)
+	require.Nil(t, herr)
+
+	writeCert(t, dir, "page", "example.com", "*.example.com", "renewed.example.com")
+	require.Nil(t, store.Reload())
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.Contains(t, certNames(t, cert), "renewed.example.com")
+
+	// A broken update must not take the domain offline.
+	require.NoError(t, os.WriteFile(conf.Pages[0].TLS.CertFile, []byte("garbage"), 0o600))
+	assert.NotNil(t, store.Reload())
+
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.Contains(t, certNames(t, cert), "renewed.example.com")
+}
+
+func TestNewStoreWithoutCertificates(t *testing.T) {
+	_, err := NewStore(config.StaticPagesConfig{Server: config.Server{TLS: config.ServerTLS{Enabled: true}}})
+	assert.NotNil(t, err)
+}
+
+func TestNewAPIStore(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(t, dir)
+	conf.Server.TLS.ACME = config.ACME{Enabled: true, Cache: config.ACMECache{Type: config.ACMECacheDir, Dir: t.TempDir()}}
+
+	// The API serves the default certificate for every name and never uses
+	// ACME, which is left to the proxy.
+	store, err := NewAPIStore(conf)
+	require.Nil(t, err)
+	assert.Nil(t, store.acme)
+	assert.NotContains(t, store.TLSConfig().NextProtos, "acme-tls/1")
+
+	for _, serverName := range []string{"api.example.org", "example.com", ""} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err, serverName)
+		assert.Equal(t, []string{"api.example.org"}, certNames(t, cert), serverName)
+	}
+
+	// A certificate of its own replaces the default one.
+	conf.Server.TLS.ApiCertFile, conf.Server.TLS.ApiKeyFile = writeCert(t, dir, "api", "uploads.example.org")
+	store, err = NewAPIStore(conf)
+	require.Nil(t, err)
+	cert, certErr := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "uploads.example.org"})
+	require.NoError(t, certErr)
+	assert.Equal(t, []string{"uploads.example.org"}, certNames(t, cert))
+
+	// Page certificates and ACME are no certificate for the API.
+	conf.Server.TLS.CertFile, conf.Server.TLS.KeyFile = "", ""
+	conf.Server.TLS.ApiCertFile, conf.Server.TLS.ApiKeyFile = "", ""
+	_, err = NewAPIStore(conf)
+	assert.NotNil(t, err)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		addr     string
+		host     string
+		expected string
+	}{
+		{addr: ":443", host: "example.com", expected: "https://example.com/a?b=c"},
+		{addr: ":8443", host: "example.com:8080", expected: "https://example.com:8443/a?b=c"},
+	}
+
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/a?b=c", nil)
+		RedirectHandler(test.addr).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusPermanentRedirect, rr.Code)
+		assert.Equal(t, test.expected, rr.Header().Get("Location"))
+	}
+}
+
+// The HTTPS listener must negotiate HTTP/2 and serve the page certificate,
+// while the plain listener redirects.
+func TestServerServesHTTP2AndRedirects(t *testing.T) {
+	conf := testConfig(t, t.TempDir())
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	secure, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})
+
+	srv, herr := New(conf, plain.Addr().String(), secure.Addr().String(), handler)
+	require.Nil(t, herr)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(plain, secure) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		<-done
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "preview.example.com"},
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get("https://" + secure.Addr().String() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Contains(t, resp.TLS.PeerCertificates[0].DNSNames, "*.example.com")
+
+	resp, err = client.Get("http://" + plain.Addr().String() + "/page")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	_, port, _ := net.SplitHostPort(secure.Addr().String())
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	assert.Equal(t, "https://127.0.0.1:"+port+"/page", resp.Header.Get("Location"))
+}
+
+func TestStoreWatchPicksUpChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, herr := NewStore(testConfig(t, dir))
+	require.Nil(t, herr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx)
+
+	// Give the watcher a moment to register the directory.
+	time.Sleep(100 * time.Millisecond)
+	writeCert(t, dir, "page", "example.com", "*.example.com", "watched.example.com")
+
+	assert.Eventually(t, func() bool {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		return err == nil && assert.ObjectsAreEqual([]string{"example.com", "*.example.com", "watched.example.com"}, certNames(t, cert))
+	}, 5*time.Second, 50*time.Millisecond)
+}
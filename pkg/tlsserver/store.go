@@ -0,0 +1,296 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SpechtLabs/StaticPages/pkg/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sierrasoftworks/humane-errors-go"
+	"github.com/spechtlabs/go-otel-utils/otelzap"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// reloadDelay debounces file events: writing a certificate and its key (or a
+// Kubernetes secret update swapping a symlink) produces several events in
+// quick succession.
+const reloadDelay = 500 * time.Millisecond
+
+type certFiles struct {
+	cert string
+	key  string
+}
+
+// Store holds the certificates of every page and the default certificate,
+// and selects among them by SNI. With ACME enabled, pages without a configured
+// certificate get one from the certificate authority.
+type Store struct {
+	pages        config.DomainMapper
+	files        map[config.DomainScope]certFiles
+	defaultFiles certFiles
+
+	acme        *autocert.Manager // nil when ACME is disabled
+	acmeDomains []config.DomainScope
+
+	mu          sync.RWMutex
+	certs       map[config.DomainScope]*tls.Certificate
+	defaultCert *tls.Certificate
+}
+
+// NewStore loads the default certificate and the certificate of every page
+// that configures one, and sets up ACME for the others if enabled.
+func NewStore(conf config.StaticPagesConfig) (*Store, humane.Error) {
+	s := &Store{
+		pages:        config.NewDomainMapperFromPages(conf.Pages),
+		files:        make(map[config.DomainScope]certFiles),
+		defaultFiles: certFiles{cert: conf.Server.TLS.CertFile, key: conf.Server.TLS.KeyFile},
+		certs:        make(map[config.DomainScope]*tls.Certificate),
+	}
+
+	for _, page := range conf.Pages {
+		if page.TLS.CertFile == "" && page.TLS.KeyFile == "" {
+			s.acmeDomains = append(s.acmeDomains, page.Domain)
+			continue
+		}
+		s.files[page.Domain] = certFiles{cert: page.TLS.CertFile, key: page.TLS.KeyFile}
+	}
+
+	if conf.Server.TLS.ACME.Enabled {
+		manager, err := newACMEManager(conf, s.pages)
+		if err != nil {
+			return nil, err
+		}
+		s.acme = manager
+	}
+
+	if s.defaultFiles.cert == "" && len(s.files) == 0 && s.acme == nil {
+		return nil, humane.New("no TLS certificate configured",
+			"Configure server.tls.certFile and server.tls.keyFile, pages[].tls for every page, or enable server.tls.acme.")
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewAPIStore loads the certificate of the API listener: server.tls.apiCertFile,
+// or the default certificate. Unlike NewStore, it never sets up ACME, so the
+// API does not order certificates for the page domains next to the proxy.
+func NewAPIStore(conf config.StaticPagesConfig) (*Store, humane.Error) {
+	files := certFiles{cert: conf.Server.TLS.ApiCertFile, key: conf.Server.TLS.ApiKeyFile}
+	if files.cert == "" && files.key == "" {
+		files = certFiles{cert: conf.Server.TLS.CertFile, key: conf.Server.TLS.KeyFile}
+	}
+
+	if files.cert == "" {
+		return nil, humane.New("no TLS certificate configured for the API",
+			"Configure server.tls.apiCertFile and server.tls.apiKeyFile, or server.tls.certFile and server.tls.keyFile. ACME certificates are only obtained by the proxy.")
+	}
+
+	s := &Store{
+		pages:        config.NewDomainMapperFromPages(nil),
+		files:        make(map[config.DomainScope]certFiles),
+		defaultFiles: files,
+		certs:        make(map[config.DomainScope]*tls.Certificate),
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads every certificate from disk again. A certificate that fails to
+// load keeps its previously loaded version, so a half-written update does not
+// take a domain offline.
+func (s *Store) Reload() humane.Error {
+	var errs []error
+
+	var defaultCert *tls.Certificate
+	if s.defaultFiles.cert != "" {
+		cert, err := loadCertificate(s.defaultFiles)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("default certificate: %w", err))
+		}
+		defaultCert = cert
+	}
+
+	certs := make(map[config.DomainScope]*tls.Certificate, len(s.files))
+	for domain, files := range s.files {
+		cert, err := loadCertificate(files)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("certificate of %s: %w", domain, err))
+		}
+		certs[domain] = cert
+	}
+
+	s.mu.Lock()
+	if defaultCert != nil {
+		s.defaultCert = defaultCert
+	}
+	for domain, cert := range certs {
+		if cert != nil {
+			s.certs[domain] = cert
+		}
+	}
+	s.mu.Unlock()
+
+	if len(errs) > 0 {
+		return humane.Wrap(errors.Join(errs...), "unable to load TLS certificates",
+			"Make sure every configured certificate and key file exists and is a valid PEM encoded pair.")
+	}
+
+	return nil
+}
+
+func loadCertificate(files certFiles) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(files.cert, files.key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// GetCertificate returns the certificate of the page serving the requested
+// server name. Pages without a configured certificate are served by ACME, if
+// enabled. Everything else gets the default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// TLS-ALPN-01 challenges offer nothing but the acme-tls/1 protocol.
+	if s.acme != nil && len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		return s.acme.GetCertificate(hello)
+	}
+
+	page := s.pages.Lookup(strings.ToLower(hello.ServerName))
+
+	s.mu.RLock()
+	var cert *tls.Certificate
+	if page != nil {
+		cert = s.certs[page.Domain]
+	}
+	defaultCert := s.defaultCert
+	s.mu.RUnlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+
+	if page != nil && s.acme != nil {
+		cert, err := s.acme.GetCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+
+		if defaultCert == nil {
+			return nil, err
+		}
+		otelzap.L().WithError(err).Debug("no ACME certificate, serving the default certificate",
+			zap.String("server_name", hello.ServerName))
+	}
+
+	if defaultCert != nil {
+		return defaultCert, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges and passes every other request
+// on to fallback.
+func (s *Store) HTTPHandler(fallback http.Handler) http.Handler {
+	if s.acme == nil {
+		return fallback
+	}
+	return s.acme.HTTPHandler(fallback)
+}
+
+// TLSConfig returns a server configuration serving the certificates of the
+// store, with HTTP/2 enabled.
+func (s *Store) TLSConfig() *tls.Config {
+	protos := []string{"h2", "http/1.1"}
+	if s.acme != nil {
+		protos = append(protos, acme.ALPNProto)
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     protos,
+	}
+}
+
+// Watch reloads the certificates whenever one of their files changes. The
+// directories are watched rather than the files, as editors and Kubernetes
+// replace files instead of writing them in place. It blocks until ctx is
+// cancelled.
+func (s *Store) Watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		otelzap.L().WithError(err).Error("unable to watch TLS certificates; changes require a restart")
+		return
+	}
+	defer func() { _ = watcher.Close() }()
+
+	dirs := make(map[string]bool)
+	for _, files := range append([]certFiles{s.defaultFiles}, s.pageFiles()...) {
+		for _, file := range []string{files.cert, files.key} {
+			if file != "" {
+				dirs[filepath.Dir(file)] = true
+			}
+		}
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			otelzap.L().WithError(err).Error("unable to watch TLS certificate directory", zap.String("dir", dir))
+		}
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			otelzap.L().Debug("TLS certificate directory changed", zap.String("file", event.Name), zap.Stringer("op", event.Op))
+			reload = time.After(reloadDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			otelzap.L().WithError(err).Warn("error watching TLS certificates")
+
+		case <-reload:
+			reload = nil
+			if err := s.Reload(); err != nil {
+				otelzap.L().WithError(err).Error("unable to reload TLS certificates; keeping the previous ones")
+				continue
+			}
+			otelzap.L().Info("reloaded TLS certificates")
+		}
+	}
+}
+
+func (s *Store) pageFiles() []certFiles {
+	files := make([]certFiles, 0, len(s.files))
+	for _, f := range s.files {
+		files = append(files, f)
+	}
+	return files
+}